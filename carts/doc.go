@@ -0,0 +1,12 @@
+/*
+The cart module containing the per-user shopping cart and its anonymous counterpart.
+
+model.go: definition of orm based data model
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+
+validators.go: definition the validator of form data
+*/
+package carts
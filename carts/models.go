@@ -0,0 +1,322 @@
+package carts
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+)
+
+// A cart belongs either to a signed-in user (OwnerID set) or to an anonymous
+// visitor who only knows its Token. Every cart gets a token so the column can stay
+// unique; anonymous carts are merged into the owner's cart on login.
+type CartModel struct {
+	gorm.Model
+	Token   string `gorm:"unique_index"`
+	Owner   items.ItemUserModel
+	OwnerID uint            `gorm:"index"`
+	Lines   []CartLineModel `gorm:"ForeignKey:CartID"`
+}
+
+// One item, or one variant of an item, in a cart. Price and Currency remember the
+// unit price the buyer saw when the line was last read, so a later price change
+// can be reported.
+type CartLineModel struct {
+	gorm.Model
+	Cart      CartModel
+	CartID    uint `gorm:"index"`
+	Item      items.ItemModel
+	ItemID    uint
+	Variant   items.ItemVariantModel
+	VariantID uint
+	Quantity  int
+	Price     int64
+	Currency  string `gorm:"size:3"`
+
+	// Filled by Revalidate, never stored.
+	PriceChanged  bool  `gorm:"-"`
+	PreviousPrice int64 `gorm:"-"`
+	Unavailable   bool  `gorm:"-"`
+}
+
+const cartTokenLength = 32
+
+var ErrInvalidQuantity = errors.New("quantity should be positive")
+var ErrOwnItem = errors.New("sellers can not buy their own item")
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+	db.AutoMigrate(&CartModel{})
+	db.AutoMigrate(&CartLineModel{})
+}
+
+// Find the cart of a signed-in owner, or the anonymous cart matching token when
+// owner is the zero ItemUserModel. The returned cart has ID 0 when there is none.
+func FindCart(owner items.ItemUserModel, token string) (CartModel, error) {
+	db := common.GetDB()
+	var cart CartModel
+	var err error
+	if owner.ID != 0 {
+		err = db.Where("owner_id = ?", owner.ID).Find(&cart).Error
+	} else if token != "" {
+		err = db.Where("token = ? AND owner_id = 0", token).Find(&cart).Error
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		err = nil
+	}
+	return cart, err
+}
+
+// Same as FindCart but creates the cart when none exists yet.
+//
+//	cart, err := FindOrCreateCart(items.GetItemUserModel(myUserModel), c.GetHeader(CartTokenHeader))
+func FindOrCreateCart(owner items.ItemUserModel, token string) (CartModel, error) {
+	cart, err := FindCart(owner, token)
+	if err != nil || cart.ID != 0 {
+		return cart, err
+	}
+	db := common.GetDB()
+	cart = CartModel{
+		Token:   common.RandString(cartTokenLength),
+		OwnerID: owner.ID,
+	}
+	err = db.Create(&cart).Error
+	return cart, err
+}
+
+// Load the cart lines together with their items and sellers.
+func (cart *CartModel) getLines() error {
+	db := common.GetDB()
+	tx := db.Begin()
+	tx.Model(cart).Order("id asc").Related(&cart.Lines, "Lines")
+	for i := range cart.Lines {
+		// Deleted items are loaded too, so the line can still say what it was.
+		tx.Unscoped().Model(&cart.Lines[i]).Related(&cart.Lines[i].Item, "Item")
+		tx.Model(&cart.Lines[i].Item).Related(&cart.Lines[i].Item.Seller, "Seller")
+		tx.Model(&cart.Lines[i].Item.Seller).Related(&cart.Lines[i].Item.Seller.UserModel)
+		if cart.Lines[i].VariantID != 0 {
+			tx.Unscoped().Preload("Attributes").First(&cart.Lines[i].Variant, cart.Lines[i].VariantID)
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Units of the line's variant, or of its item, that can still be bought.
+func (line CartLineModel) QuantityAvailable() int {
+	if line.VariantID != 0 {
+		return line.Variant.QuantityAvailable()
+	}
+	return line.Item.QuantityAvailable()
+}
+
+// Reload the lines and check them against the current state of their items: lines
+// whose item or variant was deleted, or whose item can not be bought by the owner
+// any more (unpublished, sold, expired or reserved for another buyer), are flagged
+// unavailable, and lines whose price moved are flagged and re-priced so
+// the buyer sees the change exactly once. Stock is not stored on the line,
+// serializers compare Quantity with QuantityAvailable().
+func (cart *CartModel) Revalidate() error {
+	if err := cart.getLines(); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	var owner items.ItemUserModel
+	owner.ID = cart.OwnerID
+	for i := range cart.Lines {
+		line := &cart.Lines[i]
+		if line.Item.ID == 0 || line.Item.DeletedAt != nil || !line.Item.AvailableTo(owner) {
+			line.Unavailable = true
+			continue
+		}
+		price := line.Item.Price
+		if line.VariantID != 0 {
+			if line.Variant.ID == 0 || line.Variant.DeletedAt != nil {
+				line.Unavailable = true
+				continue
+			}
+			price = line.Variant.Price
+		}
+		if line.Price != price || line.Currency != line.Item.Currency {
+			line.PriceChanged = true
+			line.PreviousPrice = line.Price
+			line.Price = price
+			line.Currency = line.Item.Currency
+			err := db.Model(&CartLineModel{}).Where("id = ?", line.ID).Updates(map[string]interface{}{
+				"price":    line.Price,
+				"currency": line.Currency,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The line of the cart holding item, or the given variant of it (0 for none).
+func (cart *CartModel) findLine(itemID, variantID uint) CartLineModel {
+	db := common.GetDB()
+	var line CartLineModel
+	db.Where("cart_id = ? AND item_id = ? AND variant_id = ?", cart.ID, itemID, variantID).First(&line)
+	return line
+}
+
+// Add quantity units of item to the cart, on top of what is already there. Items
+// with variants are added with AddVariant.
+func (cart *CartModel) AddItem(item items.ItemModel, quantity int) error {
+	if item.HasVariants() {
+		return items.ErrVariantRequired
+	}
+	return cart.addLine(item, items.ItemVariantModel{}, quantity)
+}
+
+// Same as AddItem for one variant of item.
+func (cart *CartModel) AddVariant(item items.ItemModel, variant items.ItemVariantModel, quantity int) error {
+	return cart.addLine(item, variant, quantity)
+}
+
+func (cart *CartModel) addLine(item items.ItemModel, variant items.ItemVariantModel, quantity int) error {
+	if quantity <= 0 {
+		return ErrInvalidQuantity
+	}
+	if cart.OwnerID != 0 && item.SellerID == cart.OwnerID {
+		return ErrOwnItem
+	}
+	if item.OnAuction() {
+		return items.ErrAuctionItem
+	}
+	line := cart.findLine(item.ID, variant.ID)
+	available, price := item.QuantityAvailable(), item.Price
+	if variant.ID != 0 {
+		available, price = variant.QuantityAvailable(), variant.Price
+	}
+	if line.Quantity+quantity > available {
+		return items.ErrOutOfStock
+	}
+	line.CartID = cart.ID
+	line.ItemID = item.ID
+	line.VariantID = variant.ID
+	line.Quantity += quantity
+	line.Price = price
+	line.Currency = item.Currency
+	db := common.GetDB()
+	return db.Save(&line).Error
+}
+
+// Set the quantity of item in the cart, removing the line when quantity is 0.
+func (cart *CartModel) SetQuantity(item items.ItemModel, quantity int) error {
+	return cart.setLineQuantity(item, items.ItemVariantModel{}, quantity)
+}
+
+// Same as SetQuantity for one variant of item.
+func (cart *CartModel) SetVariantQuantity(item items.ItemModel, variant items.ItemVariantModel, quantity int) error {
+	return cart.setLineQuantity(item, variant, quantity)
+}
+
+func (cart *CartModel) setLineQuantity(item items.ItemModel, variant items.ItemVariantModel, quantity int) error {
+	if quantity < 0 {
+		return ErrInvalidQuantity
+	}
+	if quantity == 0 {
+		return cart.RemoveVariant(item, variant)
+	}
+	available := item.QuantityAvailable()
+	if variant.ID != 0 {
+		available = variant.QuantityAvailable()
+	}
+	if quantity > available {
+		return items.ErrOutOfStock
+	}
+	line := cart.findLine(item.ID, variant.ID)
+	if line.ID == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	db := common.GetDB()
+	return db.Model(&line).Update("quantity", quantity).Error
+}
+
+func (cart *CartModel) RemoveItem(item items.ItemModel) error {
+	return cart.RemoveVariant(item, items.ItemVariantModel{})
+}
+
+// Remove the line of one variant of item from the cart.
+func (cart *CartModel) RemoveVariant(item items.ItemModel, variant items.ItemVariantModel) error {
+	db := common.GetDB()
+	err := db.Where("cart_id = ? AND item_id = ? AND variant_id = ?", cart.ID, item.ID, variant.ID).Delete(CartLineModel{}).Error
+	return err
+}
+
+// Remove every line of the cart. A cart never saved has no lines to remove.
+func (cart *CartModel) Clear() error {
+	if cart.ID == 0 {
+		return nil
+	}
+	db := common.GetDB()
+	err := db.Where("cart_id = ?", cart.ID).Delete(CartLineModel{}).Error
+	return err
+}
+
+// Move the lines of the anonymous cart identified by token into owner's cart and
+// delete the anonymous cart. Quantities of items (and variants) present in both
+// are added up; the next Revalidate reports any line that no longer fits the stock.
+func MergeAnonymousCart(owner items.ItemUserModel, token string) error {
+	if owner.ID == 0 || token == "" {
+		return nil
+	}
+	anonymous, err := FindCart(items.ItemUserModel{}, token)
+	if err != nil || anonymous.ID == 0 {
+		return err
+	}
+	cart, err := FindOrCreateCart(owner, "")
+	if err != nil {
+		return err
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	var lines []CartLineModel
+	if err := tx.Where("cart_id = ?", anonymous.ID).Find(&lines).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, line := range lines {
+		var item items.ItemModel
+		err := tx.First(&item, line.ItemID).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			tx.Rollback()
+			return err
+		}
+		if item.SellerID == owner.ID {
+			if err := tx.Delete(&line).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			continue
+		}
+		var existing CartLineModel
+		err = tx.Where("cart_id = ? AND item_id = ? AND variant_id = ?", cart.ID, line.ItemID, line.VariantID).First(&existing).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			tx.Rollback()
+			return err
+		}
+		if existing.ID != 0 {
+			err = tx.Model(&existing).Update("quantity", existing.Quantity+line.Quantity).Error
+			if err == nil {
+				err = tx.Delete(&line).Error
+			}
+		} else {
+			err = tx.Model(&line).Update("cart_id", cart.ID).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Delete(&anonymous).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,200 @@
+package carts
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+// Anonymous visitors identify their cart with the token returned in every cart
+// response, sent back in this header. Signed-in users do not need it, except on
+// login to have the anonymous cart merged.
+const CartTokenHeader = "X-Cart-Token"
+
+// Works with and without authentication, register it behind AuthMiddleware(false).
+// Lines of a variant are changed and removed with ?variant=<id>.
+func CartRegister(router *gin.RouterGroup) {
+	router.GET("/", CartRetrieve)
+	router.POST("/", CartAddItem)
+	router.DELETE("/", CartClear)
+	router.PATCH("/:slug", CartUpdateItem)
+	router.DELETE("/:slug", CartRemoveItem)
+}
+
+func currentOwner(c *gin.Context) items.ItemUserModel {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	return items.GetItemUserModel(myUserModel)
+}
+
+// Only published items can be put in a cart, see removableItem for the others.
+func findItem(slug string) (items.ItemModel, error) {
+	itemModel, err := removableItem(slug)
+	if err == nil && itemModel.Status != items.ItemPublished {
+		err = errors.New("Invalid slug")
+	}
+	return itemModel, err
+}
+
+// Lines of items unpublished since they were added can still be removed.
+func removableItem(slug string) (items.ItemModel, error) {
+	itemModel, err := items.FindOneItem(&items.ItemModel{Slug: slug})
+	if err == nil && itemModel.ID == 0 {
+		err = errors.New("Invalid slug")
+	}
+	return itemModel, err
+}
+
+// The variant of itemModel with the given id, or none when id is 0.
+func findVariant(itemModel items.ItemModel, id uint) (items.ItemVariantModel, error) {
+	if id == 0 {
+		return items.ItemVariantModel{}, nil
+	}
+	return itemModel.FindVariant(id)
+}
+
+func queryVariant(c *gin.Context) uint {
+	id64, _ := strconv.ParseUint(c.Query("variant"), 10, 32)
+	return uint(id64)
+}
+
+func renderCart(c *gin.Context, status int, cart CartModel) {
+	if err := cart.Revalidate(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := CartSerializer{c, cart}
+	c.JSON(status, gin.H{"cart": serializer.Response()})
+}
+
+func renderCartError(c *gin.Context, err error) {
+	switch err {
+	case items.ErrOutOfStock, items.ErrItemUnavailable:
+		c.JSON(http.StatusConflict, common.NewError("stock", err))
+	case ErrOwnItem, ErrInvalidQuantity, items.ErrAuctionItem, items.ErrVariantRequired:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("cart", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	}
+}
+
+func CartRetrieve(c *gin.Context) {
+	cart, err := FindCart(currentOwner(c), c.GetHeader(CartTokenHeader))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	renderCart(c, http.StatusOK, cart)
+}
+
+func CartAddItem(c *gin.Context) {
+	cartLineValidator := NewCartLineValidator()
+	if err := cartLineValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	itemModel, err := findItem(cartLineValidator.Line.Slug)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	variantModel, err := findVariant(itemModel, cartLineValidator.Line.Variant)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("variant", err))
+		return
+	}
+	cart, err := FindOrCreateCart(currentOwner(c), c.GetHeader(CartTokenHeader))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if variantModel.ID != 0 {
+		err = cart.AddVariant(itemModel, variantModel, cartLineValidator.Line.Quantity)
+	} else {
+		err = cart.AddItem(itemModel, cartLineValidator.Line.Quantity)
+	}
+	if err != nil {
+		renderCartError(c, err)
+		return
+	}
+	renderCart(c, http.StatusCreated, cart)
+}
+
+func CartUpdateItem(c *gin.Context) {
+	cartLineValidator := NewCartLineValidator()
+	if err := cartLineValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	itemModel, err := findItem(c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	variantModel, err := findVariant(itemModel, queryVariant(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("variant", err))
+		return
+	}
+	cart, err := FindCart(currentOwner(c), c.GetHeader(CartTokenHeader))
+	if err != nil || cart.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("cart", errors.New("Cart not found")))
+		return
+	}
+	if err := cart.SetVariantQuantity(itemModel, variantModel, cartLineValidator.Line.Quantity); err != nil {
+		renderCartError(c, err)
+		return
+	}
+	renderCart(c, http.StatusOK, cart)
+}
+
+func CartRemoveItem(c *gin.Context) {
+	itemModel, err := removableItem(c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	variantModel, err := findVariant(itemModel, queryVariant(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("variant", err))
+		return
+	}
+	cart, err := FindCart(currentOwner(c), c.GetHeader(CartTokenHeader))
+	if err != nil || cart.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("cart", errors.New("Cart not found")))
+		return
+	}
+	if err := cart.RemoveVariant(itemModel, variantModel); err != nil {
+		renderCartError(c, err)
+		return
+	}
+	renderCart(c, http.StatusOK, cart)
+}
+
+func CartClear(c *gin.Context) {
+	cart, err := FindCart(currentOwner(c), c.GetHeader(CartTokenHeader))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if err := cart.Clear(); err != nil {
+		renderCartError(c, err)
+		return
+	}
+	renderCart(c, http.StatusOK, cart)
+}
+
+// Login hook merging the anonymous cart sent in CartTokenHeader into the user's
+// cart, see users.OnLogin.
+func MergeCartOnLogin(c *gin.Context, userModel users.UserModel) {
+	token := c.GetHeader(CartTokenHeader)
+	if err := MergeAnonymousCart(items.GetItemUserModel(userModel), token); err != nil {
+		fmt.Println("cart err: (MergeCartOnLogin) ", err)
+	}
+}
@@ -0,0 +1,125 @@
+package carts
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+type CartSerializer struct {
+	C *gin.Context
+	CartModel
+}
+
+type CartLineSerializer struct {
+	C *gin.Context
+	CartLineModel
+}
+
+type TotalResponse struct {
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+	Formatted string `json:"formatted"`
+}
+
+type CartLineResponse struct {
+	Slug              string `json:"slug"`
+	Title             string `json:"title"`
+	VariantID         uint   `json:"variant,omitempty"`
+	VariantName       string `json:"variantName,omitempty"`
+	Quantity          int    `json:"quantity"`
+	Price             int64  `json:"price"`
+	Currency          string `json:"currency"`
+	FormattedPrice    string `json:"formattedPrice"`
+	LineTotal         int64  `json:"lineTotal"`
+	QuantityAvailable int    `json:"quantityAvailable"`
+	InStock           bool   `json:"inStock"`
+	PriceChanged      bool   `json:"priceChanged"`
+	PreviousPrice     int64  `json:"previousPrice,omitempty"`
+	Unavailable       bool   `json:"unavailable"`
+}
+
+// Lines are grouped by seller because every seller ships (and is paid) separately.
+type CartSellerResponse struct {
+	Seller    users.ProfileResponse `json:"seller"`
+	Lines     []CartLineResponse    `json:"lines"`
+	Subtotals []TotalResponse       `json:"subtotals"`
+}
+
+type CartResponse struct {
+	Token      string               `json:"token"`
+	Sellers    []CartSellerResponse `json:"sellers"`
+	ItemsCount int                  `json:"itemsCount"`
+}
+
+func (s *CartLineSerializer) Response() CartLineResponse {
+	price := common.Money{Amount: s.Price, Currency: s.Currency}
+	response := CartLineResponse{
+		Slug:              s.Item.Slug,
+		Title:             s.Item.Title,
+		Quantity:          s.Quantity,
+		Price:             s.Price,
+		Currency:          s.Currency,
+		FormattedPrice:    price.String(),
+		LineTotal:         price.Mul(int64(s.Quantity)).Amount,
+		VariantID:         s.VariantID,
+		VariantName:       s.Variant.Name,
+		QuantityAvailable: s.QuantityAvailable(),
+		InStock:           !s.Unavailable && s.Quantity <= s.QuantityAvailable(),
+		PriceChanged:      s.PriceChanged,
+		Unavailable:       s.Unavailable,
+	}
+	if s.PriceChanged {
+		response.PreviousPrice = s.PreviousPrice
+	}
+	return response
+}
+
+// The cart must have been revalidated (see CartModel.Revalidate) so lines carry
+// their items and current prices.
+func (s *CartSerializer) Response() CartResponse {
+	response := CartResponse{
+		Token:   s.Token,
+		Sellers: []CartSellerResponse{},
+	}
+	groups := map[uint]int{}
+	subtotals := map[uint]map[string]int64{}
+	for _, line := range s.Lines {
+		sellerID := line.Item.SellerID
+		index, ok := groups[sellerID]
+		if !ok {
+			sellerSerializer := items.ItemUserSerializer{C: s.C, ItemUserModel: line.Item.Seller}
+			response.Sellers = append(response.Sellers, CartSellerResponse{
+				Seller:    sellerSerializer.Response(),
+				Lines:     []CartLineResponse{},
+				Subtotals: []TotalResponse{},
+			})
+			index = len(response.Sellers) - 1
+			groups[sellerID] = index
+			subtotals[sellerID] = map[string]int64{}
+		}
+		serializer := CartLineSerializer{s.C, line}
+		lineResponse := serializer.Response()
+		group := &response.Sellers[index]
+		group.Lines = append(group.Lines, lineResponse)
+		if line.Unavailable {
+			continue
+		}
+		if _, ok := subtotals[sellerID][line.Currency]; !ok {
+			group.Subtotals = append(group.Subtotals, TotalResponse{Currency: line.Currency})
+		}
+		subtotals[sellerID][line.Currency] += lineResponse.LineTotal
+		response.ItemsCount += line.Quantity
+	}
+	for sellerID, index := range groups {
+		group := &response.Sellers[index]
+		for i := range group.Subtotals {
+			total := common.Money{Amount: subtotals[sellerID][group.Subtotals[i].Currency], Currency: group.Subtotals[i].Currency}
+			group.Subtotals[i].Amount = total.Amount
+			group.Subtotals[i].Formatted = total.String()
+		}
+	}
+	return response
+}
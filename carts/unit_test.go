@@ -0,0 +1,206 @@
+package carts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+var test_db *gorm.DB
+
+func userModelMocker(n int) []users.UserModel {
+	var offset int
+	test_db.Model(&users.UserModel{}).Count(&offset)
+	var ret []users.UserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username:     fmt.Sprintf("user%v", i),
+			Email:        fmt.Sprintf("user%v@linkedin.com", i),
+			PasswordHash: "password123",
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func itemModelMocker(seller users.UserModel, price int64, quantity int) items.ItemModel {
+	var offset int
+	test_db.Unscoped().Model(&items.ItemModel{}).Count(&offset)
+	itemModel := items.ItemModel{
+		Slug:     fmt.Sprintf("item-%v", offset+1),
+		Title:    fmt.Sprintf("item %v", offset+1),
+		Price:    price,
+		Currency: "USD",
+		Quantity: quantity,
+		SellerID: items.GetItemUserModel(seller).ID,
+	}
+	test_db.Create(&itemModel)
+	return itemModel
+}
+
+func cartRequest(r *gin.Engine, method, url, token string, user uint, body string) (*httptest.ResponseRecorder, CartResponse) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(CartTokenHeader, token)
+	}
+	if user != 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(user)))
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response struct {
+		Cart CartResponse `json:"cart"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response.Cart
+}
+
+func TestCart(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	sellerA, sellerB, buyer := people[0], people[1], people[2]
+	itemA1 := itemModelMocker(sellerA, 1000, 5)
+	itemA2 := itemModelMocker(sellerA, 250, 1)
+	itemB := itemModelMocker(sellerB, 4000, 2)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	CartRegister(r.Group("/cart"))
+
+	w, cart := cartRequest(r, "POST", "/cart/", "", 0, fmt.Sprintf(`{"line":{"slug":"%v","quantity":2}}`, itemA1.Slug))
+	asserts.Equal(http.StatusCreated, w.Code, "anonymous visitor should be able to add to a cart")
+	asserts.Len(cart.Token, cartTokenLength, "anonymous cart should come with a token")
+	token := cart.Token
+
+	w, _ = cartRequest(r, "POST", "/cart/", token, 0, fmt.Sprintf(`{"line":{"slug":"%v","quantity":2}}`, itemA2.Slug))
+	asserts.Equal(http.StatusConflict, w.Code, "adding more than the stock should be refused")
+
+	draft := itemModelMocker(sellerB, 100, 1)
+	test_db.Model(&items.ItemModel{}).Where("id = ?", draft.ID).Update("status", items.ItemDraft)
+	w, _ = cartRequest(r, "POST", "/cart/", token, 0, fmt.Sprintf(`{"line":{"slug":"%v"}}`, draft.Slug))
+	asserts.Equal(http.StatusNotFound, w.Code, "unpublished items should not be added")
+
+	w, cart = cartRequest(r, "POST", "/cart/", token, 0, fmt.Sprintf(`{"line":{"slug":"%v"}}`, itemB.Slug))
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Equal(token, cart.Token, "the token should keep pointing at the same cart")
+	asserts.Len(cart.Sellers, 2, "lines should be grouped by seller")
+	asserts.Equal(3, cart.ItemsCount)
+	asserts.Equal(int64(2000), cart.Sellers[0].Subtotals[0].Amount, "subtotal should be price times quantity")
+	asserts.Equal("20.00 USD", cart.Sellers[0].Subtotals[0].Formatted)
+
+	test_db.Model(&items.ItemModel{}).Where("id = ?", itemA1.ID).Update("price", 1200)
+	w, cart = cartRequest(r, "GET", "/cart/", token, 0, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	line := cart.Sellers[0].Lines[0]
+	asserts.True(line.PriceChanged, "price change should be reported on read")
+	asserts.Equal(int64(1000), line.PreviousPrice)
+	asserts.Equal(int64(1200), line.Price, "line should be re-priced on read")
+	_, cart = cartRequest(r, "GET", "/cart/", token, 0, ``)
+	asserts.False(cart.Sellers[0].Lines[0].PriceChanged, "price change should only be reported once")
+
+	w, cart = cartRequest(r, "PATCH", "/cart/"+itemA1.Slug, token, 0, `{"line":{"quantity":4}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(4, cart.Sellers[0].Lines[0].Quantity, "quantity should be replaced")
+
+	// The buyer already has a cart with one unit of itemB before logging in.
+	buyerCart, _ := FindOrCreateCart(items.GetItemUserModel(buyer), "")
+	asserts.NoError(buyerCart.AddItem(itemB, 1))
+	asserts.NoError(MergeAnonymousCart(items.GetItemUserModel(buyer), token))
+	var unsaved CartModel
+	asserts.NoError(unsaved.Clear())
+
+	w, cart = cartRequest(r, "GET", "/cart/", "", buyer.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(buyerCart.Token, cart.Token, "merged lines should live in the user's cart")
+	asserts.Equal(6, cart.ItemsCount, "quantities of both carts should be added up")
+	anonymous, _ := FindCart(items.ItemUserModel{}, token)
+	asserts.Zero(anonymous.ID, "anonymous cart should be gone after merging")
+
+	test_db.Delete(&itemB)
+	_, cart = cartRequest(r, "GET", "/cart/", "", buyer.ID, ``)
+	asserts.True(cart.Sellers[1].Lines[0].Unavailable, "deleted item should be flagged")
+	asserts.Empty(cart.Sellers[1].Subtotals, "unavailable lines should not count in subtotals")
+
+	listing := func(availability string, reservedFor uint) {
+		test_db.Model(&items.ItemModel{}).Where("id = ?", itemA1.ID).
+			Updates(map[string]interface{}{"availability": availability, "reserved_for_id": reservedFor})
+		_, cart = cartRequest(r, "GET", "/cart/", "", buyer.ID, ``)
+	}
+	listing(items.ListingReserved, items.GetItemUserModel(sellerB).ID)
+	asserts.True(cart.Sellers[0].Lines[0].Unavailable, "items reserved for another buyer should be flagged")
+	listing(items.ListingReserved, items.GetItemUserModel(buyer).ID)
+	asserts.False(cart.Sellers[0].Lines[0].Unavailable, "items reserved for the buyer should stay available")
+	listing(items.ListingSold, 0)
+	asserts.True(cart.Sellers[0].Lines[0].Unavailable, "sold items should be flagged")
+	listing(items.ListingExpired, 0)
+	asserts.True(cart.Sellers[0].Lines[0].Unavailable, "expired items should be flagged")
+	listing(items.ListingAvailable, 0)
+
+	w, _ = cartRequest(r, "POST", "/cart/", "", sellerA.ID, fmt.Sprintf(`{"line":{"slug":"%v"}}`, itemA1.Slug))
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "sellers should not buy their own items")
+
+	w, cart = cartRequest(r, "DELETE", "/cart/", "", buyer.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Zero(cart.ItemsCount, "cleared cart should be empty")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	items.AutoMigrate()
+	AutoMigrate()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
+
+func TestCartVariants(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, buyer := people[0], people[1]
+	item := itemModelMocker(seller, 1000, 5)
+	small, err := item.AddVariant("Small", 900, 3, nil)
+	asserts.NoError(err)
+	large, _ := item.AddVariant("Large", 1200, 1, nil)
+	cart, _ := FindOrCreateCart(items.GetItemUserModel(buyer), "")
+
+	asserts.Equal(items.ErrVariantRequired, cart.AddItem(item, 1), "items with variants should be added through them")
+	asserts.NoError(cart.AddVariant(item, small, 2))
+	asserts.NoError(cart.AddVariant(item, large, 1))
+	asserts.Equal(items.ErrOutOfStock, cart.AddVariant(item, large, 1), "each variant should have its own stock")
+	asserts.NoError(cart.SetVariantQuantity(item, small, 3))
+
+	test_db.Model(&items.ItemVariantModel{}).Where("id = ?", large.ID).Update("price", 1500)
+	asserts.NoError(cart.Revalidate())
+	asserts.Len(cart.Lines, 2)
+	asserts.Equal(900, int(cart.Lines[0].Price))
+	asserts.False(cart.Lines[0].PriceChanged)
+	asserts.True(cart.Lines[1].PriceChanged, "lines should follow the variant's price")
+	asserts.Equal(1500, int(cart.Lines[1].Price))
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	CartRegister(r.Group("/cart"))
+	w, response := cartRequest(r, "DELETE", fmt.Sprintf("/cart/%v?variant=%v", item.Slug, small.ID), "", buyer.ID, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Len(response.Sellers[0].Lines, 1)
+	asserts.Equal("Large", response.Sellers[0].Lines[0].VariantName)
+	asserts.Equal(1, response.Sellers[0].Lines[0].QuantityAvailable)
+}
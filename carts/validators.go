@@ -0,0 +1,26 @@
+package carts
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+type CartLineValidator struct {
+	Line struct {
+		Slug     string `form:"slug" json:"slug"`
+		Variant  uint   `form:"variant" json:"variant"`
+		Quantity int    `form:"quantity" json:"quantity" binding:"min=0"`
+	} `json:"line"`
+}
+
+// Adding an item without a quantity puts a single unit in the cart.
+func NewCartLineValidator() CartLineValidator {
+	cartLineValidator := CartLineValidator{}
+	cartLineValidator.Line.Quantity = 1
+	return cartLineValidator
+}
+
+func (s *CartLineValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
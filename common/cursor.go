@@ -0,0 +1,176 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A position in a list, handed to clients as an opaque signed string so they can
+// neither forge nor edit it. Order names the list ordering the cursor belongs to,
+// Key is the sort value of the row it points at and ID breaks ties. Prev cursors
+// page backwards, towards the start of the list.
+type Cursor struct {
+	Order string `json:"o"`
+	Key   string `json:"k,omitempty"`
+	ID    uint   `json:"i"`
+	Prev  bool   `json:"p,omitempty"`
+}
+
+// Cursors are signed with the app secret, the prefix keeps the signatures apart
+// from any other use of it.
+func signCursor(payload string) string {
+	mac := hmac.New(sha256.New, []byte(NBSecretPassword))
+	mac.Write([]byte("cursor:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func EncodeCursor(cursor Cursor) string {
+	data, _ := json.Marshal(cursor)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signCursor(payload)
+}
+
+func DecodeCursor(value string) (Cursor, error) {
+	var cursor Cursor
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signCursor(parts[0]))) {
+		return cursor, ErrInvalidCursor
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &cursor) != nil {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// Keyset pagination over a list ordered by Key then ID: instead of skipping
+// offset rows, every page starts right after the row the cursor points at, so
+// rows arriving in the meantime never shift the pages.
+//
+// Key is the SQL expression of the sort value, "" to order by ID alone; Time
+// tells a time Key from an integer one. ID is the SQL expression of a unique
+// column.
+//
+//	query, cursor, err := keyset.Seek(query, c.Query("cursor"), limit)
+//	query.Find(&models)
+//	n, hasPrev, hasNext := keyset.Finish(models, cursor, limit)
+type Keyset struct {
+	Name string
+	Key  string
+	ID   string
+	Desc bool
+	Time bool
+}
+
+func (k Keyset) direction(desc bool) string {
+	if desc {
+		return " desc"
+	}
+	return " asc"
+}
+
+// The ORDER BY clause of the list.
+func (k Keyset) OrderBy() string {
+	order := k.ID + k.direction(k.Desc)
+	if k.Key != "" {
+		order = k.Key + k.direction(k.Desc) + ", " + order
+	}
+	return order
+}
+
+// A cursor pointing at the row with sort value key (a time.Time or an integer)
+// and the given id.
+func (k Keyset) Encode(key interface{}, id uint, prev bool) string {
+	cursor := Cursor{Order: k.Name, ID: id, Prev: prev}
+	switch key := key.(type) {
+	case time.Time:
+		cursor.Key = key.Format(time.RFC3339Nano)
+	case nil:
+	default:
+		value := reflect.ValueOf(key)
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			cursor.Key = strconv.FormatInt(value.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			cursor.Key = strconv.FormatUint(value.Uint(), 10)
+		}
+	}
+	return EncodeCursor(cursor)
+}
+
+// Restrict db to the rows past the cursor, nearest first, reading one row more
+// than limit to tell whether the list goes on. An empty cursor starts at the top
+// of the list. The decoded cursor is returned for Finish.
+func (k Keyset) Seek(db *gorm.DB, value string, limit int) (*gorm.DB, Cursor, error) {
+	if value == "" {
+		return db.Order(k.OrderBy()).Limit(limit + 1), Cursor{}, nil
+	}
+	cursor, err := DecodeCursor(value)
+	if err != nil || cursor.Order != k.Name {
+		return db, cursor, ErrInvalidCursor
+	}
+	// Going backwards reads the rows before the cursor in reverse order.
+	desc := k.Desc != cursor.Prev
+	op := " > "
+	if desc {
+		op = " < "
+	}
+	if k.Key == "" {
+		db = db.Where(k.ID+op+"?", cursor.ID)
+	} else {
+		var key interface{}
+		if k.Time {
+			key, err = time.Parse(time.RFC3339Nano, cursor.Key)
+		} else {
+			key, err = strconv.ParseInt(cursor.Key, 10, 64)
+		}
+		if err != nil {
+			return db, cursor, ErrInvalidCursor
+		}
+		db = db.Where(k.Key+op+"? OR ("+k.Key+" = ? AND "+k.ID+op+"?)", key, key, cursor.ID)
+	}
+	order := k.ID + k.direction(desc)
+	if k.Key != "" {
+		order = k.Key + k.direction(desc) + ", " + order
+	}
+	return db.Order(order).Limit(limit + 1), cursor, nil
+}
+
+// Put the rows read after Seek back in list order, and report how many of them
+// make the page and whether there are rows before and after it. rows is the
+// slice the query was read into.
+func (k Keyset) Finish(rows interface{}, cursor Cursor, limit int) (n int, hasPrev bool, hasNext bool) {
+	value := reflect.ValueOf(rows)
+	n = value.Len()
+	more := n > limit
+	if more {
+		n = limit
+	}
+	if !cursor.Prev {
+		return n, cursor.ID != 0, more
+	}
+	swap := reflect.Swapper(rows)
+	for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+		swap(i, j)
+	}
+	return n, more, true
+}
+
+// The JSON value of a next or prev cursor, null at either end of the list.
+func CursorResponse(cursor string) *string {
+	if cursor == "" {
+		return nil
+	}
+	return &cursor
+}
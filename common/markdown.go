@@ -0,0 +1,37 @@
+package common
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+)
+
+// CommonMark without extensions; raw HTML in the source is left out by goldmark
+// and whatever else could be unsafe by the sanitizer.
+var markdown = goldmark.New()
+
+// The allowlist rendered Markdown goes through: user generated content markup
+// only, no scripts nor styles, and links with rel="nofollow".
+var markdownPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowURLSchemes("http", "https", "mailto")
+	policy.RequireNoFollowOnLinks(true)
+	return policy
+}()
+
+// Render the Markdown source to HTML that is safe to insert into any page as is.
+//
+//	RenderMarkdown("**hi** [shop](http://example.com)")
+//	// <p><strong>hi</strong> <a href="http://example.com" rel="nofollow">shop</a></p>
+func RenderMarkdown(source string) string {
+	if source == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "<p>" + html.EscapeString(source) + "</p>"
+	}
+	return markdownPolicy.Sanitize(buf.String())
+}
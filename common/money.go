@@ -0,0 +1,174 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Money is an amount expressed in the minor unit of its ISO 4217 currency
+// (cents for USD, yen for JPY...). It deliberately has no float constructor or
+// accessor: prices are stored, compared and summed as integers only.
+//
+//	price, err := common.NewMoney(1250, "USD") // 12.50 USD
+//	total, err := price.Mul(3)
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// The currency used when a seller does not send one.
+const DefaultCurrency = "USD"
+
+var ErrCurrencyMismatch = errors.New("currencies do not match")
+var ErrInvalidCurrency = errors.New("invalid ISO 4217 currency code")
+var ErrInvalidAmount = errors.New("invalid money amount")
+
+// Active ISO 4217 codes, kept as one string so the list stays readable.
+const iso4217Codes = "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD " +
+	"CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD " +
+	"HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD " +
+	"MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG " +
+	"QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS " +
+	"UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL"
+
+// Number of minor-unit digits for currencies that do not use the usual two.
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+var currencies = map[string]bool{}
+
+// The "currency" binding tag accepts the codes IsCurrency does, so requests and
+// Money agree on what a currency is.
+func init() {
+	for _, code := range strings.Fields(iso4217Codes) {
+		currencies[code] = true
+	}
+	if engine, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		engine.RegisterValidation("currency", func(fl validator.FieldLevel) bool {
+			return IsCurrency(fl.Field().String())
+		})
+	}
+}
+
+// Reports whether code is an active, upper-case ISO 4217 currency code.
+func IsCurrency(code string) bool {
+	return currencies[code]
+}
+
+// Number of digits after the decimal separator for the given currency.
+func CurrencyExponent(code string) int {
+	if exp, ok := currencyExponents[code]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Build a Money value, checking the currency code.
+func NewMoney(amount int64, currency string) (Money, error) {
+	if !IsCurrency(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// Parse a decimal string such as "12.5" or "1200" in the major unit of currency
+// into a Money value without going through float64.
+//
+//	m, err := common.ParseMoney("12.50", "USD") // Money{1250, "USD"}
+func ParseMoney(value string, currency string) (Money, error) {
+	if !IsCurrency(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+	exp := CurrencyExponent(currency)
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+	parts := strings.SplitN(value, ".", 2)
+	whole, fraction := parts[0], ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if (whole == "" && fraction == "") || len(fraction) > exp {
+		return Money{}, ErrInvalidAmount
+	}
+	fraction += strings.Repeat("0", exp-len(fraction))
+	digits := whole + fraction
+	for _, ch := range digits {
+		if ch < '0' || ch > '9' {
+			return Money{}, ErrInvalidAmount
+		}
+	}
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, ErrInvalidAmount
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount - other.Amount, Currency: m.Currency}, nil
+}
+
+// Multiply by an integer quantity, e.g. unit price times the number of units.
+func (m Money) Mul(quantity int64) Money {
+	return Money{Amount: m.Amount * quantity, Currency: m.Currency}
+}
+
+// Returns -1, 0 or 1 like strings.Compare, or an error for different currencies.
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// The amount in the major unit without a currency, e.g. "12.50" or "-0.05".
+func (m Money) Decimal() string {
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	exp := CurrencyExponent(m.Currency)
+	if exp == 0 {
+		return fmt.Sprintf("%v%d", sign, amount)
+	}
+	unit := int64(1)
+	for i := 0; i < exp; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%v%d.%0*d", sign, amount/unit, exp, amount%unit)
+}
+
+// Human readable form used in API responses, e.g. "12.50 USD".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConnectingDatabase(t *testing.T) {
@@ -162,3 +164,85 @@ func TestNewError(t *testing.T) {
 	assert.Equal(map[string]interface{}(map[string]interface{}{"database": "no such table: not_exists"}),
 		commenError.Errors, "commenError should have right error info")
 }
+
+func TestMoney(t *testing.T) {
+	asserts := assert.New(t)
+
+	price, err := NewMoney(1250, "USD")
+	asserts.NoError(err, "USD should be a valid currency")
+	asserts.Equal("12.50 USD", price.String(), "USD should be formatted with two decimals")
+
+	_, err = NewMoney(1250, "usd")
+	asserts.Equal(ErrInvalidCurrency, err, "lower case currency should be rejected")
+
+	asserts.Equal("1250 JPY", Money{1250, "JPY"}.String(), "JPY has no minor unit")
+	asserts.Equal("1.250 KWD", Money{1250, "KWD"}.String(), "KWD has three decimals")
+	asserts.Equal("-0.05 EUR", Money{-5, "EUR"}.String(), "negative amounts keep their sign")
+
+	total := price.Mul(3)
+	asserts.Equal(int64(3750), total.Amount, "Mul should multiply the minor units")
+	sum, err := price.Add(Money{50, "USD"})
+	asserts.NoError(err)
+	asserts.Equal(int64(1300), sum.Amount, "Add should sum the minor units")
+	_, err = price.Add(Money{50, "EUR"})
+	asserts.Equal(ErrCurrencyMismatch, err, "adding different currencies should fail")
+	cmp, err := price.Cmp(sum)
+	asserts.NoError(err)
+	asserts.Equal(-1, cmp, "12.50 should be less than 13.00")
+
+	parsed, err := ParseMoney("12.5", "USD")
+	asserts.NoError(err)
+	asserts.Equal(Money{1250, "USD"}, parsed, "ParseMoney should pad the fraction")
+	parsed, err = ParseMoney("7", "JPY")
+	asserts.NoError(err)
+	asserts.Equal(Money{7, "JPY"}, parsed, "ParseMoney should handle currencies without minor unit")
+	_, err = ParseMoney("12.505", "USD")
+	asserts.Equal(ErrInvalidAmount, err, "too many decimals should be rejected")
+	_, err = ParseMoney("1e3", "USD")
+	asserts.Equal(ErrInvalidAmount, err, "float notation should be rejected")
+}
+
+func TestCursor(t *testing.T) {
+	asserts := assert.New(t)
+
+	keyset := Keyset{Name: "newest", Key: "created_at", ID: "id", Desc: true, Time: true}
+	at := time.Date(2020, 1, 10, 12, 0, 0, 500, time.UTC)
+	value := keyset.Encode(at, 7, false)
+	cursor, err := DecodeCursor(value)
+	asserts.NoError(err)
+	asserts.Equal(Cursor{Order: "newest", Key: at.Format(time.RFC3339Nano), ID: 7}, cursor)
+	asserts.Equal("created_at desc, id desc", keyset.OrderBy())
+
+	forged := EncodeCursor(Cursor{Order: "newest", ID: 8})
+	_, err = DecodeCursor(strings.Split(forged, ".")[0] + "." + strings.Split(value, ".")[1])
+	asserts.Equal(ErrInvalidCursor, err, "a cursor with another cursor's signature should be rejected")
+	_, err = DecodeCursor("garbage")
+	asserts.Equal(ErrInvalidCursor, err)
+
+	_, _, err = Keyset{Name: "oldest", Key: "created_at", ID: "id", Time: true}.Seek(nil, value, 10)
+	asserts.Equal(ErrInvalidCursor, err, "a cursor should only work with its own ordering")
+
+	rows := []int{3, 2, 1}
+	n, hasPrev, hasNext := keyset.Finish(rows, Cursor{Order: "newest", ID: 4, Prev: true}, 2)
+	asserts.Equal(2, n)
+	asserts.True(hasPrev)
+	asserts.True(hasNext)
+	asserts.Equal([]int{2, 3}, rows[:n], "prev pages should be put back in list order")
+	n, hasPrev, hasNext = keyset.Finish(rows[:2], Cursor{}, 2)
+	asserts.Equal(2, n)
+	asserts.False(hasPrev, "the first page has nothing before it")
+	asserts.False(hasNext)
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal("<h1>Lamp</h1>\n<ul>\n<li><em>brass</em></li>\n</ul>\n", RenderMarkdown("# Lamp\n\n- *brass*"))
+	asserts.Equal(`<p><a href="http://example.com" rel="nofollow">shop</a></p>`+"\n", RenderMarkdown("[shop](http://example.com)"),
+		"links should be nofollow")
+	asserts.Equal("<p><strong>hi</strong> alert(1)</p>\n", RenderMarkdown("**hi** <script>alert(1)</script>"),
+		"raw HTML should be left out")
+	asserts.Equal("<p>x</p>\n", RenderMarkdown("[x](javascript:alert(1))"), "unsafe links should be dropped")
+	asserts.NotContains(RenderMarkdown(`<img src=x onerror="alert(1)">`), "onerror")
+	asserts.Equal("", RenderMarkdown(""))
+}
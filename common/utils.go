@@ -4,10 +4,11 @@ package common
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"gopkg.in/go-playground/validator.v8"
+	"github.com/go-playground/validator/v10"
 
 	"github.com/gin-gonic/gin/binding"
 	"github.com/gin-gonic/gin"
@@ -56,10 +57,10 @@ func NewValidatorError(err error) CommonError {
 	for _, v := range errs {
 		// can translate each error one at a time.
 		//fmt.Println("gg",v.NameNamespace)
-		if v.Param != "" {
-			res.Errors[v.Field] = fmt.Sprintf("{%v: %v}", v.Tag, v.Param)
+		if v.Param() != "" {
+			res.Errors[v.Field()] = fmt.Sprintf("{%v: %v}", v.Tag(), v.Param())
 		} else {
-			res.Errors[v.Field] = fmt.Sprintf("{key: %v}", v.Tag)
+			res.Errors[v.Field()] = fmt.Sprintf("{key: %v}", v.Tag())
 		}
 
 	}
@@ -74,6 +75,22 @@ func NewError(key string, err error) CommonError {
 	return res
 }
 
+// The validators still use the "exists" tag of validator v8, which gin used
+// before v10: the field has to be present, i.e. not a nil pointer, map or slice.
+func init() {
+	engine, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	engine.RegisterValidation("exists", func(fl validator.FieldLevel) bool {
+		switch fl.Field().Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			return !fl.Field().IsNil()
+		}
+		return true
+	}, true)
+}
+
 // Changed the c.MustBindWith() ->  c.ShouldBindWith().
 // I don't want to auto return 400 when error happened.
 // origin function is here: https://github.com/gin-gonic/gin/blob/master/context.go
@@ -81,3 +98,16 @@ func Bind(c *gin.Context, obj interface{}) error {
 	b := binding.Default(c.Request.Method, c.ContentType())
 	return c.ShouldBindWith(obj, b)
 }
+
+// Run job every interval in a background goroutine for the lifetime of the process,
+// passing it the tick time. Used by main to start maintenance jobs such as expiring
+// stock reservations.
+// 	common.Every(time.Minute, func(now time.Time) { items.ExpireStockReservations(now) })
+func Every(interval time.Duration, job func(now time.Time)) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for now := range ticker.C {
+			job(now)
+		}
+	}()
+}
@@ -1,23 +1,217 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
-	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/carts"
 	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/offers"
+	"github.com/NivRichter/GoLang-test1/orders"
+	"github.com/NivRichter/GoLang-test1/payments"
 	"github.com/NivRichter/GoLang-test1/users"
 	"github.com/jinzhu/gorm"
 )
 
 func Migrate(db *gorm.DB) {
 	users.AutoMigrate()
-	db.AutoMigrate(&items.ItemModel{})
-	db.AutoMigrate(&items.TagModel{})
-	db.AutoMigrate(&items.FavoriteModel{})
-	db.AutoMigrate(&items.ItemUserModel{})
-	db.AutoMigrate(&items.CommentModel{})
+	items.AutoMigrate()
+	carts.AutoMigrate()
+	orders.AutoMigrate()
+	payments.AutoMigrate()
+	offers.AutoMigrate()
+}
+
+// Payments need a provider chosen with PAYMENT_PROVIDER. The only one so far is
+// "fake", the local provider for development which delivers its signed webhooks
+// straight back to us; the server does not start without one.
+func SetupPayments() error {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "fake":
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			secret = common.RandString(32)
+		}
+		provider := payments.NewFakeProvider(secret, payments.FakeSucceed)
+		provider.Deliver = func(payload []byte, signature string) {
+			if err := payments.HandleWebhookPayload(payload, signature); err != nil {
+				fmt.Println("webhook err: ", err)
+			}
+		}
+		payments.SetProvider(provider)
+		return nil
+	case "":
+		return errors.New("no payment provider, set PAYMENT_PROVIDER=fake to use the development one")
+	default:
+		return fmt.Errorf("unknown payment provider %q", name)
+	}
+}
+
+// Periodic maintenance that runs alongside the HTTP server.
+func StartJobs() {
+	// LISTING_PERIOD is a duration like "720h".
+	if value := os.Getenv("LISTING_PERIOD"); value != "" {
+		period, err := time.ParseDuration(value)
+		if err != nil {
+			fmt.Println("job err: (LISTING_PERIOD) ", err)
+		} else {
+			items.ListingPeriod = period
+		}
+	}
+	common.Every(time.Minute, func(now time.Time) {
+		if _, err := items.ExpireStockReservations(now); err != nil {
+			fmt.Println("job err: (ExpireStockReservations) ", err)
+		}
+		if _, err := orders.CancelExpiredOrders(now); err != nil {
+			fmt.Println("job err: (CancelExpiredOrders) ", err)
+		}
+		if _, err := offers.ExpireOffers(now); err != nil {
+			fmt.Println("job err: (ExpireOffers) ", err)
+		}
+		if _, err := items.CloseAuctions(now); err != nil {
+			fmt.Println("job err: (CloseAuctions) ", err)
+		}
+		if _, err := items.PublishScheduledItems(now); err != nil {
+			fmt.Println("job err: (PublishScheduledItems) ", err)
+		}
+		if _, err := items.ExpireListings(now); err != nil {
+			fmt.Println("job err: (ExpireListings) ", err)
+		}
+	})
+	// TRASH_RETENTION is a duration like "720h".
+	retention := items.DefaultTrashRetention
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			fmt.Println("job err: (TRASH_RETENTION) ", err)
+		} else {
+			retention = parsed
+		}
+	}
+	common.Every(time.Hour, func(now time.Time) {
+		if _, err := items.PurgeTrash(now.Add(-retention)); err != nil {
+			fmt.Println("job err: (PurgeTrash) ", err)
+		}
+		if _, err := items.RollupViews(now); err != nil {
+			fmt.Println("job err: (RollupViews) ", err)
+		}
+		if _, err := items.ComputeRelatedItems(); err != nil {
+			fmt.Println("job err: (ComputeRelatedItems) ", err)
+		}
+	})
+}
+
+// Recompute every stored counter from the rows it counts, for when they drift
+// (e.g. after editing the database by hand).
+func Recount() error {
+	if err := users.Recount(); err != nil {
+		return err
+	}
+	return items.Recount()
+}
+
+// Compute the related items now rather than waiting for the hourly job.
+func Related() error {
+	n, err := items.ComputeRelatedItems()
+	if err == nil {
+		fmt.Println("related items: ", n)
+	}
+	return err
+}
+
+// The items seller of the -seller flag of import and export.
+func commandSeller(username string) (items.ItemUserModel, error) {
+	if username == "" {
+		return items.ItemUserModel{}, errors.New("-seller is required")
+	}
+	userModel, err := users.FindOneUser(&users.UserModel{Username: username})
+	if err != nil {
+		return items.ItemUserModel{}, err
+	}
+	return items.GetItemUserModel(userModel), nil
+}
+
+// Import listings for a seller from a CSV or NDJSON file ("-" for stdin):
+//
+//	go run hello.go import -seller jake -map title=Name,price=Cost [-dry-run] [-report errors.csv] items.csv
+func Import() error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("seller", "", "username of the seller")
+	format := flags.String("format", "", "csv or ndjson, from the file extension by default")
+	mapping := flags.String("map", "", "columns of the fields, as field=column,...")
+	dryRun := flags.Bool("dry-run", false, "check the rows without creating the items")
+	report := flags.String("report", "", "file to write the error report to")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		return errors.New("one file to import is required")
+	}
+	seller, err := commandSeller(*username)
+	if err != nil {
+		return err
+	}
+	var file io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		opened, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer opened.Close()
+		file = opened
+		if *format == "" {
+			*format = strings.TrimPrefix(filepath.Ext(name), ".")
+		}
+	}
+	columns := map[string]string{}
+	for _, pair := range strings.Split(*mapping, ",") {
+		if field := strings.SplitN(pair, "=", 2); len(field) == 2 {
+			columns[field[0]] = field[1]
+		}
+	}
+	result, err := items.ImportItems(seller, file, *format, columns, *dryRun)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("import %v: %v rows, %v created, %v errors\n", result.ID, result.RowsCount, result.CreatedCount, result.ErrorsCount)
+	if *report != "" {
+		return ioutil.WriteFile(*report, []byte(result.ReportCSV()), 0644)
+	}
+	if result.ErrorsCount != 0 {
+		fmt.Print(result.ReportCSV())
+	}
+	return nil
+}
+
+// Export the listings of a seller to stdout:
+//
+//	go run hello.go export -seller jake [-format ndjson] > items.csv
+func Export() error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	username := flags.String("seller", "", "username of the seller")
+	format := flags.String("format", items.BulkCSV, "csv or ndjson")
+	flags.Parse(os.Args[2:])
+	seller, err := commandSeller(*username)
+	if err != nil {
+		return err
+	}
+	return items.ExportItems(seller, os.Stdout, *format)
+}
+
+// Maintenance commands, run instead of the server as `go run hello.go <command>`.
+var commands = map[string]func() error{
+	"recount": Recount,
+	"import":  Import,
+	"export":  Export,
+	"related": Related,
 }
 
 func main() {
@@ -25,20 +219,56 @@ func main() {
 	db := common.Init()
 	Migrate(db)
 	defer db.Close()
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Println("unknown command: ", os.Args[1])
+			os.Exit(2)
+		}
+		if err := command(); err != nil {
+			fmt.Println(os.Args[1], "err: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := SetupPayments(); err != nil {
+		fmt.Println("payments err: ", err)
+		os.Exit(1)
+	}
+	StartJobs()
 
 	r := gin.Default()
 
 	v1 := r.Group("/api")
+	users.OnLogin(carts.MergeCartOnLogin)
+	items.OnAuctionWon(orders.CheckoutAuctionWinner)
+	items.SetSalesCounter(orders.CountSales)
 	users.UsersRegister(v1.Group("/users"))
 	v1.Use(users.AuthMiddleware(false))
 	items.ItemsAnonymousRegister(v1.Group("/items"))
 	items.TagsAnonymousRegister(v1.Group("/tags"))
+	items.CategoriesAnonymousRegister(v1.Group("/categories"))
+	carts.CartRegister(v1.Group("/cart"))
+	payments.PaymentsAnonymousRegister(v1.Group("/payments"))
 
 	v1.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1.Group("/user"))
+	items.TrashRegister(v1.Group("/user/trash"))
+	items.AnalyticsRegister(v1.Group("/user/analytics"))
 	users.ProfileRegister(v1.Group("/profiles"))
 
 	items.ItemsRegister(v1.Group("/items"))
+	items.TagsRegister(v1.Group("/tags"))
+	orders.OrdersRegister(v1.Group("/orders"))
+	payments.PaymentsRegister(v1.Group("/payments"))
+	offers.OffersRegister(v1.Group("/offers"))
+
+	categoriesAdmin := v1.Group("/categories")
+	categoriesAdmin.Use(users.AdminMiddleware())
+	items.CategoriesAdminRegister(categoriesAdmin)
+	admin := v1.Group("/admin")
+	admin.Use(users.AdminMiddleware())
+	items.TrashAdminRegister(admin)
 
 	testAuth := r.Group("/api/ping")
 
@@ -0,0 +1,318 @@
+package items
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/jinzhu/gorm"
+)
+
+// A view of an item page. Viewer identifies who viewed it without keeping who
+// they are: a user id, or a hash of the address and user agent of anonymous
+// viewers. Views are kept until their day is rolled up, see RollupViews.
+type ItemViewModel struct {
+	gorm.Model
+	ItemID uint   `gorm:"index"`
+	Viewer string `gorm:"size:64;index"`
+}
+
+// The views of an item on a day (UTC, as 2006-01-02), and how many distinct
+// viewers made them.
+type ItemViewDailyModel struct {
+	gorm.Model
+	ItemID  uint   `gorm:"unique_index:idx_item_view_day"`
+	Day     string `gorm:"size:10;unique_index:idx_item_view_day"`
+	Views   int
+	Viewers int
+}
+
+// The distinct viewers of an item on a day. A day's views can be rolled up over
+// several runs, e.g. when a view made before midnight is saved after the rollup
+// read them, so the viewers of a day are kept to count each of them once.
+type ItemViewDailyViewerModel struct {
+	gorm.Model
+	ItemID uint   `gorm:"unique_index:idx_item_view_day_viewer"`
+	Day    string `gorm:"size:10;unique_index:idx_item_view_day_viewer"`
+	Viewer string `gorm:"size:64;unique_index:idx_item_view_day_viewer"`
+}
+
+// Views of an item by the same viewer within the window count once.
+var ViewWindow = 30 * time.Minute
+
+// Analytics cover at most a year.
+const maxAnalyticsDays = 366
+
+var ErrInvalidDateRange = errors.New("from should be a date before to, at most a year apart")
+
+// Parts of the user agents of crawlers, link previews and scripts, lowercase.
+var botUserAgents = []string{"bot", "crawl", "spider", "slurp", "preview", "facebookexternalhit", "curl", "wget",
+	"python-requests", "go-http-client", "headless"}
+
+// Whether the user agent is a bot rather than someone browsing; an empty user
+// agent is one.
+func IsBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	if strings.TrimSpace(userAgent) == "" {
+		return true
+	}
+	for _, bot := range botUserAgents {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// The Viewer of an ItemViewModel: the user id of users, a hash of the client
+// address and user agent of anonymous viewers.
+func viewerKey(userID uint, clientIP, userAgent string) string {
+	if userID != 0 {
+		return fmt.Sprintf("user:%v", userID)
+	}
+	sum := sha256.Sum256([]byte(clientIP + "\n" + userAgent))
+	return "anon:" + hex.EncodeToString(sum[:16])
+}
+
+// Record that viewer viewed the item at now, unless they already did within
+// ViewWindow. Returns whether the view was recorded.
+func RecordView(item ItemModel, viewer string, now time.Time) (bool, error) {
+	db := common.GetDB()
+	var count int
+	err := db.Model(&ItemViewModel{}).Where("item_id = ? AND viewer = ? AND created_at > ?", item.ID, viewer, now.Add(-ViewWindow).UTC()).
+		Count(&count).Error
+	if err != nil || count != 0 {
+		return false, err
+	}
+	view := ItemViewModel{ItemID: item.ID, Viewer: viewer}
+	view.CreatedAt = now.UTC()
+	view.UpdatedAt = now.UTC()
+	return true, db.Create(&view).Error
+}
+
+type itemDay struct {
+	itemID uint
+	day    string
+}
+
+// The number of views and the distinct viewers of each item on each day.
+func countViews(views []ItemViewModel) (map[itemDay]int, map[itemDay]map[string]bool) {
+	counts := map[itemDay]int{}
+	viewers := map[itemDay]map[string]bool{}
+	for _, view := range views {
+		k := itemDay{view.ItemID, view.CreatedAt.UTC().Format("2006-01-02")}
+		counts[k]++
+		if viewers[k] == nil {
+			viewers[k] = map[string]bool{}
+		}
+		viewers[k][view.Viewer] = true
+	}
+	return counts, viewers
+}
+
+// Add up the views of the days over before now (UTC) into daily rollups and
+// delete them. Every view not rolled up yet is, however long the job did not
+// run, and only the views added up are deleted. The distinct viewers of a day are
+// recounted from its viewers each time, see ItemViewDailyViewerModel. Returns how
+// many daily rows were written. Meant to be run periodically, see common.Every.
+func RollupViews(now time.Time) (int, error) {
+	db := common.GetDB()
+	today := now.UTC().Truncate(24 * time.Hour)
+	var views []ItemViewModel
+	if err := db.Select("id, item_id, viewer, created_at").Where("created_at < ?", today).Find(&views).Error; err != nil {
+		return 0, err
+	}
+	if len(views) == 0 {
+		return 0, nil
+	}
+	var lastID uint
+	for _, view := range views {
+		if view.ID > lastID {
+			lastID = view.ID
+		}
+	}
+	counts, viewers := countViews(views)
+	tx := db.Begin()
+	for k, count := range counts {
+		var daily ItemViewDailyModel
+		err := tx.Where(ItemViewDailyModel{ItemID: k.itemID, Day: k.day}).FirstOrCreate(&daily).Error
+		if err == nil {
+			err = addDailyViewers(tx, k, viewers[k])
+		}
+		var distinct int
+		if err == nil {
+			err = tx.Model(&ItemViewDailyViewerModel{}).Where("item_id = ? AND day = ?", k.itemID, k.day).Count(&distinct).Error
+		}
+		if err == nil {
+			err = tx.Model(&daily).UpdateColumns(map[string]interface{}{
+				"views":   gorm.Expr("views + ?", count),
+				"viewers": distinct,
+			}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Unscoped().Where("created_at < ? AND id <= ?", today, lastID).Delete(&ItemViewModel{}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(counts), tx.Commit().Error
+}
+
+// Remember the viewers of the item on the day that are not known yet.
+func addDailyViewers(tx *gorm.DB, k itemDay, viewers map[string]bool) error {
+	var known []string
+	err := tx.Model(&ItemViewDailyViewerModel{}).Where("item_id = ? AND day = ?", k.itemID, k.day).Pluck("viewer", &known).Error
+	if err != nil {
+		return err
+	}
+	for _, viewer := range known {
+		delete(viewers, viewer)
+	}
+	for viewer := range viewers {
+		if err := tx.Create(&ItemViewDailyViewerModel{ItemID: k.itemID, Day: k.day, Viewer: viewer}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counts the orders paid for each of the items between from and to, see
+// SetSalesCounter.
+type SalesCounter func(itemIDs []uint, from, to time.Time) (map[uint]int, error)
+
+var salesCounter SalesCounter
+
+// Set how analytics count the orders of items, once at startup: orders are
+// kept by the orders package, which items can not import.
+//
+//	items.SetSalesCounter(orders.CountSales)
+func SetSalesCounter(counter SalesCounter) {
+	salesCounter = counter
+}
+
+// How an item did over a range of days. ViewerDays adds up the distinct viewers
+// of each day, so someone coming back on two days counts twice. Conversion is the
+// share of views that ended in an order.
+type ItemAnalytics struct {
+	Item       ItemModel
+	Views      int
+	ViewerDays int
+	Favorites  int
+	Comments   int
+	Orders     int
+	Conversion float64
+}
+
+// The analytics of every listing of seller over the days from and to (UTC dates,
+// both included), most viewed first, with their totals. Views of the days not
+// rolled up yet are counted from the views themselves, see RollupViews.
+func GetSellerAnalytics(seller ItemUserModel, from, to time.Time) ([]ItemAnalytics, ItemAnalytics, error) {
+	var totals ItemAnalytics
+	from = from.UTC().Truncate(24 * time.Hour)
+	to = to.UTC().Truncate(24 * time.Hour)
+	if to.Before(from) || to.Sub(from) >= maxAnalyticsDays*24*time.Hour {
+		return nil, totals, ErrInvalidDateRange
+	}
+	end := to.AddDate(0, 0, 1)
+	db := common.GetDB()
+	var models []ItemModel
+	if err := db.Where("seller_id = ?", seller.ID).Order("id asc").Find(&models).Error; err != nil {
+		return nil, totals, err
+	}
+	if len(models) == 0 {
+		return []ItemAnalytics{}, totals, nil
+	}
+	var ids []uint
+	for _, model := range models {
+		ids = append(ids, model.ID)
+	}
+
+	var views []struct {
+		ItemID  uint
+		Views   int
+		Viewers int
+	}
+	err := db.Model(&ItemViewDailyModel{}).Select("item_id, sum(views) AS views, sum(viewers) AS viewers").
+		Where("item_id IN (?) AND day >= ? AND day <= ?", ids, from.Format("2006-01-02"), to.Format("2006-01-02")).
+		Group("item_id").Scan(&views).Error
+	if err != nil {
+		return nil, totals, err
+	}
+	var recent []ItemViewModel
+	err = db.Select("item_id, viewer, created_at").Where("item_id IN (?) AND created_at >= ? AND created_at < ?", ids, from, end).
+		Find(&recent).Error
+	if err != nil {
+		return nil, totals, err
+	}
+	recentCounts, recentViewers := countViews(recent)
+	type count struct {
+		ItemID uint
+		Count  int
+	}
+	var favorites, comments []count
+	err = db.Model(&FavoriteModel{}).Select("favorite_id AS item_id, count(*) AS count").
+		Where("favorite_id IN (?) AND created_at >= ? AND created_at < ?", ids, from, end).Group("favorite_id").Scan(&favorites).Error
+	if err != nil {
+		return nil, totals, err
+	}
+	err = db.Model(&CommentModel{}).Select("item_id, count(*) AS count").
+		Where("item_id IN (?) AND created_at >= ? AND created_at < ?", ids, from, end).Group("item_id").Scan(&comments).Error
+	if err != nil {
+		return nil, totals, err
+	}
+	orders := map[uint]int{}
+	if salesCounter != nil {
+		if orders, err = salesCounter(ids, from, end); err != nil {
+			return nil, totals, err
+		}
+	}
+
+	byItem := map[uint]*ItemAnalytics{}
+	ret := make([]ItemAnalytics, len(models))
+	for i, model := range models {
+		ret[i] = ItemAnalytics{Item: model, Orders: orders[model.ID]}
+		byItem[model.ID] = &ret[i]
+	}
+	for _, row := range views {
+		byItem[row.ItemID].Views = row.Views
+		byItem[row.ItemID].ViewerDays = row.Viewers
+	}
+	for k, count := range recentCounts {
+		byItem[k.itemID].Views += count
+		byItem[k.itemID].ViewerDays += len(recentViewers[k])
+	}
+	for _, row := range favorites {
+		byItem[row.ItemID].Favorites = row.Count
+	}
+	for _, row := range comments {
+		byItem[row.ItemID].Comments = row.Count
+	}
+	for i := range ret {
+		ret[i].Conversion = conversion(ret[i].Orders, ret[i].Views)
+		totals.Views += ret[i].Views
+		totals.ViewerDays += ret[i].ViewerDays
+		totals.Favorites += ret[i].Favorites
+		totals.Comments += ret[i].Comments
+		totals.Orders += ret[i].Orders
+	}
+	totals.Conversion = conversion(totals.Orders, totals.Views)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Views > ret[j].Views
+	})
+	return ret, totals, nil
+}
+
+func conversion(orders, views int) float64 {
+	if views == 0 {
+		return 0
+	}
+	return float64(orders) / float64(views)
+}
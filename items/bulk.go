@@ -0,0 +1,432 @@
+package items
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/users"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/jinzhu/gorm"
+)
+
+// Listings are imported and exported in bulk as CSV, with a header row, or as
+// NDJSON, one JSON object per line. Both name their fields like the JSON of
+// ItemModelValidator; attributes are "attributes.<name>" CSV columns.
+const (
+	BulkCSV    = "csv"
+	BulkNDJSON = "ndjson"
+)
+
+// The fields of exports, in CSV column order. Imports read the same fields but
+// slug and availability, which new items make for themselves.
+var BulkFields = []string{"slug", "title", "description", "body", "price", "currency", "quantity", "tagList",
+	"category", "status", "publishAt", "availability"}
+
+var ErrInvalidBulkFormat = errors.New("format should be csv or ndjson")
+
+// Import responses only list the first errors, the report has them all.
+const importErrorsShown = 100
+
+// An import of listings, kept with its error report so it can be downloaded
+// once the import is over. Dry runs check every row but create nothing.
+type ItemImportModel struct {
+	gorm.Model
+	SellerID     uint   `gorm:"index"`
+	Format       string `gorm:"size:16"`
+	DryRun       bool
+	RowsCount    int
+	CreatedCount int
+	ErrorsCount  int
+	// The errors as CSV, see ItemImportModel.ReportCSV.
+	Report string            `gorm:"type:text"`
+	Errors []ItemImportError `gorm:"-"`
+}
+
+// What is wrong with a row, counted from 1 without the CSV header. Field is the
+// item field at fault, "row" when the row could not be read at all.
+type ItemImportError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// The error report of the import: one row,field,message line per error under a
+// header line.
+func (model ItemImportModel) ReportCSV() string {
+	if model.Report == "" {
+		return "row,field,message\n"
+	}
+	return model.Report
+}
+
+func FindOneItemImport(condition interface{}) (ItemImportModel, error) {
+	db := common.GetDB()
+	var model ItemImportModel
+	err := db.Where(condition).First(&model).Error
+	return model, err
+}
+
+// A row of an import, the raw JSON of each field by name.
+type bulkRow map[string]json.RawMessage
+
+// Reads the rows of r one at a time, io.EOF after the last. mapping renames
+// the columns of r: the key is the field, the value the column holding it.
+type bulkReader func() (bulkRow, error)
+
+func newBulkReader(r io.Reader, format string, mapping map[string]string) (bulkReader, error) {
+	rename := map[string]string{}
+	for field, column := range mapping {
+		rename[column] = field
+	}
+	field := func(column string) string {
+		if field, ok := rename[column]; ok {
+			return field
+		}
+		return column
+	}
+	switch format {
+	case BulkCSV:
+		return newCSVReader(r, field)
+	case BulkNDJSON:
+		return newNDJSONReader(r, field), nil
+	}
+	return nil, ErrInvalidBulkFormat
+}
+
+// CSV cells are all text: numbers are parsed and tags split on commas before
+// the row is read like JSON. Empty cells are left out.
+func newCSVReader(r io.Reader, field func(string) string) (bulkReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return func() (bulkRow, error) { return nil, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, len(header))
+	for i, column := range header {
+		fields[i] = field(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+	}
+	return func() (bulkRow, error) {
+		record, err := reader.Read()
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				return nil, importError{"row", err.Error()}
+			}
+			return nil, err
+		}
+		row := bulkRow{}
+		attributes := map[string]string{}
+		for i, cell := range record {
+			if i >= len(fields) || cell == "" {
+				continue
+			}
+			name := fields[i]
+			var value interface{} = cell
+			switch {
+			case strings.HasPrefix(name, "attributes."):
+				attributes[strings.TrimPrefix(name, "attributes.")] = cell
+				continue
+			case name == "price" || name == "quantity":
+				number, err := strconv.ParseInt(strings.TrimSpace(cell), 10, 64)
+				if err != nil {
+					return nil, importError{name, "should be a whole number"}
+				}
+				value = number
+			case name == "tagList":
+				var tags []string
+				for _, tag := range strings.Split(cell, ",") {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						tags = append(tags, tag)
+					}
+				}
+				value = tags
+			}
+			row[name], _ = json.Marshal(value)
+		}
+		if len(attributes) != 0 {
+			row["attributes"], _ = json.Marshal(attributes)
+		}
+		return row, nil
+	}, nil
+}
+
+// Blank lines are skipped, and do not count as rows.
+func newNDJSONReader(r io.Reader, field func(string) string) bulkReader {
+	reader := bufio.NewReader(r)
+	return func() (bulkRow, error) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) == 0 {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(line, &object); err != nil {
+				return nil, importError{"row", "should be a JSON object"}
+			}
+			row := bulkRow{}
+			for column, value := range object {
+				row[field(column)] = value
+			}
+			return row, nil
+		}
+	}
+}
+
+// An error of a single row, that does not stop the import.
+type importError struct {
+	field   string
+	message string
+}
+
+func (e importError) Error() string {
+	return e.field + ": " + e.message
+}
+
+// Check the row like ItemModelValidator.Bind checks a request, returning what
+// is wrong with it.
+func (s *ItemModelValidator) bindRow(seller users.UserModel, row bulkRow) []importError {
+	item := reflect.ValueOf(&s.Item).Elem()
+	names := map[string]string{}
+	var errs []importError
+	for i := 0; i < item.NumField(); i++ {
+		name := item.Type().Field(i).Tag.Get("json")
+		names[item.Type().Field(i).Name] = name
+		if raw, ok := row[name]; ok {
+			if err := json.Unmarshal(raw, item.Field(i).Addr().Interface()); err != nil {
+				errs = append(errs, importError{name, "is invalid"})
+			}
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	if err := binding.Validator.ValidateStruct(s); err != nil {
+		for field, message := range common.NewValidatorError(err).Errors {
+			if name, ok := names[field]; ok {
+				field = name
+			}
+			errs = append(errs, importError{field, fmt.Sprint(message)})
+		}
+		sort.Slice(errs, func(i, j int) bool { return errs[i].field < errs[j].field })
+		return errs
+	}
+	if err := s.bind(seller); err != nil {
+		field := bindErrorField(err)
+		if field == "" {
+			field = "row"
+		}
+		return []importError{{field, err.Error()}}
+	}
+	return nil
+}
+
+// Import the listings read from r for seller, checking every row like a
+// request to create the item. Rows with errors are skipped and reported, the
+// others created unless dryRun. The import is saved with its report; only an
+// unreadable input or a database failure is an error.
+//
+//	result, err := ImportItems(seller, file, BulkCSV, map[string]string{"title": "Name"}, false)
+func ImportItems(seller ItemUserModel, r io.Reader, format string, mapping map[string]string, dryRun bool) (ItemImportModel, error) {
+	result := ItemImportModel{SellerID: seller.ID, Format: format, DryRun: dryRun}
+	next, err := newBulkReader(r, format, mapping)
+	if err != nil {
+		return result, err
+	}
+	var report bytes.Buffer
+	reportWriter := csv.NewWriter(&report)
+	reportWriter.Write([]string{"row", "field", "message"})
+	fail := func(errs ...importError) {
+		for _, e := range errs {
+			result.ErrorsCount++
+			if len(result.Errors) < importErrorsShown {
+				result.Errors = append(result.Errors, ItemImportError{result.RowsCount, e.field, e.message})
+			}
+			reportWriter.Write([]string{strconv.Itoa(result.RowsCount), e.field, e.message})
+		}
+	}
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		result.RowsCount++
+		if e, ok := err.(importError); ok {
+			fail(e)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		itemModelValidator := NewItemModelValidator()
+		if errs := itemModelValidator.bindRow(seller.UserModel, row); errs != nil {
+			fail(errs...)
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		item := &itemModelValidator.itemModel
+		item.setTags(itemModelValidator.Item.Tags)
+		if err := SaveOne(item); err != nil {
+			fail(importError{"database", err.Error()})
+			continue
+		}
+		if err := item.setAttributes(itemModelValidator.attributes); err != nil {
+			fail(importError{"database", err.Error()})
+			continue
+		}
+		result.CreatedCount++
+	}
+	reportWriter.Flush()
+	result.Report = report.String()
+	db := common.GetDB()
+	err = db.Create(&result).Error
+	return result, err
+}
+
+// A listing as exported, see BulkFields.
+type itemExport struct {
+	Slug         string            `json:"slug"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	Body         string            `json:"body"`
+	Price        int64             `json:"price"`
+	Currency     string            `json:"currency"`
+	Quantity     int               `json:"quantity"`
+	Tags         []string          `json:"tagList"`
+	Category     string            `json:"category"`
+	Status       string            `json:"status"`
+	PublishAt    *time.Time        `json:"publishAt"`
+	Availability string            `json:"availability"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+func (e itemExport) record(attributes []string) []string {
+	var publishAt string
+	if e.PublishAt != nil {
+		publishAt = e.PublishAt.UTC().Format(time.RFC3339)
+	}
+	record := []string{e.Slug, e.Title, e.Description, e.Body, strconv.FormatInt(e.Price, 10), e.Currency,
+		strconv.Itoa(e.Quantity), strings.Join(e.Tags, ","), e.Category, e.Status, publishAt, e.Availability}
+	for _, name := range attributes {
+		record = append(record, e.Attributes[name])
+	}
+	return record
+}
+
+// How many items ExportItems reads at once.
+const exportBatchSize = 100
+
+// Write all the listings of seller to w, whatever their status, oldest first,
+// in a format ImportItems reads back.
+func ExportItems(seller ItemUserModel, w io.Writer, format string) error {
+	if format != BulkCSV && format != BulkNDJSON {
+		return ErrInvalidBulkFormat
+	}
+	db := common.GetDB()
+	var attributes []string
+	mine := db.Model(&ItemModel{}).Select("id").Where("seller_id = ?", seller.ID).QueryExpr()
+	if err := db.Model(&ItemAttributeModel{}).Where("item_id IN (?) AND variant_id = 0", mine).
+		Pluck("DISTINCT name", &attributes).Error; err != nil {
+		return err
+	}
+	sort.Strings(attributes)
+
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if format == BulkCSV {
+		header := append([]string{}, BulkFields...)
+		for _, name := range attributes {
+			header = append(header, "attributes."+name)
+		}
+		csvWriter.Write(header)
+	}
+	var lastID uint
+	for {
+		var models []ItemModel
+		err := db.Where("seller_id = ? AND id > ?", seller.ID, lastID).Order("id asc").Limit(exportBatchSize).Find(&models).Error
+		if err != nil {
+			return err
+		}
+		if len(models) == 0 {
+			break
+		}
+		lastID = models[len(models)-1].ID
+		loadItemRelations(db, models)
+		var ids, categoryIDs []uint
+		for _, model := range models {
+			ids = append(ids, model.ID)
+			categoryIDs = append(categoryIDs, model.CategoryID)
+		}
+		var categories []CategoryModel
+		db.Where("id IN (?)", categoryIDs).Find(&categories)
+		categorySlugs := map[uint]string{}
+		for _, category := range categories {
+			categorySlugs[category.ID] = category.Slug
+		}
+		var attributeModels []ItemAttributeModel
+		db.Where("item_id IN (?) AND variant_id = 0", ids).Find(&attributeModels)
+		attributesByItem := map[uint]map[string]string{}
+		for _, attribute := range attributeModels {
+			if attributesByItem[attribute.ItemID] == nil {
+				attributesByItem[attribute.ItemID] = map[string]string{}
+			}
+			attributesByItem[attribute.ItemID][attribute.Name] = attribute.Value
+		}
+
+		for _, model := range models {
+			export := itemExport{
+				Slug:         model.Slug,
+				Title:        model.Title,
+				Description:  model.Description,
+				Body:         model.Body,
+				Price:        model.Price,
+				Currency:     model.Currency,
+				Quantity:     model.Quantity,
+				Tags:         []string{},
+				Category:     categorySlugs[model.CategoryID],
+				Status:       model.Status,
+				PublishAt:    model.PublishAt,
+				Availability: model.Availability,
+				Attributes:   attributesByItem[model.ID],
+			}
+			for _, tag := range model.Tags {
+				export.Tags = append(export.Tags, tag.Tag)
+			}
+			if export.Attributes == nil {
+				export.Attributes = map[string]string{}
+			}
+			if format == BulkCSV {
+				csvWriter.Write(export.record(attributes))
+			} else if err := encoder.Encode(export); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
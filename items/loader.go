@@ -0,0 +1,253 @@
+package items
+
+import (
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/users"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"strconv"
+)
+
+// Load the sellers (with their users) and tags of models, with three queries
+// whatever their number.
+func loadItemRelations(db *gorm.DB, models []ItemModel) {
+	if len(models) == 0 {
+		return
+	}
+	var ids, sellerIDs []uint
+	for _, model := range models {
+		ids = append(ids, model.ID)
+		sellerIDs = append(sellerIDs, model.SellerID)
+	}
+	var sellers []ItemUserModel
+	db.Where("id IN (?)", sellerIDs).Find(&sellers)
+	var userIDs []uint
+	for _, seller := range sellers {
+		userIDs = append(userIDs, seller.UserModelID)
+	}
+	var userModels []users.UserModel
+	db.Where("id IN (?)", userIDs).Find(&userModels)
+	userByID := map[uint]users.UserModel{}
+	for _, userModel := range userModels {
+		userByID[userModel.ID] = userModel
+	}
+	sellerByID := map[uint]ItemUserModel{}
+	for _, seller := range sellers {
+		seller.UserModel = userByID[seller.UserModelID]
+		sellerByID[seller.ID] = seller
+	}
+
+	var tags []struct {
+		ItemModelID uint
+		TagModelID  uint
+		Tag         string
+	}
+	db.Table("item_tags").Select("item_tags.item_model_id, item_tags.tag_model_id, tag_models.tag").
+		Joins("JOIN tag_models ON tag_models.id = item_tags.tag_model_id AND tag_models.deleted_at IS NULL").
+		Where("item_tags.item_model_id IN (?)", ids).Order("item_tags.rowid").Scan(&tags)
+	tagsByItem := map[uint][]TagModel{}
+	for _, tag := range tags {
+		tagModel := TagModel{Tag: tag.Tag}
+		tagModel.ID = tag.TagModelID
+		tagsByItem[tag.ItemModelID] = append(tagsByItem[tag.ItemModelID], tagModel)
+	}
+
+	for i := range models {
+		models[i].Seller = sellerByID[models[i].SellerID]
+		models[i].Tags = tagsByItem[models[i].ID]
+	}
+}
+
+// Everything ItemSerializer shows besides the item itself and its seller and
+// tags (see loadItemRelations), read for a whole list of items at once: a page
+// costs the same fixed number of queries however many items it holds.
+//
+//	loader := NewItemLoader(c, models)
+//	response := loader.Response(models[0])
+type ItemLoader struct {
+	C           *gin.Context
+	myUserModel users.UserModel
+	me          ItemUserModel
+	favorited   map[uint]bool
+	// By users.UserModel id of the seller.
+	following  map[uint]bool
+	categories map[uint]*ItemCategoryResponse
+	images     map[uint][]ItemImageModel
+	attributes map[uint]map[string]string
+	variants   map[uint][]ItemVariantModel
+	auctions   map[uint]AuctionModel
+}
+
+func NewItemLoader(c *gin.Context, models []ItemModel) *ItemLoader {
+	db := common.GetDB()
+	loader := &ItemLoader{
+		C:           c,
+		myUserModel: c.MustGet("my_user_model").(users.UserModel),
+		favorited:   map[uint]bool{},
+		following:   map[uint]bool{},
+		categories:  map[uint]*ItemCategoryResponse{},
+		images:      map[uint][]ItemImageModel{},
+		attributes:  map[uint]map[string]string{},
+		variants:    map[uint][]ItemVariantModel{},
+		auctions:    map[uint]AuctionModel{},
+	}
+	if len(models) == 0 {
+		return loader
+	}
+	var ids, sellerUserIDs, categoryIDs []uint
+	for _, model := range models {
+		ids = append(ids, model.ID)
+		sellerUserIDs = append(sellerUserIDs, model.Seller.UserModelID)
+		if model.CategoryID != 0 {
+			categoryIDs = append(categoryIDs, model.CategoryID)
+		}
+	}
+
+	// Unlike GetItemUserModel this never creates the ItemUserModel, someone who
+	// never bought nor sold has nothing to find anyway.
+	if loader.myUserModel.ID != 0 {
+		db.Where(ItemUserModel{UserModelID: loader.myUserModel.ID}).First(&loader.me)
+		loader.me.UserModel = loader.myUserModel
+		var following []uint
+		db.Model(&users.FollowModel{}).Where("followed_by_id = ? AND following_id IN (?)", loader.myUserModel.ID, sellerUserIDs).
+			Pluck("following_id", &following)
+		for _, id := range following {
+			loader.following[id] = true
+		}
+	}
+	if loader.me.ID != 0 {
+		var favorited []uint
+		db.Model(&FavoriteModel{}).Where("favorite_by_id = ? AND favorite_id IN (?)", loader.me.ID, ids).
+			Pluck("favorite_id", &favorited)
+		for _, id := range favorited {
+			loader.favorited[id] = true
+		}
+	}
+
+	if len(categoryIDs) != 0 {
+		var categories []CategoryModel
+		db.Where("id IN (?)", categoryIDs).Find(&categories)
+		var pathIDs []string
+		for _, category := range categories {
+			pathIDs = append(pathIDs, category.pathIDs()...)
+		}
+		var ancestors []CategoryModel
+		db.Where("id IN (?)", pathIDs).Find(&ancestors)
+		names := map[string]string{}
+		for _, ancestor := range ancestors {
+			names[strconv.FormatUint(uint64(ancestor.ID), 10)] = ancestor.Name
+		}
+		for _, category := range categories {
+			response := &ItemCategoryResponse{Slug: category.Slug, Name: category.Name, Breadcrumb: []string{}}
+			for _, id := range category.pathIDs() {
+				if name, ok := names[id]; ok {
+					response.Breadcrumb = append(response.Breadcrumb, name)
+				}
+			}
+			loader.categories[category.ID] = response
+		}
+	}
+
+	var images []ItemImageModel
+	db.Where("item_id IN (?)", ids).Order("position asc, id asc").Find(&images)
+	for _, image := range images {
+		loader.images[image.ItemID] = append(loader.images[image.ItemID], image)
+	}
+
+	var attributes []ItemAttributeModel
+	db.Where("item_id IN (?) AND variant_id = 0", ids).Order("id asc").Find(&attributes)
+	for _, attribute := range attributes {
+		if loader.attributes[attribute.ItemID] == nil {
+			loader.attributes[attribute.ItemID] = map[string]string{}
+		}
+		loader.attributes[attribute.ItemID][attribute.Name] = attribute.Value
+	}
+
+	var variants []ItemVariantModel
+	db.Where("item_id IN (?)", ids).Preload("Attributes").Order("id asc").Find(&variants)
+	for _, variant := range variants {
+		loader.variants[variant.ItemID] = append(loader.variants[variant.ItemID], variant)
+	}
+
+	var auctions []AuctionModel
+	last := db.Model(&AuctionModel{}).Select("max(id)").Where("item_id IN (?)", ids).Group("item_id")
+	db.Where("id IN (?)", last.QueryExpr()).Find(&auctions)
+	for _, auction := range auctions {
+		loader.auctions[auction.ItemID] = auction
+	}
+	return loader
+}
+
+func (l *ItemLoader) Response(item ItemModel) ItemResponse {
+	seller := item.Seller.UserModel
+	response := ItemResponse{
+		ID:                item.ID,
+		Slug:              item.Slug,
+		Title:             item.Title,
+		Description:       item.Description,
+		Body:              item.Body,
+		BodyHTML:          renderedBody(item.Body, item.BodyHTML),
+		Price:             item.Price,
+		Currency:          item.Currency,
+		FormattedPrice:    item.PriceMoney().String(),
+		InStock:           item.QuantityAvailable() > 0,
+		QuantityAvailable: item.QuantityAvailable(),
+		CreatedAt:         item.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt:         item.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Seller: users.ProfileResponse{
+			ID:        seller.ID,
+			Username:  seller.Username,
+			Bio:       seller.Bio,
+			Image:     seller.Image,
+			Following: l.following[seller.ID],
+		},
+		Favorite:       l.favorited[item.ID],
+		FavoritesCount: item.FavoritesCount,
+		CommentsCount:  item.CommentsCount,
+		Category:       l.categories[item.CategoryID],
+		Status:         item.Status,
+		Availability:   item.Availability,
+	}
+	if item.PublishAt != nil {
+		publishAt := item.PublishAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.PublishAt = &publishAt
+	}
+	if item.ExpiresAt != nil {
+		expiresAt := item.ExpiresAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.ExpiresAt = &expiresAt
+	}
+	response.Tags = make([]string, 0)
+	for _, tag := range item.Tags {
+		serializer := TagSerializer{l.C, tag}
+		response.Tags = append(response.Tags, serializer.Response())
+	}
+	imagesSerializer := ItemImagesSerializer{l.C, l.images[item.ID]}
+	response.Images = imagesSerializer.Response()
+	for i := range response.Images {
+		if response.Images[i].Cover {
+			response.CoverImage = &response.Images[i]
+		}
+	}
+	response.Attributes = l.attributes[item.ID]
+	if response.Attributes == nil {
+		response.Attributes = map[string]string{}
+	}
+	variants := l.variants[item.ID]
+	response.Variants = []ItemVariantResponse{}
+	for _, variant := range variants {
+		response.Variants = append(response.Variants, variantResponse(variant, item.Currency))
+	}
+	// An item with variants is only sold through them, so is its stock.
+	if len(variants) != 0 {
+		response.QuantityAvailable = 0
+		for _, variant := range variants {
+			response.QuantityAvailable += variant.QuantityAvailable()
+		}
+		response.InStock = response.QuantityAvailable > 0
+	}
+	if auction, ok := l.auctions[item.ID]; ok {
+		auctionResponse := auctionResponse(auction, l.me)
+		response.Auction = &auctionResponse
+	}
+	return response
+}
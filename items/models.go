@@ -1,11 +1,18 @@
 package items
 
 import (
-	_ "fmt"
-	"github.com/jinzhu/gorm"
+	"errors"
+	"fmt"
 	"github.com/NivRichter/GoLang-test1/common"
 	"github.com/NivRichter/GoLang-test1/users"
+	"github.com/gosimple/slug"
+	"github.com/jinzhu/gorm"
+	"html"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ItemModel struct {
@@ -14,18 +21,72 @@ type ItemModel struct {
 	Title       string
 	Description string `gorm:"size:2048"`
 	Body        string `gorm:"size:2048"`
-	Seller      ItemUserModel
-	SellerID    uint
-	Tags        []TagModel     `gorm:"many2many:item_tags;"`
-	Comments    []CommentModel `gorm:"ForeignKey:ItemID"`
+	// Body rendered by common.RenderMarkdown, stored along with it.
+	BodyHTML string `gorm:"size:8192"`
+	Price    int64
+	Currency string `gorm:"size:3"`
+	Quantity int
+	Reserved int
+	// Saving an item must never write back a stale copy of its seller's counters.
+	Seller     ItemUserModel `gorm:"association_autoupdate:false"`
+	SellerID   uint
+	CategoryID uint           `gorm:"index"`
+	Tags       []TagModel     `gorm:"many2many:item_tags;"`
+	Comments   []CommentModel `gorm:"ForeignKey:ItemID"`
+	// Maintained along with the favorites and comments themselves, see Recount.
+	FavoritesCount uint
+	CommentsCount  uint
+	// Only published items are listed, see the Item* statuses.
+	Status    string `gorm:"size:16;index;default:'published'"`
+	PublishAt *time.Time
+	// Whether the listing can still be bought, see the Listing* availabilities.
+	// Reserved and sold listings may name their buyer.
+	Availability  string `gorm:"size:16;index;default:'available'"`
+	ReservedForID uint
+	SoldAt        *time.Time
+	ExpiresAt     *time.Time
 }
 
+// The availability of a listing, apart from its lifecycle Status. Sellers mark
+// listings reserved for a buyer or sold; available listings expire once their
+// ExpiresAt has passed (see ExpireListings) until renewed.
+const (
+	ListingAvailable = "available"
+	ListingReserved  = "reserved"
+	ListingSold      = "sold"
+	ListingExpired   = "expired"
+)
+
+// How long listings stay up before they expire, from their creation or renewal.
+var ListingPeriod = 30 * 24 * time.Hour
+
+var ErrInvalidAvailability = errors.New("availability should be available, reserved or sold")
+var ErrBuyerRequired = errors.New("reserved items need a buyer")
+var ErrItemUnavailable = errors.New("item is unpublished, sold, expired or reserved for someone else")
+var ErrItemSold = errors.New("sold items can not be renewed")
+
+// The lifecycle of an item. Drafts are prepared privately, scheduled items get
+// published by PublishScheduledItems once their PublishAt has come, and archived
+// items are taken off the market. Whatever their status, items stay visible to
+// their seller.
+const (
+	ItemDraft     = "draft"
+	ItemScheduled = "scheduled"
+	ItemPublished = "published"
+	ItemArchived  = "archived"
+)
+
+var ErrInvalidStatus = errors.New("status should be draft, scheduled, published or archived")
+var ErrInvalidPublishAt = errors.New("scheduled items need a publishAt in the future")
+
 type ItemUserModel struct {
 	gorm.Model
 	UserModel      users.UserModel
 	UserModelID    uint
-	ItemModels  []ItemModel  `gorm:"ForeignKey:SellerID"`
+	ItemModels     []ItemModel     `gorm:"ForeignKey:SellerID"`
 	FavoriteModels []FavoriteModel `gorm:"ForeignKey:FavoriteByID"`
+	// The number of items the user is selling, see Recount.
+	ItemsCount uint
 }
 
 type FavoriteModel struct {
@@ -38,17 +99,279 @@ type FavoriteModel struct {
 
 type TagModel struct {
 	gorm.Model
-	Tag           string         `gorm:"unique_index"`
+	Tag        string      `gorm:"unique_index"`
 	ItemModels []ItemModel `gorm:"many2many:item_tags;"`
+	// The number of (not deleted) items carrying the tag, see Recount.
+	ItemsCount uint
+}
+
+// A tag followed by a user, its items show up in their ranked feed.
+type TagFollowModel struct {
+	gorm.Model
+	Tag        TagModel
+	TagID      uint `gorm:"index"`
+	FollowerID uint `gorm:"index"`
+}
+
+// An item a user has opened, UpdatedAt being the last time. The ranked feed
+// pushes seen items down.
+type ItemSeenModel struct {
+	gorm.Model
+	ItemUserID uint `gorm:"index"`
+	ItemID     uint `gorm:"index"`
+}
+
+// A node of the admin-managed category tree. Path is the materialized path of ids
+// from the root down to the category itself, e.g. "/1/4/", so a whole subtree is
+// found with one prefix match. Items can only be filed under leaf categories.
+type CategoryModel struct {
+	gorm.Model
+	Name     string
+	Slug     string `gorm:"unique_index"`
+	ParentID uint   `gorm:"index"`
+	Path     string `gorm:"index"`
 }
 
 type CommentModel struct {
 	gorm.Model
-	Item   ItemModel
-	ItemID uint
-	Seller    ItemUserModel
-	SellerID  uint
-	Body      string `gorm:"size:2048"`
+	Item     ItemModel `gorm:"association_autoupdate:false"`
+	ItemID   uint
+	Seller   ItemUserModel `gorm:"association_autoupdate:false"`
+	SellerID uint
+	Body     string `gorm:"size:2048"`
+	BodyHTML string `gorm:"size:8192"`
+}
+
+// Stock held for a buyer while they go through checkout. Quantity is moved from
+// ItemModel.Quantity into ItemModel.Reserved when the reservation is created, and
+// either removed for good (committed) or handed back (released) when it ends.
+// Reservations of a variant (VariantID set) use the variant's stock instead.
+type StockReservationModel struct {
+	gorm.Model
+	Item      ItemModel
+	ItemID    uint `gorm:"index"`
+	VariantID uint
+	Buyer     ItemUserModel
+	BuyerID   uint
+	Quantity  int
+	Status    string    `gorm:"size:16;index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+// How long a checkout may hold stock before ExpireStockReservations hands it back.
+var ReservationTTL = 15 * time.Minute
+
+// How long the winner of an auction has to pay for it.
+var AuctionPaymentTTL = 72 * time.Hour
+
+var ErrOutOfStock = errors.New("not enough stock")
+var ErrQuantityBelowReserved = errors.New("quantity can not be less than the units reserved")
+var ErrReservationClosed = errors.New("reservation is no longer held")
+
+// A timed auction of an item. CurrentBid, BidCount and LeaderID are only ever
+// changed together by PlaceBid's conditional UPDATE, so they always describe the
+// best bid in BidModel. Prices are in the item's currency, like ItemModel.Price.
+// The unit auctioned is held by Reservation while the auction is open, then
+// handed to the winner or released.
+type AuctionModel struct {
+	gorm.Model
+	Item          ItemModel
+	ItemID        uint `gorm:"index"`
+	Reservation   StockReservationModel
+	ReservationID uint
+	StartPrice    int64
+	ReservePrice  int64
+	Increment     int64
+	EndsAt        time.Time `gorm:"index"`
+	CurrentBid    int64
+	BidCount      int
+	LeaderID      uint
+	WinnerID      uint
+	Status        string `gorm:"size:16;index"`
+}
+
+type BidModel struct {
+	gorm.Model
+	Auction   AuctionModel
+	AuctionID uint `gorm:"index"`
+	Bidder    ItemUserModel
+	BidderID  uint
+	Amount    int64
+}
+
+const (
+	AuctionOpen   = "open"
+	AuctionSold   = "sold"
+	AuctionUnsold = "unsold"
+)
+
+// A bid this close to the end pushes the end back to this far from the bid, so
+// nobody can win by bidding in the last second.
+var AuctionSnipeWindow = 2 * time.Minute
+
+var ErrInvalidAuction = errors.New("auction needs a start price, an increment and an end in the future")
+var ErrAuctionItem = errors.New("item is up for auction, bid on it instead")
+var ErrAuctionClosed = errors.New("auction is closed")
+var ErrBidTooLow = errors.New("bid is below the minimum bid")
+var ErrSellerBid = errors.New("sellers can not bid on their own item")
+
+// One picture of an item's gallery. Images are shown by ascending Position and
+// exactly one image of a gallery is the Cover, used on listing cards. The image
+// itself lives at URL, we only keep track of it.
+type ItemImageModel struct {
+	gorm.Model
+	Item     ItemModel
+	ItemID   uint   `gorm:"index"`
+	URL      string `gorm:"size:2048"`
+	AltText  string `gorm:"size:256"`
+	Position int
+	Cover    bool
+}
+
+// A gallery never grows past this many images.
+const MaxItemImages = 12
+
+var ErrTooManyImages = errors.New("item has too many images")
+var ErrInvalidImageOrder = errors.New("order should list every image of the item once")
+
+var ErrCategoryNotFound = errors.New("category not found")
+var ErrCategoryNotLeaf = errors.New("items can only be filed under a category without subcategories")
+var ErrCategoryInUse = errors.New("category still has items or subcategories")
+var ErrCategoryExists = errors.New("category already exists")
+var ErrInvalidCategoryParent = errors.New("a category can not be moved under itself")
+
+// The attribute schema of a category, inherited by all its subcategories. Enum
+// attributes list their allowed values in Options, comma separated. Variant
+// attributes are what the variants of an item differ in (size, colour) and are
+// set per variant, the others once per item.
+type CategoryAttributeModel struct {
+	gorm.Model
+	CategoryID uint   `gorm:"index"`
+	Name       string `gorm:"size:64"`
+	Type       string `gorm:"size:16"`
+	Options    string `gorm:"size:1024"`
+	Required   bool
+	Variant    bool
+}
+
+const (
+	AttributeEnum    = "enum"
+	AttributeNumber  = "number"
+	AttributeText    = "text"
+	AttributeBoolean = "boolean"
+)
+
+// The value of one attribute of an item, or of one of its variants when VariantID
+// is set. Value always holds the text form; Number holds the parsed value of
+// number attributes so they can be filtered by range.
+type ItemAttributeModel struct {
+	gorm.Model
+	ItemID    uint   `gorm:"index"`
+	VariantID uint   `gorm:"index"`
+	Name      string `gorm:"size:64;index"`
+	Value     string `gorm:"size:256"`
+	Number    float64
+}
+
+// A purchasable version of an item, e.g. size M in red, with its own price (in the
+// item's currency) and stock. An item with variants is only sold through them.
+type ItemVariantModel struct {
+	gorm.Model
+	ItemID     uint `gorm:"index"`
+	Name       string
+	Price      int64
+	Quantity   int
+	Reserved   int
+	Attributes []ItemAttributeModel `gorm:"ForeignKey:VariantID"`
+}
+
+// The title, description, body and tags of an item as of one of its updates,
+// numbered from 1 per item. Fields lists the fields the update changed, comma
+// separated; it is empty for the first revision, the item as it was before its
+// first update. Revisions are never changed once stored.
+type ItemRevisionModel struct {
+	gorm.Model
+	ItemID      uint          `gorm:"index"`
+	Editor      ItemUserModel `gorm:"association_autoupdate:false"`
+	EditorID    uint
+	Number      int
+	Fields      string
+	Title       string
+	Description string `gorm:"size:2048"`
+	Body        string `gorm:"size:2048"`
+	BodyHTML    string `gorm:"size:8192"`
+	Tags        string `gorm:"size:2048"`
+}
+
+// A slug an item was reachable at before its title changed, kept so that old
+// links still lead to it; see FindItemSlug.
+type ItemSlugModel struct {
+	gorm.Model
+	Slug   string `gorm:"unique_index"`
+	ItemID uint   `gorm:"index"`
+}
+
+var ErrRevisionNotFound = errors.New("revision not found")
+var ErrRevisionImmutable = errors.New("revisions can not be changed")
+
+// Attribute values failing the category schema, by attribute name.
+type AttributeError map[string]string
+
+func (e AttributeError) Error() string {
+	var messages []string
+	for name, message := range e {
+		messages = append(messages, name+": "+message)
+	}
+	sort.Strings(messages)
+	return strings.Join(messages, ", ")
+}
+
+var ErrVariantRequired = errors.New("item has variants, choose one of them")
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+	migrateItems(db)
+	db.AutoMigrate(&TagModel{})
+	db.AutoMigrate(&FavoriteModel{})
+	db.AutoMigrate(&ItemUserModel{})
+	db.AutoMigrate(&CommentModel{})
+	db.AutoMigrate(&StockReservationModel{})
+	db.AutoMigrate(&AuctionModel{})
+	db.AutoMigrate(&BidModel{})
+	db.AutoMigrate(&ItemImageModel{})
+	db.AutoMigrate(&CategoryModel{})
+	db.AutoMigrate(&CategoryAttributeModel{})
+	db.AutoMigrate(&ItemAttributeModel{})
+	db.AutoMigrate(&ItemVariantModel{})
+	db.AutoMigrate(&TagFollowModel{})
+	db.AutoMigrate(&ItemSeenModel{})
+	db.AutoMigrate(&ItemRevisionModel{})
+	db.AutoMigrate(&ItemSlugModel{})
+	db.AutoMigrate(&ItemImportModel{})
+	db.AutoMigrate(&ItemViewModel{})
+	db.AutoMigrate(&ItemViewDailyModel{})
+	db.AutoMigrate(&ItemViewDailyViewerModel{})
+	db.AutoMigrate(&ItemRelatedModel{})
+	if err := setupSearchIndex(db); err != nil {
+		fmt.Println("search err: (AutoMigrate) ", err)
+	}
+}
+
+// Migrate the items table. Items listed before stock was tracked were single
+// listings, so they get a quantity of 1 rather than being out of stock.
+func migrateItems(db *gorm.DB) {
+	addingQuantity := db.HasTable(&ItemModel{}) && !db.Dialect().HasColumn("item_models", "quantity")
+	db.AutoMigrate(&ItemModel{})
+	if addingQuantity {
+		db.Exec("UPDATE item_models SET quantity = 1")
+	}
 }
 
 func GetItemUserModel(userModel users.UserModel) ItemUserModel {
@@ -64,206 +387,2457 @@ func GetItemUserModel(userModel users.UserModel) ItemUserModel {
 	return itemUserModel
 }
 
-func (item ItemModel) favoritesCount() uint {
-	db := common.GetDB()
-	var count uint
-	db.Model(&FavoriteModel{}).Where(FavoriteModel{
-		FavoriteID: item.ID,
-	}).Count(&count)
-	return count
+// The item's price as a Money value; Price is always kept in the currency's minor unit.
+func (item ItemModel) PriceMoney() common.Money {
+	return common.Money{Amount: item.Price, Currency: item.Currency}
 }
 
-func (item ItemModel) isFavoriteBy(user ItemUserModel) bool {
-	db := common.GetDB()
-	var favorite FavoriteModel
-	db.Where(FavoriteModel{
-		FavoriteID:   item.ID,
-		FavoriteByID: user.ID,
-	}).First(&favorite)
-	return favorite.ID != 0
+// Set the status of the item; "" publishes it. Scheduled items need publishAt
+// to be after now, published ones get now as PublishAt unless they have one.
+func (item *ItemModel) setStatus(status string, publishAt *time.Time, now time.Time) error {
+	if status == "" {
+		status = ItemPublished
+	}
+	if publishAt != nil {
+		utc := publishAt.UTC()
+		publishAt = &utc
+	}
+	switch status {
+	case ItemDraft, ItemArchived:
+	case ItemScheduled:
+		if publishAt == nil || !publishAt.After(now) {
+			return ErrInvalidPublishAt
+		}
+	case ItemPublished:
+		if publishAt == nil || publishAt.After(now) {
+			utc := now.UTC()
+			publishAt = &utc
+		}
+	default:
+		return ErrInvalidStatus
+	}
+	item.Status = status
+	item.PublishAt = publishAt
+	return nil
 }
 
-func (item ItemModel) favoriteBy(user ItemUserModel) error {
-	db := common.GetDB()
-	var favorite FavoriteModel
-	err := db.FirstOrCreate(&favorite, &FavoriteModel{
-		FavoriteID:   item.ID,
-		FavoriteByID: user.ID,
-	}).Error
-	return err
+// Items that are not published are only visible to their seller, whose user
+// must be loaded.
+func (item ItemModel) VisibleTo(user users.UserModel) bool {
+	return item.Status == ItemPublished || (user.ID != 0 && user.ID == item.Seller.UserModelID)
 }
 
-func (item ItemModel) unFavoriteBy(user ItemUserModel) error {
+// Publish the scheduled items whose PublishAt has come, returning how many were.
+// They are bumped to the top of the feed like any freshly updated item, and their
+// listing period starts.
+func PublishScheduledItems(now time.Time) (int, error) {
 	db := common.GetDB()
-	err := db.Where(FavoriteModel{
-		FavoriteID:   item.ID,
-		FavoriteByID: user.ID,
-	}).Delete(FavoriteModel{}).Error
-	return err
+	result := db.Model(&ItemModel{}).Where("status = ? AND publish_at <= ?", ItemScheduled, now.UTC()).
+		UpdateColumns(map[string]interface{}{"status": ItemPublished, "updated_at": now, "expires_at": now.Add(ListingPeriod).UTC()})
+	return int(result.RowsAffected), result.Error
 }
 
-func SaveOne(data interface{}) error {
-	db := common.GetDB()
-	err := db.Save(data).Error
-	return err
+// Units that can still be bought: on hand minus what open checkouts are holding.
+func (item ItemModel) QuantityAvailable() int {
+	available := item.Quantity - item.Reserved
+	if available < 0 {
+		return 0
+	}
+	return available
 }
 
-func FindOneItem(condition interface{}) (ItemModel, error) {
-	db := common.GetDB()
-	var model ItemModel
-	tx := db.Begin()
-	tx.Where(condition).First(&model)
-	tx.Model(&model).Related(&model.Seller, "Seller")
-	tx.Model(&model.Seller).Related(&model.Seller.UserModel)
-	tx.Model(&model).Related(&model.Tags, "Tags")
-	err := tx.Commit().Error
-	return model, err
+// Units of the variant that can still be bought, like ItemModel.QuantityAvailable.
+func (variant ItemVariantModel) QuantityAvailable() int {
+	available := variant.Quantity - variant.Reserved
+	if available < 0 {
+		return 0
+	}
+	return available
 }
 
-func (self *ItemModel) getComments() error {
-	db := common.GetDB()
-	tx := db.Begin()
-	tx.Model(self).Related(&self.Comments, "Comments")
-	for i, _ := range self.Comments {
-		tx.Model(&self.Comments[i]).Related(&self.Comments[i].Seller, "Seller")
-		tx.Model(&self.Comments[i].Seller).Related(&self.Comments[i].Seller.UserModel)
+// Hold quantity units of the item for buyer until ReservationTTL elapses. Items
+// with variants can not be reserved as a whole, see ReserveVariantStock.
+//
+// The availability check and the increment happen in one UPDATE statement, so
+// concurrent checkouts can never reserve more than is on hand: the losers simply
+// match no row and get ErrOutOfStock.
+//
+//	reservation, err := ReserveStock(itemModel, GetItemUserModel(myUserModel), 1)
+func ReserveStock(item ItemModel, buyer ItemUserModel, quantity int) (StockReservationModel, error) {
+	if item.HasVariants() {
+		return StockReservationModel{}, ErrVariantRequired
 	}
-	err := tx.Commit().Error
-	return err
+	return reserveStock(StockReservationModel{ItemID: item.ID}, buyer, quantity)
 }
 
-func getAllTags() ([]TagModel, error) {
-	db := common.GetDB()
-	var models []TagModel
-	err := db.Find(&models).Error
-	return models, err
+// Same as ReserveStock for one variant of an item.
+func ReserveVariantStock(variant ItemVariantModel, buyer ItemUserModel, quantity int) (StockReservationModel, error) {
+	return reserveStock(StockReservationModel{ItemID: variant.ItemID, VariantID: variant.ID}, buyer, quantity)
 }
 
-func FindManyItem(tag, seller, limit, offset, favorited string) ([]ItemModel, int, error) {
-	db := common.GetDB()
-	var models []ItemModel
-	var count int
+// The table and row holding the stock of what is reserved: the variant if any,
+// otherwise the item.
+func (reservation StockReservationModel) stockRow() (string, uint) {
+	if reservation.VariantID != 0 {
+		return "item_variant_models", reservation.VariantID
+	}
+	return "item_models", reservation.ItemID
+}
 
-	offset_int, err := strconv.Atoi(offset)
+func reserveStock(reservation StockReservationModel, buyer ItemUserModel, quantity int) (StockReservationModel, error) {
+	db := common.GetDB()
+	// Read outside the transaction: reading first in it would make concurrent
+	// checkouts fight over the write lock instead of queueing for it.
+	if err := checkAvailable(db, reservation, buyer); err != nil {
+		return reservation, err
+	}
+	tx := db.Begin()
+	reservation, err := holdStock(tx, reservation, buyer, quantity)
 	if err != nil {
-		offset_int = 0
+		tx.Rollback()
+		return reservation, err
 	}
+	err = tx.Commit().Error
+	return reservation, err
+}
 
-	limit_int, err := strconv.Atoi(limit)
+// Sell quantity units of the item, or of the variant when it is set, inside tx
+// without holding them first. This is for stock that is paid for already, e.g. an
+// order paid after its reservation expired: ErrOutOfStock means the caller should
+// roll tx back.
+func SellStock(tx *gorm.DB, item ItemModel, variant ItemVariantModel, buyer ItemUserModel, quantity int) error {
+	reservation := StockReservationModel{ItemID: item.ID, VariantID: variant.ID}
+	if err := checkAvailable(tx, reservation, buyer); err != nil {
+		return err
+	}
+	reservation, err := holdStock(tx, reservation, buyer, quantity)
 	if err != nil {
-		limit_int = 20
+		return err
 	}
+	return reservation.CommitIn(tx)
+}
 
-	tx := db.Begin()
-	if tag != "" {
-		var tagModel TagModel
-		tx.Where(TagModel{Tag: tag}).First(&tagModel)
-		if tagModel.ID != 0 {
-			tx.Model(&tagModel).Offset(offset_int).Limit(limit_int).Related(&models, "ItemModels")
-			count = tx.Model(&tagModel).Association("ItemModels").Count()
-		}
-	} else if seller != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: seller}).First(&userModel)
-		itemUserModel := GetItemUserModel(userModel)
-
-		if itemUserModel.ID != 0 {
-			count = tx.Model(&itemUserModel).Association("ItemModels").Count()
-			tx.Model(&itemUserModel).Offset(offset_int).Limit(limit_int).Related(&models, "ItemModels")
-		}
-	} else if favorited != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
-		itemUserModel := GetItemUserModel(userModel)
-		if itemUserModel.ID != 0 {
-			var favoriteModels []FavoriteModel
-			tx.Where(FavoriteModel{
-				FavoriteByID: itemUserModel.ID,
-			}).Offset(offset_int).Limit(limit_int).Find(&favoriteModels)
-
-			count = tx.Model(&itemUserModel).Association("FavoriteModels").Count()
-			for _, favorite := range favoriteModels {
-				var model ItemModel
-				tx.Model(&favorite).Related(&model, "Favorite")
-				models = append(models, model)
-			}
-		}
-	} else {
-		db.Model(&models).Count(&count)
-		db.Offset(offset_int).Limit(limit_int).Find(&models)
+func checkAvailable(db *gorm.DB, reservation StockReservationModel, buyer ItemUserModel) error {
+	var item ItemModel
+	if err := db.First(&item, reservation.ItemID).Error; err != nil {
+		return err
+	}
+	if !item.AvailableTo(buyer) {
+		return ErrItemUnavailable
 	}
+	return nil
+}
 
-	for i, _ := range models {
-		tx.Model(&models[i]).Related(&models[i].Seller, "Seller")
-		tx.Model(&models[i].Seller).Related(&models[i].Seller.UserModel)
-		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+// The availability check and the increment happen in one UPDATE statement, see
+// ReserveStock.
+func holdStock(tx *gorm.DB, reservation StockReservationModel, buyer ItemUserModel, quantity int) (StockReservationModel, error) {
+	reservation.BuyerID = buyer.ID
+	reservation.Quantity = quantity
+	reservation.Status = ReservationHeld
+	if reservation.ExpiresAt.IsZero() {
+		reservation.ExpiresAt = time.Now().Add(ReservationTTL)
 	}
-	err = tx.Commit().Error
-	return models, count, err
+	if quantity <= 0 {
+		return reservation, ErrOutOfStock
+	}
+	table, id := reservation.stockRow()
+	result := tx.Exec("UPDATE "+table+" SET reserved = reserved + ? WHERE id = ? AND deleted_at IS NULL AND quantity - reserved >= ?",
+		quantity, id, quantity)
+	if result.Error != nil {
+		return reservation, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return reservation, ErrOutOfStock
+	}
+	err := tx.Create(&reservation).Error
+	return reservation, err
 }
 
-func (self *ItemUserModel) GetItemFeed(limit, offset string) ([]ItemModel, int, error) {
+// Turn a held reservation into a sale, removing the units from stock for good.
+func (reservation *StockReservationModel) Commit() error {
+	return inTransaction(reservation.CommitIn)
+}
+
+// Same as Commit inside tx, so the sale stands or falls with the rest of it.
+func (reservation *StockReservationModel) CommitIn(tx *gorm.DB) error {
+	q := reservation.Quantity
+	table, id := reservation.stockRow()
+	return reservation.close(tx, ReservationCommitted, func(tx *gorm.DB) *gorm.DB {
+		return tx.Exec("UPDATE "+table+" SET quantity = quantity - ?, reserved = reserved - ? WHERE id = ? AND reserved >= ?",
+			q, q, id, q)
+	})
+}
+
+// Give the held units back, e.g. when the buyer abandons the checkout.
+func (reservation *StockReservationModel) Release() error {
+	return inTransaction(reservation.ReleaseIn)
+}
+
+// Same as Release inside tx.
+func (reservation *StockReservationModel) ReleaseIn(tx *gorm.DB) error {
+	q := reservation.Quantity
+	table, id := reservation.stockRow()
+	return reservation.close(tx, ReservationReleased, func(tx *gorm.DB) *gorm.DB {
+		return tx.Exec("UPDATE "+table+" SET reserved = reserved - ? WHERE id = ? AND reserved >= ?",
+			q, id, q)
+	})
+}
+
+// Only one of Commit, Release or the expiry job may close a reservation: the status
+// switch is conditional on it still being held, and the stock update runs in the
+// same transaction.
+func (reservation *StockReservationModel) close(tx *gorm.DB, status string, updateStock func(tx *gorm.DB) *gorm.DB) error {
+	result := tx.Model(&StockReservationModel{}).
+		Where("id = ? AND status = ?", reservation.ID, ReservationHeld).
+		Update("status", status)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrReservationClosed
+	}
+	if err := updateStock(tx).Error; err != nil {
+		return err
+	}
+	reservation.Status = status
+	return nil
+}
+
+// Run fn in a transaction of its own, committing it only when fn succeeds.
+func inTransaction(fn func(tx *gorm.DB) error) error {
+	tx := common.GetDB().Begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Release every held reservation whose ExpiresAt is before now, returning how many
+// were released. Those of open auctions are kept until the auction closes, see
+// CloseAuctions. Meant to be run periodically, see common.Every.
+func ExpireStockReservations(now time.Time) (int, error) {
+	db := common.GetDB()
+	var reservations []StockReservationModel
+	err := db.Where("status = ? AND expires_at < ?", ReservationHeld, now).
+		Where("id NOT IN (SELECT reservation_id FROM auction_models WHERE status = ? AND deleted_at IS NULL)", AuctionOpen).
+		Find(&reservations).Error
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for i := range reservations {
+		err := reservations[i].Release()
+		if err == ErrReservationClosed {
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+// Find the buyer's reservations of an item that are still holding stock.
+func FindHeldReservations(item ItemModel, buyer ItemUserModel) ([]StockReservationModel, error) {
+	db := common.GetDB()
+	var reservations []StockReservationModel
+	err := db.Where(StockReservationModel{
+		ItemID:  item.ID,
+		BuyerID: buyer.ID,
+		Status:  ReservationHeld,
+	}).Find(&reservations).Error
+	return reservations, err
+}
+
+// The item's most recent auction, with ID 0 when it was never auctioned.
+func (item ItemModel) LastAuction() AuctionModel {
+	db := common.GetDB()
+	var auction AuctionModel
+	db.Where(AuctionModel{ItemID: item.ID}).Order("id desc").First(&auction)
+	return auction
+}
+
+// Items with an open auction are only sold through bids, not checkout or offers.
+func (item ItemModel) OnAuction() bool {
 	db := common.GetDB()
-	var models []ItemModel
 	var count int
+	db.Model(&AuctionModel{}).Where(AuctionModel{ItemID: item.ID, Status: AuctionOpen}).Count(&count)
+	return count != 0
+}
 
-	offset_int, err := strconv.Atoi(offset)
-	if err != nil {
-		offset_int = 0
+// Put item up for auction until endsAt, holding one unit of its stock for the
+// winner. The item must be in stock and not on auction already, and items with
+// variants can not be auctioned.
+func CreateAuction(item ItemModel, startPrice, reservePrice, increment int64, endsAt time.Time) (AuctionModel, error) {
+	if startPrice <= 0 || increment <= 0 || reservePrice < 0 || !endsAt.After(time.Now()) {
+		return AuctionModel{}, ErrInvalidAuction
 	}
-	limit_int, err := strconv.Atoi(limit)
+	if item.OnAuction() {
+		return AuctionModel{}, ErrAuctionItem
+	}
+	if item.HasVariants() {
+		return AuctionModel{}, ErrVariantRequired
+	}
+	reservation, err := reserveStock(StockReservationModel{ItemID: item.ID, ExpiresAt: endsAt}, ItemUserModel{}, 1)
 	if err != nil {
-		limit_int = 20
+		return AuctionModel{}, err
 	}
-
-	tx := db.Begin()
-	followings := self.UserModel.GetFollowings()
-	var itemUserModels []uint
-	for _, following := range followings {
-		itemUserModel := GetItemUserModel(following)
-		itemUserModels = append(itemUserModels, itemUserModel.ID)
+	auction := AuctionModel{
+		ItemID:        item.ID,
+		ReservationID: reservation.ID,
+		StartPrice:    startPrice,
+		ReservePrice:  reservePrice,
+		Increment:     increment,
+		EndsAt:        endsAt,
+		Status:        AuctionOpen,
 	}
+	db := common.GetDB()
+	if err := db.Create(&auction).Error; err != nil {
+		reservation.Release()
+		return AuctionModel{}, err
+	}
+	return auction, nil
+}
 
-	tx.Where("seller_id in (?)", itemUserModels).Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
-
-	for i, _ := range models {
-		tx.Model(&models[i]).Related(&models[i].Seller, "Seller")
-		tx.Model(&models[i].Seller).Related(&models[i].Seller.UserModel)
-		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+// The lowest amount the next bid may have.
+func (auction AuctionModel) MinimumBid() int64 {
+	if auction.BidCount == 0 {
+		return auction.StartPrice
 	}
-	err = tx.Commit().Error
-	return models, count, err
+	return auction.CurrentBid + auction.Increment
 }
 
-func (model *ItemModel) setTags(tags []string) error {
+// Reports whether the best bid so far would sell the item.
+func (auction AuctionModel) ReserveMet() bool {
+	return auction.BidCount > 0 && auction.CurrentBid >= auction.ReservePrice
+}
+
+// Bid amount on the auction for bidder.
+//
+// Whether the auction is still open and the bid beats the minimum is checked by
+// the same UPDATE that records it, so of two concurrent bids of the same amount
+// only one wins and the other gets ErrBidTooLow. A bid within AuctionSnipeWindow
+// of the end extends the auction.
+//
+//	bid, err := PlaceBid(auction, GetItemUserModel(myUserModel), 2500)
+func PlaceBid(auction *AuctionModel, bidder ItemUserModel, amount int64) (BidModel, error) {
 	db := common.GetDB()
-	var tagList []TagModel
-	for _, tag := range tags {
-		var tagModel TagModel
-		err := db.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error
-		if err != nil {
-			return err
+	var item ItemModel
+	db.Unscoped().First(&item, auction.ItemID)
+	if bidder.ID == item.SellerID {
+		return BidModel{}, ErrSellerBid
+	}
+	now := time.Now()
+	extended := now.Add(AuctionSnipeWindow)
+	tx := db.Begin()
+	result := tx.Model(&AuctionModel{}).
+		Where("id = ? AND status = ? AND ends_at > ?", auction.ID, AuctionOpen, now).
+		Where("(bid_count = 0 AND start_price <= ?) OR (bid_count > 0 AND current_bid + increment <= ?)", amount, amount).
+		Updates(map[string]interface{}{
+			"current_bid": amount,
+			"bid_count":   gorm.Expr("bid_count + 1"),
+			"leader_id":   bidder.ID,
+			"ends_at":     gorm.Expr("CASE WHEN ends_at < ? THEN ? ELSE ends_at END", extended, extended),
+		})
+	if result.Error != nil {
+		tx.Rollback()
+		return BidModel{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		db.First(auction, auction.ID)
+		if auction.Status != AuctionOpen || !auction.EndsAt.After(now) {
+			return BidModel{}, ErrAuctionClosed
 		}
-		tagList = append(tagList, tagModel)
+		return BidModel{}, ErrBidTooLow
 	}
-	model.Tags = tagList
-	return nil
+	bid := BidModel{AuctionID: auction.ID, BidderID: bidder.ID, Amount: amount}
+	if err := tx.Create(&bid).Error; err != nil {
+		tx.Rollback()
+		return BidModel{}, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return BidModel{}, err
+	}
+	db.First(auction, auction.ID)
+	return bid, nil
 }
 
-func (model *ItemModel) Update(data interface{}) error {
+// Functions run when an auction closes with a winner, e.g. to create their order.
+var auctionWonHooks []func(auction AuctionModel) error
+
+// Register a function to run for every auction CloseAuctions sells. Its errors
+// are returned by CloseAuctions.
+//
+//	items.OnAuctionWon(orders.CheckoutAuctionWinner)
+func OnAuctionWon(hook func(auction AuctionModel) error) {
+	auctionWonHooks = append(auctionWonHooks, hook)
+}
+
+// Close the open auctions that ended before now, returning how many were closed.
+// The best bid wins if it meets the reserve price: the unit held by the auction
+// is handed to the winner until AuctionPaymentTTL elapses. Otherwise the item
+// stays unsold and the unit is released. The first error of the winner hooks is
+// returned once every auction is closed. Meant to be run periodically, see
+// common.Every.
+func CloseAuctions(now time.Time) (int, error) {
 	db := common.GetDB()
-	err := db.Model(model).Update(data).Error
-	return err
+	var auctions []AuctionModel
+	err := db.Where("status = ? AND ends_at <= ?", AuctionOpen, now).Find(&auctions).Error
+	if err != nil {
+		return 0, err
+	}
+	closed := 0
+	var hookErr error
+	for i := range auctions {
+		auction := &auctions[i]
+		status, winner := AuctionUnsold, uint(0)
+		if auction.ReserveMet() {
+			status, winner = AuctionSold, auction.LeaderID
+		}
+		tx := db.Begin()
+		// A last-moment bid may have extended the auction since it was loaded.
+		result := tx.Model(&AuctionModel{}).
+			Where("id = ? AND status = ? AND ends_at <= ? AND bid_count = ?", auction.ID, AuctionOpen, now, auction.BidCount).
+			Updates(map[string]interface{}{"status": status, "winner_id": winner})
+		if result.Error != nil {
+			tx.Rollback()
+			return closed, result.Error
+		}
+		if result.RowsAffected == 0 {
+			tx.Rollback()
+			continue
+		}
+		if status == AuctionSold {
+			err = tx.Model(&StockReservationModel{}).Where("id = ? AND status = ?", auction.ReservationID, ReservationHeld).
+				Updates(map[string]interface{}{"buyer_id": winner, "expires_at": now.Add(AuctionPaymentTTL)}).Error
+			if err != nil {
+				tx.Rollback()
+				return closed, err
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			return closed, err
+		}
+		closed++
+		auction.Status, auction.WinnerID = status, winner
+		if status == AuctionUnsold && auction.ReservationID != 0 {
+			var reservation StockReservationModel
+			db.First(&reservation, auction.ReservationID)
+			if err := reservation.Release(); err != nil && err != ErrReservationClosed {
+				return closed, err
+			}
+		}
+		if status == AuctionSold {
+			for _, hook := range auctionWonHooks {
+				if err := hook(*auction); err != nil && hookErr == nil {
+					hookErr = err
+				}
+			}
+		}
+	}
+	return closed, hookErr
 }
 
-func DeleteItemModel(condition interface{}) error {
+// The item's images in gallery order.
+func (item ItemModel) Gallery() ([]ItemImageModel, error) {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(ItemModel{}).Error
-	return err
+	var images []ItemImageModel
+	err := db.Where(ItemImageModel{ItemID: item.ID}).Order("position asc, id asc").Find(&images).Error
+	return images, err
 }
 
-func DeleteCommentModel(condition interface{}) error {
+// Append an image to the end of the gallery. The first image of a gallery always
+// becomes its cover, a later one only when cover is set.
+func (item ItemModel) AddImage(url, altText string, cover bool) (ItemImageModel, error) {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(CommentModel{}).Error
-	return err
+	tx := db.Begin()
+	var count int
+	tx.Model(&ItemImageModel{}).Where(ItemImageModel{ItemID: item.ID}).Count(&count)
+	if count >= MaxItemImages {
+		tx.Rollback()
+		return ItemImageModel{}, ErrTooManyImages
+	}
+	var last ItemImageModel
+	tx.Where(ItemImageModel{ItemID: item.ID}).Order("position desc").First(&last)
+	image := ItemImageModel{
+		ItemID:   item.ID,
+		URL:      url,
+		AltText:  altText,
+		Position: last.Position + 1,
+		Cover:    cover || count == 0,
+	}
+	if image.Cover {
+		tx.Model(&ItemImageModel{}).Where("item_id = ?", item.ID).Update("cover", false)
+	}
+	if err := tx.Create(&image).Error; err != nil {
+		tx.Rollback()
+		return ItemImageModel{}, err
+	}
+	return image, tx.Commit().Error
+}
+
+// Put the gallery in the order of imageIDs, which must list every image of the item
+// exactly once. When cover is not 0 that image becomes the cover.
+//
+//	err := item.ReorderImages([]uint{3, 1, 2}, 3)
+func (item ItemModel) ReorderImages(imageIDs []uint, cover uint) error {
+	images, err := item.Gallery()
+	if err != nil {
+		return err
+	}
+	known := map[uint]bool{}
+	for _, image := range images {
+		known[image.ID] = true
+	}
+	if len(imageIDs) != len(images) || (cover != 0 && !known[cover]) {
+		return ErrInvalidImageOrder
+	}
+	for _, id := range imageIDs {
+		if !known[id] {
+			return ErrInvalidImageOrder
+		}
+		delete(known, id)
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	for i, id := range imageIDs {
+		update := map[string]interface{}{"position": i + 1}
+		if cover != 0 {
+			update["cover"] = id == cover
+		}
+		if err := tx.Model(&ItemImageModel{}).Where("id = ?", id).Updates(update).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Remove an image from the gallery. Removing the cover hands it to the first image left.
+func (item ItemModel) RemoveImage(imageID uint) error {
+	db := common.GetDB()
+	var image ItemImageModel
+	db.Where(ItemImageModel{ItemID: item.ID}).Where("id = ?", imageID).First(&image)
+	if image.ID == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	tx := db.Begin()
+	if err := tx.Delete(&image).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if image.Cover {
+		var first ItemImageModel
+		tx.Where(ItemImageModel{ItemID: item.ID}).Order("position asc, id asc").First(&first)
+		if first.ID != 0 {
+			tx.Model(&ItemImageModel{}).Where("id = ?", first.ID).Update("cover", true)
+		}
+	}
+	return tx.Commit().Error
+}
+
+func FindOneCategory(condition interface{}) (CategoryModel, error) {
+	db := common.GetDB()
+	var model CategoryModel
+	err := db.Where(condition).First(&model).Error
+	return model, err
+}
+
+// The category and all its descendants.
+func (category CategoryModel) subtree() *gorm.DB {
+	db := common.GetDB()
+	return db.Model(&CategoryModel{}).Where("path LIKE ?", category.Path+"%")
+}
+
+func (category CategoryModel) IsLeaf() bool {
+	var count int
+	db := common.GetDB()
+	db.Model(&CategoryModel{}).Where("parent_id = ?", category.ID).Count(&count)
+	return count == 0
+}
+
+// Items in the trash count too: restoring them must not file them under an
+// inner node.
+func (category CategoryModel) hasItems() bool {
+	var count int
+	db := common.GetDB()
+	db.Unscoped().Model(&ItemModel{}).Where("category_id = ?", category.ID).Count(&count)
+	return count != 0
+}
+
+// The names from the root down to the category, e.g. ["Electronics", "Phones"].
+func (category CategoryModel) Breadcrumb() []string {
+	var ancestors []CategoryModel
+	db := common.GetDB()
+	db.Where("id IN (?)", category.pathIDs()).Order("length(path) asc").Find(&ancestors)
+	names := []string{}
+	for _, ancestor := range ancestors {
+		names = append(names, ancestor.Name)
+	}
+	return names
+}
+
+// Find the parent category may be created (ID 0) or moved under; "" is the root.
+func findCategoryParent(category CategoryModel, parentSlug string) (CategoryModel, error) {
+	if parentSlug == "" {
+		return CategoryModel{}, nil
+	}
+	parent, _ := FindOneCategory(&CategoryModel{Slug: parentSlug})
+	if parent.ID == 0 {
+		return parent, ErrCategoryNotFound
+	}
+	if category.ID != 0 && strings.HasPrefix(parent.Path, category.Path) {
+		return parent, ErrInvalidCategoryParent
+	}
+	// Adding a child would make the items filed under the parent sit in an inner node.
+	if parent.hasItems() {
+		return parent, ErrCategoryInUse
+	}
+	return parent, nil
+}
+
+// Add a category named name under the category parentSlug, or at the root when
+// parentSlug is "".
+func CreateCategory(name, parentSlug string) (CategoryModel, error) {
+	parent, err := findCategoryParent(CategoryModel{}, parentSlug)
+	if err != nil {
+		return CategoryModel{}, err
+	}
+	category := CategoryModel{Name: name, Slug: slug.Make(name), ParentID: parent.ID}
+	if existing, _ := FindOneCategory(&CategoryModel{Slug: category.Slug}); existing.ID != 0 {
+		return CategoryModel{}, ErrCategoryExists
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Create(&category).Error; err != nil {
+		tx.Rollback()
+		return CategoryModel{}, err
+	}
+	category.Path = fmt.Sprintf("%v%d/", parent.Path, category.ID)
+	if parent.ID == 0 {
+		category.Path = fmt.Sprintf("/%d/", category.ID)
+	}
+	if err := tx.Model(&CategoryModel{}).Where("id = ?", category.ID).Update("path", category.Path).Error; err != nil {
+		tx.Rollback()
+		return CategoryModel{}, err
+	}
+	return category, tx.Commit().Error
+}
+
+// Rename the category and move it with its whole subtree under parentSlug ("" for
+// the root). Items keep their category, only the paths of the subtree change.
+func (category *CategoryModel) Update(name, parentSlug string) error {
+	parent, err := findCategoryParent(*category, parentSlug)
+	if err != nil {
+		return err
+	}
+	newSlug := slug.Make(name)
+	if existing, _ := FindOneCategory(&CategoryModel{Slug: newSlug}); existing.ID != 0 && existing.ID != category.ID {
+		return ErrCategoryExists
+	}
+	newPath := fmt.Sprintf("/%d/", category.ID)
+	if parent.ID != 0 {
+		newPath = fmt.Sprintf("%v%d/", parent.Path, category.ID)
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	err = tx.Model(&CategoryModel{}).Where("id = ?", category.ID).
+		Updates(map[string]interface{}{"name": name, "slug": newSlug, "parent_id": parent.ID}).Error
+	if err == nil && newPath != category.Path {
+		err = tx.Model(&CategoryModel{}).Where("path LIKE ?", category.Path+"%").
+			Update("path", gorm.Expr("? || substr(path, ?)", newPath, len(category.Path)+1)).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	category.Name, category.Slug, category.ParentID, category.Path = name, newSlug, parent.ID, newPath
+	return nil
+}
+
+// Delete a category, which must be empty: no items, not even deleted ones, and no
+// subcategories. Nothing refers to it then, so it is deleted for good along with
+// its attributes and its name can be given to a new category.
+func (category CategoryModel) Delete() error {
+	if !category.IsLeaf() || category.hasItems() {
+		return ErrCategoryInUse
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Unscoped().Where("category_id = ?", category.ID).Delete(CategoryAttributeModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Unscoped().Delete(&category).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Every category in creation order, along with the number of published items in
+// each category's subtree.
+func FindCategoryTree() ([]CategoryModel, map[uint]int, error) {
+	db := common.GetDB()
+	var categories []CategoryModel
+	if err := db.Order("id asc").Find(&categories).Error; err != nil {
+		return nil, nil, err
+	}
+	var rows []struct {
+		CategoryID uint
+		Count      int
+	}
+	err := db.Model(&ItemModel{}).Select("category_id, count(*) as count").
+		Where("category_id <> 0 AND status = ?", ItemPublished).Group("category_id").Scan(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	direct := map[uint]int{}
+	for _, row := range rows {
+		direct[row.CategoryID] = row.Count
+	}
+	counts := map[uint]int{}
+	for _, category := range categories {
+		for _, other := range categories {
+			if strings.HasPrefix(other.Path, category.Path) {
+				counts[category.ID] += direct[other.ID]
+			}
+		}
+	}
+	return categories, counts, nil
+}
+
+// File the item under the leaf category categorySlug, or under none when it is "".
+func (model *ItemModel) setCategory(categorySlug string) error {
+	if categorySlug == "" {
+		model.CategoryID = 0
+		return nil
+	}
+	category, _ := FindOneCategory(&CategoryModel{Slug: categorySlug})
+	if category.ID == 0 {
+		return ErrCategoryNotFound
+	}
+	if !category.IsLeaf() {
+		return ErrCategoryNotLeaf
+	}
+	model.CategoryID = category.ID
+	return nil
+}
+
+var ErrInvalidAttribute = errors.New("attribute type should be enum, number, text or boolean")
+var ErrAttributeExists = errors.New("attribute already exists in the category or its ancestors")
+var ErrAttributeNotFound = errors.New("attribute not found")
+var ErrVariantNotFound = errors.New("variant not found")
+var ErrVariantExists = errors.New("a variant with these attributes already exists")
+
+// The ids of the category and its ancestors, from the root down.
+func (category CategoryModel) pathIDs() []string {
+	var ids []string
+	for _, id := range strings.Split(strings.Trim(category.Path, "/"), "/") {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// The attributes of the category, including those inherited from its ancestors,
+// in the order they were defined.
+func (category CategoryModel) AttributeSchema() ([]CategoryAttributeModel, error) {
+	var schema []CategoryAttributeModel
+	if category.ID == 0 {
+		return schema, nil
+	}
+	db := common.GetDB()
+	err := db.Where("category_id IN (?)", category.pathIDs()).Order("id asc").Find(&schema).Error
+	return schema, err
+}
+
+// Add an attribute to the schema of the category. Enum attributes need at least
+// one option; the options of other types are ignored.
+func (category CategoryModel) AddAttribute(name, kind string, options []string, required, variant bool) (CategoryAttributeModel, error) {
+	attribute := CategoryAttributeModel{
+		CategoryID: category.ID,
+		Name:       strings.TrimSpace(name),
+		Type:       kind,
+		Required:   required,
+		Variant:    variant,
+	}
+	switch kind {
+	case AttributeEnum:
+		var cleaned []string
+		for _, option := range options {
+			if option = strings.TrimSpace(option); option != "" {
+				cleaned = append(cleaned, option)
+			}
+		}
+		if len(cleaned) == 0 {
+			return attribute, errors.New("enum attributes need at least one option")
+		}
+		attribute.Options = strings.Join(cleaned, ",")
+	case AttributeNumber, AttributeText, AttributeBoolean:
+	default:
+		return attribute, ErrInvalidAttribute
+	}
+	schema, err := category.AttributeSchema()
+	if err != nil {
+		return attribute, err
+	}
+	for _, existing := range schema {
+		if strings.EqualFold(existing.Name, attribute.Name) {
+			return attribute, ErrAttributeExists
+		}
+	}
+	db := common.GetDB()
+	err = db.Create(&attribute).Error
+	return attribute, err
+}
+
+// Remove an attribute defined on the category itself; inherited attributes can
+// only be removed from the category defining them. Values already stored on items
+// are kept but no longer shown or validated.
+func (category CategoryModel) RemoveAttribute(name string) error {
+	db := common.GetDB()
+	result := db.Where("category_id = ? AND name = ?", category.ID, name).Delete(CategoryAttributeModel{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAttributeNotFound
+	}
+	return nil
+}
+
+func (attribute CategoryAttributeModel) OptionList() []string {
+	if attribute.Options == "" {
+		return []string{}
+	}
+	return strings.Split(attribute.Options, ",")
+}
+
+// Check value against the attribute's type and return the value to store, with
+// enum and boolean values normalised to their canonical spelling.
+func (attribute CategoryAttributeModel) parse(value string) (ItemAttributeModel, error) {
+	value = strings.TrimSpace(value)
+	parsed := ItemAttributeModel{Name: attribute.Name, Value: value}
+	switch attribute.Type {
+	case AttributeEnum:
+		for _, option := range attribute.OptionList() {
+			if strings.EqualFold(option, value) {
+				parsed.Value = option
+				return parsed, nil
+			}
+		}
+		return parsed, fmt.Errorf("should be one of %v", strings.Join(attribute.OptionList(), ", "))
+	case AttributeNumber:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return parsed, errors.New("should be a number")
+		}
+		parsed.Number = number
+	case AttributeBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return parsed, errors.New("should be true or false")
+		}
+		parsed.Value = strconv.FormatBool(b)
+	default:
+		if len(value) > 256 {
+			return parsed, errors.New("should be at most 256 characters")
+		}
+	}
+	return parsed, nil
+}
+
+// Validate values against the item attributes of schema, or against its variant
+// attributes when variant is true. Every attribute of the other kind, and every
+// name the schema does not know, is rejected.
+func checkAttributes(schema []CategoryAttributeModel, values map[string]string, variant bool) ([]ItemAttributeModel, error) {
+	problems := AttributeError{}
+	var attributes []ItemAttributeModel
+	known := map[string]bool{}
+	for _, attribute := range schema {
+		if attribute.Variant != variant {
+			continue
+		}
+		known[attribute.Name] = true
+		value, ok := values[attribute.Name]
+		if !ok || strings.TrimSpace(value) == "" {
+			if attribute.Required {
+				problems[attribute.Name] = "is required"
+			}
+			continue
+		}
+		parsed, err := attribute.parse(value)
+		if err != nil {
+			problems[attribute.Name] = err.Error()
+			continue
+		}
+		attributes = append(attributes, parsed)
+	}
+	for name := range values {
+		if !known[name] {
+			problems[name] = "is not an attribute of the category"
+		}
+	}
+	if len(problems) != 0 {
+		return nil, problems
+	}
+	return attributes, nil
+}
+
+// The schema of the item's category, empty for an uncategorized item.
+func (item ItemModel) attributeSchema() ([]CategoryAttributeModel, error) {
+	if item.CategoryID == 0 {
+		return nil, nil
+	}
+	category, err := FindOneCategory(&CategoryModel{Model: gorm.Model{ID: item.CategoryID}})
+	if err != nil {
+		return nil, err
+	}
+	return category.AttributeSchema()
+}
+
+// The item level attribute values by name, variant attributes are on the variants.
+func (item ItemModel) Attributes() map[string]string {
+	var models []ItemAttributeModel
+	db := common.GetDB()
+	db.Where("item_id = ? AND variant_id = 0", item.ID).Order("id asc").Find(&models)
+	attributes := map[string]string{}
+	for _, model := range models {
+		attributes[model.Name] = model.Value
+	}
+	return attributes
+}
+
+// Replace the item level attribute values with attributes.
+func (item ItemModel) setAttributes(attributes []ItemAttributeModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Unscoped().Where("item_id = ? AND variant_id = 0", item.ID).Delete(ItemAttributeModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, attribute := range attributes {
+		attribute.ItemID = item.ID
+		if err := tx.Create(&attribute).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (item ItemModel) HasVariants() bool {
+	var count int
+	db := common.GetDB()
+	db.Model(&ItemVariantModel{}).Where(ItemVariantModel{ItemID: item.ID}).Count(&count)
+	return count != 0
+}
+
+// The variants of the item with their attributes, oldest first.
+func (item ItemModel) Variants() ([]ItemVariantModel, error) {
+	var variants []ItemVariantModel
+	db := common.GetDB()
+	err := db.Where(ItemVariantModel{ItemID: item.ID}).Preload("Attributes").Order("id asc").Find(&variants).Error
+	return variants, err
+}
+
+func (item ItemModel) FindVariant(id uint) (ItemVariantModel, error) {
+	var variant ItemVariantModel
+	db := common.GetDB()
+	db.Where("id = ? AND item_id = ?", id, item.ID).Preload("Attributes").First(&variant)
+	if variant.ID == 0 {
+		return variant, ErrVariantNotFound
+	}
+	return variant, nil
+}
+
+// The variant attribute values by name.
+func (variant ItemVariantModel) AttributeMap() map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range variant.Attributes {
+		attributes[attribute.Name] = attribute.Value
+	}
+	return attributes
+}
+
+// Validate the variant attribute values and make sure no other variant of the item
+// has the very same ones; uncategorized items only tell their variants apart by
+// name. An empty name defaults to the values, e.g. "M / Red".
+func (item ItemModel) checkVariant(id uint, name string, values map[string]string) (string, []ItemAttributeModel, error) {
+	schema, err := item.attributeSchema()
+	if err != nil {
+		return name, nil, err
+	}
+	attributes, err := checkAttributes(schema, values, true)
+	if err != nil {
+		return name, nil, err
+	}
+	key := map[string]string{}
+	var parts []string
+	for _, attribute := range attributes {
+		key[attribute.Name] = attribute.Value
+		parts = append(parts, attribute.Value)
+	}
+	variants, err := item.Variants()
+	if err != nil {
+		return name, nil, err
+	}
+	for _, other := range variants {
+		if len(key) != 0 && other.ID != id && fmt.Sprint(other.AttributeMap()) == fmt.Sprint(key) {
+			return name, nil, ErrVariantExists
+		}
+	}
+	if strings.TrimSpace(name) == "" {
+		name = strings.Join(parts, " / ")
+	}
+	return name, attributes, nil
+}
+
+func saveVariantAttributes(tx *gorm.DB, variant ItemVariantModel, attributes []ItemAttributeModel) error {
+	if err := tx.Unscoped().Where("variant_id = ?", variant.ID).Delete(ItemAttributeModel{}).Error; err != nil {
+		return err
+	}
+	for _, attribute := range attributes {
+		attribute.ItemID = variant.ItemID
+		attribute.VariantID = variant.ID
+		if err := tx.Create(&attribute).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add a variant with its own price and stock. values holds the variant attributes
+// of the item's category, e.g. {"size": "M", "colour": "red"}.
+func (item ItemModel) AddVariant(name string, price int64, quantity int, values map[string]string) (ItemVariantModel, error) {
+	variant := ItemVariantModel{ItemID: item.ID, Price: price, Quantity: quantity}
+	if item.OnAuction() {
+		return variant, ErrAuctionItem
+	}
+	name, attributes, err := item.checkVariant(0, name, values)
+	if err != nil {
+		return variant, err
+	}
+	variant.Name = name
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Create(&variant).Error; err != nil {
+		tx.Rollback()
+		return variant, err
+	}
+	if err := saveVariantAttributes(tx, variant, attributes); err != nil {
+		tx.Rollback()
+		return variant, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return variant, err
+	}
+	return item.FindVariant(variant.ID)
+}
+
+// Change a variant. Units held by checkouts stay reserved, so quantity is the new
+// stock on hand including them and can not go below them, see Revise.
+func (item ItemModel) UpdateVariant(id uint, name string, price int64, quantity int, values map[string]string) (ItemVariantModel, error) {
+	variant, err := item.FindVariant(id)
+	if err != nil {
+		return variant, err
+	}
+	name, attributes, err := item.checkVariant(id, name, values)
+	if err != nil {
+		return variant, err
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	result := tx.Model(&ItemVariantModel{}).Where("id = ? AND reserved <= ?", id, quantity).
+		Updates(map[string]interface{}{"name": name, "price": price, "quantity": quantity})
+	err = result.Error
+	if err == nil && result.RowsAffected == 0 {
+		err = ErrQuantityBelowReserved
+	}
+	if err == nil {
+		err = saveVariantAttributes(tx, variant, attributes)
+	}
+	if err != nil {
+		tx.Rollback()
+		return variant, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return variant, err
+	}
+	return item.FindVariant(id)
+}
+
+// Remove a variant; carts and orders still refer to it, so it is only soft deleted.
+func (item ItemModel) RemoveVariant(id uint) error {
+	variant, err := item.FindVariant(id)
+	if err != nil {
+		return err
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Where("variant_id = ?", variant.ID).Delete(ItemAttributeModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&variant).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (item ItemModel) isFavoriteBy(user ItemUserModel) bool {
+	db := common.GetDB()
+	var favorite FavoriteModel
+	db.Where(FavoriteModel{
+		FavoriteID:   item.ID,
+		FavoriteByID: user.ID,
+	}).First(&favorite)
+	return favorite.ID != 0
+}
+
+// Add n to the counter column of the rows of model matching where, without
+// touching updated_at. Rows in the trash are counted too, to be right once
+// restored.
+func addToCounter(tx *gorm.DB, model interface{}, column string, n int64, where string, args ...interface{}) error {
+	return tx.Unscoped().Model(model).Where(where, args...).UpdateColumn(column, gorm.Expr(column+" + ?", n)).Error
+}
+
+func (item ItemModel) favoriteBy(user ItemUserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	var favorite FavoriteModel
+	tx.Where(FavoriteModel{FavoriteID: item.ID, FavoriteByID: user.ID}).First(&favorite)
+	if favorite.ID != 0 {
+		return tx.Commit().Error
+	}
+	favorite = FavoriteModel{FavoriteID: item.ID, FavoriteByID: user.ID}
+	if err := tx.Create(&favorite).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := addToCounter(tx, &ItemModel{}, "favorites_count", 1, "id = ?", item.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (item ItemModel) unFavoriteBy(user ItemUserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	result := tx.Where(FavoriteModel{
+		FavoriteID:   item.ID,
+		FavoriteByID: user.ID,
+	}).Delete(FavoriteModel{})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if err := addToCounter(tx, &ItemModel{}, "favorites_count", -result.RowsAffected, "id = ?", item.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func SaveOne(data interface{}) error {
+	db := common.GetDB()
+	err := db.Save(data).Error
+	return err
+}
+
+func FindOneItem(condition interface{}) (ItemModel, error) {
+	db := common.GetDB()
+	var model ItemModel
+	tx := db.Begin()
+	tx.Where(condition).First(&model)
+	tx.Model(&model).Related(&model.Seller, "Seller")
+	tx.Model(&model.Seller).Related(&model.Seller.UserModel)
+	tx.Model(&model).Related(&model.Tags, "Tags")
+	err := tx.Commit().Error
+	return model, err
+}
+
+func (self *ItemModel) getComments() error {
+	db := common.GetDB()
+	tx := db.Begin()
+	tx.Model(self).Related(&self.Comments, "Comments")
+	for i, _ := range self.Comments {
+		tx.Model(&self.Comments[i]).Related(&self.Comments[i].Seller, "Seller")
+		tx.Model(&self.Comments[i].Seller).Related(&self.Comments[i].Seller.UserModel)
+	}
+	err := tx.Commit().Error
+	return err
+}
+
+var commentsKeyset = common.Keyset{Name: "comments", ID: "comment_models.id"}
+
+// A page of an item's comments, oldest first. Next and Prev are the cursors of
+// the neighbouring pages, "" at either end.
+type CommentPage struct {
+	Comments []CommentModel
+	Count    int
+	Next     string
+	Prev     string
+}
+
+func (self *ItemModel) getCommentPage(limit int, cursor string) (CommentPage, error) {
+	db := common.GetDB()
+	page := CommentPage{Comments: []CommentModel{}}
+	query := db.Model(&CommentModel{}).Where("item_id = ?", self.ID)
+	query.Count(&page.Count)
+	query, position, err := commentsKeyset.Seek(query, cursor, limit)
+	if err != nil {
+		return page, err
+	}
+	var comments []CommentModel
+	if err := query.Find(&comments).Error; err != nil {
+		return page, err
+	}
+	n, hasPrev, hasNext := commentsKeyset.Finish(comments, position, limit)
+	page.Comments = comments[:n]
+	for i := range page.Comments {
+		db.Model(&page.Comments[i]).Related(&page.Comments[i].Seller, "Seller")
+		db.Model(&page.Comments[i].Seller).Related(&page.Comments[i].Seller.UserModel)
+	}
+	if n != 0 && hasPrev {
+		page.Prev = commentsKeyset.Encode(nil, page.Comments[0].ID, true)
+	}
+	if n != 0 && hasNext {
+		page.Next = commentsKeyset.Encode(nil, page.Comments[n-1].ID, false)
+	}
+	return page, nil
+}
+
+func getAllTags() ([]TagModel, error) {
+	db := common.GetDB()
+	var models []TagModel
+	err := db.Order("items_count desc, tag asc").Find(&models).Error
+	return models, err
+}
+
+// Optional constraints for FindManyItem, all of which apply together. Like limit
+// and offset the values are raw query strings: MinPrice and MaxPrice are in minor
+// units of Currency, Category is a category slug matching its whole subtree, and
+// CreatedAfter and CreatedBefore are RFC 3339 times or 2006-01-02 dates, the
+// latter exclusive. Items must carry all Tags, or any of them when TagMode is
+// "any". Empty fields are ignored.
+//
+// Attributes matches attribute values of the item or of any of its variants, by
+// attribute name: "10..20" is a numeric range (either end may be left out), "M,L"
+// matches any of the listed values and anything else the value itself, ignoring
+// case.
+//
+// Sort is one of ItemSortOrders, "newest" by default. Prices are only comparable
+// within a currency, so price filters and sorts are meant to come with Currency.
+//
+// Only published items are listed unless Unpublished is set.
+type ItemFilter struct {
+	Tags          []string
+	TagMode       string
+	Seller        string
+	Favorited     string
+	MinPrice      string
+	MaxPrice      string
+	Currency      string
+	Category      string
+	CreatedAfter  string
+	CreatedBefore string
+	Sort          string
+	Attributes    map[string]string
+	// Also list the items that are not published, for sellers looking at their own.
+	Unpublished bool
+	// Listing availabilities to list, all but sold and expired when empty.
+	Availability []string
+}
+
+// An ordering of item lists, with the sort value of an item for cursors.
+type ItemSortOrder struct {
+	common.Keyset
+	key func(item ItemModel) interface{}
+}
+
+// The orderings of item lists by Sort name. Ties are broken by id, so pages never
+// overlap.
+var ItemSortOrders = map[string]ItemSortOrder{
+	"newest": {
+		common.Keyset{Name: "newest", Key: "item_models.created_at", ID: "item_models.id", Desc: true, Time: true},
+		func(item ItemModel) interface{} { return item.CreatedAt },
+	},
+	"oldest": {
+		common.Keyset{Name: "oldest", Key: "item_models.created_at", ID: "item_models.id", Time: true},
+		func(item ItemModel) interface{} { return item.CreatedAt },
+	},
+	"most_favorited": {
+		common.Keyset{Name: "most_favorited", Key: "item_models.favorites_count", ID: "item_models.id", Desc: true},
+		func(item ItemModel) interface{} { return item.FavoritesCount },
+	},
+	"price": {
+		common.Keyset{Name: "price", Key: "item_models.price", ID: "item_models.id"},
+		func(item ItemModel) interface{} { return item.Price },
+	},
+	"-price": {
+		common.Keyset{Name: "-price", Key: "item_models.price", ID: "item_models.id", Desc: true},
+		func(item ItemModel) interface{} { return item.Price },
+	},
+}
+
+func (f ItemFilter) sortOrder() ItemSortOrder {
+	if order, ok := ItemSortOrders[f.Sort]; ok {
+		return order
+	}
+	return ItemSortOrders["newest"]
+}
+
+func attributeFilter(db *gorm.DB, name, value string) *gorm.DB {
+	values := common.GetDB().Model(&ItemAttributeModel{}).Select("item_id").Where("name = ?", name)
+	if bounds := strings.SplitN(value, "..", 2); len(bounds) == 2 {
+		if min, err := strconv.ParseFloat(bounds[0], 64); err == nil {
+			values = values.Where("number >= ?", min)
+		}
+		if max, err := strconv.ParseFloat(bounds[1], 64); err == nil {
+			values = values.Where("number <= ?", max)
+		}
+	} else if strings.Contains(value, ",") {
+		var options []string
+		for _, option := range strings.Split(value, ",") {
+			options = append(options, strings.ToLower(strings.TrimSpace(option)))
+		}
+		values = values.Where("lower(value) IN (?)", options)
+	} else {
+		values = values.Where("lower(value) = ?", strings.ToLower(strings.TrimSpace(value)))
+	}
+	return db.Where("item_models.id IN (?)", values.QueryExpr())
+}
+
+// Parse an RFC 3339 time or a plain date.
+func parseFilterTime(value string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// The item user ids of the user named username, as a subquery.
+func itemUserIDs(username string) interface{} {
+	db := common.GetDB()
+	return db.Model(&ItemUserModel{}).Select("item_user_models.id").
+		Joins("JOIN user_models ON user_models.id = item_user_models.user_model_id").
+		Where("user_models.username = ?", username).QueryExpr()
+}
+
+func (f ItemFilter) where(db *gorm.DB) *gorm.DB {
+	if !f.Unpublished {
+		db = db.Where("item_models.status = ?", ItemPublished)
+	}
+	if len(f.Availability) != 0 {
+		db = db.Where("item_models.availability IN (?)", f.Availability)
+	} else {
+		db = db.Where("item_models.availability NOT IN (?)", []string{ListingSold, ListingExpired})
+	}
+	var tags []string
+	for _, tag := range f.Tags {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) != 0 {
+		tagged := common.GetDB().Table("item_tags").Select("item_tags.item_model_id").
+			Joins("JOIN tag_models ON tag_models.id = item_tags.tag_model_id").
+			Where("tag_models.tag IN (?)", tags)
+		if f.TagMode != "any" {
+			tagged = tagged.Group("item_tags.item_model_id").
+				Having("count(DISTINCT tag_models.id) = ?", len(tags))
+		}
+		db = db.Where("item_models.id IN (?)", tagged.QueryExpr())
+	}
+	if f.Seller != "" {
+		db = db.Where("item_models.seller_id IN (?)", itemUserIDs(f.Seller))
+	}
+	if f.Favorited != "" {
+		favorites := common.GetDB().Model(&FavoriteModel{}).Select("favorite_id").
+			Where("favorite_by_id IN (?)", itemUserIDs(f.Favorited))
+		db = db.Where("item_models.id IN (?)", favorites.QueryExpr())
+	}
+	if f.Category != "" {
+		category, _ := FindOneCategory(&CategoryModel{Slug: f.Category})
+		if category.ID == 0 {
+			return db.Where("1 = 0")
+		}
+		db = db.Where("item_models.category_id IN (?)", category.subtree().Select("id").QueryExpr())
+	}
+	if f.Currency != "" {
+		db = db.Where("item_models.currency = ?", f.Currency)
+	}
+	if minPrice, err := strconv.ParseInt(f.MinPrice, 10, 64); err == nil {
+		db = db.Where("item_models.price >= ?", minPrice)
+	}
+	if maxPrice, err := strconv.ParseInt(f.MaxPrice, 10, 64); err == nil {
+		db = db.Where("item_models.price <= ?", maxPrice)
+	}
+	if after, ok := parseFilterTime(f.CreatedAfter); ok {
+		db = db.Where("item_models.created_at >= ?", after)
+	}
+	if before, ok := parseFilterTime(f.CreatedBefore); ok {
+		db = db.Where("item_models.created_at < ?", before)
+	}
+	for name, value := range f.Attributes {
+		db = attributeFilter(db, name, value)
+	}
+	return db
+}
+
+func (f ItemFilter) order(db *gorm.DB) *gorm.DB {
+	return db.Order(f.sortOrder().OrderBy())
+}
+
+// List the items matching filter, along with how many match in all. The tag,
+// seller and favorited arguments are shorthands for the filter fields of the same
+// name.
+func FindManyItem(tag, seller, limit, offset, favorited string, filter ItemFilter) ([]ItemModel, int, error) {
+	db := common.GetDB()
+	var models []ItemModel
+	var count int
+
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil {
+		offset_int = 0
+	}
+
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil {
+		limit_int = 20
+	}
+
+	if tag != "" {
+		filter.Tags = append(filter.Tags, tag)
+	}
+	if seller != "" {
+		filter.Seller = seller
+	}
+	if favorited != "" {
+		filter.Favorited = favorited
+	}
+
+	tx := db.Begin()
+	query := tx.Model(&ItemModel{}).Scopes(filter.where)
+	query.Count(&count)
+	query.Scopes(filter.order).Offset(offset_int).Limit(limit_int).Find(&models)
+	loadItemRelations(tx, models)
+	err = tx.Commit().Error
+	return models, count, err
+}
+
+// A page of items read with a cursor. Next and Prev are the cursors of the
+// following and preceding pages, "" at either end of the list; Count is the
+// number of items in the whole list.
+type ItemPage struct {
+	Items []ItemModel
+	Count int
+	Next  string
+	Prev  string
+}
+
+// Read the page of query starting at cursor ("" for the first page) in the order
+// of keyset, key giving the sort value of an item.
+func findItemPage(query *gorm.DB, keyset common.Keyset, key func(ItemModel) interface{}, limit, cursor string) (ItemPage, error) {
+	page := ItemPage{Items: []ItemModel{}}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil || limit_int <= 0 {
+		limit_int = 20
+	}
+	query.Count(&page.Count)
+	query, position, err := keyset.Seek(query, cursor, limit_int)
+	if err != nil {
+		return page, err
+	}
+	var models []ItemModel
+	if err := query.Find(&models).Error; err != nil {
+		return page, err
+	}
+	n, hasPrev, hasNext := keyset.Finish(models, position, limit_int)
+	page.Items = models[:n]
+	if n != 0 && hasPrev {
+		page.Prev = keyset.Encode(key(page.Items[0]), page.Items[0].ID, true)
+	}
+	if n != 0 && hasNext {
+		page.Next = keyset.Encode(key(page.Items[n-1]), page.Items[n-1].ID, false)
+	}
+	db := common.GetDB()
+	loadItemRelations(db, page.Items)
+	return page, nil
+}
+
+// Same as FindManyItem with a cursor instead of an offset, see common.Keyset.
+// Cursors only work with the sort order they were made for, any other gives
+// common.ErrInvalidCursor.
+func FindItemPage(filter ItemFilter, limit, cursor string) (ItemPage, error) {
+	db := common.GetDB()
+	order := filter.sortOrder()
+	return findItemPage(db.Model(&ItemModel{}).Scopes(filter.where), order.Keyset, order.key, limit, cursor)
+}
+
+func (self *ItemUserModel) GetItemFeed(limit, offset string) ([]ItemModel, int, error) {
+	db := common.GetDB()
+	var models []ItemModel
+	var count int
+
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil {
+		offset_int = 0
+	}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil {
+		limit_int = 20
+	}
+
+	tx := db.Begin()
+	followings := self.UserModel.GetFollowings()
+	var itemUserModels []uint
+	for _, following := range followings {
+		itemUserModel := GetItemUserModel(following)
+		itemUserModels = append(itemUserModels, itemUserModel.ID)
+	}
+
+	query := tx.Model(&ItemModel{}).Where("seller_id in (?)", itemUserModels).Scopes(ItemFilter{}.where)
+	query.Count(&count)
+	query.Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
+
+	loadItemRelations(tx, models)
+	err = tx.Commit().Error
+	return models, count, err
+}
+
+var feedKeyset = common.Keyset{Name: "feed", Key: "item_models.updated_at", ID: "item_models.id", Desc: true, Time: true}
+
+// Same as GetItemFeed with a cursor instead of an offset.
+func (self *ItemUserModel) GetItemFeedPage(limit, cursor string) (ItemPage, error) {
+	db := common.GetDB()
+	followed := db.Model(&users.FollowModel{}).Select("item_user_models.id").
+		Joins("JOIN item_user_models ON item_user_models.user_model_id = follow_models.following_id").
+		Where("follow_models.followed_by_id = ?", self.UserModelID)
+	query := db.Model(&ItemModel{}).Where("item_models.seller_id IN (?)", followed.QueryExpr()).Scopes(ItemFilter{}.where)
+	return findItemPage(query, feedKeyset, func(item ItemModel) interface{} { return item.UpdatedAt }, limit, cursor)
+}
+
+// Tuning of the ranked feed, see GetRankedFeed.
+const (
+	feedSellerWeight   = 3.0
+	feedTagWeight      = 2.0
+	feedTrendingWeight = 1.0
+	// An item's score halves every feedHalfLife after it was listed.
+	feedHalfLife = 48 * time.Hour
+	// Items the user has already opened keep this share of their score.
+	feedSeenFactor = 0.2
+	// Trending items are the most favorited over the last feedTrendingWindow.
+	feedTrendingWindow = 7 * 24 * time.Hour
+	// How many items each source contributes at most.
+	feedCandidates = 200
+)
+
+type feedCandidate struct {
+	item   ItemModel
+	weight float64
+	score  float64
+}
+
+// The home feed ranked by relevance instead of time: items of followed sellers,
+// items carrying followed tags and trending items are blended, each source
+// weighted (an item found by several adds them up), boosted by its favorites and
+// decayed by its age. Items the user has opened drop down, their own items are
+// left out. The count is the number of ranked items.
+func (self *ItemUserModel) GetRankedFeed(limit, offset string) ([]ItemModel, int, error) {
+	db := common.GetDB()
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil {
+		offset_int = 0
+	}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil {
+		limit_int = 20
+	}
+
+	candidates := map[uint]*feedCandidate{}
+	add := func(query *gorm.DB, weight float64) error {
+		var models []ItemModel
+		err := query.Where("item_models.seller_id <> ?", self.ID).Scopes(ItemFilter{}.where).
+			Order("item_models.created_at desc").Limit(feedCandidates).Find(&models).Error
+		for _, model := range models {
+			if candidates[model.ID] == nil {
+				candidates[model.ID] = &feedCandidate{item: model}
+			}
+			candidates[model.ID].weight += weight
+		}
+		return err
+	}
+	followed := db.Model(&users.FollowModel{}).Select("item_user_models.id").
+		Joins("JOIN item_user_models ON item_user_models.user_model_id = follow_models.following_id").
+		Where("follow_models.followed_by_id = ?", self.UserModelID)
+	if err := add(db.Where("item_models.seller_id IN (?)", followed.QueryExpr()), feedSellerWeight); err != nil {
+		return nil, 0, err
+	}
+	tagged := db.Table("item_tags").Select("item_tags.item_model_id").
+		Joins("JOIN tag_follow_models ON tag_follow_models.tag_id = item_tags.tag_model_id").
+		Where("tag_follow_models.follower_id = ? AND tag_follow_models.deleted_at IS NULL", self.ID)
+	if err := add(db.Where("item_models.id IN (?)", tagged.QueryExpr()), feedTagWeight); err != nil {
+		return nil, 0, err
+	}
+	trending := db.Model(&FavoriteModel{}).Select("favorite_id").
+		Where("created_at > ?", time.Now().Add(-feedTrendingWindow)).
+		Group("favorite_id").Order("count(*) desc").Limit(feedCandidates)
+	if err := add(db.Where("item_models.id IN (?)", trending.QueryExpr()), feedTrendingWeight); err != nil {
+		return nil, 0, err
+	}
+
+	var ids []uint
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	var seen []uint
+	db.Model(&ItemSeenModel{}).Where("item_user_id = ? AND item_id IN (?)", self.ID, ids).Pluck("item_id", &seen)
+	seenSet := map[uint]bool{}
+	for _, id := range seen {
+		seenSet[id] = true
+	}
+
+	now := time.Now()
+	ranked := make([]*feedCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		age := now.Sub(candidate.item.CreatedAt)
+		if age < 0 {
+			age = 0
+		}
+		candidate.score = (candidate.weight + math.Log1p(float64(candidate.item.FavoritesCount))) *
+			math.Pow(0.5, float64(age)/float64(feedHalfLife))
+		if seenSet[candidate.item.ID] {
+			candidate.score *= feedSeenFactor
+		}
+		ranked = append(ranked, candidate)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].item.ID > ranked[j].item.ID
+	})
+
+	models := []ItemModel{}
+	for i := offset_int; i < len(ranked) && i < offset_int+limit_int; i++ {
+		models = append(models, ranked[i].item)
+	}
+	loadItemRelations(db, models)
+	return models, len(ranked), nil
+}
+
+// Remember that user opened the item, for the ranked feed.
+func (self ItemUserModel) markSeen(item ItemModel) error {
+	db := common.GetDB()
+	var seen ItemSeenModel
+	err := db.Where(ItemSeenModel{ItemUserID: self.ID, ItemID: item.ID}).FirstOrCreate(&seen).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&seen).Update("updated_at", time.Now()).Error
+}
+
+// Follow a tag, creating it if no item carries it yet.
+func (self ItemUserModel) followTag(tag string) (TagModel, error) {
+	db := common.GetDB()
+	var tagModel TagModel
+	if err := db.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error; err != nil {
+		return tagModel, err
+	}
+	var follow TagFollowModel
+	err := db.FirstOrCreate(&follow, TagFollowModel{TagID: tagModel.ID, FollowerID: self.ID}).Error
+	return tagModel, err
+}
+
+func (self ItemUserModel) unfollowTag(tag string) error {
+	db := common.GetDB()
+	var tagModel TagModel
+	if err := db.Where(TagModel{Tag: tag}).First(&tagModel).Error; err != nil {
+		return err
+	}
+	return db.Where(TagFollowModel{TagID: tagModel.ID, FollowerID: self.ID}).Delete(TagFollowModel{}).Error
+}
+
+// One term of a search query: a word, a "quoted phrase", or a word (or phrase)
+// ending in * matching anything it starts.
+type searchTerm struct {
+	Text   string
+	Phrase bool
+	Prefix bool
+}
+
+// Split a user search query into terms, all of which must match. Anything the
+// index could read as query syntax is taken literally.
+func parseSearchQuery(q string) []searchTerm {
+	var terms []searchTerm
+	add := func(text string, phrase bool) {
+		prefix := strings.HasSuffix(text, "*")
+		text = strings.TrimSpace(strings.Trim(text, "*"))
+		text = strings.Join(strings.Fields(text), " ")
+		if text != "" {
+			terms = append(terms, searchTerm{Text: text, Phrase: phrase, Prefix: prefix})
+		}
+	}
+	for i, part := range strings.Split(q, "\"") {
+		// Every other part sits between quotes; an unmatched quote runs to the end.
+		if i%2 == 1 {
+			add(part, true)
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			add(word, false)
+		}
+	}
+	return terms
+}
+
+// Markers put around the matched words of a snippet by the search backends. They
+// can not appear in user text, so the snippet is escaped first and the markers
+// turned into <mark> tags afterwards.
+const (
+	snippetOpen  = "\x02"
+	snippetClose = "\x03"
+)
+
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.Replace(snippet, snippetOpen, "<mark>", -1)
+	return strings.Replace(snippet, snippetClose, "</mark>", -1)
+}
+
+// What a search backend returns for every matching item, best first.
+type searchHit struct {
+	ID      uint
+	Snippet string
+}
+
+// An item found by SearchItems along with a snippet of its text, HTML escaped
+// apart from the <mark> tags around the matched words.
+type ItemSearchResult struct {
+	Item    ItemModel
+	Snippet string
+}
+
+// Find the items matching the search query q, best matches first. Title matches
+// weigh most, then tags, description and body. Limit and offset are raw query
+// strings like in FindManyItem. See parseSearchQuery for the query syntax; the
+// ranking itself depends on the backend, FTS5 with the sqlite_fts5 build tag and
+// plain LIKE matching otherwise. Sold and expired listings are left out.
+func SearchItems(q, limit, offset string) ([]ItemSearchResult, int, error) {
+	results := []ItemSearchResult{}
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil {
+		offset_int = 0
+	}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil {
+		limit_int = 20
+	}
+	terms := parseSearchQuery(q)
+	if len(terms) == 0 {
+		return results, 0, nil
+	}
+	hits, count, err := searchItems(terms, limit_int, offset_int)
+	if err != nil || len(hits) == 0 {
+		return results, count, err
+	}
+	var ids []uint
+	for _, hit := range hits {
+		ids = append(ids, hit.ID)
+	}
+	var models []ItemModel
+	db := common.GetDB()
+	tx := db.Begin()
+	tx.Where("id IN (?)", ids).Find(&models)
+	loadItemRelations(tx, models)
+	byID := map[uint]ItemModel{}
+	for _, model := range models {
+		byID[model.ID] = model
+	}
+	err = tx.Commit().Error
+	for _, hit := range hits {
+		if item, ok := byID[hit.ID]; ok {
+			results = append(results, ItemSearchResult{Item: item, Snippet: highlightSnippet(hit.Snippet)})
+		}
+	}
+	return results, count, err
+}
+
+// Keep the search index in sync with the item table. Indexing never fails a save:
+// a broken index only degrades search.
+func (model *ItemModel) AfterSave(tx *gorm.DB) error {
+	if model.ID != 0 {
+		if err := indexItem(tx, model.ID); err != nil {
+			fmt.Println("search err: (AfterSave) ", err)
+		}
+	}
+	// Tags added by a save are counted in its transaction, see Revise for removals.
+	return recountTags(tx, itemTagIDs(model.ID))
+}
+
+// Bodies are rendered once per version, when saved, rather than on every read.
+func (model *ItemModel) BeforeSave() error {
+	model.BodyHTML = common.RenderMarkdown(model.Body)
+	return nil
+}
+
+func (model *CommentModel) BeforeSave() error {
+	model.BodyHTML = common.RenderMarkdown(model.Body)
+	return nil
+}
+
+// The rendered body, for rows saved before bodies were rendered too.
+func renderedBody(body, bodyHTML string) string {
+	if bodyHTML == "" {
+		return common.RenderMarkdown(body)
+	}
+	return bodyHTML
+}
+
+// Items created without a slug get one made from their title, and start their
+// listing period.
+func (model *ItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if model.ExpiresAt == nil {
+		expiresAt := time.Now().Add(ListingPeriod).UTC()
+		model.ExpiresAt = &expiresAt
+	}
+	if model.Slug == "" {
+		model.Slug, err = uniqueSlug(tx, model.Title, 0)
+	}
+	return err
+}
+
+func (model *ItemModel) AfterCreate(tx *gorm.DB) error {
+	return addToCounter(tx, &ItemUserModel{}, "items_count", 1, "id = ?", model.SellerID)
+}
+
+func (model *CommentModel) AfterCreate(tx *gorm.DB) error {
+	return addToCounter(tx, &ItemModel{}, "comments_count", 1, "id = ?", model.ItemID)
+}
+
+// The ids of the tags of the items, as a subquery.
+func itemTagIDs(itemIDs interface{}) interface{} {
+	db := common.GetDB()
+	return db.Table("item_tags").Select("tag_model_id").Where("item_model_id IN (?)", itemIDs).QueryExpr()
+}
+
+func (model *ItemModel) AfterDelete(tx *gorm.DB) error {
+	if model.ID != 0 {
+		if err := unindexItem(tx, model.ID); err != nil {
+			fmt.Println("search err: (AfterDelete) ", err)
+		}
+	}
+	return nil
+}
+
+func (model *ItemModel) setTags(tags []string) error {
+	db := common.GetDB()
+	var tagList []TagModel
+	for _, tag := range tags {
+		var tagModel TagModel
+		err := db.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error
+		if err != nil {
+			return err
+		}
+		tagList = append(tagList, tagModel)
+	}
+	model.Tags = tagList
+	return nil
+}
+
+func (model *ItemModel) Update(data interface{}) error {
+	db := common.GetDB()
+	err := db.Model(model).Update(data).Error
+	return err
+}
+
+func DeleteItemModel(condition interface{}) error {
+	db := common.GetDB()
+	var models []ItemModel
+	tx := db.Begin()
+	tx.Where(condition).Find(&models)
+	if err := tx.Where(condition).Delete(ItemModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	var ids []uint
+	for _, model := range models {
+		ids = append(ids, model.ID)
+		if err := addToCounter(tx, &ItemUserModel{}, "items_count", -1, "id = ?", model.SellerID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if len(ids) != 0 {
+		if err := recountTags(tx, itemTagIDs(ids)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	for i := range models {
+		models[i].AfterDelete(db)
+	}
+	return nil
+}
+
+func DeleteCommentModel(condition interface{}) error {
+	db := common.GetDB()
+	var comments []CommentModel
+	tx := db.Begin()
+	tx.Where(condition).Find(&comments)
+	if err := tx.Where(condition).Delete(CommentModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, comment := range comments {
+		if err := addToCounter(tx, &ItemModel{}, "comments_count", -1, "id = ?", comment.ItemID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+const tagItemsCountSQL = "(SELECT count(*) FROM item_tags JOIN item_models ON item_models.id = item_tags.item_model_id" +
+	" AND item_models.deleted_at IS NULL WHERE item_tags.tag_model_id = tag_models.id)"
+
+func recountTags(tx *gorm.DB, tagIDs interface{}) error {
+	return tx.Model(&TagModel{}).Where("id IN (?)", tagIDs).UpdateColumn("items_count", gorm.Expr(tagItemsCountSQL)).Error
+}
+
+// Recompute every counter column of the package from the rows it counts,
+// repairing any drift (see the recount command).
+func Recount() error {
+	db := common.GetDB()
+	tx := db.Begin()
+	updates := []struct {
+		model  interface{}
+		column string
+		count  string
+	}{
+		{&ItemModel{}, "favorites_count", "(SELECT count(*) FROM favorite_models WHERE favorite_models.favorite_id = item_models.id" +
+			" AND favorite_models.deleted_at IS NULL)"},
+		{&ItemModel{}, "comments_count", "(SELECT count(*) FROM comment_models WHERE comment_models.item_id = item_models.id" +
+			" AND comment_models.deleted_at IS NULL)"},
+		{&ItemUserModel{}, "items_count", "(SELECT count(*) FROM item_models WHERE item_models.seller_id = item_user_models.id" +
+			" AND item_models.deleted_at IS NULL)"},
+		{&TagModel{}, "items_count", tagItemsCountSQL},
+	}
+	for _, update := range updates {
+		if err := tx.Unscoped().Model(update.model).UpdateColumn(update.column, gorm.Expr(update.count)).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (revision *ItemRevisionModel) BeforeUpdate() error {
+	return ErrRevisionImmutable
+}
+
+func (revision ItemRevisionModel) TagList() []string {
+	if revision.Tags == "" {
+		return []string{}
+	}
+	return strings.Split(revision.Tags, ",")
+}
+
+// The revision holding the current title, description, body and tags of the
+// item, whose Tags must be loaded.
+func (model ItemModel) revision() ItemRevisionModel {
+	var tags []string
+	for _, tag := range model.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	return ItemRevisionModel{
+		ItemID:      model.ID,
+		Title:       model.Title,
+		Description: model.Description,
+		Body:        model.Body,
+		BodyHTML:    common.RenderMarkdown(model.Body),
+		Tags:        strings.Join(tags, ","),
+	}
+}
+
+// The names of the fields that differ between the two revisions, by their JSON
+// names.
+func (revision ItemRevisionModel) changedFields(other ItemRevisionModel) []string {
+	var fields []string
+	if revision.Title != other.Title {
+		fields = append(fields, "title")
+	}
+	if revision.Description != other.Description {
+		fields = append(fields, "description")
+	}
+	if revision.Body != other.Body {
+		fields = append(fields, "body")
+	}
+	if revision.Tags != other.Tags {
+		fields = append(fields, "tagList")
+	}
+	return fields
+}
+
+// Update the item with data like Update, replacing its tags with data.Tags, and
+// store the change as a new revision by editor. Items updated for the first time
+// get a first revision of how they were before. A new title gives the item a new
+// slug, the old one being kept in its slug history. Price and Quantity are set
+// even when zero; a Quantity below the units reserved is ErrQuantityBelowReserved.
+func (model *ItemModel) Revise(editor ItemUserModel, data ItemModel) error {
+	db := common.GetDB()
+	before := model.revision()
+	after := data.revision()
+	var oldTagIDs []uint
+	for _, tag := range model.Tags {
+		oldTagIDs = append(oldTagIDs, tag.ID)
+	}
+
+	tx := db.Begin()
+	var number int
+	tx.Model(&ItemRevisionModel{}).Where("item_id = ?", model.ID).Count(&number)
+	if number == 0 {
+		number++
+		before.Number = number
+		before.EditorID = model.SellerID
+		if err := tx.Create(&before).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var err error
+	data.Slug = model.Slug
+	if after.Title != before.Title {
+		data.Slug, err = uniqueSlug(tx, data.Title, model.ID)
+	}
+	if err == nil && data.Slug != model.Slug {
+		err = tx.Create(&ItemSlugModel{Slug: model.Slug, ItemID: model.ID}).Error
+		if err == nil {
+			// The item is getting one of its old slugs back.
+			err = tx.Unscoped().Where("slug = ? AND item_id = ?", data.Slug, model.ID).Delete(&ItemSlugModel{}).Error
+		}
+	}
+	// Update skips blank fields while the text fields may be cleared and price and
+	// quantity set to zero on purpose.
+	if err == nil {
+		err = tx.Model(model).Update(data).Error
+	}
+	if err == nil {
+		// The reserved units are checked in the same statement as they may change
+		// concurrently.
+		result := tx.Model(model).Where("reserved <= ?", data.Quantity).Updates(map[string]interface{}{
+			"title": data.Title, "description": data.Description, "body": data.Body, "body_html": after.BodyHTML,
+			"price": data.Price, "quantity": data.Quantity,
+		})
+		err = result.Error
+		if err == nil && result.RowsAffected == 0 {
+			err = ErrQuantityBelowReserved
+		}
+	}
+	if err == nil {
+		err = tx.Model(model).Association("Tags").Replace(data.Tags).Error
+	}
+	if err == nil {
+		// The tags kept or added are recounted by the update's AfterSave.
+		err = recountTags(tx, append(oldTagIDs, 0))
+	}
+	if fields := before.changedFields(after); err == nil && len(fields) != 0 {
+		after.ItemID = model.ID
+		after.Number = number + 1
+		after.EditorID = editor.ID
+		after.Fields = strings.Join(fields, ",")
+		err = tx.Create(&after).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// The revisions of the item, latest first, with their editors.
+func (model ItemModel) Revisions() ([]ItemRevisionModel, error) {
+	db := common.GetDB()
+	var revisions []ItemRevisionModel
+	err := db.Where("item_id = ?", model.ID).Preload("Editor").Preload("Editor.UserModel").
+		Order("number desc").Find(&revisions).Error
+	return revisions, err
+}
+
+func (model ItemModel) findRevision(number int) (ItemRevisionModel, error) {
+	db := common.GetDB()
+	var revision ItemRevisionModel
+	if number <= 0 {
+		return revision, ErrRevisionNotFound
+	}
+	err := db.Where("item_id = ? AND number = ?", model.ID, number).First(&revision).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = ErrRevisionNotFound
+	}
+	return revision, err
+}
+
+// One field changed between two revisions. Tag changes list the tags added and
+// removed rather than the whole lists.
+type ItemFieldChange struct {
+	Field   string
+	From    string
+	To      string
+	Added   []string
+	Removed []string
+}
+
+// The changes from revision from to revision to of the item. From 0 compares
+// against an empty item.
+func (model ItemModel) DiffRevisions(from, to int) ([]ItemFieldChange, error) {
+	var older ItemRevisionModel
+	var err error
+	if from != 0 {
+		if older, err = model.findRevision(from); err != nil {
+			return nil, err
+		}
+	}
+	newer, err := model.findRevision(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := []ItemFieldChange{}
+	for _, field := range older.changedFields(newer) {
+		switch field {
+		case "title":
+			changes = append(changes, ItemFieldChange{Field: field, From: older.Title, To: newer.Title})
+		case "description":
+			changes = append(changes, ItemFieldChange{Field: field, From: older.Description, To: newer.Description})
+		case "body":
+			changes = append(changes, ItemFieldChange{Field: field, From: older.Body, To: newer.Body})
+		case "tagList":
+			change := ItemFieldChange{Field: field, From: older.Tags, To: newer.Tags, Added: []string{}, Removed: []string{}}
+			had := map[string]bool{}
+			for _, tag := range older.TagList() {
+				had[tag] = true
+			}
+			has := map[string]bool{}
+			for _, tag := range newer.TagList() {
+				has[tag] = true
+				if !had[tag] {
+					change.Added = append(change.Added, tag)
+				}
+			}
+			for _, tag := range older.TagList() {
+				if !has[tag] {
+					change.Removed = append(change.Removed, tag)
+				}
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// Bring the title, description, body and tags of the item back to those of one
+// of its revisions. This is itself an update by editor, stored as a new revision.
+func (model *ItemModel) RestoreRevision(editor ItemUserModel, number int) error {
+	revision, err := model.findRevision(number)
+	if err != nil {
+		return err
+	}
+	data := ItemModel{
+		Title:       revision.Title,
+		Description: revision.Description,
+		Body:        revision.Body,
+		Price:       model.Price,
+		Currency:    model.Currency,
+		Quantity:    model.Quantity,
+	}
+	if err := data.setTags(revision.TagList()); err != nil {
+		return err
+	}
+	return model.Revise(editor, data)
+}
+
+// Words routed under /items/ by ItemRetrieve, which an item with that slug could
+// never be reached at.
+var reservedSlugs = map[string]bool{"feed": true, "search": true, "export": true, "import": true, "imports": true}
+
+// A slug for title that no other item has, nor had: the slug of the title itself
+// or else the first free one of it with a -2, -3... suffix. Deleted items keep
+// their slugs too, and reservedSlugs are never used.
+func uniqueSlug(tx *gorm.DB, title string, itemID uint) (string, error) {
+	base := slug.Make(title)
+	if base == "" {
+		base = "item"
+	}
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%v-%v", base, n)
+		}
+		if reservedSlugs[candidate] {
+			continue
+		}
+		var items, slugs int
+		if err := tx.Unscoped().Model(&ItemModel{}).Where("slug = ? AND id <> ?", candidate, itemID).Count(&items).Error; err != nil {
+			return "", err
+		}
+		if err := tx.Unscoped().Model(&ItemSlugModel{}).Where("slug = ? AND item_id <> ?", candidate, itemID).Count(&slugs).Error; err != nil {
+			return "", err
+		}
+		if items+slugs == 0 {
+			return candidate, nil
+		}
+	}
+}
+
+// The current slug of the item that used to be at oldSlug.
+func FindItemSlug(oldSlug string) (string, error) {
+	db := common.GetDB()
+	var item ItemModel
+	err := db.Joins("JOIN item_slug_models ON item_slug_models.item_id = item_models.id").
+		Where("item_slug_models.slug = ?", oldSlug).First(&item).Error
+	return item.Slug, err
+}
+
+// How long deleted items and comments stay in the trash, where their authors can
+// still restore them, before PurgeTrash removes them for good.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+var ErrNotInTrash = errors.New("not in the trash")
+var ErrItemInTrash = errors.New("the item of the comment is in the trash, restore it first")
+
+// The items and comments user deleted and can still restore, most recently
+// deleted first.
+func GetTrash(user ItemUserModel) ([]ItemModel, []CommentModel, error) {
+	db := common.GetDB()
+	var models []ItemModel
+	var comments []CommentModel
+	err := db.Unscoped().Where("seller_id = ? AND deleted_at IS NOT NULL", user.ID).Order("deleted_at desc, id desc").Find(&models).Error
+	if err != nil {
+		return models, comments, err
+	}
+	loadItemRelations(db, models)
+	err = db.Unscoped().Where("seller_id = ? AND deleted_at IS NOT NULL", user.ID).Order("deleted_at desc, id desc").Find(&comments).Error
+	for i := range comments {
+		comments[i].Seller = user
+		db.Unscoped().First(&comments[i].Item, comments[i].ItemID)
+	}
+	return models, comments, err
+}
+
+// Take the item with the given slug out of the trash of user, counting and
+// indexing it again.
+func RestoreItem(user ItemUserModel, slug string) (ItemModel, error) {
+	db := common.GetDB()
+	var model ItemModel
+	tx := db.Begin()
+	err := tx.Unscoped().Where("slug = ? AND seller_id = ? AND deleted_at IS NOT NULL", slug, user.ID).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = ErrNotInTrash
+	}
+	if err == nil {
+		err = tx.Unscoped().Model(&model).UpdateColumn("deleted_at", nil).Error
+	}
+	if err == nil {
+		err = addToCounter(tx, &ItemUserModel{}, "items_count", 1, "id = ?", model.SellerID)
+	}
+	if err == nil {
+		err = recountTags(tx, itemTagIDs(model.ID))
+	}
+	if err == nil {
+		err = indexItem(tx, model.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return model, err
+	}
+	return model, tx.Commit().Error
+}
+
+// Take the comment out of the trash of user. Comments of items still in the
+// trash give ErrItemInTrash.
+func RestoreComment(user ItemUserModel, id uint) (CommentModel, error) {
+	db := common.GetDB()
+	var comment CommentModel
+	tx := db.Begin()
+	err := tx.Unscoped().Where("id = ? AND seller_id = ? AND deleted_at IS NOT NULL", id, user.ID).First(&comment).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = ErrNotInTrash
+	}
+	if err == nil && tx.First(&comment.Item, comment.ItemID).RecordNotFound() {
+		err = ErrItemInTrash
+	}
+	if err == nil {
+		err = tx.Unscoped().Model(&comment).UpdateColumn("deleted_at", nil).Error
+	}
+	if err == nil {
+		err = addToCounter(tx, &ItemModel{}, "comments_count", 1, "id = ?", comment.ItemID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return comment, err
+	}
+	comment.Seller = user
+	return comment, tx.Commit().Error
+}
+
+// Delete the items for good, with the rows that only exist for them. Orders,
+// auctions and reservations are history and keep pointing at the items.
+func purgeItems(tx *gorm.DB, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		if err := unindexItem(tx, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Exec("DELETE FROM item_tags WHERE item_model_id IN (?)", ids).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("favorite_id IN (?)", ids).Delete(&FavoriteModel{}).Error; err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&CommentModel{}, &ItemImageModel{}, &ItemAttributeModel{}, &ItemVariantModel{},
+		&ItemRevisionModel{}, &ItemSlugModel{}, &ItemSeenModel{}, &ItemViewModel{}, &ItemViewDailyModel{},
+		&ItemViewDailyViewerModel{}, &ItemRelatedModel{}} {
+		if err := tx.Unscoped().Where("item_id IN (?)", ids).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Unscoped().Where("id IN (?)", ids).Delete(&ItemModel{}).Error
+}
+
+// Delete for good the items and comments that went to the trash before the given
+// time, returning how many there were.
+func PurgeTrash(before time.Time) (int, error) {
+	db := common.GetDB()
+	var ids []uint
+	tx := db.Begin()
+	err := tx.Unscoped().Model(&ItemModel{}).Where("deleted_at < ?", before.UTC()).Pluck("id", &ids).Error
+	if err == nil {
+		err = purgeItems(tx, ids)
+	}
+	var comments int64
+	if err == nil {
+		result := tx.Unscoped().Where("deleted_at < ?", before.UTC()).Delete(&CommentModel{})
+		err, comments = result.Error, result.RowsAffected
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(ids) + int(comments), tx.Commit().Error
+}
+
+// Delete the item with the given slug for good, whether or not it is in the trash.
+func PurgeItem(slug string) error {
+	if err := DeleteItemModel(&ItemModel{Slug: slug}); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	var ids []uint
+	tx := db.Begin()
+	err := tx.Unscoped().Model(&ItemModel{}).Where("slug = ?", slug).Pluck("id", &ids).Error
+	if err == nil && len(ids) == 0 {
+		err = gorm.ErrRecordNotFound
+	}
+	if err == nil {
+		err = purgeItems(tx, ids)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Delete the comment for good, whether or not it is in the trash.
+func PurgeComment(id uint) error {
+	if err := DeleteCommentModel([]uint{id}); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	result := db.Unscoped().Where("id = ?", id).Delete(&CommentModel{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// Whether buyer can buy the item: it is published, and available or reserved for
+// them.
+func (model ItemModel) AvailableTo(buyer ItemUserModel) bool {
+	if model.Status != ItemPublished {
+		return false
+	}
+	switch model.Availability {
+	case ListingAvailable, "":
+		return true
+	case ListingReserved:
+		return buyer.ID != 0 && buyer.ID == model.ReservedForID
+	}
+	return false
+}
+
+// Mark the listing available, reserved for buyer or sold, to buyer if known (the
+// zero ItemUserModel otherwise). Expired listings made available again are
+// renewed.
+func (model *ItemModel) SetAvailability(availability string, buyer ItemUserModel, now time.Time) error {
+	updates := map[string]interface{}{"availability": availability, "reserved_for_id": buyer.ID, "sold_at": nil}
+	switch availability {
+	case ListingAvailable:
+		updates["reserved_for_id"] = 0
+		if model.Availability == ListingExpired || (model.ExpiresAt != nil && !model.ExpiresAt.After(now)) {
+			updates["expires_at"] = now.Add(ListingPeriod).UTC()
+		}
+	case ListingReserved:
+		if buyer.ID == 0 {
+			return ErrBuyerRequired
+		}
+	case ListingSold:
+		updates["sold_at"] = now.UTC()
+	default:
+		return ErrInvalidAvailability
+	}
+	db := common.GetDB()
+	return db.Model(model).UpdateColumns(updates).Error
+}
+
+// Start a new listing period for the item, bringing it back if it expired.
+func (model *ItemModel) Renew(now time.Time) error {
+	if model.Availability == ListingSold {
+		return ErrItemSold
+	}
+	updates := map[string]interface{}{"expires_at": now.Add(ListingPeriod).UTC()}
+	if model.Availability == ListingExpired {
+		updates["availability"] = ListingAvailable
+	}
+	db := common.GetDB()
+	return db.Model(model).UpdateColumns(updates).Error
+}
+
+// Expire the published, available listings whose ExpiresAt has passed, returning
+// how many did.
+func ExpireListings(now time.Time) (int, error) {
+	db := common.GetDB()
+	result := db.Model(&ItemModel{}).Where("status = ? AND availability = ? AND expires_at <= ?", ItemPublished, ListingAvailable, now.UTC()).
+		UpdateColumn("availability", ListingExpired)
+	return int(result.RowsAffected), result.Error
 }
@@ -0,0 +1,164 @@
+package items
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/jinzhu/gorm"
+)
+
+// An item related to another, precomputed by ComputeRelatedItems so reading
+// them is a single lookup. Position orders the related items of an item, the
+// best first.
+type ItemRelatedModel struct {
+	gorm.Model
+	ItemID    uint `gorm:"index"`
+	RelatedID uint
+	Position  int
+	Score     float64
+}
+
+// How many related items are kept for each item.
+const RelatedLimit = 12
+
+// What relates two items: each tag they share, each user who favorited both,
+// and having the same seller.
+var (
+	RelatedTagWeight      = 1.0
+	RelatedFavoriteWeight = 2.0
+	RelatedSellerWeight   = 0.5
+)
+
+// The items that can be shown as related: published and still for sale.
+func relatableItems(db *gorm.DB) *gorm.DB {
+	return db.Where("item_models.deleted_at IS NULL AND item_models.status = ? AND item_models.availability NOT IN (?)",
+		ItemPublished, []string{ListingSold, ListingExpired})
+}
+
+// Score every relatable item against the others and store the best
+// RelatedLimit of each, replacing the previous ones. Items sharing no tag nor
+// fan are filled in with other items of their seller, newest first. Returns how
+// many related items were stored. Meant to be run periodically, see
+// common.Every.
+func ComputeRelatedItems() (int, error) {
+	db := common.GetDB()
+	var models []ItemModel
+	if err := relatableItems(db.Select("id, seller_id")).Order("id desc").Find(&models).Error; err != nil {
+		return 0, err
+	}
+	sellerOf := map[uint]uint{}
+	bySeller := map[uint][]uint{}
+	for _, model := range models {
+		sellerOf[model.ID] = model.SellerID
+		bySeller[model.SellerID] = append(bySeller[model.SellerID], model.ID)
+	}
+
+	scores := map[uint]map[uint]float64{}
+	add := func(itemID, relatedID uint, score float64) {
+		if _, ok := sellerOf[itemID]; !ok {
+			return
+		}
+		if _, ok := sellerOf[relatedID]; !ok {
+			return
+		}
+		if scores[itemID] == nil {
+			scores[itemID] = map[uint]float64{}
+		}
+		scores[itemID][relatedID] += score
+	}
+	var pairs []struct {
+		ItemID    uint
+		RelatedID uint
+		Count     int
+	}
+	err := db.Raw("SELECT a.item_model_id AS item_id, b.item_model_id AS related_id, count(*) AS count FROM item_tags a " +
+		"JOIN item_tags b ON b.tag_model_id = a.tag_model_id AND b.item_model_id <> a.item_model_id " +
+		"GROUP BY a.item_model_id, b.item_model_id").Scan(&pairs).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, pair := range pairs {
+		add(pair.ItemID, pair.RelatedID, RelatedTagWeight*float64(pair.Count))
+	}
+	pairs = nil
+	err = db.Raw("SELECT a.favorite_id AS item_id, b.favorite_id AS related_id, count(*) AS count FROM favorite_models a " +
+		"JOIN favorite_models b ON b.favorite_by_id = a.favorite_by_id AND b.favorite_id <> a.favorite_id AND b.deleted_at IS NULL " +
+		"WHERE a.deleted_at IS NULL GROUP BY a.favorite_id, b.favorite_id").Scan(&pairs).Error
+	if err != nil {
+		return 0, err
+	}
+	for _, pair := range pairs {
+		add(pair.ItemID, pair.RelatedID, RelatedFavoriteWeight*float64(pair.Count))
+	}
+
+	var rows []ItemRelatedModel
+	for _, model := range models {
+		related := scores[model.ID]
+		if related == nil {
+			related = map[uint]float64{}
+		}
+		for relatedID := range related {
+			if sellerOf[relatedID] == model.SellerID {
+				related[relatedID] += RelatedSellerWeight
+			}
+		}
+		// bySeller lists the newest first.
+		for _, relatedID := range bySeller[model.SellerID] {
+			if len(related) >= RelatedLimit {
+				break
+			}
+			if _, ok := related[relatedID]; !ok && relatedID != model.ID {
+				related[relatedID] = RelatedSellerWeight
+			}
+		}
+		var ids []uint
+		for relatedID := range related {
+			ids = append(ids, relatedID)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if related[ids[i]] != related[ids[j]] {
+				return related[ids[i]] > related[ids[j]]
+			}
+			return ids[i] > ids[j]
+		})
+		if len(ids) > RelatedLimit {
+			ids = ids[:RelatedLimit]
+		}
+		for i, relatedID := range ids {
+			rows = append(rows, ItemRelatedModel{ItemID: model.ID, RelatedID: relatedID, Position: i, Score: related[relatedID]})
+		}
+	}
+
+	tx := db.Begin()
+	if err := tx.Unscoped().Delete(&ItemRelatedModel{}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for i := range rows {
+		if err := tx.Create(&rows[i]).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(rows), tx.Commit().Error
+}
+
+// The related items of the item, best first, as last computed by
+// ComputeRelatedItems; those no longer for sale since are left out.
+func (model ItemModel) RelatedItems(limit string) ([]ItemModel, error) {
+	db := common.GetDB()
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil || limitInt <= 0 || limitInt > RelatedLimit {
+		limitInt = RelatedLimit
+	}
+	var models []ItemModel
+	err = relatableItems(db).Joins("JOIN item_related_models ON item_related_models.related_id = item_models.id AND item_related_models.deleted_at IS NULL").
+		Where("item_related_models.item_id = ?", model.ID).Order("item_related_models.position asc").
+		Limit(limitInt).Find(&models).Error
+	if err != nil {
+		return models, err
+	}
+	loadItemRelations(db, models)
+	return models, nil
+}
@@ -2,11 +2,16 @@ package items
 
 import (
 	"errors"
+	"fmt"
 	"github.com/NivRichter/GoLang-test1/common"
 	"github.com/NivRichter/GoLang-test1/users"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func ItemsRegister(router *gin.RouterGroup) {
@@ -17,22 +22,111 @@ func ItemsRegister(router *gin.RouterGroup) {
 	router.DELETE("/:slug/favorite", ItemUnfavorite)
 	router.POST("/:slug/comments", ItemCommentCreate)
 	router.DELETE("/:slug/comments/:id", ItemCommentDelete)
+	router.POST("/:slug/reserve", ItemReserve)
+	router.DELETE("/:slug/reserve", ItemReleaseReservation)
+	router.POST("/:slug/auction", ItemAuctionCreate)
+	router.POST("/:slug/bids", ItemBid)
+	router.POST("/:slug/images", ItemImageCreate)
+	router.PUT("/:slug/images", ItemImageReorder)
+	router.DELETE("/:slug/images/:id", ItemImageDelete)
+	router.POST("/:slug/variants", ItemVariantCreate)
+	router.PUT("/:slug/variants/:id", ItemVariantUpdate)
+	router.DELETE("/:slug/variants/:id", ItemVariantDelete)
+	router.POST("/:slug/revisions/:number/restore", ItemRevisionRestore)
+	router.PUT("/:slug/availability", ItemAvailability)
+	router.POST("/:slug/renew", ItemRenew)
+	router.POST("/import", ItemImport)
+	router.GET("/imports/:id/report", ItemImportReport)
 }
 
 func ItemsAnonymousRegister(router *gin.RouterGroup) {
 	router.GET("/", ItemList)
 	router.GET("/:slug", ItemRetrieve)
 	router.GET("/:slug/comments", ItemCommentList)
+	router.GET("/:slug/related", ItemRelatedList)
+	router.GET("/:slug/revisions", ItemRevisionList)
+	router.GET("/:slug/revisions/:number/diff", ItemRevisionDiff)
 }
 
 func TagsAnonymousRegister(router *gin.RouterGroup) {
 	router.GET("/", TagList)
 }
 
+func TagsRegister(router *gin.RouterGroup) {
+	router.POST("/:tag/follow", TagFollow)
+	router.DELETE("/:tag/follow", TagUnfollow)
+}
+
+func TrashRegister(router *gin.RouterGroup) {
+	router.GET("/", TrashList)
+	router.POST("/items/:slug/restore", TrashItemRestore)
+	router.POST("/comments/:id/restore", TrashCommentRestore)
+}
+
+func AnalyticsRegister(router *gin.RouterGroup) {
+	router.GET("/", SellerAnalytics)
+}
+
+func TrashAdminRegister(router *gin.RouterGroup) {
+	router.DELETE("/items/:slug", ItemPurge)
+	router.DELETE("/comments/:id", CommentPurge)
+}
+
+func CategoriesAnonymousRegister(router *gin.RouterGroup) {
+	router.GET("/", CategoryList)
+}
+
+// Routes changing the category tree, to be used behind users.AdminMiddleware.
+func CategoriesAdminRegister(router *gin.RouterGroup) {
+	router.POST("/", CategoryCreate)
+	router.PUT("/:slug", CategoryUpdate)
+	router.DELETE("/:slug", CategoryDelete)
+	router.POST("/:slug/attributes", CategoryAttributeCreate)
+	router.DELETE("/:slug/attributes/:name", CategoryAttributeDelete)
+}
+
+// Category and attribute errors are not validator errors, they are reported under
+// their own key.
+func renderItemBindError(c *gin.Context, err error) {
+	if field := bindErrorField(err); field != "" {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError(field, err))
+		return
+	}
+	c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+}
+
+// The item field an error of ItemModelValidator.Bind is about, "" for the
+// errors of the validator itself.
+func bindErrorField(err error) string {
+	switch err.(type) {
+	case AttributeError:
+		return "attributes"
+	}
+	switch err {
+	case ErrCategoryNotFound, ErrCategoryNotLeaf:
+		return "category"
+	case ErrInvalidStatus:
+		return "status"
+	case ErrInvalidPublishAt:
+		return "publishAt"
+	}
+	return ""
+}
+
+// The item with the given slug, if the user of c may see it; see
+// ItemModel.VisibleTo.
+func findVisibleItem(c *gin.Context, slug string) (ItemModel, error) {
+	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	if err == nil && !itemModel.VisibleTo(c.MustGet("my_user_model").(users.UserModel)) {
+		err = gorm.ErrRecordNotFound
+	}
+	return itemModel, err
+}
+
 func ItemCreate(c *gin.Context) {
 	itemModelValidator := NewItemModelValidator()
 	if err := itemModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		renderItemBindError(c, err)
 		return
 	}
 	//fmt.Println(itemModelValidator.itemModel.Seller.UserModel)
@@ -41,26 +135,106 @@ func ItemCreate(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	if err := itemModelValidator.itemModel.setAttributes(itemModelValidator.attributes); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
 	serializer := ItemSerializer{c, itemModelValidator.itemModel}
 	c.JSON(http.StatusCreated, gin.H{"item": serializer.Response()})
 }
 
+// Tags are given as ?tag=a&tag=b or ?tag=a,b; every filter combines with the
+// others, see ItemFilter.
 func ItemList(c *gin.Context) {
 	//condition := ItemModel{}
-	tag := c.Query("tag")
+	var tags []string
+	for _, tag := range c.QueryArray("tag") {
+		tags = append(tags, strings.Split(tag, ",")...)
+	}
 	seller := c.Query("seller")
 	favorited := c.Query("favorited")
 	limit := c.Query("limit")
 	offset := c.Query("offset")
-	itemModels, modelCount, err := FindManyItem(tag, seller, limit, offset, favorited)
+	filter := ItemFilter{
+		Tags:          tags,
+		TagMode:       c.Query("tagMode"),
+		MinPrice:      c.Query("minPrice"),
+		MaxPrice:      c.Query("maxPrice"),
+		Currency:      c.Query("currency"),
+		Category:      c.Query("category"),
+		CreatedAfter:  c.Query("createdAfter"),
+		CreatedBefore: c.Query("createdBefore"),
+		Sort:          c.Query("sort"),
+		Attributes:    c.QueryMap("attr"),
+	}
+	// Sellers also see their drafts, scheduled and archived items.
+	if myUserModel := c.MustGet("my_user_model").(users.UserModel); seller != "" && seller == myUserModel.Username {
+		filter.Unpublished = true
+	}
+	for _, status := range c.QueryArray("status") {
+		filter.Availability = append(filter.Availability, strings.Split(status, ",")...)
+	}
+	for _, availability := range filter.Availability {
+		switch availability {
+		case ListingAvailable, ListingReserved, ListingSold, ListingExpired:
+		default:
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("status", errors.New("Invalid status")))
+			return
+		}
+	}
+	if _, ok := ItemSortOrders[filter.Sort]; filter.Sort != "" && !ok {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("sort", errors.New("Invalid sort order")))
+		return
+	}
+	if filter.Currency != "" && !common.IsCurrency(filter.Currency) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("currency", common.ErrInvalidCurrency))
+		return
+	}
+	// Amounts in minor units of different currencies do not compare.
+	priced := filter.MinPrice != "" || filter.MaxPrice != "" || filter.Sort == "price" || filter.Sort == "-price"
+	if priced && filter.Currency == "" {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("currency", errors.New("Price filters and sorts need a currency")))
+		return
+	}
+	// Offsets are still served as before; without one the list is read with a
+	// cursor so next/prev can be handed out.
+	if offset != "" {
+		itemModels, modelCount, err := FindManyItem("", seller, limit, offset, favorited, filter)
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid param")))
+			return
+		}
+		serializer := ItemsSerializer{c, itemModels}
+		c.JSON(http.StatusOK, gin.H{"items": serializer.Response(), "itemsCount": modelCount})
+		return
+	}
+	filter.Seller = seller
+	filter.Favorited = favorited
+	page, err := FindItemPage(filter, limit, c.Query("cursor"))
+	renderItemPage(c, page, err)
+}
+
+func renderItemPage(c *gin.Context, page ItemPage, err error) {
+	if err == common.ErrInvalidCursor {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("cursor", err))
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid param")))
 		return
 	}
-	serializer := ItemsSerializer{c, itemModels}
-	c.JSON(http.StatusOK, gin.H{"items": serializer.Response(), "itemsCount": modelCount})
+	serializer := ItemsSerializer{c, page.Items}
+	c.JSON(http.StatusOK, gin.H{
+		"items":      serializer.Response(),
+		"itemsCount": page.Count,
+		"next":       common.CursorResponse(page.Next),
+		"prev":       common.CursorResponse(page.Prev),
+	})
 }
 
+// The feed lists the items of followed sellers, newest first, or with
+// ?mode=ranked a blend of followed sellers, followed tags and trending items, see
+// GetRankedFeed.
 func ItemFeed(c *gin.Context) {
 	limit := c.Query("limit")
 	offset := c.Query("offset")
@@ -70,6 +244,26 @@ func ItemFeed(c *gin.Context) {
 		return
 	}
 	itemUserModel := GetItemUserModel(myUserModel)
+	switch c.Query("mode") {
+	case "", "latest":
+	case "ranked":
+		itemModels, modelCount, err := itemUserModel.GetRankedFeed(limit, offset)
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid param")))
+			return
+		}
+		serializer := ItemsSerializer{c, itemModels}
+		c.JSON(http.StatusOK, gin.H{"items": serializer.Response(), "itemsCount": modelCount})
+		return
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("mode", errors.New("Invalid feed mode")))
+		return
+	}
+	if offset == "" {
+		page, err := itemUserModel.GetItemFeedPage(limit, c.Query("cursor"))
+		renderItemPage(c, page, err)
+		return
+	}
 	itemModels, modelCount, err := itemUserModel.GetItemFeed(limit, offset)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid param")))
@@ -79,36 +273,87 @@ func ItemFeed(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"items": serializer.Response(), "itemsCount": modelCount})
 }
 
+func ItemSearch(c *gin.Context) {
+	q := c.Query("q")
+	limit := c.Query("limit")
+	offset := c.Query("offset")
+	results, modelCount, err := SearchItems(q, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid param")))
+		return
+	}
+	serializer := ItemSearchSerializer{c, results}
+	c.JSON(http.StatusOK, gin.H{"items": serializer.Response(), "itemsCount": modelCount})
+}
+
 func ItemRetrieve(c *gin.Context) {
 	slug := c.Param("slug")
 	if slug == "feed" {
 		ItemFeed(c)
 		return
 	}
-	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	if slug == "search" {
+		ItemSearch(c)
+		return
+	}
+	if slug == "export" {
+		ItemExport(c)
+		return
+	}
+	itemModel, err := findVisibleItem(c, slug)
 	if err != nil {
+		// Links made before the item's title changed lead to where it is now.
+		if current, err := FindItemSlug(slug); err == nil {
+			location := strings.TrimSuffix(c.Request.URL.Path, slug) + current
+			if c.Request.URL.RawQuery != "" {
+				location += "?" + c.Request.URL.RawQuery
+			}
+			c.Redirect(http.StatusMovedPermanently, location)
+			return
+		}
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
 		return
 	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if myUserModel.ID != 0 {
+		if err := GetItemUserModel(myUserModel).markSeen(itemModel); err != nil {
+			fmt.Println("feed err: (markSeen) ", err)
+		}
+	}
+	// Sellers looking at their own items are no audience.
+	if userAgent := c.Request.UserAgent(); !IsBot(userAgent) && itemModel.Seller.UserModelID != myUserModel.ID {
+		if _, err := RecordView(itemModel, viewerKey(myUserModel.ID, c.ClientIP(), userAgent), time.Now()); err != nil {
+			fmt.Println("analytics err: (RecordView) ", err)
+		}
+	}
 	serializer := ItemSerializer{c, itemModel}
 	c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
 }
 
 func ItemUpdate(c *gin.Context) {
-	slug := c.Param("slug")
-	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	itemModel, err := findMyItem(c)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
 		return
 	}
 	itemModelValidator := NewItemModelValidatorFillWith(itemModel)
 	if err := itemModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		renderItemBindError(c, err)
 		return
 	}
 
 	itemModelValidator.itemModel.ID = itemModel.ID
-	if err := itemModel.Update(itemModelValidator.itemModel); err != nil {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	err = itemModel.Revise(GetItemUserModel(myUserModel), itemModelValidator.itemModel)
+	if err == ErrQuantityBelowReserved {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("quantity", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if err := itemModel.setAttributes(itemModelValidator.attributes); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -117,8 +362,12 @@ func ItemUpdate(c *gin.Context) {
 }
 
 func ItemDelete(c *gin.Context) {
-	slug := c.Param("slug")
-	err := DeleteItemModel(&ItemModel{Slug: slug})
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	err = DeleteItemModel(&ItemModel{Model: gorm.Model{ID: itemModel.ID}})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
 		return
@@ -128,33 +377,437 @@ func ItemDelete(c *gin.Context) {
 
 func ItemFavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	itemModel, err := findVisibleItem(c, slug)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 	err = itemModel.favoriteBy(GetItemUserModel(myUserModel))
+	itemModel, _ = FindOneItem(&ItemModel{Slug: slug})
 	serializer := ItemSerializer{c, itemModel}
 	c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
 }
 
 func ItemUnfavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	itemModel, err := findVisibleItem(c, slug)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 	err = itemModel.unFavoriteBy(GetItemUserModel(myUserModel))
+	itemModel, _ = FindOneItem(&ItemModel{Slug: slug})
 	serializer := ItemSerializer{c, itemModel}
 	c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
 }
 
-func ItemCommentCreate(c *gin.Context) {
+func ItemReserve(c *gin.Context) {
+	slug := c.Param("slug")
+	itemModel, err := findVisibleItem(c, slug)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	reservationValidator := NewReservationValidator()
+	if err := reservationValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	buyer := GetItemUserModel(myUserModel)
+	quantity := reservationValidator.Reservation.Quantity
+	var reservation StockReservationModel
+	if variantID := reservationValidator.Reservation.Variant; variantID != 0 {
+		variant, verr := itemModel.FindVariant(variantID)
+		if verr != nil {
+			c.JSON(http.StatusNotFound, common.NewError("variant", verr))
+			return
+		}
+		reservation, err = ReserveVariantStock(variant, buyer, quantity)
+	} else {
+		reservation, err = ReserveStock(itemModel, buyer, quantity)
+	}
+	if err == ErrOutOfStock {
+		c.JSON(http.StatusConflict, common.NewError("stock", err))
+		return
+	}
+	if err == ErrItemUnavailable {
+		c.JSON(http.StatusConflict, common.NewError("item", err))
+		return
+	}
+	if err == ErrVariantRequired {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("variant", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ReservationSerializer{c, reservation}
+	c.JSON(http.StatusCreated, gin.H{"reservation": serializer.Response()})
+}
+
+// Sellers mark their listing available, reserved for a buyer or sold.
+func ItemAvailability(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	availabilityValidator := NewAvailabilityValidator()
+	if err := availabilityValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	var buyer ItemUserModel
+	if username := availabilityValidator.Availability.Buyer; username != "" {
+		userModel, err := users.FindOneUser(&users.UserModel{Username: username})
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("buyer", errors.New("Invalid username")))
+			return
+		}
+		buyer = GetItemUserModel(userModel)
+	}
+	err = itemModel.SetAvailability(availabilityValidator.Availability.Status, buyer, time.Now())
+	switch err {
+	case nil:
+		serializer := ItemSerializer{c, itemModel}
+		c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
+	case ErrInvalidAvailability, ErrBuyerRequired:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("availability", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	}
+}
+
+func ItemRenew(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	err = itemModel.Renew(time.Now())
+	switch err {
+	case nil:
+		serializer := ItemSerializer{c, itemModel}
+		c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
+	case ErrItemSold:
+		c.JSON(http.StatusConflict, common.NewError("availability", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	}
+}
+
+func ItemReleaseReservation(c *gin.Context) {
 	slug := c.Param("slug")
 	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	reservations, err := FindHeldReservations(itemModel, GetItemUserModel(myUserModel))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	for i := range reservations {
+		if err := reservations[i].Release(); err != nil && err != ErrReservationClosed {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"reservation": "Release success"})
+}
+
+// Load the item in the :slug param if the current user is its seller.
+func findMyItem(c *gin.Context) (ItemModel, error) {
+	itemModel, err := FindOneItem(&ItemModel{Slug: c.Param("slug")})
+	if err != nil {
+		return itemModel, err
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if itemModel.ID == 0 || itemModel.SellerID != GetItemUserModel(myUserModel).ID {
+		return itemModel, errors.New("Invalid slug")
+	}
+	return itemModel, nil
+}
+
+func ItemAuctionCreate(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	auctionValidator := NewAuctionValidator()
+	if err := auctionValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	auction := auctionValidator.Auction
+	auctionModel, err := CreateAuction(itemModel, auction.StartPrice, auction.ReservePrice, auction.Increment, auction.EndsAt)
+	if err == ErrAuctionItem || err == ErrVariantRequired {
+		c.JSON(http.StatusConflict, common.NewError("auction", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("auction", err))
+		return
+	}
+	serializer := AuctionSerializer{c, auctionModel}
+	c.JSON(http.StatusCreated, gin.H{"auction": serializer.Response()})
+}
+
+func ItemBid(c *gin.Context) {
+	slug := c.Param("slug")
+	itemModel, err := findVisibleItem(c, slug)
+	if err != nil || itemModel.ID == 0 || itemModel.Status != ItemPublished {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	auctionModel := itemModel.LastAuction()
+	if auctionModel.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("auction", errors.New("Item is not on auction")))
+		return
+	}
+	bidValidator := NewBidValidator()
+	if err := bidValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	bid, err := PlaceBid(&auctionModel, GetItemUserModel(myUserModel), bidValidator.Bid.Amount)
+	switch err {
+	case nil:
+	case ErrBidTooLow, ErrAuctionClosed:
+		c.JSON(http.StatusConflict, common.NewError("bid", err))
+		return
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("bid", err))
+		return
+	}
+	bidSerializer := BidSerializer{c, bid}
+	auctionSerializer := AuctionSerializer{c, auctionModel}
+	c.JSON(http.StatusCreated, gin.H{"bid": bidSerializer.Response(), "auction": auctionSerializer.Response()})
+}
+
+func renderGallery(c *gin.Context, code int, itemModel ItemModel) {
+	images, err := itemModel.Gallery()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ItemImagesSerializer{c, images}
+	c.JSON(code, gin.H{"images": serializer.Response()})
+}
+
+func ItemImageCreate(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	imageValidator := NewItemImageValidator()
+	if err := imageValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	image := imageValidator.Image
+	if _, err := itemModel.AddImage(image.URL, image.AltText, image.Cover); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("image", err))
+		return
+	}
+	renderGallery(c, http.StatusCreated, itemModel)
+}
+
+func ItemImageReorder(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	galleryValidator := NewGalleryValidator()
+	if err := galleryValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if err := itemModel.ReorderImages(galleryValidator.Gallery.Order, galleryValidator.Gallery.Cover); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("gallery", err))
+		return
+	}
+	renderGallery(c, http.StatusOK, itemModel)
+}
+
+func ItemImageDelete(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err == nil {
+		err = itemModel.RemoveImage(uint(id64))
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("image", errors.New("Invalid id")))
+		return
+	}
+	renderGallery(c, http.StatusOK, itemModel)
+}
+
+func renderVariantError(c *gin.Context, err error) {
+	switch err.(type) {
+	case AttributeError:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("attributes", err))
+		return
+	}
+	switch err {
+	case ErrVariantNotFound:
+		c.JSON(http.StatusNotFound, common.NewError("variant", err))
+	case ErrVariantExists, ErrAuctionItem:
+		c.JSON(http.StatusConflict, common.NewError("variant", err))
+	case ErrQuantityBelowReserved:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("quantity", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("variant", err))
+	}
+}
+
+func ItemVariantCreate(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	variantValidator := NewItemVariantValidator()
+	if err := variantValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	variant := variantValidator.Variant
+	variantModel, err := itemModel.AddVariant(variant.Name, variant.Price, variant.Quantity, variant.Attributes)
+	if err != nil {
+		renderVariantError(c, err)
+		return
+	}
+	serializer := ItemVariantSerializer{c, variantModel}
+	c.JSON(http.StatusCreated, gin.H{"variant": serializer.Response()})
+}
+
+func ItemVariantUpdate(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	id64, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	variantModel, err := itemModel.FindVariant(uint(id64))
+	if err != nil {
+		renderVariantError(c, err)
+		return
+	}
+	variantValidator := NewItemVariantValidatorFillWith(variantModel)
+	if err := variantValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	variant := variantValidator.Variant
+	variantModel, err = itemModel.UpdateVariant(variantModel.ID, variant.Name, variant.Price, variant.Quantity, variant.Attributes)
+	if err != nil {
+		renderVariantError(c, err)
+		return
+	}
+	serializer := ItemVariantSerializer{c, variantModel}
+	c.JSON(http.StatusOK, gin.H{"variant": serializer.Response()})
+}
+
+func ItemVariantDelete(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	id64, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err := itemModel.RemoveVariant(uint(id64)); err != nil {
+		renderVariantError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"variant": "Delete success"})
+}
+
+func ItemRevisionList(c *gin.Context) {
+	itemModel, err := findVisibleItem(c, c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	revisions, err := itemModel.Revisions()
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Database error")))
+		return
+	}
+	serializer := ItemRevisionsSerializer{c, revisions}
+	c.JSON(http.StatusOK, gin.H{"revisions": serializer.Response(), "revisionsCount": len(revisions)})
+}
+
+// Compares the revision with the one before it, or with ?from= when given.
+func ItemRevisionDiff(c *gin.Context) {
+	itemModel, err := findVisibleItem(c, c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	to, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", ErrRevisionNotFound))
+		return
+	}
+	from := to - 1
+	if c.Query("from") != "" {
+		if from, err = strconv.Atoi(c.Query("from")); err != nil || from < 0 {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("from", errors.New("Invalid revision")))
+			return
+		}
+	}
+	changes, err := itemModel.DiffRevisions(from, to)
+	if err == ErrRevisionNotFound {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Database error")))
+		return
+	}
+	serializer := ItemFieldChangesSerializer{c, changes}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "changes": serializer.Response()})
+}
+
+func ItemRevisionRestore(c *gin.Context) {
+	itemModel, err := findMyItem(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	number, _ := strconv.Atoi(c.Param("number"))
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	err = itemModel.RestoreRevision(GetItemUserModel(myUserModel), number)
+	if err == ErrRevisionNotFound {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ItemSerializer{c, itemModel}
+	c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
+}
+
+func ItemCommentCreate(c *gin.Context) {
+	slug := c.Param("slug")
+	itemModel, err := findVisibleItem(c, slug)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
 		return
@@ -191,11 +844,35 @@ func ItemCommentDelete(c *gin.Context) {
 
 func ItemCommentList(c *gin.Context) {
 	slug := c.Param("slug")
-	itemModel, err := FindOneItem(&ItemModel{Slug: slug})
+	itemModel, err := findVisibleItem(c, slug)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
 		return
 	}
+	// Without limit or cursor the whole list is returned, as it always was.
+	if c.Query("limit") != "" || c.Query("cursor") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			limit = 20
+		}
+		page, err := itemModel.getCommentPage(limit, c.Query("cursor"))
+		if err == common.ErrInvalidCursor {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("cursor", err))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
+			return
+		}
+		serializer := CommentsSerializer{c, page.Comments}
+		c.JSON(http.StatusOK, gin.H{
+			"comments":      serializer.Response(),
+			"commentsCount": page.Count,
+			"next":          common.CursorResponse(page.Next),
+			"prev":          common.CursorResponse(page.Prev),
+		})
+		return
+	}
 	err = itemModel.getComments()
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
@@ -204,6 +881,75 @@ func ItemCommentList(c *gin.Context) {
 	serializer := CommentsSerializer{c, itemModel.Comments}
 	c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
 }
+func TrashList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	itemModels, comments, err := GetTrash(GetItemUserModel(myUserModel))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("trash", errors.New("Database error")))
+		return
+	}
+	serializer := TrashSerializer{c, itemModels, comments}
+	c.JSON(http.StatusOK, serializer.Response())
+}
+
+func TrashItemRestore(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	itemModel, err := RestoreItem(GetItemUserModel(myUserModel), c.Param("slug"))
+	if err == ErrNotInTrash {
+		c.JSON(http.StatusNotFound, common.NewError("trash", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	itemModel, _ = FindOneItem(&ItemModel{Model: gorm.Model{ID: itemModel.ID}})
+	serializer := ItemSerializer{c, itemModel}
+	c.JSON(http.StatusOK, gin.H{"item": serializer.Response()})
+}
+
+func TrashCommentRestore(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("trash", ErrNotInTrash))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	comment, err := RestoreComment(GetItemUserModel(myUserModel), uint(id))
+	switch err {
+	case nil:
+		serializer := CommentSerializer{c, comment}
+		c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+	case ErrNotInTrash:
+		c.JSON(http.StatusNotFound, common.NewError("trash", err))
+	case ErrItemInTrash:
+		c.JSON(http.StatusConflict, common.NewError("trash", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	}
+}
+
+func ItemPurge(c *gin.Context) {
+	err := PurgeItem(c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": "Purge success"})
+}
+
+func CommentPurge(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err == nil {
+		err = PurgeComment(uint(id))
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"comment": "Purge success"})
+}
+
 func TagList(c *gin.Context) {
 	tagModels, err := getAllTags()
 	if err != nil {
@@ -213,3 +959,271 @@ func TagList(c *gin.Context) {
 	serializer := TagsSerializer{c, tagModels}
 	c.JSON(http.StatusOK, gin.H{"tags": serializer.Response()})
 }
+
+func TagFollow(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	tagModel, err := GetItemUserModel(myUserModel).followTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tag": gin.H{"tag": tagModel.Tag, "following": true}})
+}
+
+func TagUnfollow(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	tag := c.Param("tag")
+	if err := GetItemUserModel(myUserModel).unfollowTag(tag); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tags", errors.New("Invalid tag")))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tag": gin.H{"tag": tag, "following": false}})
+}
+
+func CategoryList(c *gin.Context) {
+	categoryModels, counts, err := FindCategoryTree()
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("categories", errors.New("Database error")))
+		return
+	}
+	serializer := CategoryTreeSerializer{c, categoryModels, counts}
+	c.JSON(http.StatusOK, gin.H{"categories": serializer.Response()})
+}
+
+func renderCategoryError(c *gin.Context, err error) {
+	switch err {
+	case ErrCategoryNotFound:
+		c.JSON(http.StatusNotFound, common.NewError("category", err))
+	case ErrCategoryExists, ErrCategoryInUse:
+		c.JSON(http.StatusConflict, common.NewError("category", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("category", err))
+	}
+}
+
+func CategoryCreate(c *gin.Context) {
+	categoryValidator := NewCategoryValidator()
+	if err := categoryValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	categoryModel, err := CreateCategory(categoryValidator.Category.Name, categoryValidator.Category.Parent)
+	if err != nil {
+		renderCategoryError(c, err)
+		return
+	}
+	serializer := CategorySerializer{c, categoryModel}
+	c.JSON(http.StatusCreated, gin.H{"category": serializer.Response()})
+}
+
+func CategoryUpdate(c *gin.Context) {
+	categoryModel, err := FindOneCategory(&CategoryModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("category", errors.New("Invalid slug")))
+		return
+	}
+	categoryValidator := NewCategoryValidatorFillWith(categoryModel)
+	if err := categoryValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if err := categoryModel.Update(categoryValidator.Category.Name, categoryValidator.Category.Parent); err != nil {
+		renderCategoryError(c, err)
+		return
+	}
+	serializer := CategorySerializer{c, categoryModel}
+	c.JSON(http.StatusOK, gin.H{"category": serializer.Response()})
+}
+
+func CategoryDelete(c *gin.Context) {
+	categoryModel, err := FindOneCategory(&CategoryModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("category", errors.New("Invalid slug")))
+		return
+	}
+	if err := categoryModel.Delete(); err != nil {
+		renderCategoryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"category": "Delete success"})
+}
+
+func CategoryAttributeCreate(c *gin.Context) {
+	categoryModel, _ := FindOneCategory(&CategoryModel{Slug: c.Param("slug")})
+	if categoryModel.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("category", errors.New("Invalid slug")))
+		return
+	}
+	attributeValidator := NewCategoryAttributeValidator()
+	if err := attributeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	attribute := attributeValidator.Attribute
+	attributeModel, err := categoryModel.AddAttribute(attribute.Name, attribute.Type, attribute.Options, attribute.Required, attribute.Variant)
+	if err == ErrAttributeExists {
+		c.JSON(http.StatusConflict, common.NewError("attribute", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("attribute", err))
+		return
+	}
+	serializer := CategoryAttributeSerializer{c, attributeModel}
+	c.JSON(http.StatusCreated, gin.H{"attribute": serializer.Response()})
+}
+
+func CategoryAttributeDelete(c *gin.Context) {
+	categoryModel, _ := FindOneCategory(&CategoryModel{Slug: c.Param("slug")})
+	if categoryModel.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("category", errors.New("Invalid slug")))
+		return
+	}
+	if err := categoryModel.RemoveAttribute(c.Param("name")); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("attribute", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"attribute": "Delete success"})
+}
+
+// The format of a bulk file, from ?format= or else its name or content type.
+func bulkFormat(c *gin.Context, filename string) string {
+	if format := c.Query("format"); format != "" {
+		return format
+	}
+	switch {
+	case strings.HasSuffix(filename, ".csv"), c.ContentType() == "text/csv":
+		return BulkCSV
+	case strings.HasSuffix(filename, ".ndjson"), strings.HasSuffix(filename, ".jsonl"),
+		c.ContentType() == "application/x-ndjson", c.ContentType() == "application/ndjson":
+		return BulkNDJSON
+	}
+	return ""
+}
+
+// The file is the request body, or the "file" of a multipart form. Columns are
+// renamed with ?map[<field>]=<column>, and ?dryRun=true only checks the rows.
+func ItemImport(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	var body io.Reader = c.Request.Body
+	var filename string
+	if c.ContentType() == "multipart/form-data" {
+		header, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("file", err))
+			return
+		}
+		file, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("file", err))
+			return
+		}
+		defer file.Close()
+		body, filename = file, header.Filename
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	result, err := ImportItems(GetItemUserModel(myUserModel), body, bulkFormat(c, filename), c.QueryMap("map"), dryRun)
+	if err == ErrInvalidBulkFormat {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("format", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("import", err))
+		return
+	}
+	status := http.StatusCreated
+	if dryRun {
+		status = http.StatusOK
+	}
+	serializer := ItemImportSerializer{c, result}
+	c.JSON(status, gin.H{"import": serializer.Response()})
+}
+
+// The errors of an import as a CSV file, for the seller who made it.
+func ItemImportReport(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	result, err := FindOneItemImport(&ItemImportModel{Model: gorm.Model{ID: uint(id)}, SellerID: GetItemUserModel(myUserModel).ID})
+	if id == 0 || err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("import", errors.New("Invalid id")))
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=import-%v-errors.csv", result.ID))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", []byte(result.ReportCSV()))
+}
+
+// All the listings of the user, as ?format=csv (the default) or ndjson.
+func ItemExport(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if myUserModel.ID == 0 {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
+		return
+	}
+	format := c.DefaultQuery("format", BulkCSV)
+	contentType := "text/csv; charset=utf-8"
+	switch format {
+	case BulkCSV:
+	case BulkNDJSON:
+		contentType = "application/x-ndjson"
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("format", ErrInvalidBulkFormat))
+		return
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename=items."+format)
+	c.Status(http.StatusOK)
+	if err := ExportItems(GetItemUserModel(myUserModel), c.Writer, format); err != nil {
+		fmt.Println("export err: (ExportItems) ", err)
+	}
+}
+
+// Analytics of the user's listings over ?from= and ?to= (dates as 2006-01-02,
+// both included), the last 30 days by default.
+func SellerAnalytics(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("to", errors.New("Invalid date")))
+			return
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("from", errors.New("Invalid date")))
+			return
+		}
+		from = parsed
+	}
+	analytics, totals, err := GetSellerAnalytics(GetItemUserModel(myUserModel), from, to)
+	if err == ErrInvalidDateRange {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("from", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("analytics", errors.New("Database error")))
+		return
+	}
+	serializer := SellerAnalyticsSerializer{c, from, to, analytics, totals}
+	c.JSON(http.StatusOK, gin.H{"analytics": serializer.Response()})
+}
+
+// Listings similar to the item, see ComputeRelatedItems.
+func ItemRelatedList(c *gin.Context) {
+	itemModel, err := findVisibleItem(c, c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	itemModels, err := itemModel.RelatedItems(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Database error")))
+		return
+	}
+	serializer := ItemsSerializer{c, itemModels}
+	c.JSON(http.StatusOK, gin.H{"items": serializer.Response(), "itemsCount": len(itemModels)})
+}
@@ -0,0 +1,87 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package items
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+// The FTS5 index of the searchable text of every item, its rowid being the item
+// id. Tags are indexed space separated.
+const searchTable = "item_search"
+
+// Words around the match kept in a snippet.
+const snippetTokens = 16
+
+// Create the index and fill it from the item table when it is new, e.g. the first
+// time the app runs with the sqlite_fts5 build tag.
+func setupSearchIndex(db *gorm.DB) error {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + searchTable +
+		" USING fts5(title, description, body, tags, tokenize = 'unicode61 remove_diacritics 2')").Error
+	if err != nil {
+		return err
+	}
+	var indexed int
+	db.Table(searchTable).Count(&indexed)
+	if indexed != 0 {
+		return nil
+	}
+	return db.Exec("INSERT INTO " + searchTable + " (rowid, title, description, body, tags) " +
+		searchSource + " WHERE item_models.deleted_at IS NULL").Error
+}
+
+// The indexed columns of items, read from the item and tag tables.
+const searchSource = "SELECT item_models.id, item_models.title, item_models.description, item_models.body, " +
+	"(SELECT group_concat(tag_models.tag, ' ') FROM tag_models JOIN item_tags ON item_tags.tag_model_id = tag_models.id " +
+	"WHERE item_tags.item_model_id = item_models.id) FROM item_models"
+
+// Replace the indexed text of the item with its current one.
+func indexItem(db *gorm.DB, id uint) error {
+	if err := unindexItem(db, id); err != nil {
+		return err
+	}
+	return db.Exec("INSERT INTO "+searchTable+" (rowid, title, description, body, tags) "+
+		searchSource+" WHERE item_models.id = ? AND item_models.deleted_at IS NULL", id).Error
+}
+
+func unindexItem(db *gorm.DB, id uint) error {
+	return db.Exec("DELETE FROM "+searchTable+" WHERE rowid = ?", id).Error
+}
+
+// The MATCH expression of the terms. Every term is quoted, which is how FTS5 takes
+// text literally; a quote inside is written twice.
+func matchExpression(terms []searchTerm) string {
+	var parts []string
+	for _, term := range terms {
+		part := `"` + strings.Replace(term.Text, `"`, `""`, -1) + `"`
+		if term.Prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// BM25 ranks the matches, with the columns weighted like the LIKE backend does.
+func searchItems(terms []searchTerm, limit, offset int) ([]searchHit, int, error) {
+	db := common.GetDB()
+	match := matchExpression(terms)
+	from := " FROM " + searchTable + " JOIN item_models ON item_models.id = " + searchTable + ".rowid" +
+		" WHERE " + searchTable + " MATCH ? AND item_models.deleted_at IS NULL AND item_models.status = '" + ItemPublished + "'" +
+		" AND item_models.availability NOT IN ('" + ListingSold + "', '" + ListingExpired + "')"
+
+	var count int
+	if err := db.Raw("SELECT count(*)"+from, match).Row().Scan(&count); err != nil {
+		return nil, 0, err
+	}
+	var hits []searchHit
+	err := db.Raw("SELECT "+searchTable+".rowid AS id, snippet("+searchTable+", -1, ?, ?, '…', ?) AS snippet"+from+
+		" ORDER BY bm25("+searchTable+", 10.0, 2.0, 1.0, 5.0), item_models.id DESC LIMIT ? OFFSET ?",
+		snippetOpen, snippetClose, snippetTokens, match, limit, offset).Scan(&hits).Error
+	return hits, count, err
+}
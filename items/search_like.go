@@ -0,0 +1,149 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package items
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+// Without the sqlite_fts5 build tag there is no index to keep: searches scan the
+// item table with LIKE. Good enough for development and small catalogs.
+func setupSearchIndex(db *gorm.DB) error {
+	return nil
+}
+
+func indexItem(db *gorm.DB, id uint) error {
+	return nil
+}
+
+func unindexItem(db *gorm.DB, id uint) error {
+	return nil
+}
+
+// Characters kept around the first match in a snippet.
+const snippetRunes = 60
+
+func likePattern(text string) string {
+	text = strings.Replace(text, `\`, `\\`, -1)
+	text = strings.Replace(text, "%", `\%`, -1)
+	text = strings.Replace(text, "_", `\_`, -1)
+	return "%" + text + "%"
+}
+
+// Substring matching makes every term a prefix term already. The score adds up
+// column weights for each term: title 10, tags 5, description 2, body 1.
+func searchItems(terms []searchTerm, limit, offset int) ([]searchHit, int, error) {
+	db := common.GetDB()
+	tagged := "item_models.id IN (SELECT item_tags.item_model_id FROM item_tags JOIN tag_models ON " +
+		"tag_models.id = item_tags.tag_model_id WHERE tag_models.tag LIKE ? ESCAPE '\\')"
+	query := db.Model(&ItemModel{}).Scopes(ItemFilter{}.where)
+	var scores []string
+	var scoreArgs []interface{}
+	for _, term := range terms {
+		pattern := likePattern(term.Text)
+		query = query.Where("item_models.title LIKE ? ESCAPE '\\' OR item_models.description LIKE ? ESCAPE '\\' OR "+
+			"item_models.body LIKE ? ESCAPE '\\' OR "+tagged, pattern, pattern, pattern, pattern)
+		scores = append(scores, "(CASE WHEN item_models.title LIKE ? ESCAPE '\\' THEN 10 ELSE 0 END + "+
+			"CASE WHEN "+tagged+" THEN 5 ELSE 0 END + "+
+			"CASE WHEN item_models.description LIKE ? ESCAPE '\\' THEN 2 ELSE 0 END + "+
+			"CASE WHEN item_models.body LIKE ? ESCAPE '\\' THEN 1 ELSE 0 END)")
+		scoreArgs = append(scoreArgs, pattern, pattern, pattern, pattern)
+	}
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var rows []struct {
+		ID          uint
+		Title       string
+		Description string
+		Body        string
+	}
+	err := query.Select("item_models.id, item_models.title, item_models.description, item_models.body, "+
+		strings.Join(scores, " + ")+" AS score", scoreArgs...).
+		Order("score desc").Order("item_models.id desc").Limit(limit).Offset(offset).Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	var hits []searchHit
+	for _, row := range rows {
+		hits = append(hits, searchHit{ID: row.ID, Snippet: likeSnippet(terms, row.Title, row.Description, row.Body)})
+	}
+	return hits, count, nil
+}
+
+// The text around the first term found in the first field containing one, with
+// every term occurrence in it marked.
+func likeSnippet(terms []searchTerm, fields ...string) string {
+	for _, field := range fields {
+		lower := strings.ToLower(field)
+		if len(lower) != len(field) {
+			lower = field
+		}
+		start := -1
+		for _, term := range terms {
+			if i := strings.Index(lower, strings.ToLower(term.Text)); i >= 0 && (start < 0 || i < start) {
+				start = i
+			}
+		}
+		if start < 0 {
+			continue
+		}
+		from, to := start, start
+		for n := 0; n < snippetRunes/2 && from > 0; n++ {
+			_, size := utf8.DecodeLastRuneInString(field[:from])
+			from -= size
+		}
+		for n := 0; n < snippetRunes && to < len(field); n++ {
+			_, size := utf8.DecodeRuneInString(field[to:])
+			to += size
+		}
+		snippet := markTerms(terms, field[from:to])
+		if from > 0 {
+			snippet = "…" + snippet
+		}
+		if to < len(field) {
+			snippet += "…"
+		}
+		return snippet
+	}
+	return ""
+}
+
+func markTerms(terms []searchTerm, text string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		lower = text
+	}
+	marked := make([]bool, len(text)+1)
+	for _, term := range terms {
+		needle := strings.ToLower(term.Text)
+		for i := 0; needle != "" && i <= len(lower)-len(needle); {
+			j := strings.Index(lower[i:], needle)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(needle); k++ {
+				marked[k] = true
+			}
+			i += j + len(needle)
+		}
+	}
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			out.WriteString(snippetOpen)
+		}
+		out.WriteByte(text[i])
+		if marked[i] && !marked[i+1] {
+			out.WriteString(snippetClose)
+		}
+	}
+	return out.String()
+}
@@ -1,9 +1,13 @@
 package items
 
 import (
-	"github.com/gosimple/slug"
+	"github.com/NivRichter/GoLang-test1/common"
 	"github.com/NivRichter/GoLang-test1/users"
 	"github.com/gin-gonic/gin"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type TagSerializer struct {
@@ -45,53 +49,75 @@ type ItemSerializer struct {
 }
 
 type ItemResponse struct {
-	ID             uint                  `json:"-"`
-	Title          string                `json:"title"`
-	Slug           string                `json:"slug"`
-	Description    string                `json:"description"`
-	Body           string                `json:"body"`
-	CreatedAt      string                `json:"createdAt"`
-	UpdatedAt      string                `json:"updatedAt"`
-	Seller         users.ProfileResponse `json:"seller"`
-	Tags           []string              `json:"tagList"`
-	Favorite       bool                  `json:"favorited"`
-	FavoritesCount uint                  `json:"favoritesCount"`
+	ID                uint                  `json:"-"`
+	Title             string                `json:"title"`
+	Slug              string                `json:"slug"`
+	Description       string                `json:"description"`
+	Body              string                `json:"body"`
+	BodyHTML          string                `json:"bodyHtml,omitempty"`
+	Price             int64                 `json:"price"`
+	Currency          string                `json:"currency"`
+	FormattedPrice    string                `json:"formattedPrice"`
+	InStock           bool                  `json:"inStock"`
+	QuantityAvailable int                   `json:"quantityAvailable"`
+	CreatedAt         string                `json:"createdAt"`
+	UpdatedAt         string                `json:"updatedAt"`
+	Status            string                `json:"status"`
+	PublishAt         *string               `json:"publishAt"`
+	Availability      string                `json:"availability"`
+	ExpiresAt         *string               `json:"expiresAt"`
+	Seller            users.ProfileResponse `json:"seller"`
+	Tags              []string              `json:"tagList"`
+	Favorite          bool                  `json:"favorited"`
+	FavoritesCount    uint                  `json:"favoritesCount"`
+	CommentsCount     uint                  `json:"commentsCount"`
+	Auction           *AuctionResponse      `json:"auction,omitempty"`
+	Category          *ItemCategoryResponse `json:"category"`
+	CoverImage        *ItemImageResponse    `json:"coverImage"`
+	Images            []ItemImageResponse   `json:"images"`
+	Attributes        map[string]string     `json:"attributes"`
+	Variants          []ItemVariantResponse `json:"variants"`
 }
 
 type ItemsSerializer struct {
-	C        *gin.Context
+	C     *gin.Context
 	Items []ItemModel
 }
 
 func (s *ItemSerializer) Response() ItemResponse {
-	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
-	sellerSerializer := ItemUserSerializer{s.C, s.Seller}
-	response := ItemResponse{
-		ID:          s.ID,
-		Slug:        slug.Make(s.Title),
-		Title:       s.Title,
-		Description: s.Description,
-		Body:        s.Body,
-		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
-		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		Seller:         sellerSerializer.Response(),
-		Favorite:       s.isFavoriteBy(GetItemUserModel(myUserModel)),
-		FavoritesCount: s.favoritesCount(),
-	}
-	response.Tags = make([]string, 0)
-	for _, tag := range s.Tags {
-		serializer := TagSerializer{s.C, tag}
-		response.Tags = append(response.Tags, serializer.Response())
-	}
-	return response
+	loader := NewItemLoader(s.C, []ItemModel{s.ItemModel})
+	return loader.Response(s.ItemModel)
 }
 
 func (s *ItemsSerializer) Response() []ItemResponse {
 	response := []ItemResponse{}
+	loader := NewItemLoader(s.C, s.Items)
 	for _, item := range s.Items {
-		serializer := ItemSerializer{s.C, item}
-		response = append(response, serializer.Response())
+		response = append(response, loader.Response(item))
+	}
+	return response
+}
+
+type ItemSearchSerializer struct {
+	C       *gin.Context
+	Results []ItemSearchResult
+}
+
+// A search result is the item itself plus the snippet showing why it matched.
+type ItemSearchResponse struct {
+	ItemResponse
+	Snippet string `json:"snippet"`
+}
+
+func (s *ItemSearchSerializer) Response() []ItemSearchResponse {
+	response := []ItemSearchResponse{}
+	var models []ItemModel
+	for _, result := range s.Results {
+		models = append(models, result.Item)
+	}
+	loader := NewItemLoader(s.C, models)
+	for _, result := range s.Results {
+		response = append(response, ItemSearchResponse{loader.Response(result.Item), result.Snippet})
 	}
 	return response
 }
@@ -109,6 +135,7 @@ type CommentsSerializer struct {
 type CommentResponse struct {
 	ID        uint                  `json:"id"`
 	Body      string                `json:"body"`
+	BodyHTML  string                `json:"bodyHtml,omitempty"`
 	CreatedAt string                `json:"createdAt"`
 	UpdatedAt string                `json:"updatedAt"`
 	Seller    users.ProfileResponse `json:"seller"`
@@ -119,6 +146,7 @@ func (s *CommentSerializer) Response() CommentResponse {
 	response := CommentResponse{
 		ID:        s.ID,
 		Body:      s.Body,
+		BodyHTML:  renderedBody(s.Body, s.BodyHTML),
 		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Seller:    sellerSerializer.Response(),
@@ -134,3 +162,488 @@ func (s *CommentsSerializer) Response() []CommentResponse {
 	}
 	return response
 }
+
+type ReservationSerializer struct {
+	C *gin.Context
+	StockReservationModel
+}
+
+type ReservationResponse struct {
+	ID        uint   `json:"id"`
+	Quantity  int    `json:"quantity"`
+	Status    string `json:"status"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func (s *ReservationSerializer) Response() ReservationResponse {
+	return ReservationResponse{
+		ID:        s.ID,
+		Quantity:  s.Quantity,
+		Status:    s.Status,
+		ExpiresAt: s.ExpiresAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+type AuctionSerializer struct {
+	C *gin.Context
+	AuctionModel
+}
+
+// The reserve price itself stays secret, bidders only learn whether it is met.
+type AuctionResponse struct {
+	Status        string `json:"status"`
+	StartPrice    int64  `json:"startPrice"`
+	Increment     int64  `json:"increment"`
+	CurrentBid    int64  `json:"currentBid"`
+	BidCount      int    `json:"bidCount"`
+	MinimumBid    int64  `json:"minimumBid"`
+	ReserveMet    bool   `json:"reserveMet"`
+	EndsAt        string `json:"endsAt"`
+	TimeRemaining int64  `json:"timeRemaining"`
+	Leading       bool   `json:"leading"`
+}
+
+func (s *AuctionSerializer) Response() AuctionResponse {
+	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
+	return auctionResponse(s.AuctionModel, GetItemUserModel(myUserModel))
+}
+
+// The auction as seen by me.
+func auctionResponse(auction AuctionModel, me ItemUserModel) AuctionResponse {
+	response := AuctionResponse{
+		Status:     auction.Status,
+		StartPrice: auction.StartPrice,
+		Increment:  auction.Increment,
+		CurrentBid: auction.CurrentBid,
+		BidCount:   auction.BidCount,
+		MinimumBid: auction.MinimumBid(),
+		ReserveMet: auction.ReserveMet(),
+		EndsAt:     auction.EndsAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Leading:    me.ID != 0 && me.ID == auction.LeaderID,
+	}
+	if auction.Status == AuctionOpen {
+		if remaining := time.Until(auction.EndsAt); remaining > 0 {
+			response.TimeRemaining = int64(remaining / time.Second)
+		}
+	}
+	return response
+}
+
+type BidSerializer struct {
+	C *gin.Context
+	BidModel
+}
+
+type BidResponse struct {
+	ID        uint   `json:"id"`
+	Amount    int64  `json:"amount"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (s *BidSerializer) Response() BidResponse {
+	return BidResponse{
+		ID:        s.ID,
+		Amount:    s.Amount,
+		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+// Width in pixels of the thumbnails offered next to every image.
+var ThumbnailWidth = 400
+
+// The URL of a resized copy of the image at imageURL. Images are expected behind
+// an image CDN resizing on the fly from the "w" query parameter; an URL that can
+// not be parsed is returned unchanged.
+func ThumbnailURL(imageURL string, width int) string {
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		return imageURL
+	}
+	query := parsed.Query()
+	query.Set("w", strconv.Itoa(width))
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+type ItemImageSerializer struct {
+	C *gin.Context
+	ItemImageModel
+}
+
+type ItemImagesSerializer struct {
+	C      *gin.Context
+	Images []ItemImageModel
+}
+
+type ItemImageResponse struct {
+	ID           uint   `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+	AltText      string `json:"alt"`
+	Position     int    `json:"position"`
+	Cover        bool   `json:"cover"`
+}
+
+func (s *ItemImageSerializer) Response() ItemImageResponse {
+	return ItemImageResponse{
+		ID:           s.ID,
+		URL:          s.URL,
+		ThumbnailURL: ThumbnailURL(s.URL, ThumbnailWidth),
+		AltText:      s.AltText,
+		Position:     s.Position,
+		Cover:        s.Cover,
+	}
+}
+
+func (s *ItemImagesSerializer) Response() []ItemImageResponse {
+	response := []ItemImageResponse{}
+	for _, image := range s.Images {
+		serializer := ItemImageSerializer{s.C, image}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+// The category an item is filed under, Breadcrumb lists the names from the root.
+type ItemCategoryResponse struct {
+	Slug       string   `json:"slug"`
+	Name       string   `json:"name"`
+	Breadcrumb []string `json:"breadcrumb"`
+}
+
+type CategorySerializer struct {
+	C *gin.Context
+	CategoryModel
+}
+
+// The whole category tree, Counts holds the number of items in each subtree.
+type CategoryTreeSerializer struct {
+	C          *gin.Context
+	Categories []CategoryModel
+	Counts     map[uint]int
+}
+
+// Attributes lists the attributes defined on the category itself; its
+// subcategories inherit them.
+type CategoryResponse struct {
+	Slug       string                      `json:"slug"`
+	Name       string                      `json:"name"`
+	ItemsCount int                         `json:"itemsCount"`
+	Attributes []CategoryAttributeResponse `json:"attributes"`
+	Children   []CategoryResponse          `json:"children"`
+}
+
+func (s *CategorySerializer) Response() CategoryResponse {
+	response := CategoryResponse{
+		Slug:       s.Slug,
+		Name:       s.Name,
+		Attributes: []CategoryAttributeResponse{},
+		Children:   []CategoryResponse{},
+	}
+	var attributes []CategoryAttributeModel
+	db := common.GetDB()
+	db.Where(CategoryAttributeModel{CategoryID: s.ID}).Order("id asc").Find(&attributes)
+	for _, attribute := range attributes {
+		serializer := CategoryAttributeSerializer{s.C, attribute}
+		response.Attributes = append(response.Attributes, serializer.Response())
+	}
+	return response
+}
+
+// Nest the categories under their parents, siblings in creation order. Paths can
+// not be used for ordering: "/12/" sorts before "/9/".
+func (s *CategoryTreeSerializer) Response() []CategoryResponse {
+	children := map[uint][]CategoryModel{}
+	for _, category := range s.Categories {
+		children[category.ParentID] = append(children[category.ParentID], category)
+	}
+	var build func(parentID uint) []CategoryResponse
+	build = func(parentID uint) []CategoryResponse {
+		response := []CategoryResponse{}
+		for _, category := range children[parentID] {
+			serializer := CategorySerializer{s.C, category}
+			node := serializer.Response()
+			node.ItemsCount = s.Counts[category.ID]
+			node.Children = build(category.ID)
+			response = append(response, node)
+		}
+		return response
+	}
+	return build(0)
+}
+
+type CategoryAttributeSerializer struct {
+	C *gin.Context
+	CategoryAttributeModel
+}
+
+type CategoryAttributeResponse struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Options  []string `json:"options"`
+	Required bool     `json:"required"`
+	Variant  bool     `json:"variant"`
+}
+
+func (s *CategoryAttributeSerializer) Response() CategoryAttributeResponse {
+	return CategoryAttributeResponse{
+		Name:     s.Name,
+		Type:     s.Type,
+		Options:  s.OptionList(),
+		Required: s.Required,
+		Variant:  s.Variant,
+	}
+}
+
+type ItemVariantSerializer struct {
+	C *gin.Context
+	ItemVariantModel
+}
+
+type ItemVariantsSerializer struct {
+	C        *gin.Context
+	Variants []ItemVariantModel
+}
+
+type ItemVariantResponse struct {
+	ID                uint              `json:"id"`
+	Name              string            `json:"name"`
+	Price             int64             `json:"price"`
+	FormattedPrice    string            `json:"formattedPrice"`
+	InStock           bool              `json:"inStock"`
+	QuantityAvailable int               `json:"quantityAvailable"`
+	Attributes        map[string]string `json:"attributes"`
+}
+
+func (s *ItemVariantSerializer) Response() ItemVariantResponse {
+	var item ItemModel
+	db := common.GetDB()
+	db.Unscoped().Select("currency").Where("id = ?", s.ItemID).First(&item)
+	return variantResponse(s.ItemVariantModel, item.Currency)
+}
+
+// The variant of an item priced in currency.
+func variantResponse(variant ItemVariantModel, currency string) ItemVariantResponse {
+	return ItemVariantResponse{
+		ID:                variant.ID,
+		Name:              variant.Name,
+		Price:             variant.Price,
+		FormattedPrice:    common.Money{Amount: variant.Price, Currency: currency}.String(),
+		InStock:           variant.QuantityAvailable() > 0,
+		QuantityAvailable: variant.QuantityAvailable(),
+		Attributes:        variant.AttributeMap(),
+	}
+}
+
+func (s *ItemVariantsSerializer) Response() []ItemVariantResponse {
+	response := []ItemVariantResponse{}
+	for _, variant := range s.Variants {
+		serializer := ItemVariantSerializer{s.C, variant}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type ItemRevisionsSerializer struct {
+	C         *gin.Context
+	Revisions []ItemRevisionModel
+}
+
+type ItemRevisionResponse struct {
+	Number      int                   `json:"number"`
+	Fields      []string              `json:"fields"`
+	Title       string                `json:"title"`
+	Description string                `json:"description"`
+	Body        string                `json:"body"`
+	BodyHTML    string                `json:"bodyHtml,omitempty"`
+	Tags        []string              `json:"tagList"`
+	CreatedAt   string                `json:"createdAt"`
+	Editor      users.ProfileResponse `json:"editor"`
+}
+
+func (s *ItemRevisionsSerializer) Response() []ItemRevisionResponse {
+	response := []ItemRevisionResponse{}
+	for _, revision := range s.Revisions {
+		editorSerializer := ItemUserSerializer{s.C, revision.Editor}
+		fields := []string{}
+		if revision.Fields != "" {
+			fields = strings.Split(revision.Fields, ",")
+		}
+		response = append(response, ItemRevisionResponse{
+			Number:      revision.Number,
+			Fields:      fields,
+			Title:       revision.Title,
+			Description: revision.Description,
+			Body:        revision.Body,
+			BodyHTML:    renderedBody(revision.Body, revision.BodyHTML),
+			Tags:        revision.TagList(),
+			CreatedAt:   revision.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			Editor:      editorSerializer.Response(),
+		})
+	}
+	return response
+}
+
+type ItemFieldChangesSerializer struct {
+	C       *gin.Context
+	Changes []ItemFieldChange
+}
+
+type ItemFieldChangeResponse struct {
+	Field   string   `json:"field"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+func (s *ItemFieldChangesSerializer) Response() []ItemFieldChangeResponse {
+	response := []ItemFieldChangeResponse{}
+	for _, change := range s.Changes {
+		response = append(response, ItemFieldChangeResponse{
+			Field:   change.Field,
+			From:    change.From,
+			To:      change.To,
+			Added:   change.Added,
+			Removed: change.Removed,
+		})
+	}
+	return response
+}
+
+// The trash of a user: their deleted items and comments.
+type TrashSerializer struct {
+	C        *gin.Context
+	Items    []ItemModel
+	Comments []CommentModel
+}
+
+type TrashItemResponse struct {
+	ItemResponse
+	DeletedAt string `json:"deletedAt"`
+}
+
+type TrashCommentResponse struct {
+	CommentResponse
+	Item      string `json:"item"`
+	DeletedAt string `json:"deletedAt"`
+}
+
+type TrashResponse struct {
+	Items    []TrashItemResponse    `json:"items"`
+	Comments []TrashCommentResponse `json:"comments"`
+}
+
+func (s *TrashSerializer) Response() TrashResponse {
+	response := TrashResponse{Items: []TrashItemResponse{}, Comments: []TrashCommentResponse{}}
+	loader := NewItemLoader(s.C, s.Items)
+	for _, item := range s.Items {
+		response.Items = append(response.Items, TrashItemResponse{
+			loader.Response(item),
+			item.DeletedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
+	}
+	for _, comment := range s.Comments {
+		serializer := CommentSerializer{s.C, comment}
+		response.Comments = append(response.Comments, TrashCommentResponse{
+			serializer.Response(),
+			comment.Item.Slug,
+			comment.DeletedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
+	}
+	return response
+}
+
+type ItemImportSerializer struct {
+	C *gin.Context
+	ItemImportModel
+}
+
+type ItemImportResponse struct {
+	ID           uint              `json:"id"`
+	Format       string            `json:"format"`
+	DryRun       bool              `json:"dryRun"`
+	RowsCount    int               `json:"rowsCount"`
+	CreatedCount int               `json:"createdCount"`
+	ErrorsCount  int               `json:"errorsCount"`
+	Errors       []ItemImportError `json:"errors"`
+	CreatedAt    string            `json:"createdAt"`
+}
+
+// Errors holds the first errors only, all of them are in the report.
+func (s *ItemImportSerializer) Response() ItemImportResponse {
+	response := ItemImportResponse{
+		ID:           s.ID,
+		Format:       s.Format,
+		DryRun:       s.DryRun,
+		RowsCount:    s.RowsCount,
+		CreatedCount: s.CreatedCount,
+		ErrorsCount:  s.ErrorsCount,
+		Errors:       s.Errors,
+		CreatedAt:    s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	if response.Errors == nil {
+		response.Errors = []ItemImportError{}
+	}
+	return response
+}
+
+type SellerAnalyticsSerializer struct {
+	C      *gin.Context
+	From   time.Time
+	To     time.Time
+	Items  []ItemAnalytics
+	Totals ItemAnalytics
+}
+
+type AnalyticsResponse struct {
+	Views      int     `json:"views"`
+	ViewerDays int     `json:"viewerDays"`
+	Favorites  int     `json:"favorites"`
+	Comments   int     `json:"comments"`
+	Orders     int     `json:"orders"`
+	Conversion float64 `json:"conversion"`
+}
+
+type ItemAnalyticsResponse struct {
+	Slug   string `json:"slug"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	AnalyticsResponse
+}
+
+type SellerAnalyticsResponse struct {
+	From   string                  `json:"from"`
+	To     string                  `json:"to"`
+	Items  []ItemAnalyticsResponse `json:"items"`
+	Totals AnalyticsResponse       `json:"totals"`
+}
+
+func analyticsResponse(analytics ItemAnalytics) AnalyticsResponse {
+	return AnalyticsResponse{
+		Views:      analytics.Views,
+		ViewerDays: analytics.ViewerDays,
+		Favorites:  analytics.Favorites,
+		Comments:   analytics.Comments,
+		Orders:     analytics.Orders,
+		Conversion: analytics.Conversion,
+	}
+}
+
+func (s *SellerAnalyticsSerializer) Response() SellerAnalyticsResponse {
+	response := SellerAnalyticsResponse{
+		From:   s.From.Format("2006-01-02"),
+		To:     s.To.Format("2006-01-02"),
+		Items:  []ItemAnalyticsResponse{},
+		Totals: analyticsResponse(s.Totals),
+	}
+	for _, analytics := range s.Items {
+		response.Items = append(response.Items, ItemAnalyticsResponse{
+			analytics.Item.Slug,
+			analytics.Item.Title,
+			analytics.Item.Status,
+			analyticsResponse(analytics),
+		})
+	}
+	return response
+}
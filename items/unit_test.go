@@ -0,0 +1,1777 @@
+package items
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+var test_db *gorm.DB
+
+func userModelMocker(n int) []ItemUserModel {
+	var offset int
+	test_db.Model(&users.UserModel{}).Count(&offset)
+	var ret []ItemUserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username:     fmt.Sprintf("user%v", i),
+			Email:        fmt.Sprintf("user%v@linkedin.com", i),
+			Bio:          fmt.Sprintf("bio%v", i),
+			PasswordHash: "password123",
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, GetItemUserModel(userModel))
+	}
+	return ret
+}
+
+func itemModelMocker(seller ItemUserModel, n int, quantity int) []ItemModel {
+	var offset int
+	test_db.Unscoped().Model(&ItemModel{}).Count(&offset)
+	var ret []ItemModel
+	for i := offset + 1; i <= offset+n; i++ {
+		itemModel := ItemModel{
+			Slug:     fmt.Sprintf("item-%v", i),
+			Title:    fmt.Sprintf("item %v", i),
+			Body:     fmt.Sprintf("body %v", i),
+			Price:    int64(i * 100),
+			Currency: "USD",
+			Quantity: quantity,
+			SellerID: seller.ID,
+		}
+		test_db.Create(&itemModel)
+		ret = append(ret, itemModel)
+	}
+	return ret
+}
+
+func reloadItem(item ItemModel) ItemModel {
+	var model ItemModel
+	test_db.First(&model, item.ID)
+	return model
+}
+
+func TestStockReservation(t *testing.T) {
+	asserts := assert.New(t)
+
+	sellers := userModelMocker(2)
+	seller, buyer := sellers[0], sellers[1]
+	item := itemModelMocker(seller, 1, 3)[0]
+	asserts.Equal(3, item.QuantityAvailable(), "new item should have its whole stock available")
+
+	reservation, err := ReserveStock(item, buyer, 2)
+	asserts.NoError(err, "reserving available stock should work")
+	asserts.Equal(1, reloadItem(item).QuantityAvailable(), "reserved units should not be available")
+
+	_, err = ReserveStock(item, buyer, 2)
+	asserts.Equal(ErrOutOfStock, err, "reserving more than available should fail")
+
+	asserts.NoError(reservation.Commit(), "held reservation should commit")
+	item = reloadItem(item)
+	asserts.Equal(1, item.Quantity, "committed units should leave the stock")
+	asserts.Equal(0, item.Reserved, "committed units should no longer be reserved")
+	asserts.Equal(ErrReservationClosed, reservation.Release(), "committed reservation can not be released")
+
+	reservation, err = ReserveStock(item, buyer, 1)
+	asserts.NoError(err)
+	asserts.Equal(0, reloadItem(item).QuantityAvailable(), "last unit should be held")
+	released, err := ExpireStockReservations(time.Now().Add(ReservationTTL + time.Second))
+	asserts.NoError(err)
+	asserts.NotZero(released, "expired reservation should be released")
+	asserts.Equal(1, reloadItem(item).QuantityAvailable(), "expired reservation should hand the unit back")
+	asserts.Equal(ErrReservationClosed, reservation.Commit(), "expired reservation can not be committed")
+
+	draft := itemModelMocker(seller, 1, 3)[0]
+	test_db.Model(&ItemModel{}).Where("id = ?", draft.ID).Update("status", ItemDraft)
+	_, err = ReserveStock(reloadItem(draft), buyer, 1)
+	asserts.Equal(ErrItemUnavailable, err, "unpublished items should not be bought")
+}
+
+func TestItemStockUpdate(t *testing.T) {
+	asserts := assert.New(t)
+
+	sellers := userModelMocker(2)
+	seller, buyer := sellers[0], sellers[1]
+	item := itemModelMocker(seller, 1, 3)[0]
+	_, err := ReserveStock(item, buyer, 2)
+	asserts.NoError(err)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsRegister(r.Group("/items"))
+	request := func(method, body string, user ItemUserModel) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/items/"+item.Slug+"?access_token="+common.GenToken(user.UserModelID), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	put := func(body string) *httptest.ResponseRecorder {
+		return request("PUT", body, seller)
+	}
+	asserts.Equal(http.StatusNotFound, request("PUT", `{"item":{"price":1000}}`, buyer).Code, "only the seller should update the item")
+	asserts.Equal(http.StatusNotFound, request("DELETE", ``, buyer).Code, "only the seller should delete the item")
+	asserts.Equal(item.Price, reloadItem(item).Price)
+	w := put(`{"item":{"quantity":1}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Contains(w.Body.String(), `"quantity"`)
+	asserts.Equal(3, reloadItem(item).Quantity, "the quantity should not go below the units reserved")
+	w = put(`{"item":{"quantity":2,"price":0}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"price":0`)
+	item = reloadItem(item)
+	asserts.Equal(2, item.Quantity)
+	asserts.Equal(int64(0), item.Price, "prices should be settable to zero")
+
+	other := itemModelMocker(seller, 1, 1)[0]
+	test_db.Model(&other).UpdateColumn("price", 500)
+	other = reloadItem(other)
+	asserts.NoError(other.Revise(seller, ItemModel{Title: other.Title, Quantity: 0, Price: 500, Currency: "USD"}))
+	asserts.Equal(0, reloadItem(other).Quantity, "quantities should be settable to zero")
+}
+
+func TestItemQuantityMigration(t *testing.T) {
+	asserts := assert.New(t)
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	asserts.NoError(err)
+	defer db.Close()
+	db.Exec("CREATE TABLE item_models (id integer primary key autoincrement, created_at datetime, updated_at datetime, " +
+		"deleted_at datetime, slug varchar(255), title varchar(255), price bigint, currency varchar(3))")
+	db.Exec("INSERT INTO item_models (slug, title, price, currency) VALUES ('old', 'old', 100, 'USD')")
+	migrateItems(db)
+	var quantity int
+	db.Table("item_models").Where("slug = 'old'").Select("quantity").Row().Scan(&quantity)
+	asserts.Equal(1, quantity, "items from before stock tracking should be in stock")
+	db.Exec("UPDATE item_models SET quantity = 0")
+	migrateItems(db)
+	db.Table("item_models").Where("slug = 'old'").Select("quantity").Row().Scan(&quantity)
+	asserts.Equal(0, quantity, "later migrations should leave quantities alone")
+}
+
+func TestStockReservationConcurrency(t *testing.T) {
+	asserts := assert.New(t)
+
+	sellers := userModelMocker(1)
+	item := itemModelMocker(sellers[0], 1, 5)[0]
+	buyers := userModelMocker(20)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(buyers))
+	for _, buyer := range buyers {
+		wg.Add(1)
+		go func(buyer ItemUserModel) {
+			defer wg.Done()
+			_, err := ReserveStock(item, buyer, 1)
+			errs <- err
+		}(buyer)
+	}
+	wg.Wait()
+	close(errs)
+
+	reserved := 0
+	for err := range errs {
+		if err == nil {
+			reserved++
+		} else {
+			asserts.Equal(ErrOutOfStock, err, "concurrent checkouts should only fail for lack of stock")
+		}
+	}
+	item = reloadItem(item)
+	asserts.Equal(5, reserved, "exactly the stock on hand should be reserved")
+	asserts.Equal(5, item.Reserved, "reserved column should match the successful checkouts")
+	asserts.Equal(0, item.QuantityAvailable(), "stock should never be oversold")
+}
+
+func TestAuction(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, alice, bob := people[0], people[1], people[2]
+	item := itemModelMocker(seller, 1, 1)[0]
+
+	_, err := CreateAuction(item, 1000, 1500, 100, time.Now().Add(-time.Minute))
+	asserts.Equal(ErrInvalidAuction, err, "auctions should end in the future")
+	soldOut := itemModelMocker(seller, 1, 0)[0]
+	_, err = CreateAuction(soldOut, 1000, 1500, 100, time.Now().Add(time.Hour))
+	asserts.Equal(ErrOutOfStock, err, "items out of stock should not be auctioned")
+	auction, err := CreateAuction(item, 1000, 1500, 100, time.Now().Add(time.Hour))
+	asserts.NoError(err)
+	asserts.True(item.OnAuction())
+	asserts.Equal(1, reloadItem(item).Reserved, "the auction should hold the unit it sells")
+	ExpireStockReservations(time.Now().Add(2 * time.Hour))
+	asserts.Equal(1, reloadItem(item).Reserved, "open auctions should keep their unit")
+	_, err = CreateAuction(item, 1000, 1500, 100, time.Now().Add(time.Hour))
+	asserts.Equal(ErrAuctionItem, err, "an item should only have one open auction")
+
+	_, err = PlaceBid(&auction, seller, 2000)
+	asserts.Equal(ErrSellerBid, err)
+	_, err = PlaceBid(&auction, alice, 900)
+	asserts.Equal(ErrBidTooLow, err, "first bid should reach the start price")
+	_, err = PlaceBid(&auction, alice, 1000)
+	asserts.NoError(err)
+	_, err = PlaceBid(&auction, bob, 1050)
+	asserts.Equal(ErrBidTooLow, err, "bids should beat the current bid by the increment")
+	_, err = PlaceBid(&auction, bob, 1100)
+	asserts.NoError(err)
+	asserts.Equal(int64(1100), auction.CurrentBid)
+	asserts.Equal(2, auction.BidCount)
+	asserts.Equal(bob.ID, auction.LeaderID)
+	asserts.False(auction.ReserveMet())
+	asserts.Equal(int64(1200), auction.MinimumBid())
+
+	test_db.Model(&AuctionModel{}).Where("id = ?", auction.ID).Update("ends_at", time.Now().Add(30*time.Second))
+	_, err = PlaceBid(&auction, alice, 1600)
+	asserts.NoError(err)
+	asserts.True(auction.EndsAt.After(time.Now().Add(AuctionSnipeWindow-time.Second)), "a late bid should extend the auction")
+
+	var won []AuctionModel
+	OnAuctionWon(func(auction AuctionModel) error {
+		won = append(won, auction)
+		return nil
+	})
+	closed, err := CloseAuctions(time.Now())
+	asserts.NoError(err)
+	asserts.Zero(closed, "running auctions should not be closed")
+	closed, err = CloseAuctions(auction.EndsAt.Add(time.Second))
+	asserts.NoError(err)
+	asserts.Equal(1, closed)
+	asserts.Len(won, 1, "winner hook should run once")
+	asserts.Equal(alice.ID, won[0].WinnerID, "best bid above the reserve should win")
+	asserts.Equal(int64(1600), won[0].CurrentBid)
+	asserts.False(item.OnAuction())
+	var reservation StockReservationModel
+	test_db.First(&reservation, won[0].ReservationID)
+	asserts.Equal(ReservationHeld, reservation.Status)
+	asserts.Equal(alice.ID, reservation.BuyerID, "the unit should be held for the winner")
+	asserts.WithinDuration(auction.EndsAt.Add(time.Second+AuctionPaymentTTL), reservation.ExpiresAt, time.Second)
+
+	unsold := itemModelMocker(seller, 1, 1)[0]
+	auction, _ = CreateAuction(unsold, 1000, 5000, 100, time.Now().Add(5*time.Minute))
+	PlaceBid(&auction, alice, 1000)
+	closed, _ = CloseAuctions(time.Now().Add(10 * time.Minute))
+	asserts.Equal(1, closed)
+	asserts.Len(won, 1, "auction below the reserve should not be won")
+	asserts.Equal(AuctionUnsold, unsold.LastAuction().Status)
+	asserts.Zero(reloadItem(unsold).Reserved, "unsold auctions should release their unit")
+
+	failing := itemModelMocker(seller, 1, 1)[0]
+	auction, _ = CreateAuction(failing, 1000, 0, 100, time.Now().Add(5*time.Minute))
+	PlaceBid(&auction, bob, 1000)
+	hookErr := errors.New("checkout failed")
+	OnAuctionWon(func(auction AuctionModel) error {
+		return hookErr
+	})
+	closed, err = CloseAuctions(time.Now().Add(10 * time.Minute))
+	asserts.Equal(1, closed)
+	asserts.Equal(hookErr, err, "winner hook errors should be reported")
+	auctionWonHooks = nil
+}
+
+func TestAuctionConcurrentBids(t *testing.T) {
+	asserts := assert.New(t)
+
+	sellers := userModelMocker(1)
+	item := itemModelMocker(sellers[0], 1, 1)[0]
+	auction, _ := CreateAuction(item, 1000, 0, 100, time.Now().Add(time.Hour))
+	bidders := userModelMocker(10)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(bidders))
+	for _, bidder := range bidders {
+		wg.Add(1)
+		go func(bidder ItemUserModel) {
+			defer wg.Done()
+			mine := auction
+			_, err := PlaceBid(&mine, bidder, 1000)
+			errs <- err
+		}(bidder)
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		} else {
+			asserts.Equal(ErrBidTooLow, err, "concurrent bids should only fail for being too low")
+		}
+	}
+	auction = item.LastAuction()
+	asserts.Equal(1, accepted, "only one of several equal bids should win")
+	asserts.Equal(1, auction.BidCount, "bid count should match the accepted bids")
+}
+
+func galleryRequest(r *gin.Engine, method, url string, user ItemUserModel, body string) (*httptest.ResponseRecorder, []ItemImageResponse) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(user.UserModelID)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response struct {
+		Images []ItemImageResponse `json:"images"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response.Images
+}
+
+func TestItemGallery(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, stranger := people[0], people[1]
+	item := itemModelMocker(seller, 1, 1)[0]
+	url := fmt.Sprintf("/items/%v/images", item.Slug)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(true))
+	ItemsRegister(r.Group("/items"))
+
+	w, _ := galleryRequest(r, "POST", url, stranger, `{"image":{"url":"https://img.example.com/a.jpg"}}`)
+	asserts.Equal(http.StatusNotFound, w.Code, "only the seller should edit the gallery")
+
+	w, images := galleryRequest(r, "POST", url, seller, `{"image":{"url":"https://img.example.com/a.jpg","alt":"front"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.True(images[0].Cover, "the first image should be the cover")
+	asserts.Equal("https://img.example.com/a.jpg?w=400", images[0].ThumbnailURL)
+	galleryRequest(r, "POST", url, seller, `{"image":{"url":"https://img.example.com/b.jpg","alt":"back"}}`)
+	_, images = galleryRequest(r, "POST", url, seller, `{"image":{"url":"https://img.example.com/c.jpg?v=2"}}`)
+	asserts.Len(images, 3)
+	asserts.Equal("back", images[1].AltText, "images should be kept in the order they were added")
+	asserts.False(images[2].Cover)
+	asserts.Equal("https://img.example.com/c.jpg?v=2&w=400", images[2].ThumbnailURL)
+
+	a, b, c := images[0].ID, images[1].ID, images[2].ID
+	w, _ = galleryRequest(r, "PUT", url, seller, fmt.Sprintf(`{"gallery":{"order":[%v,%v]}}`, c, a))
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "reordering should list every image")
+	w, images = galleryRequest(r, "PUT", url, seller, fmt.Sprintf(`{"gallery":{"order":[%v,%v,%v],"cover":%v}}`, c, a, b, c))
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal([]uint{c, a, b}, []uint{images[0].ID, images[1].ID, images[2].ID})
+	asserts.True(images[0].Cover, "cover should move with the reorder")
+	asserts.False(images[1].Cover, "there should be a single cover")
+
+	w, images = galleryRequest(r, "DELETE", fmt.Sprintf("%v/%v", url, c), seller, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Len(images, 2)
+	asserts.True(images[0].Cover, "removing the cover should promote the first image left")
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Set("my_user_model", users.UserModel{})
+	serializer := ItemSerializer{ctx, item}
+	response := serializer.Response()
+	asserts.Len(response.Images, 2)
+	asserts.Equal(a, response.CoverImage.ID, "item should come with its cover for listing cards")
+}
+
+func TestCategories(t *testing.T) {
+	asserts := assert.New(t)
+	test_db.Unscoped().Delete(&CategoryModel{})
+
+	electronics, err := CreateCategory("Electronics", "")
+	asserts.NoError(err)
+	asserts.Equal(fmt.Sprintf("/%v/", electronics.ID), electronics.Path)
+	phones, _ := CreateCategory("Phones", "electronics")
+	laptops, _ := CreateCategory("Laptops", "electronics")
+	asserts.Equal(electronics.Path+fmt.Sprintf("%v/", phones.ID), phones.Path, "path should extend the parent's")
+	_, err = CreateCategory("Phones", "")
+	asserts.Equal(ErrCategoryExists, err)
+	_, err = CreateCategory("Tablets", "nowhere")
+	asserts.Equal(ErrCategoryNotFound, err)
+
+	seller := userModelMocker(1)[0]
+	filed := itemModelMocker(seller, 3, 1)
+	asserts.Equal(ErrCategoryNotLeaf, filed[0].setCategory("electronics"), "items should only go to leaf categories")
+	asserts.NoError(filed[0].setCategory("phones"))
+	asserts.NoError(filed[1].setCategory("phones"))
+	asserts.NoError(filed[2].setCategory("laptops"))
+	for i := range filed {
+		test_db.Model(&ItemModel{}).Where("id = ?", filed[i].ID).Update("category_id", filed[i].CategoryID)
+	}
+	_, err = CreateCategory("Android", "phones")
+	asserts.Equal(ErrCategoryInUse, err, "a category holding items should stay a leaf")
+	asserts.Equal(ErrCategoryInUse, phones.Delete())
+	asserts.Equal([]string{"Electronics", "Phones"}, phones.Breadcrumb())
+	tablets, _ := CreateCategory("Tablets", "electronics")
+	trashed := itemModelMocker(seller, 1, 1)[0]
+	test_db.Model(&ItemModel{}).Where("id = ?", trashed.ID).Update("category_id", tablets.ID)
+	test_db.Delete(&trashed)
+	_, err = CreateCategory("iPads", "tablets")
+	asserts.Equal(ErrCategoryInUse, err, "items in the trash should keep their category a leaf")
+	cameras, _ := CreateCategory("Cameras", "electronics")
+	cameras.AddAttribute("megapixels", AttributeNumber, nil, false, false)
+	asserts.NoError(cameras.Delete())
+	var attributes int
+	test_db.Unscoped().Model(&CategoryAttributeModel{}).Where("category_id = ?", cameras.ID).Count(&attributes)
+	asserts.Zero(attributes, "attributes should go with the deleted category")
+	cameras, err = CreateCategory("Cameras", "electronics")
+	asserts.NoError(err, "the name of a deleted category should be free again")
+	asserts.NoError(cameras.Delete())
+
+	models, count, _ := FindManyItem("", "", "", "", "", ItemFilter{Category: "electronics"})
+	asserts.Equal(3, count, "category filter should include subcategories")
+	asserts.Len(models, 3)
+	_, count, _ = FindManyItem("", "", "", "", "", ItemFilter{Category: "laptops"})
+	asserts.Equal(1, count)
+	_, count, _ = FindManyItem("", "", "", "", "", ItemFilter{Category: "nowhere"})
+	asserts.Equal(0, count, "unknown category should match nothing")
+
+	computers, _ := CreateCategory("Computers", "")
+	asserts.Equal(ErrInvalidCategoryParent, electronics.Update("Electronics", "phones"), "a category should not move under itself")
+	asserts.NoError(laptops.Update("Laptops", "computers"))
+	asserts.Equal(computers.Path+fmt.Sprintf("%v/", laptops.ID), laptops.Path)
+	_, count, _ = FindManyItem("", "", "", "", "", ItemFilter{Category: "computers"})
+	asserts.Equal(1, count, "moved subtree should take its items along")
+	draft := itemModelMocker(seller, 1, 1)[0]
+	test_db.Model(&ItemModel{}).Where("id = ?", draft.ID).Updates(map[string]interface{}{"category_id": laptops.ID, "status": ItemDraft})
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	CategoriesAnonymousRegister(r.Group("/categories"))
+	r.Use(users.AuthMiddleware(true))
+	admin := r.Group("/categories")
+	admin.Use(users.AdminMiddleware())
+	CategoriesAdminRegister(admin)
+
+	req, _ := http.NewRequest("GET", "/categories/", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	var tree struct {
+		Categories []CategoryResponse `json:"categories"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tree)
+	asserts.Len(tree.Categories, 2)
+	asserts.Equal("electronics", tree.Categories[0].Slug)
+	asserts.Equal(2, tree.Categories[0].ItemsCount, "counts should add up the subtree")
+	asserts.Equal("phones", tree.Categories[0].Children[0].Slug)
+	asserts.Equal(1, tree.Categories[1].Children[0].ItemsCount, "only published items should be counted")
+
+	body := `{"category":{"name":"Cameras","parent":"electronics"}}`
+	req, _ = http.NewRequest("POST", "/categories/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(seller.UserModelID)))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusForbidden, w.Code, "only admins should edit categories")
+
+	test_db.Model(&users.UserModel{}).Where("id = ?", seller.UserModelID).Update("is_admin", true)
+	req, _ = http.NewRequest("POST", "/categories/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(seller.UserModelID)))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusCreated, w.Code, "admins should add categories")
+
+	req, _ = http.NewRequest("PUT", "/categories/laptops", bytes.NewBufferString(`{"category":{"name":"Notebooks"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(seller.UserModelID)))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	notebooks, _ := FindOneCategory(&CategoryModel{Slug: "notebooks"})
+	asserts.Equal(computers.ID, notebooks.ParentID, "renaming should not move the category")
+	asserts.Equal(laptops.Path, notebooks.Path)
+}
+
+func TestItemAttributes(t *testing.T) {
+	asserts := assert.New(t)
+
+	clothing, _ := CreateCategory("Clothing "+common.RandString(6), "")
+	shirts, _ := CreateCategory("Shirts "+common.RandString(6), clothing.Slug)
+	_, err := clothing.AddAttribute("brand", AttributeText, nil, true, false)
+	asserts.NoError(err)
+	clothing.AddAttribute("sleeves", AttributeEnum, []string{"Short", "Long"}, false, false)
+	shirts.AddAttribute("chest", AttributeNumber, nil, false, false)
+	shirts.AddAttribute("organic", AttributeBoolean, nil, false, false)
+	_, err = shirts.AddAttribute("Brand", AttributeText, nil, false, false)
+	asserts.Equal(ErrAttributeExists, err, "names should be unique along the path")
+	_, err = shirts.AddAttribute("fit", "colour", nil, false, false)
+	asserts.Equal(ErrInvalidAttribute, err)
+	_, err = shirts.AddAttribute("fit", AttributeEnum, nil, false, false)
+	asserts.Error(err, "enum attributes need options")
+	schema, _ := shirts.AttributeSchema()
+	asserts.Len(schema, 4, "subcategories should inherit the schema")
+
+	validator := NewItemModelValidator()
+	validator.Item.Category = shirts.Slug
+	validator.Item.Attributes = map[string]string{"sleeves": "medium", "chest": "wide", "colour": "red"}
+	err = validator.bindCategory()
+	problems, ok := err.(AttributeError)
+	asserts.True(ok)
+	asserts.Contains(problems, "brand", "required attributes should be enforced")
+	asserts.Contains(problems, "sleeves")
+	asserts.Contains(problems, "chest")
+	asserts.Contains(problems, "colour", "unknown attributes should be rejected")
+
+	validator.Item.Attributes = map[string]string{"brand": "Acme", "sleeves": "long", "chest": "96", "organic": "1"}
+	asserts.NoError(validator.bindCategory())
+	seller := userModelMocker(1)[0]
+	shirtItems := itemModelMocker(seller, 2, 1)
+	test_db.Model(&ItemModel{}).Where("id IN (?)", []uint{shirtItems[0].ID, shirtItems[1].ID}).Update("category_id", shirts.ID)
+	asserts.NoError(shirtItems[0].setAttributes(validator.attributes))
+	asserts.Equal(map[string]string{"brand": "Acme", "sleeves": "Long", "chest": "96", "organic": "true"}, shirtItems[0].Attributes())
+	shirtItems[1].setAttributes([]ItemAttributeModel{{Name: "brand", Value: "Other"}, {Name: "sleeves", Value: "Short"}, {Name: "chest", Value: "110", Number: 110}})
+
+	count := func(attributes map[string]string) int {
+		_, count, _ := FindManyItem("", "", "", "", "", ItemFilter{Category: clothing.Slug, Attributes: attributes})
+		return count
+	}
+	asserts.Equal(1, count(map[string]string{"sleeves": "LONG"}), "values should match ignoring case")
+	asserts.Equal(2, count(map[string]string{"sleeves": "short,long"}))
+	asserts.Equal(1, count(map[string]string{"chest": "90..100"}))
+	asserts.Equal(2, count(map[string]string{"chest": "90.."}))
+	asserts.Equal(1, count(map[string]string{"chest": "100..", "brand": "other"}))
+	asserts.Equal(0, count(map[string]string{"organic": "false"}))
+}
+
+func TestItemVariants(t *testing.T) {
+	asserts := assert.New(t)
+
+	shirts, _ := CreateCategory("Shirts "+common.RandString(6), "")
+	shirts.AddAttribute("size", AttributeEnum, []string{"S", "M", "L"}, true, true)
+	shirts.AddAttribute("colour", AttributeEnum, []string{"Red", "Blue"}, false, true)
+	people := userModelMocker(2)
+	seller, buyer := people[0], people[1]
+	item := itemModelMocker(seller, 1, 5)[0]
+	test_db.Model(&ItemModel{}).Where("id = ?", item.ID).Update("category_id", shirts.ID)
+	item.CategoryID = shirts.ID
+
+	medium, err := item.AddVariant("", 1500, 2, map[string]string{"size": "m", "colour": "red"})
+	asserts.NoError(err)
+	asserts.Equal("M / Red", medium.Name, "names should default to the values")
+	_, err = item.AddVariant("Another", 1500, 2, map[string]string{"size": "M", "colour": "Red"})
+	asserts.Equal(ErrVariantExists, err)
+	_, err = item.AddVariant("", 1500, 2, map[string]string{"colour": "Red"})
+	asserts.IsType(AttributeError{}, err, "required variant attributes should be enforced")
+	large, err := item.AddVariant("", 1800, 1, map[string]string{"size": "L"})
+	asserts.NoError(err)
+	asserts.True(item.HasVariants())
+
+	_, err = ReserveStock(item, buyer, 1)
+	asserts.Equal(ErrVariantRequired, err, "items with variants should be bought through them")
+	_, err = ReserveVariantStock(large, buyer, 2)
+	asserts.Equal(ErrOutOfStock, err)
+	reservation, err := ReserveVariantStock(medium, buyer, 2)
+	asserts.NoError(err)
+	asserts.NoError(reservation.Commit())
+	medium, _ = item.FindVariant(medium.ID)
+	asserts.Equal(0, medium.QuantityAvailable())
+	asserts.Equal(5, reloadItem(item).Quantity, "the item's own stock should not move")
+
+	held, err := ReserveVariantStock(large, buyer, 1)
+	asserts.NoError(err)
+	_, err = item.UpdateVariant(large.ID, "Large", 2000, 0, map[string]string{"size": "L"})
+	asserts.Equal(ErrQuantityBelowReserved, err, "stock should not go below the reserved units")
+	large, _ = item.FindVariant(large.ID)
+	asserts.Equal(1, large.Quantity, "a refused update should change nothing")
+	asserts.NoError(held.Release())
+	updated, err := item.UpdateVariant(large.ID, "Large", 2000, 3, map[string]string{"size": "L", "colour": "Blue"})
+	asserts.NoError(err)
+	asserts.Equal("Large", updated.Name)
+	_, count, _ := FindManyItem("", "", "", "", "", ItemFilter{Category: shirts.Slug, Attributes: map[string]string{"colour": "blue"}})
+	asserts.Equal(1, count, "variant attributes should be filterable")
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	req, _ := http.NewRequest("GET", "/items/"+item.Slug, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response struct {
+		Item ItemResponse `json:"item"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Len(response.Item.Variants, 2)
+	asserts.Equal(3, response.Item.QuantityAvailable, "stock should add up the variants")
+	asserts.Equal("20.00 USD", response.Item.Variants[1].FormattedPrice)
+
+	asserts.NoError(item.RemoveVariant(medium.ID))
+	asserts.Equal(ErrVariantNotFound, item.RemoveVariant(medium.ID))
+}
+
+func TestItemSearch(t *testing.T) {
+	asserts := assert.New(t)
+
+	keyword := fmt.Sprintf("kw%v", time.Now().UnixNano())
+	seller := userModelMocker(1)[0]
+	found := []ItemModel{
+		{Title: "Vintage " + keyword + " camera", Body: "Great condition"},
+		{Title: "Lens cap", Body: "Fits the vintage " + keyword + " camera <b>perfectly</b>"},
+		{Title: "Tripod", Body: "Sturdy", Tags: []TagModel{{Tag: keyword}}},
+	}
+	for i := range found {
+		found[i].Slug = fmt.Sprintf("%v-%v", keyword, i)
+		found[i].SellerID = seller.ID
+		asserts.NoError(test_db.Create(&found[i]).Error)
+	}
+
+	results, count, err := SearchItems(keyword, "", "")
+	asserts.NoError(err)
+	asserts.Equal(3, count)
+	asserts.Len(results, 3)
+	asserts.Equal(found[0].ID, results[0].Item.ID, "title matches should rank first")
+	asserts.Contains(results[0].Snippet, "<mark>"+keyword+"</mark>")
+	for _, result := range results {
+		if result.Item.ID == found[1].ID {
+			asserts.NotContains(result.Snippet, "<b>", "snippets should be escaped")
+		}
+	}
+
+	_, count, _ = SearchItems(`"vintage `+keyword+` camera"`, "", "")
+	asserts.Equal(2, count, "phrases should match in order")
+	_, count, _ = SearchItems(`"camera vintage" `+keyword, "", "")
+	asserts.Equal(0, count)
+	_, count, _ = SearchItems(keyword[:len(keyword)-3]+"*", "", "")
+	asserts.Equal(3, count, "prefix terms should match longer words")
+	_, count, _ = SearchItems(keyword+" lens", "", "")
+	asserts.Equal(1, count, "every term should match")
+	results, count, _ = SearchItems(keyword, "1", "1")
+	asserts.Equal(3, count)
+	asserts.Len(results, 1)
+	_, count, _ = SearchItems(`" *`, "", "")
+	asserts.Equal(0, count, "an empty query should find nothing")
+
+	found[2].Title = "Tripod " + keyword + "x"
+	asserts.NoError(SaveOne(&found[2]))
+	_, count, _ = SearchItems(keyword+"x", "", "")
+	asserts.Equal(1, count, "updates should be searchable")
+	asserts.NoError(DeleteItemModel(&ItemModel{Slug: found[0].Slug}))
+	_, count, _ = SearchItems(keyword, "", "")
+	asserts.Equal(2, count, "deleted items should not be found")
+	for _, availability := range []string{ListingSold, ListingExpired} {
+		test_db.Model(&ItemModel{}).Where("id = ?", found[1].ID).Update("availability", availability)
+		_, count, _ = SearchItems(keyword, "", "")
+		asserts.Equal(1, count, "%v items should not be found", availability)
+	}
+	test_db.Model(&ItemModel{}).Where("id = ?", found[1].ID).Update("availability", ListingAvailable)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	req, _ := http.NewRequest("GET", "/items/search?q="+keyword, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	var response struct {
+		Items      []ItemSearchResponse `json:"items"`
+		ItemsCount int                  `json:"itemsCount"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(2, response.ItemsCount)
+	asserts.Len(response.Items, 2)
+	asserts.NotEmpty(response.Items[0].Snippet)
+}
+
+func TestItemFilters(t *testing.T) {
+	asserts := assert.New(t)
+
+	tag := fmt.Sprintf("t%v", time.Now().UnixNano())
+	people := userModelMocker(3)
+	seller, other, fan := people[0], people[1], people[2]
+	mine := itemModelMocker(seller, 3, 1)
+	theirs := itemModelMocker(other, 1, 1)
+	mine[0].setTags([]string{tag + "a", tag + "b"})
+	mine[1].setTags([]string{tag + "a"})
+	mine[2].setTags([]string{tag + "b"})
+	theirs[0].setTags([]string{tag + "a", tag + "b"})
+	for _, item := range append(mine, theirs...) {
+		test_db.Save(&item)
+	}
+	day := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	for i, item := range mine {
+		test_db.Model(&ItemModel{}).Where("id = ?", item.ID).Update("created_at", day.AddDate(0, 0, i))
+	}
+	mine[2].favoriteBy(fan)
+	mine[1].favoriteBy(fan)
+	mine[2].favoriteBy(other)
+
+	find := func(filter ItemFilter) ([]ItemModel, int) {
+		models, count, _ := FindManyItem("", "", "", "", "", filter)
+		return models, count
+	}
+	_, count := find(ItemFilter{Tags: []string{tag + "a", tag + "b"}})
+	asserts.Equal(2, count, "items should carry all tags by default")
+	_, count = find(ItemFilter{Tags: []string{tag + "a", tag + "b"}, TagMode: "any"})
+	asserts.Equal(4, count)
+	_, count = find(ItemFilter{Tags: []string{tag + "a", tag + "b"}, Seller: seller.UserModel.Username})
+	asserts.Equal(1, count, "filters should combine")
+	_, count = find(ItemFilter{Tags: []string{tag + "b"}, Favorited: fan.UserModel.Username, TagMode: "any"})
+	asserts.Equal(1, count)
+	_, count = find(ItemFilter{Seller: "nobody"})
+	asserts.Equal(0, count)
+
+	models, count := find(ItemFilter{Seller: seller.UserModel.Username, CreatedAfter: "2020-01-11", CreatedBefore: "2020-01-12T13:00:00Z"})
+	asserts.Equal(2, count, "date range should apply")
+	asserts.Equal(mine[2].ID, models[0].ID, "newest should come first by default")
+	models, _ = find(ItemFilter{Seller: seller.UserModel.Username, Sort: "oldest"})
+	asserts.Equal(mine[0].ID, models[0].ID)
+	models, _ = find(ItemFilter{Seller: seller.UserModel.Username, Sort: "most_favorited"})
+	asserts.Equal([]uint{mine[2].ID, mine[1].ID, mine[0].ID}, []uint{models[0].ID, models[1].ID, models[2].ID})
+	models, count = find(ItemFilter{Tags: []string{tag + "a"}, Sort: "-price", MaxPrice: fmt.Sprint(theirs[0].Price - 1)})
+	asserts.Equal(2, count)
+	asserts.True(models[0].Price >= models[1].Price)
+
+	models, count, _ = FindManyItem(tag+"b", seller.UserModel.Username, "1", "1", "", ItemFilter{})
+	asserts.Equal(2, count, "the total should not depend on the page")
+	asserts.Len(models, 1)
+	asserts.Equal(mine[0].ID, models[0].ID)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/items/?tag=%va,%vb&favorited=%v", tag, tag, fan.UserModel.Username), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"itemsCount":0`)
+	req, _ = http.NewRequest("GET", "/items/?sort=random", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	list := "/items/?seller=" + seller.UserModel.Username
+	w = get(list + "&currency=USD&minPrice=" + fmt.Sprint(mine[1].Price) + "&sort=-price")
+	asserts.Equal(http.StatusOK, w.Code)
+	var response struct {
+		Items []ItemResponse `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Len(response.Items, 2, "the price filter should apply")
+	asserts.Equal([]string{mine[2].Slug, mine[1].Slug}, []string{response.Items[0].Slug, response.Items[1].Slug},
+		"the price sort should apply")
+	w = get(list + "&currency=USD&maxPrice=" + fmt.Sprint(mine[0].Price) + "&offset=0")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"itemsCount":1`)
+	w = get(list + "&currency=EUR&minPrice=0")
+	asserts.Contains(w.Body.String(), `"itemsCount":0`, "other currencies should not match")
+	w = get(list + "&minPrice=100")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "price filters should need a currency")
+	asserts.Contains(w.Body.String(), `"currency"`)
+	asserts.Equal(http.StatusUnprocessableEntity, get(list+"&sort=price").Code, "price sorts should need a currency")
+	asserts.Equal(http.StatusUnprocessableEntity, get(list+"&currency=XYZ&sort=price").Code)
+}
+
+func TestItemCreateValidation(t *testing.T) {
+	asserts := assert.New(t)
+
+	seller := userModelMocker(1)[0]
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsRegister(r.Group("/items"))
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/items/?access_token="+common.GenToken(seller.UserModelID), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := post(`{"item":{"title":"Desk lamp","price":1250,"currency":"XYZ"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"Currency":"{key: currency}"}}`, w.Body.String(), "currencies should be those of common.IsCurrency")
+	w = post(`{"item":{"title":"Desk lamp","price":-1}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"Price":"{min: 0}"}}`, w.Body.String())
+	w = post(`{"item":{"title":"Lamp","price":1250,"currency":"CLP","quantity":2}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Contains(w.Body.String(), `"formattedPrice":"1250 CLP"`)
+}
+
+func TestItemCursors(t *testing.T) {
+	asserts := assert.New(t)
+
+	seller := userModelMocker(1)[0]
+	mine := itemModelMocker(seller, 5, 1)
+	day := time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+	// The first two share a creation time, ids have to break the tie.
+	for i, days := range []int{0, 0, 1, 2, 3} {
+		test_db.Model(&ItemModel{}).Where("id = ?", mine[i].ID).Update("created_at", day.AddDate(0, 0, days))
+	}
+	filter := ItemFilter{Seller: seller.UserModel.Username}
+	all, _, _ := FindManyItem("", "", "10", "0", "", filter)
+	asserts.Len(all, 5)
+	asserts.Equal(mine[1].ID, all[3].ID, "ties should go to the highest id")
+
+	ids := func(models []ItemModel) []uint {
+		var ret []uint
+		for _, model := range models {
+			ret = append(ret, model.ID)
+		}
+		return ret
+	}
+	first, err := FindItemPage(filter, "2", "")
+	asserts.NoError(err)
+	asserts.Equal(5, first.Count)
+	asserts.Equal(ids(all[:2]), ids(first.Items))
+	asserts.Equal("", first.Prev)
+	asserts.NotEqual("", first.Next)
+
+	// New items go to the top of the list and must not shift the later pages.
+	itemModelMocker(seller, 1, 1)
+	second, err := FindItemPage(filter, "2", first.Next)
+	asserts.NoError(err)
+	asserts.Equal(ids(all[2:4]), ids(second.Items))
+	last, err := FindItemPage(filter, "2", second.Next)
+	asserts.NoError(err)
+	asserts.Equal(ids(all[4:]), ids(last.Items))
+	asserts.Equal("", last.Next, "the last page has no next cursor")
+	back, err := FindItemPage(filter, "2", second.Prev)
+	asserts.NoError(err)
+	asserts.Equal(ids(all[:2]), ids(back.Items), "prev should lead back to the first page")
+	asserts.NotEqual("", back.Prev, "the new item is now before the first page")
+
+	_, err = FindItemPage(ItemFilter{Seller: seller.UserModel.Username, Sort: "price"}, "2", first.Next)
+	asserts.Equal(common.ErrInvalidCursor, err, "cursors should not carry over to another sort")
+	byPrice, err := FindItemPage(ItemFilter{Seller: seller.UserModel.Username, Sort: "price"}, "4", "")
+	asserts.NoError(err)
+	byPrice, err = FindItemPage(ItemFilter{Seller: seller.UserModel.Username, Sort: "price"}, "4", byPrice.Next)
+	asserts.NoError(err)
+	asserts.Len(byPrice.Items, 2)
+
+	for i := 0; i < 3; i++ {
+		test_db.Create(&CommentModel{ItemID: mine[0].ID, SellerID: seller.ID, Body: fmt.Sprintf("comment %v", i)})
+	}
+	comments, err := mine[0].getCommentPage(2, "")
+	asserts.NoError(err)
+	asserts.Equal(3, comments.Count)
+	asserts.Equal("comment 0", comments.Comments[0].Body, "comments should be oldest first")
+	comments, err = mine[0].getCommentPage(2, comments.Next)
+	asserts.NoError(err)
+	asserts.Len(comments.Comments, 1)
+	asserts.Equal("", comments.Next)
+	asserts.NotEqual("", comments.Prev)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/items/?seller=%v&limit=2&sort=oldest", seller.UserModel.Username), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	var page struct {
+		Items []ItemResponse
+		Next  *string
+		Prev  *string
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	asserts.Len(page.Items, 2)
+	asserts.Nil(page.Prev)
+	if asserts.NotNil(page.Next) {
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/items/?seller=%v&limit=2&sort=oldest&cursor=%v", seller.UserModel.Username, *page.Next), nil)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		asserts.Equal(http.StatusOK, w.Code)
+		asserts.Contains(w.Body.String(), `"prev":"`)
+	}
+	req, _ = http.NewRequest("GET", "/items/?cursor=forged", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/items/%v/comments?limit=2", mine[0].Slug), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"commentsCount":3`)
+}
+
+func TestItemFeed(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(5)
+	reader, followed, tagger, popular, stranger := people[0], people[1], people[2], people[3], people[4]
+	test_db.Create(&users.FollowModel{FollowingID: followed.UserModelID, FollowedByID: reader.UserModelID})
+	fromFollowed := itemModelMocker(followed, 2, 1)
+	tag := fmt.Sprintf("t%v", time.Now().UnixNano())
+	tagged := itemModelMocker(tagger, 1, 1)[0]
+	tagged.setTags([]string{tag})
+	test_db.Save(&tagged)
+	trending := itemModelMocker(popular, 1, 1)[0]
+	for _, fan := range []ItemUserModel{tagger, stranger, followed} {
+		trending.favoriteBy(fan)
+	}
+	unrelated := itemModelMocker(stranger, 1, 1)[0]
+	own := itemModelMocker(reader, 1, 1)[0]
+	_, err := reader.followTag(tag)
+	asserts.NoError(err)
+	// The older of the followed seller's items was listed a week ago.
+	test_db.Model(&ItemModel{}).Where("id = ?", fromFollowed[0].ID).Update("created_at", time.Now().AddDate(0, 0, -7))
+
+	models, count, err := reader.GetItemFeed("1", "0")
+	asserts.NoError(err)
+	asserts.Equal(2, count, "the count should cover every page of the feed")
+	asserts.Len(models, 1)
+
+	position := func() map[uint]int {
+		models, count, err := reader.GetRankedFeed("1000", "0")
+		asserts.NoError(err)
+		asserts.Equal(len(models), count)
+		ret := map[uint]int{}
+		for i, model := range models {
+			ret[model.ID] = i + 1
+		}
+		return ret
+	}
+	ranked := position()
+	for _, item := range []ItemModel{fromFollowed[0], fromFollowed[1], tagged, trending} {
+		asserts.NotZero(ranked[item.ID], "followed sellers, followed tags and trending items should be in the feed")
+	}
+	asserts.Zero(ranked[unrelated.ID])
+	asserts.Zero(ranked[own.ID], "the reader's own items should be left out")
+	asserts.True(ranked[fromFollowed[1].ID] < ranked[tagged.ID], "followed sellers should outweigh followed tags")
+	asserts.True(ranked[tagged.ID] < ranked[fromFollowed[0].ID], "old items should decay")
+	asserts.True(ranked[trending.ID] < ranked[tagged.ID], "favorites should lift items")
+
+	asserts.NoError(reader.markSeen(fromFollowed[1]))
+	ranked = position()
+	asserts.True(ranked[tagged.ID] < ranked[fromFollowed[1].ID], "seen items should drop")
+
+	asserts.NoError(reader.unfollowTag(tag))
+	asserts.Zero(position()[tagged.ID])
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	TagsRegister(r.Group("/tags"))
+	token := common.GenToken(reader.UserModelID)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/tags/%v/follow?access_token=%v", tag, token), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(position(), tagged.ID, "following a tag should work over the API")
+	req, _ = http.NewRequest("GET", "/items/feed?mode=ranked&access_token="+token, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), fmt.Sprintf(`"itemsCount":%v`, len(position())))
+	req, _ = http.NewRequest("GET", "/items/feed?access_token="+token, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Contains(w.Body.String(), `"itemsCount":2`)
+	req, _ = http.NewRequest("GET", "/items/feed?mode=popular&access_token="+token, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	test_db.Model(&ItemModel{}).Where("id = ?", fromFollowed[0].ID).Update("availability", ListingSold)
+	test_db.Model(&ItemModel{}).Where("id = ?", trending.ID).Update("availability", ListingExpired)
+	_, count, _ = reader.GetItemFeed("10", "0")
+	asserts.Equal(1, count, "sold items should leave the feed")
+	page, err := reader.GetItemFeedPage("10", "")
+	asserts.NoError(err)
+	asserts.Equal(1, page.Count)
+	ranked = position()
+	asserts.Zero(ranked[fromFollowed[0].ID], "sold items should leave the ranked feed")
+	asserts.Zero(ranked[trending.ID], "expired items should leave the ranked feed")
+}
+
+func TestItemListQueryCount(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, fan := people[0], people[1]
+	test_db.Create(&users.FollowModel{FollowingID: seller.UserModelID, FollowedByID: fan.UserModelID})
+	mine := itemModelMocker(seller, 8, 1)
+	for i, item := range mine {
+		item.setTags([]string{fmt.Sprintf("q%v", i), "querycount"})
+		test_db.Save(&item)
+		item.AddImage(fmt.Sprintf("http://image/%v.jpg", i), "", false)
+		item.favoriteBy(fan)
+		if i%2 == 0 {
+			item.AddVariant(fmt.Sprintf("v%v", i), item.Price, 1, nil)
+		}
+	}
+	CreateAuction(mine[1], 100, 0, 10, time.Now().Add(time.Hour))
+
+	var queries int
+	count := func(scope *gorm.Scope) { queries++ }
+	test_db.Callback().Query().After("gorm:query").Register("test:count_queries", count)
+	test_db.Callback().RowQuery().After("gorm:row_query").Register("test:count_row_queries", count)
+	defer test_db.Callback().Query().Remove("test:count_queries")
+	defer test_db.Callback().RowQuery().Remove("test:count_row_queries")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("my_user_model", fan.UserModel)
+	finders := []struct {
+		name string
+		find func(limit string) ([]ItemModel, error)
+	}{
+		{"feed", func(limit string) ([]ItemModel, error) {
+			models, _, err := fan.GetItemFeed(limit, "0")
+			return models, err
+		}},
+		{"search", func(limit string) ([]ItemModel, error) {
+			results, _, err := SearchItems("querycount", limit, "0")
+			var models []ItemModel
+			for _, result := range results {
+				models = append(models, result.Item)
+			}
+			return models, err
+		}},
+		{"list", func(limit string) ([]ItemModel, error) {
+			models, _, err := FindManyItem("querycount", seller.UserModel.Username, limit, "0", "", ItemFilter{})
+			return models, err
+		}},
+	}
+	var large []ItemResponse
+	for _, finder := range finders {
+		list := func(limit string) []ItemResponse {
+			queries = 0
+			models, err := finder.find(limit)
+			asserts.NoError(err)
+			serializer := ItemsSerializer{c, models}
+			return serializer.Response()
+		}
+		small := list("2")
+		smallQueries := queries
+		large = list("8")
+		asserts.Len(small, 2, finder.name)
+		asserts.Len(large, 8, finder.name)
+		asserts.Equal(smallQueries, queries, "the number of queries of the %v should not grow with the page", finder.name)
+		asserts.True(queries <= 16, "a page of the %v should cost a handful of queries", finder.name)
+	}
+
+	for _, response := range large {
+		asserts.True(response.Favorite)
+		asserts.Equal(uint(1), response.FavoritesCount)
+		asserts.True(response.Seller.Following)
+		asserts.Equal(seller.UserModel.Username, response.Seller.Username)
+		asserts.Contains(response.Tags, "querycount")
+		asserts.Len(response.Images, 1)
+	}
+	single := ItemSerializer{c, mine[1]}
+	asserts.Equal(large[6].Auction, single.Response().Auction, "lists and single items should agree")
+}
+
+func TestCounters(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, fan, other := people[0], people[1], people[2]
+	mine := itemModelMocker(seller, 2, 1)
+	tag := fmt.Sprintf("c%v", time.Now().UnixNano())
+	for _, item := range mine {
+		item.setTags([]string{tag})
+		test_db.Save(&item)
+	}
+	tagCount := func() uint {
+		var tagModel TagModel
+		test_db.Where(TagModel{Tag: tag}).First(&tagModel)
+		return tagModel.ItemsCount
+	}
+	asserts.Equal(uint(2), tagCount())
+	var sellerModel ItemUserModel
+	test_db.First(&sellerModel, seller.ID)
+	asserts.Equal(uint(2), sellerModel.ItemsCount)
+
+	item := mine[0]
+	asserts.NoError(item.favoriteBy(fan))
+	asserts.NoError(item.favoriteBy(fan), "favoriting twice should count once")
+	asserts.NoError(item.favoriteBy(other))
+	asserts.NoError(item.unFavoriteBy(other))
+	asserts.NoError(item.unFavoriteBy(other))
+	comments := []CommentModel{{ItemID: item.ID, SellerID: fan.ID}, {ItemID: item.ID, SellerID: other.ID}}
+	for i := range comments {
+		test_db.Create(&comments[i])
+	}
+	asserts.NoError(DeleteCommentModel([]uint{comments[0].ID}))
+	item = reloadItem(item)
+	asserts.Equal(uint(1), item.FavoritesCount)
+	asserts.Equal(uint(1), item.CommentsCount)
+
+	asserts.NoError(DeleteItemModel(&ItemModel{Slug: mine[1].Slug}))
+	asserts.Equal(uint(1), tagCount(), "deleted items should not count")
+	test_db.First(&sellerModel, seller.ID)
+	asserts.Equal(uint(1), sellerModel.ItemsCount)
+
+	test_db.Model(&ItemModel{}).Where("id = ?", item.ID).UpdateColumns(map[string]interface{}{"favorites_count": 9, "comments_count": 9})
+	test_db.Model(&TagModel{}).Where(TagModel{Tag: tag}).UpdateColumn("items_count", 9)
+	test_db.Model(&ItemUserModel{}).Where("id = ?", seller.ID).UpdateColumn("items_count", 9)
+	asserts.NoError(Recount())
+	item = reloadItem(item)
+	asserts.Equal(uint(1), item.FavoritesCount, "recount should repair drift")
+	asserts.Equal(uint(1), item.CommentsCount)
+	asserts.Equal(uint(1), tagCount())
+	test_db.First(&sellerModel, seller.ID)
+	asserts.Equal(uint(1), sellerModel.ItemsCount)
+}
+
+func TestItemLifecycle(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, reader := people[0], people[1]
+	test_db.Create(&users.FollowModel{FollowingID: seller.UserModelID, FollowedByID: reader.UserModelID})
+	mine := itemModelMocker(seller, 3, 1)
+	published, draft, scheduled := mine[0], mine[1], mine[2]
+	asserts.Equal(ItemPublished, published.Status, "items should be published by default")
+	now := time.Now()
+	asserts.NoError(draft.setStatus(ItemDraft, nil, now))
+	asserts.Equal(ErrInvalidPublishAt, scheduled.setStatus(ItemScheduled, nil, now))
+	asserts.Equal(ErrInvalidPublishAt, scheduled.setStatus(ItemScheduled, &now, now))
+	asserts.Equal(ErrInvalidStatus, scheduled.setStatus("sold", nil, now))
+	later := now.Add(time.Hour)
+	asserts.NoError(scheduled.setStatus(ItemScheduled, &later, now))
+	test_db.Save(&draft)
+	test_db.Save(&scheduled)
+
+	ids := func(models []ItemModel) []uint {
+		var ret []uint
+		for _, model := range models {
+			ret = append(ret, model.ID)
+		}
+		return ret
+	}
+	listed, _, err := FindManyItem("", seller.UserModel.Username, "10", "0", "", ItemFilter{})
+	asserts.NoError(err)
+	asserts.Equal([]uint{published.ID}, ids(listed), "only published items should be listed")
+	listed, _, err = FindManyItem("", seller.UserModel.Username, "10", "0", "", ItemFilter{Unpublished: true})
+	asserts.NoError(err)
+	asserts.Len(listed, 3)
+	feed, count, err := reader.GetItemFeed("10", "0")
+	asserts.NoError(err)
+	asserts.Equal(1, count)
+	asserts.Equal([]uint{published.ID}, ids(feed))
+	results, _, err := SearchItems(draft.Title, "100", "0")
+	asserts.NoError(err)
+	for _, result := range results {
+		asserts.NotEqual(draft.ID, result.Item.ID, "drafts should not be found")
+	}
+
+	n, err := PublishScheduledItems(now)
+	asserts.NoError(err)
+	asserts.Zero(n)
+	n, err = PublishScheduledItems(later)
+	asserts.NoError(err)
+	asserts.Equal(1, n)
+	asserts.Equal(ItemPublished, reloadItem(scheduled).Status)
+	feed, _, _ = reader.GetItemFeed("10", "0")
+	asserts.Len(feed, 2, "scheduled items should show once published")
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	get := func(url string, user ItemUserModel) *httptest.ResponseRecorder {
+		if user.ID != 0 {
+			url += "&access_token=" + common.GenToken(user.UserModelID)
+		}
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	asserts.Equal(http.StatusNotFound, get("/items/"+draft.Slug+"?", reader).Code, "drafts should be hidden from others")
+	asserts.Equal(http.StatusNotFound, get("/items/"+draft.Slug+"/comments?", reader).Code)
+	w := get("/items/"+draft.Slug+"?", seller)
+	asserts.Equal(http.StatusOK, w.Code, "sellers should see their drafts")
+	asserts.Contains(w.Body.String(), `"status":"draft"`)
+	asserts.Contains(get("/items/?seller="+seller.UserModel.Username, seller).Body.String(), draft.Slug)
+	w = get("/items/?seller="+seller.UserModel.Username, ItemUserModel{})
+	asserts.NotContains(w.Body.String(), draft.Slug)
+}
+
+func TestItemRevisions(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, other := people[0], people[1]
+	item := itemModelMocker(seller, 1, 1)[0]
+	first := fmt.Sprintf("r%v", time.Now().UnixNano())
+	second := first + "b"
+	item.setTags([]string{first})
+	test_db.Save(&item)
+	item, _ = FindOneItem(&ItemModel{Slug: item.Slug})
+	original := item.Title
+	tagCount := func(tag string) uint {
+		var tagModel TagModel
+		test_db.Where(TagModel{Tag: tag}).First(&tagModel)
+		return tagModel.ItemsCount
+	}
+
+	data := ItemModel{Title: item.Title + " v2", Description: "", Body: "new body"}
+	data.setTags([]string{second})
+	asserts.NoError(item.Revise(seller, data))
+	asserts.Equal(uint(0), tagCount(first), "removed tags should not count the item")
+	asserts.Equal(uint(1), tagCount(second))
+	same := ItemModel{Title: data.Title, Body: data.Body}
+	same.setTags([]string{second})
+	asserts.NoError(item.Revise(seller, same), "updates changing nothing should not be stored")
+
+	revisions, err := item.Revisions()
+	asserts.NoError(err)
+	asserts.Len(revisions, 2)
+	asserts.Equal(2, revisions[0].Number)
+	asserts.Equal("title,body,tagList", revisions[0].Fields)
+	asserts.Equal(seller.UserModelID, revisions[0].Editor.UserModel.ID)
+	asserts.Equal(original, revisions[1].Title, "the first revision should keep the item as it was")
+	asserts.Error(test_db.Save(&revisions[1]).Error, "revisions should be immutable")
+
+	changes, err := item.DiffRevisions(1, 2)
+	asserts.NoError(err)
+	asserts.Len(changes, 3)
+	asserts.Equal(ItemFieldChange{Field: "title", From: original, To: data.Title}, changes[0])
+	asserts.Equal([]string{second}, changes[2].Added)
+	asserts.Equal([]string{first}, changes[2].Removed)
+	_, err = item.DiffRevisions(1, 5)
+	asserts.Equal(ErrRevisionNotFound, err)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	ItemsRegister(r.Group("/items"))
+	request := func(method, url string, user ItemUserModel) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url+"?access_token="+common.GenToken(user.UserModelID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	slug := reloadItem(item).Slug
+	w := request("GET", "/items/"+slug+"/revisions", other)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"revisionsCount":2`)
+	w = request("GET", "/items/"+slug+"/revisions/2/diff", other)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"removed":["`+first+`"]`)
+	asserts.Equal(http.StatusNotFound, request("POST", "/items/"+slug+"/revisions/1/restore", other).Code,
+		"only the seller should restore revisions")
+	w = request("POST", "/items/"+slug+"/revisions/1/restore", seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	item, _ = FindOneItem(&ItemModel{Model: gorm.Model{ID: item.ID}})
+	asserts.Equal(original, item.Title)
+	asserts.Equal(first, item.Tags[0].Tag)
+	asserts.Equal(uint(1), tagCount(first))
+	revisions, _ = item.Revisions()
+	asserts.Len(revisions, 3, "restoring should be a revision too")
+	asserts.Equal(seller.ID, revisions[0].EditorID)
+}
+
+func TestItemSlugs(t *testing.T) {
+	asserts := assert.New(t)
+
+	seller := userModelMocker(1)[0]
+	title := fmt.Sprintf("Lamp %v", time.Now().UnixNano())
+	base := strings.ToLower(strings.Replace(title, " ", "-", -1))
+	var created []ItemModel
+	for i := 0; i < 3; i++ {
+		item := ItemModel{Title: title, Currency: "USD", SellerID: seller.ID}
+		asserts.NoError(SaveOne(&item))
+		created = append(created, item)
+	}
+	asserts.Equal(base, created[0].Slug)
+	asserts.Equal(base+"-2", created[1].Slug, "same titles should get suffixed slugs")
+	asserts.Equal(base+"-3", created[2].Slug)
+	asserts.NoError(DeleteItemModel(&ItemModel{Slug: created[2].Slug}))
+	again := ItemModel{Title: title, Currency: "USD", SellerID: seller.ID}
+	asserts.NoError(SaveOne(&again))
+	asserts.Equal(base+"-4", again.Slug, "deleted items should keep their slugs")
+
+	item, _ := FindOneItem(&ItemModel{Slug: created[0].Slug})
+	asserts.NoError(item.Revise(seller, ItemModel{Title: strings.ToUpper(title)}))
+	asserts.Equal(base, item.Slug, "titles with the same slug should keep it")
+	asserts.NoError(item.Revise(seller, ItemModel{Title: title + " v2"}))
+	asserts.Equal(base+"-v2", item.Slug)
+	current, err := FindItemSlug(base)
+	asserts.NoError(err)
+	asserts.Equal(item.Slug, current)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/api/items"))
+	req, _ := http.NewRequest("GET", "/api/items/"+base+"?x=1", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusMovedPermanently, w.Code, "old slugs should redirect")
+	asserts.Equal("/api/items/"+base+"-v2?x=1", w.Header().Get("Location"))
+	req, _ = http.NewRequest("GET", w.Header().Get("Location"), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"slug":"`+base+`-v2"`)
+
+	asserts.NoError(item.Revise(seller, ItemModel{Title: title}))
+	asserts.Equal(base, item.Slug, "items should get their old slugs back")
+	_, err = FindItemSlug(base)
+	asserts.Error(err)
+	current, _ = FindItemSlug(base + "-v2")
+	asserts.Equal(base, current)
+
+	for _, word := range []string{"feed", "search", "export", "import", "imports"} {
+		slug, err := uniqueSlug(test_db, word, 0)
+		asserts.NoError(err)
+		asserts.Equal(word+"-2", slug, "slugs should not shadow the routes under /items")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, commenter, admin := people[0], people[1], people[2]
+	test_db.Model(&users.UserModel{}).Where("id = ?", admin.UserModelID).Update("is_admin", true)
+	mine := itemModelMocker(seller, 3, 1)
+	tag := fmt.Sprintf("trash%v", time.Now().UnixNano())
+	mine[0].setTags([]string{tag})
+	test_db.Save(&mine[0])
+	mine[0].favoriteBy(commenter)
+	comments := []CommentModel{{ItemID: mine[1].ID, SellerID: commenter.ID, Body: "kept"}, {ItemID: mine[0].ID, SellerID: commenter.ID}}
+	for i := range comments {
+		test_db.Create(&comments[i])
+	}
+	asserts.NoError(DeleteItemModel(&ItemModel{Slug: mine[0].Slug}))
+	asserts.NoError(DeleteCommentModel([]uint{comments[0].ID}))
+	asserts.NoError(DeleteCommentModel([]uint{comments[1].ID}))
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(true))
+	TrashRegister(r.Group("/user/trash"))
+	admins := r.Group("/admin")
+	admins.Use(users.AdminMiddleware())
+	TrashAdminRegister(admins)
+	request := func(method, url string, user ItemUserModel) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url+"?access_token="+common.GenToken(user.UserModelID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := request("GET", "/user/trash/", seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	var trash TrashResponse
+	json.Unmarshal(w.Body.Bytes(), &trash)
+	asserts.Len(trash.Items, 1)
+	asserts.Equal(mine[0].Slug, trash.Items[0].Slug)
+	asserts.Equal([]string{tag}, trash.Items[0].Tags)
+	asserts.Len(trash.Comments, 0, "other people's comments should not be in the trash")
+	json.Unmarshal(request("GET", "/user/trash/", commenter).Body.Bytes(), &trash)
+	asserts.Len(trash.Comments, 2)
+
+	asserts.Equal(http.StatusNotFound, request("POST", "/user/trash/items/"+mine[0].Slug+"/restore", commenter).Code,
+		"only the seller should restore an item")
+	asserts.Equal(http.StatusConflict, request("POST", fmt.Sprintf("/user/trash/comments/%v/restore", comments[1].ID), commenter).Code,
+		"comments of deleted items should wait for the item")
+	asserts.Equal(http.StatusOK, request("POST", "/user/trash/items/"+mine[0].Slug+"/restore", seller).Code)
+	asserts.Equal(http.StatusOK, request("POST", fmt.Sprintf("/user/trash/comments/%v/restore", comments[1].ID), commenter).Code)
+	item := reloadItem(mine[0])
+	asserts.Equal(uint(1), item.FavoritesCount)
+	asserts.Equal(uint(1), item.CommentsCount)
+	var tagModel TagModel
+	test_db.Where(TagModel{Tag: tag}).First(&tagModel)
+	asserts.Equal(uint(1), tagModel.ItemsCount, "restored items should count again")
+	var sellerModel ItemUserModel
+	test_db.First(&sellerModel, seller.ID)
+	asserts.Equal(uint(3), sellerModel.ItemsCount)
+
+	asserts.NoError(DeleteItemModel(&ItemModel{Slug: mine[2].Slug}))
+	n, err := PurgeTrash(time.Now().Add(-time.Hour))
+	asserts.NoError(err)
+	asserts.Zero(n, "recently deleted rows should stay in the trash")
+	test_db.Unscoped().Model(&ItemModel{}).Where("id = ?", mine[2].ID).Update("deleted_at", time.Now().AddDate(0, 0, -40))
+	n, err = PurgeTrash(time.Now().Add(-DefaultTrashRetention))
+	asserts.NoError(err)
+	asserts.True(n >= 1)
+	var left int
+	test_db.Unscoped().Model(&ItemModel{}).Where("id = ?", mine[2].ID).Count(&left)
+	asserts.Zero(left, "old trash should be purged")
+
+	asserts.Equal(http.StatusForbidden, request("DELETE", "/admin/items/"+mine[1].Slug, seller).Code)
+	asserts.Equal(http.StatusOK, request("DELETE", "/admin/items/"+mine[1].Slug, admin).Code)
+	test_db.Unscoped().Model(&ItemModel{}).Where("id = ?", mine[1].ID).Count(&left)
+	asserts.Zero(left, "admins should delete items for good")
+	test_db.Unscoped().Model(&CommentModel{}).Where("id = ?", comments[0].ID).Count(&left)
+	asserts.Zero(left, "comments should go with their item")
+	test_db.First(&sellerModel, seller.ID)
+	asserts.Equal(uint(1), sellerModel.ItemsCount)
+	asserts.Equal(http.StatusOK, request("DELETE", fmt.Sprintf("/admin/comments/%v", comments[1].ID), admin).Code)
+	asserts.Equal(uint(0), reloadItem(mine[0]).CommentsCount)
+}
+
+func TestBodyHTML(t *testing.T) {
+	asserts := assert.New(t)
+
+	seller := userModelMocker(1)[0]
+	item := ItemModel{Title: "Markdown lamp", Body: "*brass*", Currency: "USD", SellerID: seller.ID}
+	asserts.NoError(SaveOne(&item))
+	asserts.Equal("<p><em>brass</em></p>\n", reloadItem(item).BodyHTML, "bodies should be rendered when saved")
+	item, _ = FindOneItem(&ItemModel{Slug: item.Slug})
+	asserts.NoError(item.Revise(seller, ItemModel{Title: item.Title, Body: "**copper**<script>x</script>"}))
+	asserts.Equal("<p><strong>copper</strong>x</p>\n", reloadItem(item).BodyHTML)
+	revisions, _ := item.Revisions()
+	asserts.Equal("<p><em>brass</em></p>\n", revisions[1].BodyHTML, "every revision should keep its own rendering")
+
+	comment := CommentModel{ItemID: item.ID, SellerID: seller.ID, Body: "[see](http://example.com)"}
+	test_db.Create(&comment)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("my_user_model", seller.UserModel)
+	commentSerializer := CommentSerializer{c, comment}
+	asserts.Contains(commentSerializer.Response().BodyHTML, `rel="nofollow"`)
+	test_db.Model(&ItemModel{}).Where("id = ?", item.ID).UpdateColumn("body_html", "")
+	serializer := ItemSerializer{c, reloadItem(item)}
+	asserts.Equal("<p><strong>copper</strong>x</p>\n", serializer.Response().BodyHTML, "older rows should be rendered on the fly")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	AutoMigrate()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
+
+func TestItemAvailability(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, buyer, other := people[0], people[1], people[2]
+	mine := itemModelMocker(seller, 3, 2)
+	sold, reserved, expiring := mine[0], mine[1], mine[2]
+	asserts.Equal(ListingAvailable, sold.Availability, "items should be available by default")
+	asserts.NotNil(sold.ExpiresAt, "items should start their listing period")
+	now := time.Now()
+	asserts.NoError(sold.SetAvailability(ListingSold, buyer, now))
+	asserts.Equal(ErrBuyerRequired, reserved.SetAvailability(ListingReserved, ItemUserModel{}, now))
+	asserts.Equal(ErrInvalidAvailability, reserved.SetAvailability("gone", buyer, now))
+	asserts.NoError(reserved.SetAvailability(ListingReserved, buyer, now))
+
+	ids := func(models []ItemModel) []uint {
+		var ret []uint
+		for _, model := range models {
+			ret = append(ret, model.ID)
+		}
+		return ret
+	}
+	listed, _, err := FindManyItem("", seller.UserModel.Username, "10", "0", "", ItemFilter{})
+	asserts.NoError(err)
+	asserts.ElementsMatch([]uint{reserved.ID, expiring.ID}, ids(listed), "sold items should not be listed")
+	listed, _, err = FindManyItem("", seller.UserModel.Username, "10", "0", "", ItemFilter{Availability: []string{ListingSold}})
+	asserts.NoError(err)
+	asserts.Equal([]uint{sold.ID}, ids(listed))
+
+	_, err = ReserveStock(reloadItem(sold), buyer, 1)
+	asserts.Equal(ErrItemUnavailable, err)
+	_, err = ReserveStock(reloadItem(reserved), other, 1)
+	asserts.Equal(ErrItemUnavailable, err, "reserved items should only be bought by their buyer")
+	_, err = ReserveStock(reloadItem(reserved), buyer, 1)
+	asserts.NoError(err)
+
+	later := reloadItem(expiring).ExpiresAt.Add(time.Second)
+	n, err := ExpireListings(later)
+	asserts.NoError(err)
+	asserts.True(n >= 1)
+	expiring = reloadItem(expiring)
+	asserts.Equal(ListingExpired, expiring.Availability)
+	asserts.Equal(ListingReserved, reloadItem(reserved).Availability, "only available listings should expire")
+	_, err = ReserveStock(expiring, buyer, 1)
+	asserts.Equal(ErrItemUnavailable, err)
+	asserts.NoError(expiring.Renew(later))
+	expiring = reloadItem(expiring)
+	asserts.Equal(ListingAvailable, expiring.Availability)
+	asserts.True(expiring.ExpiresAt.After(later))
+	sold = reloadItem(sold)
+	asserts.Equal(ErrItemSold, sold.Renew(now))
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	ItemsRegister(r.Group("/items"))
+	request := func(method, url, body string, user ItemUserModel) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url+"access_token="+common.GenToken(user.UserModelID), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	body := `{"availability":{"status":"reserved","buyer":"` + other.UserModel.Username + `"}}`
+	asserts.Equal(http.StatusNotFound, request("PUT", "/items/"+expiring.Slug+"/availability?", body, other).Code,
+		"only the seller should change the availability")
+	w := request("PUT", "/items/"+expiring.Slug+"/availability?", body, seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"availability":"reserved"`)
+	w = request("PUT", "/items/"+expiring.Slug+"/availability?", `{"availability":{"status":"reserved"}}`, seller)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(http.StatusConflict, request("POST", "/items/"+sold.Slug+"/renew?", "", seller).Code)
+	asserts.Equal(http.StatusOK, request("POST", "/items/"+expiring.Slug+"/renew?", "", seller).Code)
+	w = request("GET", "/items/?seller="+seller.UserModel.Username+"&status=sold,reserved&", "", other)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), sold.Slug)
+	asserts.Equal(http.StatusUnprocessableEntity, request("GET", "/items/?status=gone&", "", other).Code)
+}
+
+func TestItemBulkImport(t *testing.T) {
+	asserts := assert.New(t)
+
+	seller := userModelMocker(1)[0]
+	tag := fmt.Sprintf("bulk%v", time.Now().UnixNano())
+	file := "Name,price,tagList,status\n" +
+		"Desk lamp," + "1500,\"" + tag + ",light\",draft\n" +
+		"Bad,abc,,\n" +
+		"No,100,,\n" +
+		"Floor lamp,2500," + tag + ",\n"
+	mapping := map[string]string{"title": "Name"}
+	count := func() int {
+		var n int
+		test_db.Model(&ItemModel{}).Where("seller_id = ?", seller.ID).Count(&n)
+		return n
+	}
+
+	result, err := ImportItems(seller, strings.NewReader(file), BulkCSV, mapping, true)
+	asserts.NoError(err)
+	asserts.Equal(4, result.RowsCount)
+	asserts.Equal(0, result.CreatedCount)
+	asserts.Equal(0, count(), "dry runs should create nothing")
+	asserts.Equal([]ItemImportError{
+		{Row: 2, Field: "price", Message: "should be a whole number"},
+		{Row: 3, Field: "title", Message: "{min: 4}"},
+	}, result.Errors)
+	asserts.Equal("row,field,message\n2,price,should be a whole number\n3,title,{min: 4}\n", result.ReportCSV())
+
+	result, err = ImportItems(seller, strings.NewReader(file), BulkCSV, mapping, false)
+	asserts.NoError(err)
+	asserts.Equal(2, result.CreatedCount)
+	asserts.Equal(2, result.ErrorsCount)
+	asserts.Equal(2, count())
+	lamp, _ := FindOneItem(&ItemModel{Title: "Desk lamp", SellerID: seller.ID})
+	asserts.Equal(int64(1500), lamp.Price)
+	asserts.Equal(ItemDraft, lamp.Status)
+	asserts.Len(lamp.Tags, 2)
+
+	ndjson := `{"title":"Table lamp","price":900,"tagList":["` + tag + `"],"status":"published"}` + "\n\n" +
+		`{"title":"Chair","price":"cheap"}` + "\n" +
+		`not json` + "\n"
+	result, err = ImportItems(seller, strings.NewReader(ndjson), BulkNDJSON, nil, false)
+	asserts.NoError(err)
+	asserts.Equal(3, result.RowsCount)
+	asserts.Equal(1, result.CreatedCount)
+	asserts.Equal([]ItemImportError{{2, "price", "is invalid"}, {3, "row", "should be a JSON object"}}, result.Errors)
+	_, err = ImportItems(seller, strings.NewReader(ndjson), "xml", nil, false)
+	asserts.Equal(ErrInvalidBulkFormat, err)
+
+	var exported bytes.Buffer
+	asserts.NoError(ExportItems(seller, &exported, BulkCSV))
+	lines := strings.Split(strings.TrimSpace(exported.String()), "\n")
+	asserts.Len(lines, 4)
+	asserts.Equal(strings.Join(BulkFields, ","), lines[0])
+	asserts.Contains(lines[1], `Desk lamp,,,1500,USD,0,"`+tag+`,light",,draft,,available`)
+	other := userModelMocker(1)[0]
+	result, err = ImportItems(other, strings.NewReader(exported.String()), BulkCSV, nil, false)
+	asserts.NoError(err)
+	asserts.Equal(3, result.CreatedCount, "exports should import back")
+	exported.Reset()
+	asserts.NoError(ExportItems(seller, &exported, BulkNDJSON))
+	asserts.Contains(exported.String(), `"title":"Table lamp"`)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	ItemsRegister(r.Group("/items"))
+	request := func(method, url, contentType, body string, user ItemUserModel) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url+"access_token="+common.GenToken(user.UserModelID), strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := request("POST", "/items/import?dryRun=true&map[title]=Name&", "text/csv", file, seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"errorsCount":2`)
+	var response struct {
+		Import ItemImportResponse `json:"import"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(http.StatusNotFound, request("GET", fmt.Sprintf("/items/imports/%v/report?", response.Import.ID), "", "", other).Code,
+		"reports should only be shown to their seller")
+	w = request("GET", fmt.Sprintf("/items/imports/%v/report?", response.Import.ID), "", "", seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	asserts.Contains(w.Body.String(), "3,title,{min: 4}")
+	asserts.Equal(http.StatusUnprocessableEntity, request("POST", "/items/import?", "text/plain", file, seller).Code)
+	w = request("GET", "/items/export?format=ndjson&", "", "", seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(3, strings.Count(w.Body.String(), "\n"))
+}
+
+func TestItemAnalytics(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.True(IsBot("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"))
+	asserts.True(IsBot("curl/7.68.0"))
+	asserts.True(IsBot(""))
+	asserts.False(IsBot("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"))
+
+	people := userModelMocker(2)
+	seller, fan := people[0], people[1]
+	mine := itemModelMocker(seller, 2, 1)
+	popular, quiet := mine[0], mine[1]
+	now := time.Now().UTC()
+	twoDaysAgo := now.AddDate(0, 0, -2)
+	viewer := viewerKey(0, "10.0.0.1", "Mozilla/5.0")
+	asserts.NotEqual(viewer, viewerKey(0, "10.0.0.2", "Mozilla/5.0"))
+	recorded, err := RecordView(popular, viewer, twoDaysAgo)
+	asserts.NoError(err)
+	asserts.True(recorded)
+	recorded, _ = RecordView(popular, viewer, twoDaysAgo.Add(ViewWindow/2))
+	asserts.False(recorded, "views by the same viewer within the window should count once")
+	recorded, _ = RecordView(popular, viewer, twoDaysAgo.Add(ViewWindow+time.Minute))
+	asserts.True(recorded)
+	_, err = RollupViews(twoDaysAgo.Add(time.Hour))
+	asserts.NoError(err)
+	var kept int
+	test_db.Model(&ItemViewModel{}).Where("item_id = ?", popular.ID).Count(&kept)
+	asserts.Equal(2, kept, "views of the current day should wait for it to be over")
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	AnalyticsRegister(r.Group("/user/analytics"))
+	request := func(url, userAgent string, user ItemUserModel) *httptest.ResponseRecorder {
+		if user.ID != 0 {
+			url += "&access_token=" + common.GenToken(user.UserModelID)
+		}
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	browser := "Mozilla/5.0 (X11; Linux x86_64)"
+	request("/items/"+popular.Slug+"?", browser, ItemUserModel{})
+	request("/items/"+popular.Slug+"?", browser, ItemUserModel{})
+	request("/items/"+popular.Slug+"?", browser, fan)
+	request("/items/"+popular.Slug+"?", "Googlebot/2.1", ItemUserModel{})
+	request("/items/"+popular.Slug+"?", browser, seller)
+	request("/items/"+quiet.Slug+"?", browser, fan)
+	var views int
+	test_db.Model(&ItemViewModel{}).Where("item_id = ? AND created_at >= ?", popular.ID, now.Add(-time.Minute)).Count(&views)
+	asserts.Equal(2, views, "bots, sellers and repeated views should not be recorded")
+
+	analytics, _, err := GetSellerAnalytics(seller, twoDaysAgo, now)
+	asserts.NoError(err)
+	asserts.Equal(4, analytics[0].Views, "views not rolled up yet should count too")
+
+	_, err = RollupViews(now)
+	asserts.NoError(err)
+	var old int
+	test_db.Model(&ItemViewModel{}).Where("item_id = ?", popular.ID).Count(&old)
+	asserts.Equal(2, old, "views of past days should be pruned once rolled up, however old")
+	var days []ItemViewDailyModel
+	test_db.Where("item_id = ?", popular.ID).Order("day asc").Find(&days)
+	asserts.Len(days, 1, "only days that are over should be rolled up")
+	asserts.Equal(ItemViewDailyModel{ItemID: popular.ID, Day: twoDaysAgo.Format("2006-01-02"), Views: 2, Viewers: 1},
+		ItemViewDailyModel{ItemID: days[0].ItemID, Day: days[0].Day, Views: days[0].Views, Viewers: days[0].Viewers})
+
+	popular.favoriteBy(fan)
+	test_db.Create(&CommentModel{ItemID: popular.ID, SellerID: fan.ID, Body: "nice"})
+	SetSalesCounter(func(itemIDs []uint, from, to time.Time) (map[uint]int, error) {
+		return map[uint]int{popular.ID: 1}, nil
+	})
+	defer SetSalesCounter(nil)
+	analytics, totals, err := GetSellerAnalytics(seller, twoDaysAgo, now)
+	asserts.NoError(err)
+	asserts.Len(analytics, 2)
+	asserts.Equal(popular.ID, analytics[0].Item.ID, "most viewed items should come first")
+	asserts.Equal(ItemAnalytics{Item: analytics[0].Item, Views: 4, ViewerDays: 3, Favorites: 1, Comments: 1, Orders: 1, Conversion: 0.25},
+		analytics[0])
+	asserts.Equal(5, totals.Views)
+	analytics, _, _ = GetSellerAnalytics(seller, now, now)
+	asserts.Equal(2, analytics[0].Views, "only the days asked for should count")
+	_, _, err = GetSellerAnalytics(seller, now, twoDaysAgo)
+	asserts.Equal(ErrInvalidDateRange, err)
+
+	w := request("/user/analytics/?from="+twoDaysAgo.Format("2006-01-02"), browser, seller)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"slug":"`+popular.Slug+`","title":"`+popular.Title+`","status":"published","views":4`)
+	asserts.Contains(w.Body.String(), `"conversion":0.25`)
+	asserts.Equal(http.StatusUnprocessableEntity, request("/user/analytics/?from=yesterday", browser, seller).Code)
+	asserts.Equal(http.StatusUnprocessableEntity, request("/user/analytics/?from=2020-01-01&to=2023-01-01", browser, seller).Code)
+
+	// A view saved after its day was rolled up goes into the next rollup.
+	late := ItemViewModel{ItemID: popular.ID, Viewer: viewer}
+	late.CreatedAt = twoDaysAgo.Add(2 * ViewWindow)
+	test_db.Create(&late)
+	_, err = RollupViews(now)
+	asserts.NoError(err)
+	var day ItemViewDailyModel
+	test_db.Where("item_id = ? AND day = ?", popular.ID, twoDaysAgo.Format("2006-01-02")).First(&day)
+	asserts.Equal(3, day.Views)
+	asserts.Equal(1, day.Viewers, "a returning viewer should count once however many runs roll their day up")
+}
+
+func TestRelatedItems(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	sellerA, sellerB, fan := people[0], people[1], people[2]
+	mineA := itemModelMocker(sellerA, 3, 1)
+	mineB := itemModelMocker(sellerB, 3, 1)
+	item, sameSeller, newest := mineA[0], mineA[1], mineA[2]
+	twoTags, oneTag, sold := mineB[0], mineB[1], mineB[2]
+	tag := fmt.Sprintf("rel%v", time.Now().UnixNano())
+	for _, tagged := range []struct {
+		item *ItemModel
+		tags []string
+	}{
+		{&item, []string{tag + "a", tag + "b"}},
+		{&twoTags, []string{tag + "a", tag + "b"}},
+		{&oneTag, []string{tag + "a"}},
+		{&sold, []string{tag + "a", tag + "b"}},
+	} {
+		tagged.item.setTags(tagged.tags)
+		test_db.Save(tagged.item)
+	}
+	asserts.NoError(sold.SetAvailability(ListingSold, ItemUserModel{}, time.Now()))
+	item.favoriteBy(fan)
+	oneTag.favoriteBy(fan)
+
+	n, err := ComputeRelatedItems()
+	asserts.NoError(err)
+	asserts.True(n > 0)
+	related, err := item.RelatedItems("")
+	asserts.NoError(err)
+	var ids []uint
+	for _, model := range related {
+		ids = append(ids, model.ID)
+	}
+	asserts.Equal([]uint{oneTag.ID, twoTags.ID, newest.ID, sameSeller.ID}, ids,
+		"co-favorites should outweigh a tag, sold items should be left out and the seller's items fill in")
+	asserts.Equal(tag+"a", related[0].Tags[0].Tag)
+	related, _ = sameSeller.RelatedItems("")
+	asserts.Len(related, 2, "items with nothing in common should get their seller's other items")
+	var rows []ItemRelatedModel
+	test_db.Where("item_id = ?", oneTag.ID).Order("position asc").Find(&rows)
+	asserts.Equal(3.0, rows[0].Score)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ItemsAnonymousRegister(r.Group("/items"))
+	request := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := request("/items/" + item.Slug + "/related?limit=1")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"slug":"`+oneTag.Slug+`"`)
+	asserts.Contains(w.Body.String(), `"itemsCount":1`)
+	asserts.Equal(http.StatusNotFound, request("/items/missing-item/related").Code)
+}
@@ -1,10 +1,11 @@
 package items
 
 import (
-	"github.com/gosimple/slug"
 	"github.com/NivRichter/GoLang-test1/common"
 	"github.com/NivRichter/GoLang-test1/users"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"time"
 )
 
 type ItemModelValidator struct {
@@ -12,9 +13,20 @@ type ItemModelValidator struct {
 		Title       string   `form:"title" json:"title" binding:"exists,min=4"`
 		Description string   `form:"description" json:"description" binding:"max=2048"`
 		Body        string   `form:"body" json:"body" binding:"max=2048"`
+		Price       int64    `form:"price" json:"price" binding:"min=0"`
+		Currency    string   `form:"currency" json:"currency" binding:"omitempty,currency"`
+		Quantity    int      `form:"quantity" json:"quantity" binding:"min=0"`
 		Tags        []string `form:"tagList" json:"tagList"`
+		Category    string   `form:"category" json:"category"`
+		// Values of the item attributes of the category's schema, by name.
+		Attributes map[string]string `form:"attributes" json:"attributes"`
+		// One of the Item* statuses, published when empty; scheduled items go
+		// live at PublishAt.
+		Status    string     `form:"status" json:"status"`
+		PublishAt *time.Time `form:"publishAt" json:"publishAt"`
 	} `json:"item"`
-	itemModel ItemModel `json:"-"`
+	itemModel  ItemModel            `json:"-"`
+	attributes []ItemAttributeModel `json:"-"`
 }
 
 func NewItemModelValidator() ItemModelValidator {
@@ -26,9 +38,19 @@ func NewItemModelValidatorFillWith(itemModel ItemModel) ItemModelValidator {
 	itemModelValidator.Item.Title = itemModel.Title
 	itemModelValidator.Item.Description = itemModel.Description
 	itemModelValidator.Item.Body = itemModel.Body
+	itemModelValidator.Item.Price = itemModel.Price
+	itemModelValidator.Item.Currency = itemModel.Currency
+	itemModelValidator.Item.Quantity = itemModel.Quantity
 	for _, tagModel := range itemModel.Tags {
 		itemModelValidator.Item.Tags = append(itemModelValidator.Item.Tags, tagModel.Tag)
 	}
+	if itemModel.CategoryID != 0 {
+		category, _ := FindOneCategory(&CategoryModel{Model: gorm.Model{ID: itemModel.CategoryID}})
+		itemModelValidator.Item.Category = category.Slug
+	}
+	itemModelValidator.Item.Attributes = itemModel.Attributes()
+	itemModelValidator.Item.Status = itemModel.Status
+	itemModelValidator.Item.PublishAt = itemModel.PublishAt
 	return itemModelValidator
 }
 
@@ -39,13 +61,45 @@ func (s *ItemModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	s.itemModel.Slug = slug.Make(s.Item.Title)
+	if err := s.bind(myUserModel); err != nil {
+		return err
+	}
+	s.itemModel.setTags(s.Item.Tags)
+	return nil
+}
+
+// Fill the item from the validated fields, for the seller myUserModel. Tags are
+// left for the caller to set, as that creates them.
+func (s *ItemModelValidator) bind(myUserModel users.UserModel) error {
 	s.itemModel.Title = s.Item.Title
 	s.itemModel.Description = s.Item.Description
 	s.itemModel.Body = s.Item.Body
+	// Price is in the currency's minor unit (cents for USD), never a float.
+	s.itemModel.Price = s.Item.Price
+	s.itemModel.Currency = s.Item.Currency
+	if s.itemModel.Currency == "" {
+		s.itemModel.Currency = common.DefaultCurrency
+	}
+	s.itemModel.Quantity = s.Item.Quantity
 	s.itemModel.Seller = GetItemUserModel(myUserModel)
-	s.itemModel.setTags(s.Item.Tags)
-	return nil
+	if err := s.itemModel.setStatus(s.Item.Status, s.Item.PublishAt, time.Now()); err != nil {
+		return err
+	}
+	return s.bindCategory()
+}
+
+// File the item under its category and check the attributes against the
+// category's schema. Errors are category errors or an AttributeError.
+func (s *ItemModelValidator) bindCategory() error {
+	if err := s.itemModel.setCategory(s.Item.Category); err != nil {
+		return err
+	}
+	schema, err := s.itemModel.attributeSchema()
+	if err != nil {
+		return err
+	}
+	s.attributes, err = checkAttributes(schema, s.Item.Attributes, false)
+	return err
 }
 
 type CommentModelValidator struct {
@@ -70,3 +124,180 @@ func (s *CommentModelValidator) Bind(c *gin.Context) error {
 	s.commentModel.Seller = GetItemUserModel(myUserModel)
 	return nil
 }
+
+type ReservationValidator struct {
+	Reservation struct {
+		Quantity int  `form:"quantity" json:"quantity" binding:"min=1"`
+		Variant  uint `form:"variant" json:"variant"`
+	} `json:"reservation"`
+}
+
+// A checkout reserves a single unit unless told otherwise.
+func NewReservationValidator() ReservationValidator {
+	reservationValidator := ReservationValidator{}
+	reservationValidator.Reservation.Quantity = 1
+	return reservationValidator
+}
+
+func (s *ReservationValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// Status is one of ListingAvailable, ListingReserved or ListingSold; Buyer is a
+// username, required for reserved listings.
+type AvailabilityValidator struct {
+	Availability struct {
+		Status string `form:"status" json:"status" binding:"required"`
+		Buyer  string `form:"buyer" json:"buyer"`
+	} `json:"availability"`
+}
+
+func NewAvailabilityValidator() AvailabilityValidator {
+	return AvailabilityValidator{}
+}
+
+func (s *AvailabilityValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// Prices are in minor units of the item's currency, EndsAt is an RFC 3339 time.
+type AuctionValidator struct {
+	Auction struct {
+		StartPrice   int64     `form:"startPrice" json:"startPrice" binding:"min=1"`
+		ReservePrice int64     `form:"reservePrice" json:"reservePrice" binding:"min=0"`
+		Increment    int64     `form:"increment" json:"increment" binding:"min=1"`
+		EndsAt       time.Time `form:"endsAt" json:"endsAt" binding:"required"`
+	} `json:"auction"`
+}
+
+// Bids go up by one minor unit unless told otherwise.
+func NewAuctionValidator() AuctionValidator {
+	auctionValidator := AuctionValidator{}
+	auctionValidator.Auction.Increment = 1
+	return auctionValidator
+}
+
+func (s *AuctionValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type BidValidator struct {
+	Bid struct {
+		Amount int64 `form:"amount" json:"amount" binding:"min=1"`
+	} `json:"bid"`
+}
+
+func NewBidValidator() BidValidator {
+	return BidValidator{}
+}
+
+func (s *BidValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type ItemImageValidator struct {
+	Image struct {
+		URL     string `form:"url" json:"url" binding:"required,url,max=2048"`
+		AltText string `form:"alt" json:"alt" binding:"max=256"`
+		Cover   bool   `form:"cover" json:"cover"`
+	} `json:"image"`
+}
+
+func NewItemImageValidator() ItemImageValidator {
+	return ItemImageValidator{}
+}
+
+func (s *ItemImageValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// The new gallery order as image ids, optionally with the id of the new cover.
+type GalleryValidator struct {
+	Gallery struct {
+		Order []uint `form:"order" json:"order" binding:"required"`
+		Cover uint   `form:"cover" json:"cover"`
+	} `json:"gallery"`
+}
+
+func NewGalleryValidator() GalleryValidator {
+	return GalleryValidator{}
+}
+
+func (s *GalleryValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// Parent is the slug of the parent category, empty for a root category.
+type CategoryValidator struct {
+	Category struct {
+		Name   string `form:"name" json:"name" binding:"required,max=64"`
+		Parent string `form:"parent" json:"parent"`
+	} `json:"category"`
+}
+
+func NewCategoryValidator() CategoryValidator {
+	return CategoryValidator{}
+}
+
+// Parent is left out of updates that only rename, so it starts as the current one.
+func NewCategoryValidatorFillWith(category CategoryModel) CategoryValidator {
+	categoryValidator := NewCategoryValidator()
+	categoryValidator.Category.Name = category.Name
+	if category.ParentID != 0 {
+		parent, _ := FindOneCategory(&CategoryModel{Model: gorm.Model{ID: category.ParentID}})
+		categoryValidator.Category.Parent = parent.Slug
+	}
+	return categoryValidator
+}
+
+func (s *CategoryValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// Name and Options only matter when adding an attribute; Options lists the
+// allowed values of enum attributes.
+type CategoryAttributeValidator struct {
+	Attribute struct {
+		Name     string   `form:"name" json:"name" binding:"required,max=64"`
+		Type     string   `form:"type" json:"type" binding:"required,oneof=enum number text boolean"`
+		Options  []string `form:"options" json:"options"`
+		Required bool     `form:"required" json:"required"`
+		Variant  bool     `form:"variant" json:"variant"`
+	} `json:"attribute"`
+}
+
+func NewCategoryAttributeValidator() CategoryAttributeValidator {
+	return CategoryAttributeValidator{}
+}
+
+func (s *CategoryAttributeValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// Price is in minor units of the item's currency. Attributes holds the values of
+// the variant attributes of the item's category.
+type ItemVariantValidator struct {
+	Variant struct {
+		Name       string            `form:"name" json:"name" binding:"max=128"`
+		Price      int64             `form:"price" json:"price" binding:"min=0"`
+		Quantity   int               `form:"quantity" json:"quantity" binding:"min=0"`
+		Attributes map[string]string `form:"attributes" json:"attributes"`
+	} `json:"variant"`
+}
+
+func NewItemVariantValidator() ItemVariantValidator {
+	return ItemVariantValidator{}
+}
+
+func NewItemVariantValidatorFillWith(variant ItemVariantModel) ItemVariantValidator {
+	variantValidator := NewItemVariantValidator()
+	variantValidator.Variant.Name = variant.Name
+	variantValidator.Variant.Price = variant.Price
+	variantValidator.Variant.Quantity = variant.Quantity
+	variantValidator.Variant.Attributes = variant.AttributeMap()
+	return variantValidator
+}
+
+func (s *ItemVariantValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
@@ -0,0 +1,342 @@
+package offers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/orders"
+)
+
+// A price proposed by one party of a negotiation (ProposedBy) and waiting for the
+// other one to answer. A counter-offer closes the offer it answers and opens a new
+// one pointing back at it with ParentID, so the whole negotiation can be replayed.
+type OfferModel struct {
+	gorm.Model
+	Item       items.ItemModel
+	ItemID     uint `gorm:"index"`
+	Buyer      items.ItemUserModel
+	BuyerID    uint `gorm:"index"`
+	Seller     items.ItemUserModel
+	SellerID   uint `gorm:"index"`
+	ParentID   uint
+	ProposedBy string `gorm:"size:16"`
+	Price      int64
+	Currency   string `gorm:"size:3"`
+	Quantity   int
+	Status     string    `gorm:"size:16;index"`
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+const (
+	OfferOpen      = "open"
+	OfferAccepted  = "accepted"
+	OfferRejected  = "rejected"
+	OfferCountered = "countered"
+	OfferWithdrawn = "withdrawn"
+	OfferExpired   = "expired"
+	OfferPurchased = "purchased"
+)
+
+// How long the other party has to answer an offer.
+const OfferTTL = 48 * time.Hour
+
+// How long the buyer keeps the agreed price once an offer is accepted.
+const AcceptedOfferTTL = 24 * time.Hour
+
+var ErrInvalidOfferPrice = errors.New("offer should be positive and not above the asking price")
+var ErrOfferExists = errors.New("an offer on this item is already open")
+var ErrOfferClosed = errors.New("offer is not open any more")
+var ErrNotYourTurn = errors.New("offer is waiting for the other party")
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+	db.AutoMigrate(&OfferModel{})
+}
+
+// The role user plays in the offer, or "" when it is none of their business.
+func (offer OfferModel) ActorFor(user items.ItemUserModel) string {
+	switch {
+	case user.ID == 0:
+		return ""
+	case user.ID == offer.BuyerID:
+		return orders.ActorBuyer
+	case user.ID == offer.SellerID:
+		return orders.ActorSeller
+	}
+	return ""
+}
+
+// The answers actor can give to the offer right now, e.g. to show the right buttons.
+func (offer OfferModel) NextActions(actor string, now time.Time) []string {
+	actions := []string{}
+	if actor == "" || !now.Before(offer.ExpiresAt) {
+		return actions
+	}
+	switch {
+	case offer.Status == OfferOpen && actor == offer.ProposedBy:
+		actions = append(actions, "withdraw")
+	case offer.Status == OfferOpen:
+		actions = append(actions, "accept", "reject", "counter")
+	case offer.Status == OfferAccepted && actor == orders.ActorBuyer:
+		actions = append(actions, "checkout")
+	}
+	return actions
+}
+
+func validPrice(item items.ItemModel, price int64) bool {
+	return price > 0 && price <= item.Price
+}
+
+// Let buyer offer price for quantity units of item. A buyer has at most one open
+// offer per item, they withdraw it or wait for an answer before offering again.
+// Items with variants have no single price to bargain on and take no offers.
+func MakeOffer(buyer items.ItemUserModel, item items.ItemModel, price int64, quantity int) (OfferModel, error) {
+	if item.SellerID == buyer.ID {
+		return OfferModel{}, carts.ErrOwnItem
+	}
+	if !item.AvailableTo(buyer) {
+		return OfferModel{}, items.ErrItemUnavailable
+	}
+	if item.OnAuction() {
+		return OfferModel{}, items.ErrAuctionItem
+	}
+	if item.HasVariants() {
+		return OfferModel{}, items.ErrVariantRequired
+	}
+	if !validPrice(item, price) {
+		return OfferModel{}, ErrInvalidOfferPrice
+	}
+	if quantity < 1 {
+		return OfferModel{}, carts.ErrInvalidQuantity
+	}
+	if quantity > item.QuantityAvailable() {
+		return OfferModel{}, items.ErrOutOfStock
+	}
+	db := common.GetDB()
+	var open int
+	db.Model(&OfferModel{}).
+		Where("item_id = ? AND buyer_id = ? AND status = ? AND expires_at > ?", item.ID, buyer.ID, OfferOpen, time.Now()).
+		Count(&open)
+	if open != 0 {
+		return OfferModel{}, ErrOfferExists
+	}
+	offer := OfferModel{
+		ItemID:     item.ID,
+		BuyerID:    buyer.ID,
+		SellerID:   item.SellerID,
+		ProposedBy: orders.ActorBuyer,
+		Price:      price,
+		Currency:   item.Currency,
+		Quantity:   quantity,
+		Status:     OfferOpen,
+		ExpiresAt:  time.Now().Add(OfferTTL),
+	}
+	err := db.Create(&offer).Error
+	return offer, err
+}
+
+// Close the offer with status if it is still from. The conditional UPDATE makes a
+// late answer, a second answer or an answer racing the expiry job lose cleanly.
+func (offer *OfferModel) close(tx *gorm.DB, from, status string, expiresAt time.Time) error {
+	result := tx.Model(&OfferModel{}).
+		Where("id = ? AND status = ? AND expires_at > ?", offer.ID, from, time.Now()).
+		Updates(map[string]interface{}{"status": status, "expires_at": expiresAt})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOfferClosed
+	}
+	offer.Status = status
+	offer.ExpiresAt = expiresAt
+	return nil
+}
+
+// Check actor may answer the open offer: only the party it was proposed to may,
+// the proposer can only withdraw it.
+func (offer OfferModel) answerableBy(actor string) error {
+	if offer.Status != OfferOpen {
+		return ErrOfferClosed
+	}
+	if actor == "" || actor == offer.ProposedBy {
+		return ErrNotYourTurn
+	}
+	return nil
+}
+
+// Agree on the offered price. The buyer then has AcceptedOfferTTL to check out at
+// that price, see Purchase.
+func (offer *OfferModel) Accept(actor string) error {
+	if err := offer.answerableBy(actor); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	return offer.close(db, OfferOpen, OfferAccepted, time.Now().Add(AcceptedOfferTTL))
+}
+
+func (offer *OfferModel) Reject(actor string) error {
+	if err := offer.answerableBy(actor); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	return offer.close(db, OfferOpen, OfferRejected, offer.ExpiresAt)
+}
+
+func (offer *OfferModel) Withdraw(actor string) error {
+	if offer.Status != OfferOpen {
+		return ErrOfferClosed
+	}
+	if actor != offer.ProposedBy {
+		return ErrNotYourTurn
+	}
+	db := common.GetDB()
+	return offer.close(db, OfferOpen, OfferWithdrawn, offer.ExpiresAt)
+}
+
+// Answer the offer with another price, which opens a new offer for the other party.
+//
+//	counter, err := offer.Counter(orders.ActorSeller, 4500)
+func (offer *OfferModel) Counter(actor string, price int64) (OfferModel, error) {
+	if err := offer.answerableBy(actor); err != nil {
+		return OfferModel{}, err
+	}
+	var item items.ItemModel
+	db := common.GetDB()
+	db.First(&item, offer.ItemID)
+	if item.ID == 0 || !validPrice(item, price) {
+		return OfferModel{}, ErrInvalidOfferPrice
+	}
+	tx := db.Begin()
+	if err := offer.close(tx, OfferOpen, OfferCountered, offer.ExpiresAt); err != nil {
+		tx.Rollback()
+		return OfferModel{}, err
+	}
+	counter := OfferModel{
+		ItemID:     offer.ItemID,
+		BuyerID:    offer.BuyerID,
+		SellerID:   offer.SellerID,
+		ParentID:   offer.ID,
+		ProposedBy: actor,
+		Price:      price,
+		Currency:   item.Currency,
+		Quantity:   offer.Quantity,
+		Status:     OfferOpen,
+		ExpiresAt:  time.Now().Add(OfferTTL),
+	}
+	if err := tx.Create(&counter).Error; err != nil {
+		tx.Rollback()
+		return OfferModel{}, err
+	}
+	return counter, tx.Commit().Error
+}
+
+// Check out an accepted offer at its agreed price. The offer is used up first so it
+// can not be bought twice, and handed back if the checkout fails.
+func (offer *OfferModel) Purchase(actor string) ([]orders.OrderModel, error) {
+	if actor != orders.ActorBuyer {
+		return nil, ErrNotYourTurn
+	}
+	if offer.Status != OfferAccepted {
+		return nil, ErrOfferClosed
+	}
+	db := common.GetDB()
+	var item items.ItemModel
+	db.First(&item, offer.ItemID)
+	if item.ID == 0 {
+		return nil, ErrOfferClosed
+	}
+	if err := offer.close(db, OfferAccepted, OfferPurchased, offer.ExpiresAt); err != nil {
+		return nil, err
+	}
+	var buyer items.ItemUserModel
+	buyer.ID = offer.BuyerID
+	orderModels, err := orders.CheckoutItemAtPrice(buyer, item, offer.Quantity, offer.Price)
+	if err != nil {
+		db.Model(&OfferModel{}).Where("id = ?", offer.ID).Update("status", OfferAccepted)
+		offer.Status = OfferAccepted
+		return nil, err
+	}
+	return orderModels, nil
+}
+
+func FindOneOffer(condition interface{}) (OfferModel, error) {
+	db := common.GetDB()
+	var model OfferModel
+	err := db.Where(condition).First(&model).Error
+	if err != nil {
+		return model, err
+	}
+	tx := db.Begin()
+	model.loadRelations(tx)
+	err = tx.Commit().Error
+	return model, err
+}
+
+func (offer *OfferModel) loadRelations(tx *gorm.DB) {
+	tx.Unscoped().Model(offer).Related(&offer.Item, "Item")
+	tx.Model(offer).Related(&offer.Buyer, "Buyer")
+	tx.Model(&offer.Buyer).Related(&offer.Buyer.UserModel)
+	tx.Model(offer).Related(&offer.Seller, "Seller")
+	tx.Model(&offer.Seller).Related(&offer.Seller.UserModel)
+}
+
+// List the offers user made (actor ActorBuyer) or received (ActorSeller), newest
+// first. The status defaults to open offers that have not expired yet.
+func FindManyOffer(user items.ItemUserModel, actor, status, limit, offset string) ([]OfferModel, int, error) {
+	db := common.GetDB()
+	var models []OfferModel
+	var count int
+
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil {
+		offset_int = 0
+	}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil {
+		limit_int = 20
+	}
+
+	query := db.Model(&OfferModel{})
+	if actor == orders.ActorSeller {
+		query = query.Where(OfferModel{SellerID: user.ID})
+	} else {
+		query = query.Where(OfferModel{BuyerID: user.ID})
+	}
+	if status == "" {
+		status = OfferOpen
+	}
+	query = query.Where(OfferModel{Status: status})
+	if status == OfferOpen || status == OfferAccepted {
+		query = query.Where("expires_at > ?", time.Now())
+	}
+	query.Count(&count)
+	err = query.Order("id desc").Offset(offset_int).Limit(limit_int).Find(&models).Error
+	if err != nil {
+		return models, count, err
+	}
+
+	tx := db.Begin()
+	for i := range models {
+		models[i].loadRelations(tx)
+	}
+	err = tx.Commit().Error
+	return models, count, err
+}
+
+// Expire open and accepted offers past their deadline, returning how many expired.
+// Meant to be run periodically, see common.Every; answers already check the
+// deadline, this only makes the status tell the truth.
+func ExpireOffers(now time.Time) (int, error) {
+	db := common.GetDB()
+	result := db.Model(&OfferModel{}).
+		Where("status IN (?) AND expires_at <= ?", []string{OfferOpen, OfferAccepted}, now).
+		Update("status", OfferExpired)
+	return int(result.RowsAffected), result.Error
+}
@@ -0,0 +1,183 @@
+package offers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/orders"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+func OffersRegister(router *gin.RouterGroup) {
+	router.GET("/", OfferList)
+	router.POST("/", OfferCreate)
+	router.GET("/:id", OfferRetrieve)
+	router.POST("/:id/accept", OfferAccept)
+	router.POST("/:id/reject", OfferReject)
+	router.POST("/:id/counter", OfferCounter)
+	router.POST("/:id/withdraw", OfferWithdraw)
+	router.POST("/:id/checkout", OfferCheckout)
+}
+
+func currentUser(c *gin.Context) items.ItemUserModel {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	return items.GetItemUserModel(myUserModel)
+}
+
+// Load the offer in the :id param, making sure the current user is part of it.
+func findMyOffer(c *gin.Context) (OfferModel, string, error) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return OfferModel{}, "", err
+	}
+	offerModel, err := FindOneOffer(&OfferModel{Model: gorm.Model{ID: uint(id64)}})
+	if err != nil {
+		return offerModel, "", err
+	}
+	actor := offerModel.ActorFor(currentUser(c))
+	if actor == "" {
+		return offerModel, "", errors.New("Invalid id")
+	}
+	return offerModel, actor, nil
+}
+
+func renderOfferError(c *gin.Context, err error) {
+	switch err {
+	case ErrOfferExists, ErrOfferClosed, items.ErrOutOfStock, items.ErrItemUnavailable:
+		c.JSON(http.StatusConflict, common.NewError("offer", err))
+	case ErrNotYourTurn:
+		c.JSON(http.StatusForbidden, common.NewError("offer", err))
+	case ErrInvalidOfferPrice, carts.ErrOwnItem, carts.ErrInvalidQuantity, items.ErrAuctionItem, items.ErrVariantRequired:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("offer", err))
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	}
+}
+
+func renderOffer(c *gin.Context, code int, id uint) {
+	offerModel, err := FindOneOffer(&OfferModel{Model: gorm.Model{ID: id}})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := OfferSerializer{c, offerModel}
+	c.JSON(code, gin.H{"offer": serializer.Response()})
+}
+
+func OfferCreate(c *gin.Context) {
+	offerValidator := NewOfferValidator()
+	if err := offerValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	itemModel, err := items.FindOneItem(&items.ItemModel{Slug: offerValidator.Offer.Slug})
+	if err != nil || itemModel.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	offerModel, err := MakeOffer(currentUser(c), itemModel, offerValidator.Offer.Price, offerValidator.Offer.Quantity)
+	if err != nil {
+		renderOfferError(c, err)
+		return
+	}
+	renderOffer(c, http.StatusCreated, offerModel.ID)
+}
+
+func OfferList(c *gin.Context) {
+	actor := c.DefaultQuery("role", orders.ActorBuyer)
+	status := c.Query("status")
+	limit := c.Query("limit")
+	offset := c.Query("offset")
+	offerModels, modelCount, err := FindManyOffer(currentUser(c), actor, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("offers", errors.New("Invalid param")))
+		return
+	}
+	serializer := OffersSerializer{c, offerModels}
+	c.JSON(http.StatusOK, gin.H{"offers": serializer.Response(), "offersCount": modelCount})
+}
+
+func OfferRetrieve(c *gin.Context) {
+	offerModel, _, err := findMyOffer(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("offers", errors.New("Invalid id")))
+		return
+	}
+	serializer := OfferSerializer{c, offerModel}
+	c.JSON(http.StatusOK, gin.H{"offer": serializer.Response()})
+}
+
+// Accept, reject and withdraw only differ by the model method they call.
+func answerOffer(c *gin.Context, answer func(offer *OfferModel, actor string) error) {
+	offerModel, actor, err := findMyOffer(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("offers", errors.New("Invalid id")))
+		return
+	}
+	if err := answer(&offerModel, actor); err != nil {
+		renderOfferError(c, err)
+		return
+	}
+	renderOffer(c, http.StatusOK, offerModel.ID)
+}
+
+func OfferAccept(c *gin.Context) {
+	answerOffer(c, (*OfferModel).Accept)
+}
+
+func OfferReject(c *gin.Context) {
+	answerOffer(c, (*OfferModel).Reject)
+}
+
+func OfferWithdraw(c *gin.Context) {
+	answerOffer(c, (*OfferModel).Withdraw)
+}
+
+func OfferCounter(c *gin.Context) {
+	offerModel, actor, err := findMyOffer(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("offers", errors.New("Invalid id")))
+		return
+	}
+	counterValidator := NewCounterValidator()
+	if err := counterValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	counter, err := offerModel.Counter(actor, counterValidator.Offer.Price)
+	if err != nil {
+		renderOfferError(c, err)
+		return
+	}
+	renderOffer(c, http.StatusCreated, counter.ID)
+}
+
+// Buy an accepted offer, answering like a checkout with the orders it created.
+func OfferCheckout(c *gin.Context) {
+	offerModel, actor, err := findMyOffer(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("offers", errors.New("Invalid id")))
+		return
+	}
+	orderModels, err := offerModel.Purchase(actor)
+	if err != nil {
+		renderOfferError(c, err)
+		return
+	}
+	for i := range orderModels {
+		orderModels[i], err = orders.FindOneOrder(&orders.OrderModel{Model: gorm.Model{ID: orderModels[i].ID}})
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	serializer := orders.OrdersSerializer{C: c, Orders: orderModels}
+	c.JSON(http.StatusCreated, gin.H{"orders": serializer.Response()})
+}
@@ -0,0 +1,78 @@
+package offers
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+type OfferSerializer struct {
+	C *gin.Context
+	OfferModel
+}
+
+type OffersSerializer struct {
+	C      *gin.Context
+	Offers []OfferModel
+}
+
+type OfferResponse struct {
+	ID             uint                  `json:"id"`
+	Slug           string                `json:"slug"`
+	Title          string                `json:"title"`
+	Buyer          users.ProfileResponse `json:"buyer"`
+	Seller         users.ProfileResponse `json:"seller"`
+	ParentID       uint                  `json:"parentId,omitempty"`
+	ProposedBy     string                `json:"proposedBy"`
+	Price          int64                 `json:"price"`
+	Currency       string                `json:"currency"`
+	FormattedPrice string                `json:"formattedPrice"`
+	AskingPrice    int64                 `json:"askingPrice"`
+	Quantity       int                   `json:"quantity"`
+	Status         string                `json:"status"`
+	NextActions    []string              `json:"nextActions"`
+	ExpiresAt      string                `json:"expiresAt"`
+	CreatedAt      string                `json:"createdAt"`
+}
+
+func (s *OfferSerializer) Response() OfferResponse {
+	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
+	buyerSerializer := items.ItemUserSerializer{C: s.C, ItemUserModel: s.Buyer}
+	sellerSerializer := items.ItemUserSerializer{C: s.C, ItemUserModel: s.Seller}
+	now := time.Now()
+	status := s.Status
+	if (status == OfferOpen || status == OfferAccepted) && !now.Before(s.ExpiresAt) {
+		status = OfferExpired
+	}
+	return OfferResponse{
+		ID:             s.ID,
+		Slug:           s.Item.Slug,
+		Title:          s.Item.Title,
+		Buyer:          buyerSerializer.Response(),
+		Seller:         sellerSerializer.Response(),
+		ParentID:       s.ParentID,
+		ProposedBy:     s.ProposedBy,
+		Price:          s.Price,
+		Currency:       s.Currency,
+		FormattedPrice: common.Money{Amount: s.Price, Currency: s.Currency}.String(),
+		AskingPrice:    s.Item.Price,
+		Quantity:       s.Quantity,
+		Status:         status,
+		NextActions:    s.NextActions(s.ActorFor(items.GetItemUserModel(myUserModel)), now),
+		ExpiresAt:      s.ExpiresAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		CreatedAt:      s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+func (s *OffersSerializer) Response() []OfferResponse {
+	response := []OfferResponse{}
+	for _, offer := range s.Offers {
+		serializer := OfferSerializer{s.C, offer}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
@@ -0,0 +1,182 @@
+package offers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/orders"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+var test_db *gorm.DB
+
+func userModelMocker(n int) []users.UserModel {
+	var offset int
+	test_db.Model(&users.UserModel{}).Count(&offset)
+	var ret []users.UserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username:     fmt.Sprintf("user%v", i),
+			Email:        fmt.Sprintf("user%v@linkedin.com", i),
+			PasswordHash: "password123",
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func itemModelMocker(seller users.UserModel, price int64, quantity int) items.ItemModel {
+	var offset int
+	test_db.Model(&items.ItemModel{}).Count(&offset)
+	itemModel := items.ItemModel{
+		Slug:     fmt.Sprintf("item-%v", offset+1),
+		Title:    fmt.Sprintf("item %v", offset+1),
+		Price:    price,
+		Currency: "USD",
+		Quantity: quantity,
+		SellerID: items.GetItemUserModel(seller).ID,
+	}
+	test_db.Create(&itemModel)
+	return itemModel
+}
+
+func offerRequest(r *gin.Engine, method, url string, user uint, body string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(user)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response map[string]json.RawMessage
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+func TestNegotiation(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, buyer := items.GetItemUserModel(people[0]), items.GetItemUserModel(people[1])
+	item := itemModelMocker(people[0], 5000, 2)
+
+	_, err := MakeOffer(buyer, item, 6000, 1)
+	asserts.Equal(ErrInvalidOfferPrice, err, "offers above the asking price should be refused")
+	_, err = MakeOffer(seller, item, 4000, 1)
+	asserts.Equal(carts.ErrOwnItem, err, "sellers should not bid on their own items")
+	draft := itemModelMocker(people[0], 5000, 1)
+	test_db.Model(&items.ItemModel{}).Where("id = ?", draft.ID).Update("status", items.ItemDraft)
+	draft.Status = items.ItemDraft
+	_, err = MakeOffer(buyer, draft, 4000, 1)
+	asserts.Equal(items.ErrItemUnavailable, err, "unpublished items should not get offers")
+	offer, err := MakeOffer(buyer, item, 3500, 1)
+	asserts.NoError(err)
+	asserts.Equal(orders.ActorBuyer, offer.ProposedBy)
+	_, err = MakeOffer(buyer, item, 3600, 1)
+	asserts.Equal(ErrOfferExists, err, "one open offer per buyer and item")
+
+	asserts.Equal(ErrNotYourTurn, offer.Accept(orders.ActorBuyer), "buyers should not accept their own offer")
+	counter, err := offer.Counter(orders.ActorSeller, 4500)
+	asserts.NoError(err)
+	asserts.Equal(offer.ID, counter.ParentID, "counter should point at the offer it answers")
+	asserts.Equal(OfferCountered, offer.Status)
+	asserts.Equal(ErrOfferClosed, offer.Accept(orders.ActorSeller), "countered offers should be closed")
+	asserts.Equal([]string{"accept", "reject", "counter"}, counter.NextActions(orders.ActorBuyer, time.Now()))
+
+	asserts.NoError(counter.Accept(orders.ActorBuyer))
+	asserts.True(counter.ExpiresAt.After(time.Now().Add(AcceptedOfferTTL-time.Minute)), "accepted price should be held for a while")
+	_, err = counter.Purchase(orders.ActorSeller)
+	asserts.Equal(ErrNotYourTurn, err, "only the buyer should check out an offer")
+	orderModels, err := counter.Purchase(orders.ActorBuyer)
+	asserts.NoError(err)
+	asserts.Equal(int64(4500), orderModels[0].Total, "order should use the agreed price")
+	asserts.Equal(OfferPurchased, counter.Status)
+	_, err = counter.Purchase(orders.ActorBuyer)
+	asserts.Equal(ErrOfferClosed, err, "an offer should only be bought once")
+
+	late, _ := MakeOffer(buyer, item, 3000, 1)
+	test_db.Model(&OfferModel{}).Where("id = ?", late.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	late, _ = FindOneOffer(&OfferModel{Model: gorm.Model{ID: late.ID}})
+	asserts.Equal(ErrOfferClosed, late.Accept(orders.ActorSeller), "expired offers should not be accepted")
+	expired, err := ExpireOffers(time.Now())
+	asserts.NoError(err)
+	asserts.Equal(1, expired)
+	late, _ = FindOneOffer(&OfferModel{Model: gorm.Model{ID: late.ID}})
+	asserts.Equal(OfferExpired, late.Status)
+}
+
+func TestOfferRouters(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, buyer, stranger := people[0], people[1], people[2]
+	item := itemModelMocker(seller, 2000, 1)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(true))
+	OffersRegister(r.Group("/offers"))
+
+	w, response := offerRequest(r, "POST", "/offers/", buyer.ID, fmt.Sprintf(`{"offer":{"slug":"%v","price":1500}}`, item.Slug))
+	asserts.Equal(http.StatusCreated, w.Code, "buyers should make offers")
+	var offer OfferResponse
+	json.Unmarshal(response["offer"], &offer)
+	asserts.Equal("15.00 USD", offer.FormattedPrice)
+	asserts.Equal([]string{"withdraw"}, offer.NextActions)
+	url := fmt.Sprintf("/offers/%v", offer.ID)
+
+	w, _ = offerRequest(r, "GET", url, stranger.ID, ``)
+	asserts.Equal(http.StatusNotFound, w.Code, "strangers should not see the offer")
+
+	w, response = offerRequest(r, "GET", "/offers/?role=seller", seller.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("1", string(response["offersCount"]), "seller should see the offers they received")
+	w, response = offerRequest(r, "GET", "/offers/", buyer.ID, ``)
+	asserts.Equal("1", string(response["offersCount"]), "buyer should see the offers they made")
+
+	w, _ = offerRequest(r, "POST", url+"/accept", buyer.ID, ``)
+	asserts.Equal(http.StatusForbidden, w.Code, "buyers should not accept their own offer")
+	w, response = offerRequest(r, "POST", url+"/counter", seller.ID, `{"offer":{"price":1800}}`)
+	asserts.Equal(http.StatusCreated, w.Code, "sellers should counter")
+	json.Unmarshal(response["offer"], &offer)
+	asserts.Equal(orders.ActorSeller, offer.ProposedBy)
+	url = fmt.Sprintf("/offers/%v", offer.ID)
+
+	w, response = offerRequest(r, "POST", url+"/accept", buyer.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code, "buyers should accept a counter-offer")
+	json.Unmarshal(response["offer"], &offer)
+	asserts.Equal(OfferAccepted, offer.Status)
+	asserts.Equal([]string{"checkout"}, offer.NextActions)
+
+	w, response = offerRequest(r, "POST", url+"/checkout", buyer.ID, ``)
+	asserts.Equal(http.StatusCreated, w.Code, "accepted offers should be bought at their price")
+	var created []orders.OrderResponse
+	json.Unmarshal(response["orders"], &created)
+	asserts.Equal("18.00 USD", created[0].FormattedTotal)
+	w, _ = offerRequest(r, "POST", url+"/checkout", buyer.ID, ``)
+	asserts.Equal(http.StatusConflict, w.Code, "offers should not be bought twice")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	items.AutoMigrate()
+	carts.AutoMigrate()
+	orders.AutoMigrate()
+	AutoMigrate()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
@@ -0,0 +1,41 @@
+package offers
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+// A buyer's first offer on an item, the price is in minor units of the item's currency.
+type OfferValidator struct {
+	Offer struct {
+		Slug     string `form:"slug" json:"slug" binding:"required"`
+		Price    int64  `form:"price" json:"price" binding:"min=1"`
+		Quantity int    `form:"quantity" json:"quantity" binding:"min=1"`
+	} `json:"offer"`
+}
+
+// An offer is for a single unit unless told otherwise.
+func NewOfferValidator() OfferValidator {
+	offerValidator := OfferValidator{}
+	offerValidator.Offer.Quantity = 1
+	return offerValidator
+}
+
+func (s *OfferValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type CounterValidator struct {
+	Offer struct {
+		Price int64 `form:"price" json:"price" binding:"min=1"`
+	} `json:"offer"`
+}
+
+func NewCounterValidator() CounterValidator {
+	return CounterValidator{}
+}
+
+func (s *CounterValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
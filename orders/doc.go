@@ -0,0 +1,12 @@
+/*
+The order module containing checkout, the order state machine and order listing.
+
+model.go: definition of orm based data model
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+
+validators.go: definition the validator of form data
+*/
+package orders
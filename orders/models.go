@@ -0,0 +1,513 @@
+package orders
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+)
+
+// An order is what one buyer owes one seller. Checking out a cart with items from
+// several sellers creates one order per seller (and per currency, should a seller
+// list items in more than one). Pending orders not paid by PayBy are cancelled.
+type OrderModel struct {
+	gorm.Model
+	Buyer    items.ItemUserModel
+	BuyerID  uint `gorm:"index"`
+	Seller   items.ItemUserModel
+	SellerID uint   `gorm:"index"`
+	Status   string `gorm:"size:16;index"`
+	Total    int64
+	Currency string           `gorm:"size:3"`
+	PayBy    *time.Time       `gorm:"index"`
+	Lines    []OrderLineModel `gorm:"ForeignKey:OrderID"`
+}
+
+// A snapshot of the item at purchase time: later edits of the listing never change
+// what was bought or what it cost. The stock bought is held by Reservation until
+// the order is paid (committed) or cancelled (released).
+type OrderLineModel struct {
+	gorm.Model
+	Order         OrderModel
+	OrderID       uint `gorm:"index"`
+	Item          items.ItemModel
+	ItemID        uint
+	VariantID     uint
+	Reservation   items.StockReservationModel
+	ReservationID uint
+	Slug          string
+	Title         string
+	VariantName   string
+	Price         int64
+	Currency      string `gorm:"size:3"`
+	Quantity      int
+}
+
+// Every status change, kept for the order history.
+type OrderEventModel struct {
+	gorm.Model
+	OrderID uint   `gorm:"index"`
+	From    string `gorm:"size:16"`
+	To      string `gorm:"size:16"`
+	Actor   string `gorm:"size:16"`
+}
+
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCompleted = "completed"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// Who asks for a transition. ActorSystem is used by payments and background jobs and
+// is the only one allowed to mark an order paid or refunded: those follow verified
+// payment events, never a user's word.
+const (
+	ActorBuyer  = "buyer"
+	ActorSeller = "seller"
+	ActorSystem = "system"
+)
+
+// The order state machine: for each status, the statuses it may move to and who may
+// move it there. Anything not listed here is refused by Transition.
+var orderTransitions = map[string]map[string][]string{
+	OrderPending: {
+		OrderPaid:      {ActorSystem},
+		OrderCancelled: {ActorBuyer, ActorSeller, ActorSystem},
+	},
+	OrderPaid: {
+		OrderShipped:  {ActorSeller},
+		OrderRefunded: {ActorSystem},
+	},
+	OrderShipped: {
+		OrderDelivered: {ActorBuyer, ActorSeller},
+		OrderRefunded:  {ActorSystem},
+	},
+	OrderDelivered: {
+		OrderCompleted: {ActorBuyer, ActorSystem},
+		OrderRefunded:  {ActorSystem},
+	},
+}
+
+var ErrInvalidTransition = errors.New("order can not move to this status")
+var ErrCartEmpty = errors.New("cart is empty")
+var ErrCartChanged = errors.New("cart changed since it was last read")
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+	db.AutoMigrate(&OrderModel{})
+	db.AutoMigrate(&OrderLineModel{})
+	db.AutoMigrate(&OrderEventModel{})
+}
+
+// Reports whether actor may move the order to status from its current status.
+func (order OrderModel) CanTransition(status string, actor string) bool {
+	for _, allowed := range orderTransitions[order.Status][status] {
+		if allowed == actor {
+			return true
+		}
+	}
+	return false
+}
+
+// The statuses actor may move the order to next, e.g. to show the right buttons.
+func (order OrderModel) NextStatuses(actor string) []string {
+	statuses := []string{}
+	for _, status := range []string{OrderPaid, OrderShipped, OrderDelivered, OrderCompleted, OrderCancelled, OrderRefunded} {
+		if order.CanTransition(status, actor) {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// The role user plays in the order, or "" when it is none of their business.
+func (order OrderModel) ActorFor(user items.ItemUserModel) string {
+	switch {
+	case user.ID == 0:
+		return ""
+	case user.ID == order.BuyerID:
+		return ActorBuyer
+	case user.ID == order.SellerID:
+		return ActorSeller
+	}
+	return ""
+}
+
+// Move the order to status on behalf of actor.
+//
+// The status switch is a conditional UPDATE on the current status, so two
+// concurrent transitions can not both win. Becoming paid sells the reserved stock,
+// being cancelled before payment hands it back, in the same transaction as the
+// status: a paid order whose stock is gone stays pending and gets the error.
+//
+//	err := order.Transition(OrderShipped, ActorSeller)
+func (order *OrderModel) Transition(status string, actor string) error {
+	if !order.CanTransition(status, actor) {
+		return ErrInvalidTransition
+	}
+	if order.Status == OrderPending {
+		if err := order.getLines(); err != nil {
+			return err
+		}
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	result := tx.Model(&OrderModel{}).
+		Where("id = ? AND status = ?", order.ID, order.Status).
+		Update("status", status)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrInvalidTransition
+	}
+	event := OrderEventModel{OrderID: order.ID, From: order.Status, To: status, Actor: actor}
+	if err := tx.Create(&event).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := order.moveStock(tx, status); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	order.Status = status
+	return nil
+}
+
+// Stock follows the order: it is sold when a pending order is paid and returned to
+// the shelf when it is cancelled.
+func (order *OrderModel) moveStock(tx *gorm.DB, status string) error {
+	if order.Status != OrderPending {
+		return nil
+	}
+	for i := range order.Lines {
+		line := order.Lines[i]
+		var err error
+		switch status {
+		case OrderPaid:
+			err = line.Reservation.CommitIn(tx)
+			if err == items.ErrReservationClosed {
+				// Paid after the reservation expired: buy the stock again if it is still there.
+				err = line.rebuy(tx, order.BuyerID)
+			}
+		case OrderCancelled:
+			err = line.Reservation.ReleaseIn(tx)
+			if err == items.ErrReservationClosed {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (line OrderLineModel) rebuy(tx *gorm.DB, buyerID uint) error {
+	var item items.ItemModel
+	item.ID = line.ItemID
+	var variant items.ItemVariantModel
+	variant.ID = line.VariantID
+	var buyer items.ItemUserModel
+	buyer.ID = buyerID
+	return items.SellStock(tx, item, variant, buyer, line.Quantity)
+}
+
+func (order *OrderModel) getLines() error {
+	db := common.GetDB()
+	tx := db.Begin()
+	tx.Model(order).Order("id asc").Related(&order.Lines, "Lines")
+	for i := range order.Lines {
+		tx.Model(&order.Lines[i]).Related(&order.Lines[i].Reservation, "Reservation")
+	}
+	return tx.Commit().Error
+}
+
+// Load an order with its lines and both parties.
+func FindOneOrder(condition interface{}) (OrderModel, error) {
+	db := common.GetDB()
+	var model OrderModel
+	err := db.Where(condition).First(&model).Error
+	if err != nil {
+		return model, err
+	}
+	tx := db.Begin()
+	tx.Model(&model).Order("id asc").Related(&model.Lines, "Lines")
+	tx.Model(&model).Related(&model.Buyer, "Buyer")
+	tx.Model(&model.Buyer).Related(&model.Buyer.UserModel)
+	tx.Model(&model).Related(&model.Seller, "Seller")
+	tx.Model(&model.Seller).Related(&model.Seller.UserModel)
+	err = tx.Commit().Error
+	return model, err
+}
+
+// List the orders user bought (actor ActorBuyer) or sold (ActorSeller), newest
+// first, optionally restricted to one status. Limit and offset are raw query strings
+// like in items.FindManyItem.
+func FindManyOrder(user items.ItemUserModel, actor, status, limit, offset string) ([]OrderModel, int, error) {
+	db := common.GetDB()
+	var models []OrderModel
+	var count int
+
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil {
+		offset_int = 0
+	}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil {
+		limit_int = 20
+	}
+
+	query := db.Model(&OrderModel{})
+	if actor == ActorSeller {
+		query = query.Where(OrderModel{SellerID: user.ID})
+	} else {
+		query = query.Where(OrderModel{BuyerID: user.ID})
+	}
+	if status != "" {
+		query = query.Where(OrderModel{Status: status})
+	}
+	query.Count(&count)
+	err = query.Order("id desc").Offset(offset_int).Limit(limit_int).Find(&models).Error
+	if err != nil {
+		return models, count, err
+	}
+
+	tx := db.Begin()
+	for i := range models {
+		tx.Model(&models[i]).Order("id asc").Related(&models[i].Lines, "Lines")
+		tx.Model(&models[i]).Related(&models[i].Buyer, "Buyer")
+		tx.Model(&models[i].Buyer).Related(&models[i].Buyer.UserModel)
+		tx.Model(&models[i]).Related(&models[i].Seller, "Seller")
+		tx.Model(&models[i].Seller).Related(&models[i].Seller.UserModel)
+	}
+	err = tx.Commit().Error
+	return models, count, err
+}
+
+// What the buyer wants to buy at which unit price, before stock is reserved.
+// Variant is the zero ItemVariantModel for items without variants.
+type checkoutLine struct {
+	Item     items.ItemModel
+	Variant  items.ItemVariantModel
+	Quantity int
+	Price    int64
+}
+
+// Buy quantity units of a single item straight from its page.
+func CheckoutItem(buyer items.ItemUserModel, item items.ItemModel, quantity int) ([]OrderModel, error) {
+	return CheckoutItemAtPrice(buyer, item, quantity, item.Price)
+}
+
+// Same as CheckoutItem with a unit price agreed elsewhere, e.g. an accepted offer,
+// instead of the listed one. The price is in the item's currency.
+func CheckoutItemAtPrice(buyer items.ItemUserModel, item items.ItemModel, quantity int, price int64) ([]OrderModel, error) {
+	return checkout(buyer, []checkoutLine{{Item: item, Quantity: quantity, Price: price}})
+}
+
+// Buy quantity units of one variant of item at the variant's price.
+func CheckoutVariant(buyer items.ItemUserModel, item items.ItemModel, variant items.ItemVariantModel, quantity int) ([]OrderModel, error) {
+	return checkout(buyer, []checkoutLine{{Item: item, Variant: variant, Quantity: quantity, Price: variant.Price}})
+}
+
+// Create the pending order of an auction's winner at the winning bid, for the
+// unit the auction held. They then pay it like any other order, within
+// items.AuctionPaymentTTL. Registered with items.OnAuctionWon.
+func CheckoutAuctionWinner(auction items.AuctionModel) error {
+	db := common.GetDB()
+	var item items.ItemModel
+	if err := db.First(&item, auction.ItemID).Error; err != nil {
+		return err
+	}
+	var winner items.ItemUserModel
+	winner.ID = auction.WinnerID
+	if auction.ReservationID == 0 {
+		// Auctions created before they held their unit.
+		_, err := CheckoutItemAtPrice(winner, item, 1, auction.CurrentBid)
+		return err
+	}
+	var reservation items.StockReservationModel
+	if err := db.First(&reservation, auction.ReservationID).Error; err != nil {
+		return err
+	}
+	if reservation.Status != items.ReservationHeld {
+		return items.ErrReservationClosed
+	}
+	lines := []checkoutLine{{Item: item, Quantity: 1, Price: auction.CurrentBid}}
+	_, err := placeOrders(winner, lines, []items.StockReservationModel{reservation}, reservation.ExpiresAt)
+	if err != nil {
+		reservation.Release()
+	}
+	return err
+}
+
+// Turn the buyer's cart into orders and empty it. The cart must be unchanged since
+// the buyer last read it, so nobody pays a price they have not seen.
+func CheckoutCart(buyer items.ItemUserModel, cart carts.CartModel) ([]OrderModel, error) {
+	if err := cart.Revalidate(); err != nil {
+		return nil, err
+	}
+	if len(cart.Lines) == 0 {
+		return nil, ErrCartEmpty
+	}
+	var lines []checkoutLine
+	for _, line := range cart.Lines {
+		if line.Unavailable || line.PriceChanged {
+			return nil, ErrCartChanged
+		}
+		lines = append(lines, checkoutLine{Item: line.Item, Variant: line.Variant, Quantity: line.Quantity, Price: line.Price})
+	}
+	orders, err := checkout(buyer, lines)
+	if err != nil {
+		return nil, err
+	}
+	return orders, cart.Clear()
+}
+
+// Reserve the stock of every line, then write one pending order per seller and
+// currency. If any line can not be reserved, the reservations already taken are
+// released and nothing is written.
+func checkout(buyer items.ItemUserModel, lines []checkoutLine) ([]OrderModel, error) {
+	var reservations []items.StockReservationModel
+	releaseAll := func() {
+		for i := range reservations {
+			reservations[i].Release()
+		}
+	}
+	for _, line := range lines {
+		if line.Item.SellerID == buyer.ID {
+			releaseAll()
+			return nil, carts.ErrOwnItem
+		}
+		if line.Item.OnAuction() {
+			releaseAll()
+			return nil, items.ErrAuctionItem
+		}
+		var reservation items.StockReservationModel
+		var err error
+		if line.Variant.ID != 0 {
+			reservation, err = items.ReserveVariantStock(line.Variant, buyer, line.Quantity)
+		} else {
+			reservation, err = items.ReserveStock(line.Item, buyer, line.Quantity)
+		}
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+	orders, err := placeOrders(buyer, lines, reservations, time.Now().Add(items.ReservationTTL))
+	if err != nil {
+		releaseAll()
+	}
+	return orders, err
+}
+
+// Write one pending order per seller and currency for lines, whose stock is held
+// by reservations (in the same order), to be paid by payBy.
+func placeOrders(buyer items.ItemUserModel, lines []checkoutLine, reservations []items.StockReservationModel, payBy time.Time) ([]OrderModel, error) {
+	payBy = payBy.UTC()
+	var orders []OrderModel
+	index := map[string]int{}
+	for i, line := range lines {
+		key := strconv.FormatUint(uint64(line.Item.SellerID), 10) + line.Item.Currency
+		if _, ok := index[key]; !ok {
+			orders = append(orders, OrderModel{
+				BuyerID:  buyer.ID,
+				SellerID: line.Item.SellerID,
+				Status:   OrderPending,
+				Currency: line.Item.Currency,
+				PayBy:    &payBy,
+			})
+			index[key] = len(orders) - 1
+		}
+		order := &orders[index[key]]
+		order.Total += line.Price * int64(line.Quantity)
+		order.Lines = append(order.Lines, OrderLineModel{
+			ItemID:        line.Item.ID,
+			VariantID:     line.Variant.ID,
+			ReservationID: reservations[i].ID,
+			Slug:          line.Item.Slug,
+			Title:         line.Item.Title,
+			VariantName:   line.Variant.Name,
+			Price:         line.Price,
+			Currency:      line.Item.Currency,
+			Quantity:      line.Quantity,
+		})
+	}
+
+	db := common.GetDB()
+	tx := db.Begin()
+	for i := range orders {
+		if err := tx.Create(&orders[i]).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// Cancel pending orders that were not paid by their PayBy, returning how many were
+// cancelled. Orders from before PayBy get items.ReservationTTL. Meant to be run
+// periodically, see common.Every.
+func CancelExpiredOrders(now time.Time) (int, error) {
+	db := common.GetDB()
+	var models []OrderModel
+	err := db.Where("status = ? AND (pay_by < ? OR (pay_by IS NULL AND created_at < ?))",
+		OrderPending, now.UTC(), now.Add(-items.ReservationTTL)).Find(&models).Error
+	if err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for i := range models {
+		err := models[i].Transition(OrderCancelled, ActorSystem)
+		if err == ErrInvalidTransition {
+			continue
+		}
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled++
+	}
+	return cancelled, nil
+}
+
+// Count the orders placed for each of the items between from and to and paid
+// for, whatever happened to them since short of a cancellation or refund. Set
+// for seller analytics, see items.SetSalesCounter.
+func CountSales(itemIDs []uint, from, to time.Time) (map[uint]int, error) {
+	db := common.GetDB()
+	var rows []struct {
+		ItemID uint
+		Count  int
+	}
+	err := db.Table("order_line_models").Select("order_line_models.item_id, count(DISTINCT order_models.id) AS count").
+		Joins("JOIN order_models ON order_models.id = order_line_models.order_id AND order_models.deleted_at IS NULL").
+		Where("order_line_models.item_id IN (?) AND order_line_models.deleted_at IS NULL", itemIDs).
+		Where("order_models.status IN (?) AND order_models.created_at >= ? AND order_models.created_at < ?",
+			[]string{OrderPaid, OrderShipped, OrderDelivered, OrderCompleted}, from, to).
+		Group("order_line_models.item_id").Scan(&rows).Error
+	sales := map[uint]int{}
+	for _, row := range rows {
+		sales[row.ItemID] = row.Count
+	}
+	return sales, err
+}
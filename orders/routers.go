@@ -0,0 +1,154 @@
+package orders
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+func OrdersRegister(router *gin.RouterGroup) {
+	router.GET("/", OrderList)
+	router.POST("/", OrderCreate)
+	router.POST("/checkout", OrderCheckout)
+	router.GET("/:id", OrderRetrieve)
+	router.POST("/:id/status", OrderTransition)
+}
+
+func currentUser(c *gin.Context) items.ItemUserModel {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	return items.GetItemUserModel(myUserModel)
+}
+
+// Load the order in the :id param, making sure the current user is part of it.
+func findMyOrder(c *gin.Context) (OrderModel, string, error) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return OrderModel{}, "", err
+	}
+	orderModel, err := FindOneOrder(&OrderModel{Model: gorm.Model{ID: uint(id64)}})
+	if err != nil {
+		return orderModel, "", err
+	}
+	actor := orderModel.ActorFor(currentUser(c))
+	if actor == "" {
+		return orderModel, "", errors.New("Invalid id")
+	}
+	return orderModel, actor, nil
+}
+
+func renderCheckout(c *gin.Context, orderModels []OrderModel, err error) {
+	switch err {
+	case nil:
+	case items.ErrOutOfStock, items.ErrItemUnavailable, ErrCartChanged:
+		c.JSON(http.StatusConflict, common.NewError("checkout", err))
+		return
+	case carts.ErrOwnItem, ErrCartEmpty, items.ErrReservationClosed, items.ErrAuctionItem, items.ErrVariantRequired:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("checkout", err))
+		return
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	for i := range orderModels {
+		orderModels[i], err = FindOneOrder(&OrderModel{Model: gorm.Model{ID: orderModels[i].ID}})
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	serializer := OrdersSerializer{c, orderModels}
+	c.JSON(http.StatusCreated, gin.H{"orders": serializer.Response()})
+}
+
+func OrderCreate(c *gin.Context) {
+	checkoutItemValidator := NewCheckoutItemValidator()
+	if err := checkoutItemValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	itemModel, err := items.FindOneItem(&items.ItemModel{Slug: checkoutItemValidator.Order.Slug})
+	if err != nil || itemModel.ID == 0 || itemModel.Status != items.ItemPublished {
+		c.JSON(http.StatusNotFound, common.NewError("items", errors.New("Invalid slug")))
+		return
+	}
+	var orderModels []OrderModel
+	if variantID := checkoutItemValidator.Order.Variant; variantID != 0 {
+		var variantModel items.ItemVariantModel
+		variantModel, err = itemModel.FindVariant(variantID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("variant", err))
+			return
+		}
+		orderModels, err = CheckoutVariant(currentUser(c), itemModel, variantModel, checkoutItemValidator.Order.Quantity)
+	} else {
+		orderModels, err = CheckoutItem(currentUser(c), itemModel, checkoutItemValidator.Order.Quantity)
+	}
+	renderCheckout(c, orderModels, err)
+}
+
+func OrderCheckout(c *gin.Context) {
+	buyer := currentUser(c)
+	cart, err := carts.FindCart(buyer, "")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	orderModels, err := CheckoutCart(buyer, cart)
+	renderCheckout(c, orderModels, err)
+}
+
+func OrderList(c *gin.Context) {
+	actor := c.DefaultQuery("role", ActorBuyer)
+	status := c.Query("status")
+	limit := c.Query("limit")
+	offset := c.Query("offset")
+	orderModels, modelCount, err := FindManyOrder(currentUser(c), actor, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("orders", errors.New("Invalid param")))
+		return
+	}
+	serializer := OrdersSerializer{c, orderModels}
+	c.JSON(http.StatusOK, gin.H{"orders": serializer.Response(), "ordersCount": modelCount})
+}
+
+func OrderRetrieve(c *gin.Context) {
+	orderModel, _, err := findMyOrder(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("orders", errors.New("Invalid id")))
+		return
+	}
+	serializer := OrderSerializer{c, orderModel}
+	c.JSON(http.StatusOK, gin.H{"order": serializer.Response()})
+}
+
+func OrderTransition(c *gin.Context) {
+	orderModel, actor, err := findMyOrder(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("orders", errors.New("Invalid id")))
+		return
+	}
+	orderStatusValidator := NewOrderStatusValidator()
+	if err := orderStatusValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	err = orderModel.Transition(orderStatusValidator.Order.Status, actor)
+	if err == ErrInvalidTransition {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("status", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := OrderSerializer{c, orderModel}
+	c.JSON(http.StatusOK, gin.H{"order": serializer.Response()})
+}
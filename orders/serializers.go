@@ -0,0 +1,86 @@
+package orders
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+type OrderSerializer struct {
+	C *gin.Context
+	OrderModel
+}
+
+type OrdersSerializer struct {
+	C      *gin.Context
+	Orders []OrderModel
+}
+
+type OrderLineResponse struct {
+	Slug           string `json:"slug"`
+	Title          string `json:"title"`
+	VariantName    string `json:"variantName,omitempty"`
+	Price          int64  `json:"price"`
+	Currency       string `json:"currency"`
+	FormattedPrice string `json:"formattedPrice"`
+	Quantity       int    `json:"quantity"`
+	LineTotal      int64  `json:"lineTotal"`
+}
+
+type OrderResponse struct {
+	ID             uint                  `json:"id"`
+	Status         string                `json:"status"`
+	Buyer          users.ProfileResponse `json:"buyer"`
+	Seller         users.ProfileResponse `json:"seller"`
+	Lines          []OrderLineResponse   `json:"lines"`
+	Total          int64                 `json:"total"`
+	Currency       string                `json:"currency"`
+	FormattedTotal string                `json:"formattedTotal"`
+	NextStatuses   []string              `json:"nextStatuses"`
+	CreatedAt      string                `json:"createdAt"`
+	UpdatedAt      string                `json:"updatedAt"`
+}
+
+func (s *OrderSerializer) Response() OrderResponse {
+	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
+	buyerSerializer := items.ItemUserSerializer{C: s.C, ItemUserModel: s.Buyer}
+	sellerSerializer := items.ItemUserSerializer{C: s.C, ItemUserModel: s.Seller}
+	response := OrderResponse{
+		ID:             s.ID,
+		Status:         s.Status,
+		Buyer:          buyerSerializer.Response(),
+		Seller:         sellerSerializer.Response(),
+		Lines:          []OrderLineResponse{},
+		Total:          s.Total,
+		Currency:       s.Currency,
+		FormattedTotal: common.Money{Amount: s.Total, Currency: s.Currency}.String(),
+		NextStatuses:   s.NextStatuses(s.ActorFor(items.GetItemUserModel(myUserModel))),
+		CreatedAt:      s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	for _, line := range s.Lines {
+		price := common.Money{Amount: line.Price, Currency: line.Currency}
+		response.Lines = append(response.Lines, OrderLineResponse{
+			Slug:           line.Slug,
+			Title:          line.Title,
+			VariantName:    line.VariantName,
+			Price:          line.Price,
+			Currency:       line.Currency,
+			FormattedPrice: price.String(),
+			Quantity:       line.Quantity,
+			LineTotal:      price.Mul(int64(line.Quantity)).Amount,
+		})
+	}
+	return response
+}
+
+func (s *OrdersSerializer) Response() []OrderResponse {
+	response := []OrderResponse{}
+	for _, order := range s.Orders {
+		serializer := OrderSerializer{s.C, order}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
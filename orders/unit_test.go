@@ -0,0 +1,262 @@
+package orders
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+var test_db *gorm.DB
+
+func userModelMocker(n int) []users.UserModel {
+	var offset int
+	test_db.Model(&users.UserModel{}).Count(&offset)
+	var ret []users.UserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username:     fmt.Sprintf("user%v", i),
+			Email:        fmt.Sprintf("user%v@linkedin.com", i),
+			PasswordHash: "password123",
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func itemModelMocker(seller users.UserModel, price int64, quantity int) items.ItemModel {
+	var offset int
+	test_db.Model(&items.ItemModel{}).Count(&offset)
+	itemModel := items.ItemModel{
+		Slug:     fmt.Sprintf("item-%v", offset+1),
+		Title:    fmt.Sprintf("item %v", offset+1),
+		Price:    price,
+		Currency: "USD",
+		Quantity: quantity,
+		SellerID: items.GetItemUserModel(seller).ID,
+	}
+	test_db.Create(&itemModel)
+	return itemModel
+}
+
+func reloadItem(item items.ItemModel) items.ItemModel {
+	var model items.ItemModel
+	test_db.First(&model, item.ID)
+	return model
+}
+
+func orderRequest(r *gin.Engine, method, url string, user uint, body string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(user)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response map[string]json.RawMessage
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+func TestOrderStateMachine(t *testing.T) {
+	asserts := assert.New(t)
+
+	order := OrderModel{Status: OrderPending}
+	asserts.True(order.CanTransition(OrderPaid, ActorSystem), "payment should mark pending orders paid")
+	asserts.False(order.CanTransition(OrderPaid, ActorBuyer), "buyers should not mark their orders paid")
+	asserts.False(order.CanTransition(OrderShipped, ActorSeller), "unpaid orders should not ship")
+	asserts.Equal([]string{OrderCancelled}, order.NextStatuses(ActorBuyer))
+
+	order.Status = OrderPaid
+	asserts.Equal([]string{OrderShipped}, order.NextStatuses(ActorSeller))
+	asserts.False(order.CanTransition(OrderRefunded, ActorSeller), "refunds should only follow payment events")
+	asserts.Empty(order.NextStatuses(ActorBuyer), "buyers should wait for the shipment")
+
+	for _, status := range []string{OrderCompleted, OrderCancelled, OrderRefunded} {
+		order.Status = status
+		asserts.Empty(order.NextStatuses(ActorSystem), status+" should be a final status")
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	sellerA, sellerB, buyer := people[0], people[1], people[2]
+	itemA := itemModelMocker(sellerA, 1000, 3)
+	itemB := itemModelMocker(sellerB, 4000, 1)
+	buyerModel := items.GetItemUserModel(buyer)
+
+	cart, _ := carts.FindOrCreateCart(buyerModel, "")
+	asserts.NoError(cart.AddItem(itemA, 2))
+	asserts.NoError(cart.AddItem(itemB, 1))
+	orderModels, err := CheckoutCart(buyerModel, cart)
+	asserts.NoError(err, "checkout of a valid cart should work")
+	asserts.Len(orderModels, 2, "there should be one order per seller")
+	asserts.Equal(int64(2000), orderModels[0].Total, "total should be price times quantity")
+	asserts.Equal(OrderPending, orderModels[0].Status)
+	asserts.Equal(1, reloadItem(itemA).QuantityAvailable(), "checkout should reserve the stock")
+	cart.Revalidate()
+	asserts.Empty(cart.Lines, "checkout should empty the cart")
+
+	test_db.Model(&items.ItemModel{}).Where("id = ?", itemA.ID).Updates(map[string]interface{}{"title": "renamed", "price": 5})
+	orderA, _ := FindOneOrder(&OrderModel{Model: gorm.Model{ID: orderModels[0].ID}})
+	asserts.Equal("item 1", orderA.Lines[0].Title, "line should keep the title at purchase")
+	asserts.Equal(int64(1000), orderA.Lines[0].Price, "line should keep the price at purchase")
+
+	asserts.Equal(ErrInvalidTransition, orderA.Transition(OrderShipped, ActorSeller), "unpaid order should not ship")
+	asserts.NoError(orderA.Transition(OrderPaid, ActorSystem))
+	itemA = reloadItem(itemA)
+	asserts.Equal(1, itemA.Quantity, "paying should sell the reserved stock")
+	asserts.Equal(0, itemA.Reserved)
+	asserts.NoError(orderA.Transition(OrderShipped, ActorSeller))
+	asserts.NoError(orderA.Transition(OrderDelivered, ActorBuyer))
+	asserts.NoError(orderA.Transition(OrderCompleted, ActorBuyer))
+
+	orderB, _ := FindOneOrder(&OrderModel{Model: gorm.Model{ID: orderModels[1].ID}})
+	stale := orderB
+	asserts.NoError(orderB.Transition(OrderCancelled, ActorBuyer))
+	asserts.Equal(1, reloadItem(itemB).QuantityAvailable(), "cancelling should release the stock")
+	asserts.Equal(ErrInvalidTransition, stale.Transition(OrderPaid, ActorSystem), "a stale order should not be paid after cancellation")
+	sales, err := CountSales([]uint{itemA.ID, itemB.ID}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	asserts.NoError(err)
+	asserts.Equal(map[uint]int{itemA.ID: 1}, sales, "cancelled orders should not count as sales")
+
+	_, err = CheckoutItem(buyerModel, itemB, 2)
+	asserts.Equal(items.ErrOutOfStock, err, "buying more than the stock should fail")
+	_, err = CheckoutItem(items.GetItemUserModel(sellerB), itemB, 1)
+	asserts.Equal(carts.ErrOwnItem, err, "sellers should not buy their own items")
+}
+
+func TestAuctionCheckout(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(2)
+	seller, winner := people[0], people[1]
+	item := itemModelMocker(seller, 1000, 1)
+	auction, err := items.CreateAuction(item, 1000, 0, 100, time.Now().Add(time.Minute))
+	asserts.NoError(err)
+	_, err = items.PlaceBid(&auction, items.GetItemUserModel(winner), 1200)
+	asserts.NoError(err)
+	items.OnAuctionWon(CheckoutAuctionWinner)
+	closedAt := auction.EndsAt.Add(time.Second)
+	_, err = items.CloseAuctions(closedAt)
+	asserts.NoError(err)
+
+	var order OrderModel
+	test_db.Where("buyer_id = ?", items.GetItemUserModel(winner).ID).Preload("Lines").First(&order)
+	asserts.Equal(int64(1200), order.Total, "the winner should pay the winning bid")
+	asserts.Equal(auction.ReservationID, order.Lines[0].ReservationID, "the order should take the unit held by the auction")
+	asserts.WithinDuration(closedAt.Add(items.AuctionPaymentTTL), *order.PayBy, time.Second)
+	asserts.Equal(1, reloadItem(item).Reserved, "no other unit should be reserved")
+
+	CancelExpiredOrders(closedAt.Add(items.ReservationTTL + time.Minute))
+	order, _ = FindOneOrder(&OrderModel{Model: gorm.Model{ID: order.ID}})
+	asserts.Equal(OrderPending, order.Status, "the winner should have longer than a checkout to pay")
+	CancelExpiredOrders(closedAt.Add(items.AuctionPaymentTTL + time.Minute))
+	order, _ = FindOneOrder(&OrderModel{Model: gorm.Model{ID: order.ID}})
+	asserts.Equal(OrderCancelled, order.Status, "unpaid auction orders should be cancelled at their deadline")
+	asserts.Zero(reloadItem(item).Reserved)
+}
+
+func TestPayAfterStockIsGone(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, buyer, other := people[0], people[1], people[2]
+	itemA := itemModelMocker(seller, 1000, 2)
+	itemB := itemModelMocker(seller, 1000, 1)
+	buyerModel := items.GetItemUserModel(buyer)
+
+	cart, _ := carts.FindOrCreateCart(buyerModel, "")
+	asserts.NoError(cart.AddItem(itemA, 1))
+	asserts.NoError(cart.AddItem(itemB, 1))
+	orderModels, err := CheckoutCart(buyerModel, cart)
+	asserts.NoError(err)
+	order, _ := FindOneOrder(&OrderModel{Model: gorm.Model{ID: orderModels[0].ID}})
+	asserts.NoError(order.getLines())
+	asserts.Len(order.Lines, 2)
+
+	// The reservation of the second line expires and someone else buys the unit.
+	for _, line := range order.Lines {
+		if line.ItemID == itemB.ID {
+			asserts.NoError(line.Reservation.Release())
+		}
+	}
+	_, err = CheckoutItem(items.GetItemUserModel(other), itemB, 1)
+	asserts.NoError(err)
+
+	asserts.Equal(items.ErrOutOfStock, order.Transition(OrderPaid, ActorSystem), "an order whose stock is gone should not be paid")
+	order, _ = FindOneOrder(&OrderModel{Model: gorm.Model{ID: order.ID}})
+	asserts.Equal(OrderPending, order.Status, "the order should stay pending so the payment gets refunded")
+	itemA = reloadItem(itemA)
+	asserts.Equal(2, itemA.Quantity, "lines of an unpaid order should not be sold")
+	asserts.Equal(1, itemA.Reserved, "their reservation should still hold the stock")
+}
+
+func TestOrderRouters(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(3)
+	seller, buyer, stranger := people[0], people[1], people[2]
+	item := itemModelMocker(seller, 700, 2)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(true))
+	OrdersRegister(r.Group("/orders"))
+
+	w, response := orderRequest(r, "POST", "/orders/", buyer.ID, fmt.Sprintf(`{"order":{"slug":"%v"}}`, item.Slug))
+	asserts.Equal(http.StatusCreated, w.Code, "buying a single item should create an order")
+	var created []OrderResponse
+	json.Unmarshal(response["orders"], &created)
+	asserts.Len(created, 1)
+	asserts.Equal("7.00 USD", created[0].FormattedTotal)
+	asserts.Equal([]string{OrderCancelled}, created[0].NextStatuses)
+	url := fmt.Sprintf("/orders/%v", created[0].ID)
+
+	w, _ = orderRequest(r, "GET", url, stranger.ID, ``)
+	asserts.Equal(http.StatusNotFound, w.Code, "strangers should not see the order")
+
+	draft := itemModelMocker(seller, 700, 2)
+	test_db.Model(&items.ItemModel{}).Where("id = ?", draft.ID).Update("status", items.ItemDraft)
+	w, _ = orderRequest(r, "POST", "/orders/", buyer.ID, fmt.Sprintf(`{"order":{"slug":"%v"}}`, draft.Slug))
+	asserts.Equal(http.StatusNotFound, w.Code, "unpublished items should not be bought")
+
+	w, response = orderRequest(r, "GET", "/orders/?role=seller", seller.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("1", string(response["ordersCount"]), "seller should see the order they sold")
+	w, response = orderRequest(r, "GET", "/orders/", seller.ID, ``)
+	asserts.Equal("0", string(response["ordersCount"]), "seller bought nothing")
+
+	w, _ = orderRequest(r, "POST", url+"/status", buyer.ID, `{"order":{"status":"paid"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "buyers should not mark orders paid")
+	w, response = orderRequest(r, "POST", url+"/status", buyer.ID, `{"order":{"status":"cancelled"}}`)
+	asserts.Equal(http.StatusOK, w.Code, "buyers should cancel pending orders")
+	var order OrderResponse
+	json.Unmarshal(response["order"], &order)
+	asserts.Equal(OrderCancelled, order.Status)
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	items.AutoMigrate()
+	carts.AutoMigrate()
+	AutoMigrate()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
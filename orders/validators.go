@@ -0,0 +1,41 @@
+package orders
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+// Buying a single item straight from its page.
+type CheckoutItemValidator struct {
+	Order struct {
+		Slug     string `form:"slug" json:"slug" binding:"required"`
+		Variant  uint   `form:"variant" json:"variant"`
+		Quantity int    `form:"quantity" json:"quantity" binding:"min=1"`
+	} `json:"order"`
+}
+
+// A checkout buys a single unit unless told otherwise.
+func NewCheckoutItemValidator() CheckoutItemValidator {
+	checkoutItemValidator := CheckoutItemValidator{}
+	checkoutItemValidator.Order.Quantity = 1
+	return checkoutItemValidator
+}
+
+func (s *CheckoutItemValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type OrderStatusValidator struct {
+	Order struct {
+		Status string `form:"status" json:"status" binding:"required"`
+	} `json:"order"`
+}
+
+func NewOrderStatusValidator() OrderStatusValidator {
+	return OrderStatusValidator{}
+}
+
+func (s *OrderStatusValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
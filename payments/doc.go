@@ -0,0 +1,14 @@
+/*
+The payment module taking money for orders through a PaymentProvider.
+
+model.go: definition of orm based data model and payment event handling
+
+providers.go: the PaymentProvider interface and the local fake provider
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+
+validators.go: definition the validator of form data
+*/
+package payments
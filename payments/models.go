@@ -0,0 +1,236 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/orders"
+)
+
+// One attempt at paying an order. IdempotencyKey is unique so a retried request
+// returns the payment it already created instead of charging twice.
+type PaymentModel struct {
+	gorm.Model
+	Order          orders.OrderModel
+	OrderID        uint   `gorm:"index"`
+	IdempotencyKey string `gorm:"unique_index"`
+	IntentID       string `gorm:"unique_index"`
+	ClientSecret   string
+	Amount         int64
+	Currency       string `gorm:"size:3"`
+	Status         string `gorm:"size:16"`
+}
+
+// Webhook events already handled. Providers deliver at least once, the unique
+// EventID makes handling them exactly once.
+type PaymentEventModel struct {
+	gorm.Model
+	EventID   string `gorm:"unique_index"`
+	Type      string
+	PaymentID uint
+}
+
+const (
+	PaymentCreated       = "created"
+	PaymentCaptured      = "captured"
+	PaymentFailed        = "failed"
+	PaymentRefundPending = "refund_pending"
+	PaymentRefunded      = "refunded"
+)
+
+var ErrOrderNotPayable = errors.New("order is not waiting for payment")
+var ErrNotRefundable = errors.New("payment can not be refunded")
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+	db.AutoMigrate(&PaymentModel{})
+	db.AutoMigrate(&PaymentEventModel{})
+}
+
+func FindOnePayment(condition interface{}) (PaymentModel, error) {
+	db := common.GetDB()
+	var model PaymentModel
+	err := db.Where(condition).First(&model).Error
+	return model, err
+}
+
+// Start paying order. Without an idempotency key from the client, retries are keyed
+// by the order and the number of failed attempts, so a declined payment can be
+// tried again but an in-flight one is reused.
+func CreatePayment(order orders.OrderModel, idempotencyKey string) (PaymentModel, error) {
+	db := common.GetDB()
+	if order.Status != orders.OrderPending {
+		return PaymentModel{}, ErrOrderNotPayable
+	}
+	if idempotencyKey == "" {
+		var failed int
+		db.Model(&PaymentModel{}).Where(PaymentModel{OrderID: order.ID, Status: PaymentFailed}).Count(&failed)
+		idempotencyKey = fmt.Sprintf("order-%d-%d", order.ID, failed)
+	} else {
+		idempotencyKey = fmt.Sprintf("buyer-%d-%v", order.BuyerID, idempotencyKey)
+	}
+	var payment PaymentModel
+	db.Where(PaymentModel{IdempotencyKey: idempotencyKey}).First(&payment)
+	if payment.ID != 0 {
+		return payment, nil
+	}
+
+	amount := common.Money{Amount: order.Total, Currency: order.Currency}
+	intent, err := GetProvider().CreateIntent(amount, idempotencyKey)
+	if err != nil {
+		return payment, err
+	}
+	payment = PaymentModel{
+		OrderID:        order.ID,
+		IdempotencyKey: idempotencyKey,
+		IntentID:       intent.ID,
+		ClientSecret:   intent.ClientSecret,
+		Amount:         amount.Amount,
+		Currency:       amount.Currency,
+		Status:         PaymentCreated,
+	}
+	err = db.Create(&payment).Error
+	return payment, err
+}
+
+// Ask the provider to give the money back. The order only becomes refunded once the
+// provider confirms it through a verified refund.succeeded webhook.
+func (payment *PaymentModel) Refund() error {
+	if payment.Status != PaymentCaptured {
+		return ErrNotRefundable
+	}
+	db := common.GetDB()
+	result := db.Model(&PaymentModel{}).
+		Where("id = ? AND status = ?", payment.ID, PaymentCaptured).
+		Update("status", PaymentRefundPending)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotRefundable
+	}
+	payment.Status = PaymentRefundPending
+	amount := common.Money{Amount: payment.Amount, Currency: payment.Currency}
+	if err := GetProvider().Refund(payment.IntentID, amount); err != nil {
+		payment.setStatus(PaymentCaptured)
+		return err
+	}
+	return nil
+}
+
+func (payment *PaymentModel) setStatus(status string) error {
+	db := common.GetDB()
+	err := db.Model(&PaymentModel{}).Where("id = ?", payment.ID).Update("status", status).Error
+	if err == nil {
+		payment.Status = status
+	}
+	return err
+}
+
+// Verify and handle a webhook delivery. This is the only way an order becomes paid
+// or refunded.
+func HandleWebhookPayload(payload []byte, signature string) error {
+	event, err := GetProvider().VerifyWebhook(payload, signature)
+	if err != nil {
+		return err
+	}
+	return HandleEvent(event)
+}
+
+// Apply a verified provider event. Events are claimed by inserting their ID first,
+// so a redelivered event is a no-op; if handling fails the claim is dropped and
+// the provider's retry gets another chance.
+func HandleEvent(event Event) error {
+	db := common.GetDB()
+	payment, err := FindOnePayment(&PaymentModel{IntentID: event.IntentID})
+	if err != nil {
+		return ErrUnknownIntent
+	}
+	claim := PaymentEventModel{EventID: event.ID, Type: event.Type, PaymentID: payment.ID}
+	var seen int
+	db.Model(&PaymentEventModel{}).Where(PaymentEventModel{EventID: event.ID}).Count(&seen)
+	if seen != 0 {
+		return nil
+	}
+	if err := db.Create(&claim).Error; err != nil {
+		// Lost the race against a concurrent delivery of the same event.
+		return nil
+	}
+	if err := payment.apply(event); err != nil {
+		db.Unscoped().Delete(&claim)
+		return err
+	}
+	return nil
+}
+
+func (payment *PaymentModel) apply(event Event) error {
+	order, err := orders.FindOneOrder(&orders.OrderModel{Model: gorm.Model{ID: payment.OrderID}})
+	if err != nil {
+		return err
+	}
+	switch event.Type {
+	case EventPaymentFailed:
+		if payment.Status != PaymentCreated {
+			return nil
+		}
+		return payment.setStatus(PaymentFailed)
+	case EventPaymentAuthorized:
+		return payment.captureFor(&order)
+	case EventRefundSucceeded:
+		if err := payment.setStatus(PaymentRefunded); err != nil {
+			return err
+		}
+		err := order.Transition(orders.OrderRefunded, orders.ActorSystem)
+		if err == orders.ErrInvalidTransition {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Money first, then goods: capture the authorized payment and only then mark the
+// order paid. If the order can not be paid any more (cancelled, or its stock is
+// gone), the captured money is refunded straight away.
+//
+// Whether to refund is decided from the order, which only becomes paid together
+// with its stock: a captured payment of an order that is still not paid is
+// refunded, so when the refund fails the redelivered event tries it again.
+func (payment *PaymentModel) captureFor(order *orders.OrderModel) error {
+	switch payment.Status {
+	case PaymentCreated:
+		if order.Status != orders.OrderPending {
+			return payment.setStatus(PaymentFailed)
+		}
+		if err := GetProvider().Capture(payment.IntentID); err != nil {
+			payment.setStatus(PaymentFailed)
+			return nil
+		}
+		if err := payment.setStatus(PaymentCaptured); err != nil {
+			return err
+		}
+		if order.Transition(orders.OrderPaid, orders.ActorSystem) == nil {
+			return nil
+		}
+	case PaymentCaptured:
+		if orderPaid(*order) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return payment.Refund()
+}
+
+// Reports whether the order has been paid and not refunded.
+func orderPaid(order orders.OrderModel) bool {
+	switch order.Status {
+	case orders.OrderPaid, orders.OrderShipped, orders.OrderDelivered, orders.OrderCompleted:
+		return true
+	}
+	return false
+}
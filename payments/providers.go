@@ -0,0 +1,221 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+// Everything we need from a payment service. Intents are authorized by the buyer on
+// the provider side and only captured by us once the order can really be paid, so
+// money is never taken for an order that was cancelled in the meantime. Buyers
+// authorize on the provider's side with the intent's ClientSecret, the provider
+// then tells us through the webhook.
+type PaymentProvider interface {
+	// Start a payment of amount. Reference is our idempotency key: calling twice with
+	// the same reference must return the same intent.
+	CreateIntent(amount common.Money, reference string) (Intent, error)
+	Capture(intentID string) error
+	Refund(intentID string, amount common.Money) error
+	// Check the webhook signature and decode the event, never trust an unsigned payload.
+	VerifyWebhook(payload []byte, signature string) (Event, error)
+}
+
+type Intent struct {
+	ID           string
+	ClientSecret string
+}
+
+// What a provider tells us through its webhook.
+type Event struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	IntentID string `json:"intentId"`
+}
+
+const (
+	EventPaymentAuthorized = "payment.authorized"
+	EventPaymentFailed     = "payment.failed"
+	EventRefundSucceeded   = "refund.succeeded"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+var ErrUnknownIntent = errors.New("unknown payment intent")
+
+var provider PaymentProvider
+
+// Choose the provider used by the payment endpoints, once at startup.
+//
+//	payments.SetProvider(payments.NewFakeProvider("secret", payments.FakeSucceed))
+func SetProvider(p PaymentProvider) {
+	provider = p
+}
+
+func GetProvider() PaymentProvider {
+	return provider
+}
+
+// How the fake provider answers when the buyer confirms a payment.
+const (
+	FakeSucceed = "succeed"
+	FakeDecline = "decline"
+	// Authorize the payment but hold the webhook until Flush, like a slow provider.
+	FakeDelay = "delay"
+)
+
+// A fully local PaymentProvider for development and tests. It signs its webhooks
+// with Secret exactly like a real provider would and hands them to Deliver, which
+// is usually wired to HandleWebhookPayload or to an HTTP call to the webhook route.
+// Buyers confirm its payments with POST /payments/:id/confirm, see PaymentConfirm.
+// Intents only live in memory, their IDs carry a random prefix so they never clash
+// with the ones stored by a previous run.
+type FakeProvider struct {
+	Secret  string
+	Mode    string
+	Deliver func(payload []byte, signature string)
+
+	mu       sync.Mutex
+	prefix   string
+	intents  map[string]*fakeIntent
+	byRef    map[string]string
+	pending  [][]byte
+	sequence int
+}
+
+type fakeIntent struct {
+	amount     common.Money
+	authorized bool
+	captured   bool
+	refunded   bool
+}
+
+func NewFakeProvider(secret string, mode string) *FakeProvider {
+	return &FakeProvider{
+		Secret:  secret,
+		Mode:    mode,
+		prefix:  common.RandString(8),
+		intents: map[string]*fakeIntent{},
+		byRef:   map[string]string{},
+	}
+}
+
+func (f *FakeProvider) CreateIntent(amount common.Money, reference string) (Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, ok := f.byRef[reference]
+	if !ok {
+		f.sequence++
+		id = fmt.Sprintf("fake_pi_%v_%d", f.prefix, f.sequence)
+		f.intents[id] = &fakeIntent{amount: amount}
+		f.byRef[reference] = id
+	}
+	return Intent{ID: id, ClientSecret: id + "_secret"}, nil
+}
+
+func (f *FakeProvider) Capture(intentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	intent, ok := f.intents[intentID]
+	if !ok || !intent.authorized {
+		return ErrUnknownIntent
+	}
+	intent.captured = true
+	return nil
+}
+
+func (f *FakeProvider) Refund(intentID string, amount common.Money) error {
+	f.mu.Lock()
+	intent, ok := f.intents[intentID]
+	if !ok || !intent.captured || intent.refunded {
+		f.mu.Unlock()
+		return ErrUnknownIntent
+	}
+	intent.refunded = true
+	f.mu.Unlock()
+	f.emit(EventRefundSucceeded, intentID)
+	return nil
+}
+
+func (f *FakeProvider) VerifyWebhook(payload []byte, signature string) (Event, error) {
+	var event Event
+	if !hmac.Equal([]byte(f.Sign(payload)), []byte(signature)) {
+		return event, ErrInvalidSignature
+	}
+	err := json.Unmarshal(payload, &event)
+	return event, err
+}
+
+// Hex encoded HMAC-SHA256 of payload, as sent in the webhook signature header.
+func (f *FakeProvider) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.Secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Play the buyer confirming the payment on the provider's page. Depending on Mode
+// the payment is authorized, declined, or authorized with the webhook held back.
+func (f *FakeProvider) Confirm(intentID string) error {
+	f.mu.Lock()
+	intent, ok := f.intents[intentID]
+	if !ok {
+		f.mu.Unlock()
+		return ErrUnknownIntent
+	}
+	if f.Mode == FakeDecline {
+		f.mu.Unlock()
+		f.emit(EventPaymentFailed, intentID)
+		return nil
+	}
+	intent.authorized = true
+	f.mu.Unlock()
+	f.emit(EventPaymentAuthorized, intentID)
+	return nil
+}
+
+// Deliver the webhooks held back in FakeDelay mode, oldest first.
+func (f *FakeProvider) Flush() {
+	f.mu.Lock()
+	pending := f.pending
+	f.pending = nil
+	f.mu.Unlock()
+	for _, payload := range pending {
+		f.deliver(payload)
+	}
+}
+
+// Reports whether the intent was captured and not refunded, i.e. we hold the money.
+func (f *FakeProvider) Captured(intentID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	intent, ok := f.intents[intentID]
+	return ok && intent.captured && !intent.refunded
+}
+
+func (f *FakeProvider) emit(eventType string, intentID string) {
+	f.mu.Lock()
+	f.sequence++
+	payload, _ := json.Marshal(Event{
+		ID:       fmt.Sprintf("fake_evt_%v_%d", f.prefix, f.sequence),
+		Type:     eventType,
+		IntentID: intentID,
+	})
+	if f.Mode == FakeDelay {
+		f.pending = append(f.pending, payload)
+		f.mu.Unlock()
+		return
+	}
+	f.mu.Unlock()
+	f.deliver(payload)
+}
+
+func (f *FakeProvider) deliver(payload []byte) {
+	if f.Deliver != nil {
+		f.Deliver(payload, f.Sign(payload))
+	}
+}
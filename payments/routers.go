@@ -0,0 +1,162 @@
+package payments
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/orders"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+// Header carrying the provider's signature of the webhook body.
+const SignatureHeader = "X-Payment-Signature"
+
+// Header a client may send so a retried "pay" request never creates a second payment.
+const IdempotencyHeader = "Idempotency-Key"
+
+func PaymentsRegister(router *gin.RouterGroup) {
+	router.POST("/", PaymentCreate)
+	router.GET("/:id", PaymentRetrieve)
+	router.POST("/:id/refund", PaymentRefund)
+	router.POST("/:id/confirm", PaymentConfirm)
+}
+
+// The provider is not logged in: webhooks are authenticated by their signature.
+func PaymentsAnonymousRegister(router *gin.RouterGroup) {
+	router.POST("/webhook", PaymentWebhook)
+}
+
+func currentUser(c *gin.Context) items.ItemUserModel {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	return items.GetItemUserModel(myUserModel)
+}
+
+func findOrder(id uint) (orders.OrderModel, error) {
+	return orders.FindOneOrder(&orders.OrderModel{Model: gorm.Model{ID: id}})
+}
+
+func PaymentCreate(c *gin.Context) {
+	paymentValidator := NewPaymentValidator()
+	if err := paymentValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	orderModel, err := findOrder(paymentValidator.Payment.OrderID)
+	if err != nil || orderModel.ActorFor(currentUser(c)) != orders.ActorBuyer {
+		c.JSON(http.StatusNotFound, common.NewError("orders", errors.New("Invalid id")))
+		return
+	}
+	payment, err := CreatePayment(orderModel, c.GetHeader(IdempotencyHeader))
+	if err == ErrOrderNotPayable {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("payment", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, common.NewError("payment", err))
+		return
+	}
+	serializer := PaymentSerializer{c, payment}
+	c.JSON(http.StatusCreated, gin.H{"payment": serializer.Response()})
+}
+
+// Load the payment in the :id param with the role the current user plays in its order.
+func findMyPayment(c *gin.Context) (PaymentModel, string, error) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return PaymentModel{}, "", err
+	}
+	payment, err := FindOnePayment(&PaymentModel{Model: gorm.Model{ID: uint(id64)}})
+	if err != nil {
+		return payment, "", err
+	}
+	orderModel, err := findOrder(payment.OrderID)
+	if err != nil {
+		return payment, "", err
+	}
+	actor := orderModel.ActorFor(currentUser(c))
+	if actor == "" {
+		return payment, "", errors.New("Invalid id")
+	}
+	return payment, actor, nil
+}
+
+func PaymentRetrieve(c *gin.Context) {
+	payment, _, err := findMyPayment(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("payments", errors.New("Invalid id")))
+		return
+	}
+	serializer := PaymentSerializer{c, payment}
+	c.JSON(http.StatusOK, gin.H{"payment": serializer.Response()})
+}
+
+// Only the seller gives money back; the order turns refunded when the provider
+// confirms the refund through the webhook.
+func PaymentRefund(c *gin.Context) {
+	payment, actor, err := findMyPayment(c)
+	if err != nil || actor != orders.ActorSeller {
+		c.JSON(http.StatusNotFound, common.NewError("payments", errors.New("Invalid id")))
+		return
+	}
+	err = payment.Refund()
+	if err == ErrNotRefundable {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("payment", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, common.NewError("payment", err))
+		return
+	}
+	payment, _ = FindOnePayment(&PaymentModel{Model: gorm.Model{ID: payment.ID}})
+	serializer := PaymentSerializer{c, payment}
+	c.JSON(http.StatusOK, gin.H{"payment": serializer.Response()})
+}
+
+// Buyers confirm payments on the provider's side with the client secret. The fake
+// provider has no such page, so in development the buyer confirms here instead;
+// with any other provider the route does not exist.
+func PaymentConfirm(c *gin.Context) {
+	fake, ok := GetProvider().(*FakeProvider)
+	payment, actor, err := findMyPayment(c)
+	if !ok || err != nil || actor != orders.ActorBuyer {
+		c.JSON(http.StatusNotFound, common.NewError("payments", errors.New("Invalid id")))
+		return
+	}
+	if err := fake.Confirm(payment.IntentID); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("payment", err))
+		return
+	}
+	payment, _ = FindOnePayment(&PaymentModel{Model: gorm.Model{ID: payment.ID}})
+	serializer := PaymentSerializer{c, payment}
+	c.JSON(http.StatusOK, gin.H{"payment": serializer.Response()})
+}
+
+func PaymentWebhook(c *gin.Context) {
+	payload, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("webhook", err))
+		return
+	}
+	err = HandleWebhookPayload(payload, c.GetHeader(SignatureHeader))
+	if err == ErrInvalidSignature {
+		c.JSON(http.StatusUnauthorized, common.NewError("webhook", err))
+		return
+	}
+	if err == ErrUnknownIntent {
+		c.JSON(http.StatusNotFound, common.NewError("webhook", err))
+		return
+	}
+	if err != nil {
+		// Anything else is worth a retry from the provider.
+		c.JSON(http.StatusInternalServerError, common.NewError("webhook", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": "Receive success"})
+}
@@ -0,0 +1,39 @@
+package payments
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+type PaymentSerializer struct {
+	C *gin.Context
+	PaymentModel
+}
+
+type PaymentResponse struct {
+	ID              uint   `json:"id"`
+	OrderID         uint   `json:"orderId"`
+	Status          string `json:"status"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	FormattedAmount string `json:"formattedAmount"`
+	ClientSecret    string `json:"clientSecret,omitempty"`
+}
+
+// The client secret lets the buyer confirm the payment with the provider, it is
+// only useful (and only shown) while the payment waits for that.
+func (s *PaymentSerializer) Response() PaymentResponse {
+	response := PaymentResponse{
+		ID:              s.ID,
+		OrderID:         s.OrderID,
+		Status:          s.Status,
+		Amount:          s.Amount,
+		Currency:        s.Currency,
+		FormattedAmount: common.Money{Amount: s.Amount, Currency: s.Currency}.String(),
+	}
+	if s.Status == PaymentCreated {
+		response.ClientSecret = s.ClientSecret
+	}
+	return response
+}
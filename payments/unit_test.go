@@ -0,0 +1,315 @@
+package payments
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NivRichter/GoLang-test1/carts"
+	"github.com/NivRichter/GoLang-test1/common"
+	"github.com/NivRichter/GoLang-test1/items"
+	"github.com/NivRichter/GoLang-test1/orders"
+	"github.com/NivRichter/GoLang-test1/users"
+)
+
+var test_db *gorm.DB
+
+func userModelMocker(n int) []users.UserModel {
+	var offset int
+	test_db.Model(&users.UserModel{}).Count(&offset)
+	var ret []users.UserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username:     fmt.Sprintf("user%v", i),
+			Email:        fmt.Sprintf("user%v@linkedin.com", i),
+			PasswordHash: "password123",
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func itemModelMocker(seller users.UserModel, price int64, quantity int) items.ItemModel {
+	var offset int
+	test_db.Model(&items.ItemModel{}).Count(&offset)
+	itemModel := items.ItemModel{
+		Slug:     fmt.Sprintf("item-%v", offset+1),
+		Title:    fmt.Sprintf("item %v", offset+1),
+		Price:    price,
+		Currency: "USD",
+		Quantity: quantity,
+		SellerID: items.GetItemUserModel(seller).ID,
+	}
+	test_db.Create(&itemModel)
+	return itemModel
+}
+
+// An order of one unit of a fresh item, with the buyer and seller behind it.
+func orderMocker() (orders.OrderModel, items.ItemModel, users.UserModel, users.UserModel) {
+	people := userModelMocker(2)
+	seller, buyer := people[0], people[1]
+	item := itemModelMocker(seller, 1500, 1)
+	orderModels, _ := orders.CheckoutItem(items.GetItemUserModel(buyer), item, 1)
+	return orderModels[0], item, seller, buyer
+}
+
+func reloadOrder(order orders.OrderModel) orders.OrderModel {
+	model, _ := orders.FindOneOrder(&orders.OrderModel{Model: gorm.Model{ID: order.ID}})
+	return model
+}
+
+func reloadPayment(payment PaymentModel) PaymentModel {
+	model, _ := FindOnePayment(&PaymentModel{Model: gorm.Model{ID: payment.ID}})
+	return model
+}
+
+func fakeProviderMocker(mode string) *FakeProvider {
+	fake := NewFakeProvider("test-secret", mode)
+	fake.Deliver = func(payload []byte, signature string) {
+		HandleWebhookPayload(payload, signature)
+	}
+	SetProvider(fake)
+	return fake
+}
+
+func paymentRequest(r *gin.Engine, method, url string, user uint, body string) (*httptest.ResponseRecorder, PaymentResponse) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(user)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response struct {
+		Payment PaymentResponse `json:"payment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response.Payment
+}
+
+func TestPaymentSucceeds(t *testing.T) {
+	asserts := assert.New(t)
+
+	fake := fakeProviderMocker(FakeSucceed)
+	order, item, _, _ := orderMocker()
+	payment, err := CreatePayment(order, "")
+	asserts.NoError(err)
+	asserts.Equal(int64(1500), payment.Amount, "payment should charge the order total")
+	again, _ := CreatePayment(order, "")
+	asserts.Equal(payment.ID, again.ID, "retrying should reuse the payment in flight")
+	asserts.Equal(orders.OrderPending, reloadOrder(order).Status, "creating a payment should not pay the order")
+
+	asserts.NoError(fake.Confirm(payment.IntentID))
+	asserts.Equal(PaymentCaptured, reloadPayment(payment).Status)
+	asserts.True(fake.Captured(payment.IntentID), "authorized payment should be captured")
+	asserts.Equal(orders.OrderPaid, reloadOrder(order).Status, "the webhook should mark the order paid")
+	var sold items.ItemModel
+	test_db.First(&sold, item.ID)
+	asserts.Equal(0, sold.Quantity, "paying should sell the stock")
+
+	_, err = CreatePayment(reloadOrder(order), "")
+	asserts.Equal(ErrOrderNotPayable, err, "paid orders should not be paid twice")
+}
+
+func TestPaymentDeclined(t *testing.T) {
+	asserts := assert.New(t)
+
+	fake := fakeProviderMocker(FakeDecline)
+	order, _, _, _ := orderMocker()
+	payment, _ := CreatePayment(order, "")
+	asserts.NoError(fake.Confirm(payment.IntentID))
+	asserts.Equal(PaymentFailed, reloadPayment(payment).Status)
+	asserts.Equal(orders.OrderPending, reloadOrder(order).Status, "declined payment should leave the order waiting")
+
+	retry, err := CreatePayment(order, "")
+	asserts.NoError(err)
+	asserts.NotEqual(payment.ID, retry.ID, "a declined payment should be retryable")
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	asserts := assert.New(t)
+
+	fake := fakeProviderMocker(FakeDelay)
+	var delivered [][]byte
+	fake.Deliver = func(payload []byte, signature string) {
+		delivered = append(delivered, payload)
+	}
+	order, _, seller, _ := orderMocker()
+	payment, _ := CreatePayment(order, "")
+	asserts.NoError(fake.Confirm(payment.IntentID))
+	asserts.Empty(delivered, "delayed webhooks should wait for Flush")
+	asserts.Equal(orders.OrderPending, reloadOrder(order).Status, "order should stay pending until the webhook")
+	fake.Flush()
+	asserts.Len(delivered, 1)
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	PaymentsAnonymousRegister(r.Group("/payments"))
+	r.Use(users.AuthMiddleware(true))
+	PaymentsRegister(r.Group("/payments"))
+	webhook := func(payload []byte, signature string) int {
+		req, _ := http.NewRequest("POST", "/payments/webhook", bytes.NewBuffer(payload))
+		req.Header.Set(SignatureHeader, signature)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	asserts.Equal(http.StatusUnauthorized, webhook(delivered[0], "bad"), "unsigned webhooks should be refused")
+	asserts.Equal(orders.OrderPending, reloadOrder(order).Status)
+	asserts.Equal(http.StatusOK, webhook(delivered[0], fake.Sign(delivered[0])))
+	asserts.Equal(orders.OrderPaid, reloadOrder(order).Status, "signed webhook should pay the order")
+	asserts.Equal(http.StatusOK, webhook(delivered[0], fake.Sign(delivered[0])), "redelivery should be accepted")
+	var events int
+	test_db.Model(&PaymentEventModel{}).Where(PaymentEventModel{PaymentID: payment.ID}).Count(&events)
+	asserts.Equal(1, events, "redelivery should be handled once")
+
+	url := fmt.Sprintf("/payments/%v", payment.ID)
+	w, response := paymentRequest(r, "GET", url, seller.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(PaymentCaptured, response.Status)
+	asserts.Equal("15.00 USD", response.FormattedAmount)
+	asserts.Empty(response.ClientSecret, "client secret should not outlive the payment confirmation")
+
+	w, response = paymentRequest(r, "POST", url+"/refund", seller.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code, "seller should refund a captured payment")
+	asserts.Equal(PaymentRefundPending, response.Status)
+	asserts.Equal(orders.OrderPaid, reloadOrder(order).Status, "order should wait for the refund webhook")
+	fake.Flush()
+	asserts.Len(delivered, 2)
+	asserts.Equal(http.StatusOK, webhook(delivered[1], fake.Sign(delivered[1])))
+	asserts.Equal(orders.OrderRefunded, reloadOrder(order).Status, "refund webhook should refund the order")
+	asserts.Equal(PaymentRefunded, reloadPayment(payment).Status)
+}
+
+// A FakeProvider whose refunds fail until failRefunds runs out, like a provider
+// having an outage.
+type flakyRefunds struct {
+	*FakeProvider
+	failRefunds int
+}
+
+func (f *flakyRefunds) Refund(intentID string, amount common.Money) error {
+	if f.failRefunds > 0 {
+		f.failRefunds--
+		return errors.New("provider unavailable")
+	}
+	return f.FakeProvider.Refund(intentID, amount)
+}
+
+func TestPaymentRefundRetried(t *testing.T) {
+	asserts := assert.New(t)
+
+	fake := fakeProviderMocker(FakeDelay)
+	var delivered [][]byte
+	fake.Deliver = func(payload []byte, signature string) {
+		delivered = append(delivered, payload)
+	}
+	SetProvider(&flakyRefunds{FakeProvider: fake, failRefunds: 1})
+	order, item, _, buyer := orderMocker()
+	payment, _ := CreatePayment(order, "")
+
+	// The reservation runs out and someone else buys the last unit before the
+	// payment goes through.
+	reservations, _ := items.FindHeldReservations(item, items.GetItemUserModel(buyer))
+	asserts.NoError(reservations[0].Release())
+	other := userModelMocker(1)[0]
+	_, err := orders.CheckoutItem(items.GetItemUserModel(other), item, 1)
+	asserts.NoError(err)
+
+	asserts.NoError(fake.Confirm(payment.IntentID))
+	fake.Flush()
+	asserts.Len(delivered, 1)
+	asserts.Error(HandleWebhookPayload(delivered[0], fake.Sign(delivered[0])), "a failed refund should be reported to the provider")
+	asserts.Equal(PaymentCaptured, reloadPayment(payment).Status)
+	asserts.Equal(orders.OrderPending, reloadOrder(order).Status, "an order without stock should not be paid")
+	asserts.True(fake.Captured(payment.IntentID))
+
+	asserts.NoError(HandleWebhookPayload(delivered[0], fake.Sign(delivered[0])))
+	asserts.Equal(PaymentRefundPending, reloadPayment(payment).Status, "redelivery should retry the refund")
+	fake.Flush()
+	asserts.Len(delivered, 2)
+	asserts.NoError(HandleWebhookPayload(delivered[1], fake.Sign(delivered[1])))
+	asserts.Equal(PaymentRefunded, reloadPayment(payment).Status)
+	asserts.False(fake.Captured(payment.IntentID), "the money should go back to the buyer")
+
+	failed := Event{ID: "evt-late-failure", Type: EventPaymentFailed, IntentID: payment.IntentID}
+	asserts.NoError(HandleEvent(failed))
+	asserts.Equal(PaymentRefunded, reloadPayment(payment).Status, "a late failure should not touch a captured payment")
+}
+
+func TestPaymentRouters(t *testing.T) {
+	asserts := assert.New(t)
+
+	fakeProviderMocker(FakeSucceed)
+	order, _, seller, buyer := orderMocker()
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(true))
+	PaymentsRegister(r.Group("/payments"))
+
+	body := fmt.Sprintf(`{"payment":{"orderId":%v}}`, order.ID)
+	w, _ := paymentRequest(r, "POST", "/payments/", seller.ID, body)
+	asserts.Equal(http.StatusNotFound, w.Code, "only the buyer should pay the order")
+
+	req, _ := http.NewRequest("POST", "/payments/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(buyer.ID)))
+	req.Header.Set(IdempotencyHeader, "checkout-1")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusCreated, w.Code)
+	var first struct {
+		Payment PaymentResponse `json:"payment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &first)
+	asserts.NotEmpty(first.Payment.ClientSecret, "buyer needs the client secret to confirm")
+
+	req, _ = http.NewRequest("POST", "/payments/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(buyer.ID)))
+	req.Header.Set(IdempotencyHeader, "checkout-1")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var second struct {
+		Payment PaymentResponse `json:"payment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &second)
+	asserts.Equal(first.Payment.ID, second.Payment.ID, "same idempotency key should return the same payment")
+
+	w, _ = paymentRequest(r, "POST", fmt.Sprintf("/payments/%v/refund", first.Payment.ID), seller.ID, ``)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "uncaptured payments should not be refunded")
+
+	url := fmt.Sprintf("/payments/%v/confirm", first.Payment.ID)
+	w, _ = paymentRequest(r, "POST", url, seller.ID, ``)
+	asserts.Equal(http.StatusNotFound, w.Code, "only the buyer should confirm the payment")
+	w, response := paymentRequest(r, "POST", url, buyer.ID, ``)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(PaymentCaptured, response.Status, "confirmed payment should be captured")
+	asserts.Equal(orders.OrderPaid, reloadOrder(order).Status)
+
+	SetProvider(nil)
+	w, _ = paymentRequest(r, "POST", url, buyer.ID, ``)
+	asserts.Equal(http.StatusNotFound, w.Code, "only the fake provider should be confirmed here")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	items.AutoMigrate()
+	carts.AutoMigrate()
+	orders.AutoMigrate()
+	AutoMigrate()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
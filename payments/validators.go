@@ -0,0 +1,21 @@
+package payments
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/NivRichter/GoLang-test1/common"
+)
+
+type PaymentValidator struct {
+	Payment struct {
+		OrderID uint `form:"orderId" json:"orderId" binding:"required"`
+	} `json:"payment"`
+}
+
+func NewPaymentValidator() PaymentValidator {
+	return PaymentValidator{}
+}
+
+func (s *PaymentValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
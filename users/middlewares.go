@@ -1,6 +1,7 @@
 package users
 
 import (
+	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
 	"github.com/NivRichter/GoLang-test1/common"
@@ -65,3 +66,15 @@ func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 		}
 	}
 }
+
+// Only let admins through, to be used after AuthMiddleware(true).
+//
+//	router.Use(AdminMiddleware())
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if !myUserModel.IsAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("user", errors.New("Require admin!")))
+		}
+	}
+}
@@ -19,6 +19,9 @@ type UserModel struct {
 	Bio          string  `gorm:"column:bio;size:1024"`
 	Image        *string `gorm:"column:image"`
 	PasswordHash string  `gorm:"column:password;not null"`
+	// Admins manage the shared parts of the marketplace, like the category tree.
+	// There is no endpoint granting it, set the column directly.
+	IsAdmin bool `gorm:"column:is_admin"`
 }
 
 // A hack way to save ManyToMany relationship,
@@ -39,12 +42,22 @@ type FollowModel struct {
 	FollowedByID uint
 }
 
+// How many users follow the user and how many they follow, maintained along with
+// the FollowModels (see Recount). Users nobody ever followed and who never
+// followed anyone have no row.
+type FollowCountsModel struct {
+	UserModelID uint `gorm:"primary_key;auto_increment:false"`
+	Followers   uint
+	Following   uint
+}
+
 // Migrate the schema of database if needed
 func AutoMigrate() {
 	db := common.GetDB()
 
 	db.AutoMigrate(&UserModel{})
 	db.AutoMigrate(&FollowModel{})
+	db.AutoMigrate(&FollowCountsModel{})
 }
 
 // What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
@@ -96,15 +109,48 @@ func (model *UserModel) Update(data interface{}) error {
 }
 
 // You could add a following relationship as userModel1 following userModel2
-// 	err = userModel1.following(userModel2)
+//
+//	err = userModel1.following(userModel2)
 func (u UserModel) following(v UserModel) error {
 	db := common.GetDB()
+	tx := db.Begin()
 	var follow FollowModel
-	err := db.FirstOrCreate(&follow, &FollowModel{
-		FollowingID:  v.ID,
-		FollowedByID: u.ID,
-	}).Error
-	return err
+	tx.Where(FollowModel{FollowingID: v.ID, FollowedByID: u.ID}).First(&follow)
+	if follow.ID != 0 {
+		return tx.Commit().Error
+	}
+	follow = FollowModel{FollowingID: v.ID, FollowedByID: u.ID}
+	if err := tx.Create(&follow).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := addFollows(tx, u.ID, v.ID, 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Move the following count of u and the followers count of v by n.
+func addFollows(tx *gorm.DB, u, v uint, n int64) error {
+	for _, id := range []uint{u, v} {
+		if err := tx.FirstOrCreate(&FollowCountsModel{}, FollowCountsModel{UserModelID: id}).Error; err != nil {
+			return err
+		}
+	}
+	err := tx.Model(&FollowCountsModel{}).Where("user_model_id = ?", u).UpdateColumn("following", gorm.Expr("following + ?", n)).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&FollowCountsModel{}).Where("user_model_id = ?", v).UpdateColumn("followers", gorm.Expr("followers + ?", n)).Error
+}
+
+// The follower and following counts of u.
+func (u UserModel) FollowCounts() FollowCountsModel {
+	db := common.GetDB()
+	counts := FollowCountsModel{UserModelID: u.ID}
+	db.Where("user_model_id = ?", u.ID).First(&counts)
+	return counts
 }
 
 // You could check whether  userModel1 following userModel2
@@ -120,14 +166,44 @@ func (u UserModel) isFollowing(v UserModel) bool {
 }
 
 // You could delete a following relationship as userModel1 following userModel2
-// 	err = userModel1.unFollowing(userModel2)
+//
+//	err = userModel1.unFollowing(userModel2)
 func (u UserModel) unFollowing(v UserModel) error {
 	db := common.GetDB()
-	err := db.Where(FollowModel{
+	tx := db.Begin()
+	result := tx.Where(FollowModel{
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
-	}).Delete(FollowModel{}).Error
-	return err
+	}).Delete(FollowModel{})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if err := addFollows(tx, u.ID, v.ID, -result.RowsAffected); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Recompute the follower and following counts from the FollowModels, repairing
+// any drift (see the recount command).
+func Recount() error {
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Delete(FollowCountsModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Exec("INSERT INTO follow_counts_models (user_model_id, followers, following) SELECT id," +
+		" (SELECT count(*) FROM follow_models WHERE follow_models.following_id = user_models.id AND follow_models.deleted_at IS NULL)," +
+		" (SELECT count(*) FROM follow_models WHERE follow_models.followed_by_id = user_models.id AND follow_models.deleted_at IS NULL)" +
+		" FROM user_models").Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
 
 // You could get a following list of userModel
@@ -148,3 +224,62 @@ func (u UserModel) GetFollowings() []UserModel {
 	tx.Commit()
 	return followings
 }
+
+var followersKeyset = common.Keyset{Name: "followers", ID: "follow_models.id", Desc: true}
+var followingKeyset = common.Keyset{Name: "following", ID: "follow_models.id", Desc: true}
+
+// A page of a follower or following list, most recent follow first. Next and
+// Prev are the cursors of the neighbouring pages, "" at either end; Count is the
+// length of the whole list, from the user's FollowCountsModel.
+type FollowPage struct {
+	Users []UserModel
+	Count int
+	Next  string
+	Prev  string
+}
+
+// The users following u, a page at a time, see common.Keyset.
+//
+//	page, err := userModel.GetFollowersPage(20, c.Query("cursor"))
+func (u UserModel) GetFollowersPage(limit int, cursor string) (FollowPage, error) {
+	page, err := getFollowPage(followersKeyset, "following_id = ?", u.ID, limit, cursor,
+		func(follow FollowModel) uint { return follow.FollowedByID })
+	page.Count = int(u.FollowCounts().Followers)
+	return page, err
+}
+
+// The users u follows, a page at a time.
+func (u UserModel) GetFollowingPage(limit int, cursor string) (FollowPage, error) {
+	page, err := getFollowPage(followingKeyset, "followed_by_id = ?", u.ID, limit, cursor,
+		func(follow FollowModel) uint { return follow.FollowingID })
+	page.Count = int(u.FollowCounts().Following)
+	return page, err
+}
+
+func getFollowPage(keyset common.Keyset, where string, id uint, limit int, cursor string, user func(FollowModel) uint) (FollowPage, error) {
+	db := common.GetDB()
+	page := FollowPage{Users: []UserModel{}}
+	query := db.Model(&FollowModel{}).Where(where, id)
+	query, position, err := keyset.Seek(query, cursor, limit)
+	if err != nil {
+		return page, err
+	}
+	var follows []FollowModel
+	if err := query.Find(&follows).Error; err != nil {
+		return page, err
+	}
+	n, hasPrev, hasNext := keyset.Finish(follows, position, limit)
+	follows = follows[:n]
+	for _, follow := range follows {
+		var userModel UserModel
+		db.First(&userModel, user(follow))
+		page.Users = append(page.Users, userModel)
+	}
+	if n != 0 && hasPrev {
+		page.Prev = keyset.Encode(nil, follows[0].ID, true)
+	}
+	if n != 0 && hasNext {
+		page.Next = keyset.Encode(nil, follows[n-1].ID, false)
+	}
+	return page, nil
+}
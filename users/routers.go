@@ -5,6 +5,7 @@ import (
 	"github.com/NivRichter/GoLang-test1/common"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
 )
 
 func UsersRegister(router *gin.RouterGroup) {
@@ -21,6 +22,8 @@ func ProfileRegister(router *gin.RouterGroup) {
 	router.GET("/:username", ProfileRetrieve)
 	router.POST("/:username/follow", ProfileFollow)
 	router.DELETE("/:username/follow", ProfileUnfollow)
+	router.GET("/:username/followers", ProfileFollowers)
+	router.GET("/:username/following", ProfileFollowing)
 }
 
 func ProfileRetrieve(c *gin.Context) {
@@ -69,6 +72,49 @@ func ProfileUnfollow(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
 }
 
+func ProfileFollowers(c *gin.Context) {
+	profileFollowList(c, UserModel.GetFollowersPage)
+}
+
+func ProfileFollowing(c *gin.Context) {
+	profileFollowList(c, UserModel.GetFollowingPage)
+}
+
+// Follow lists are read a page at a time with ?limit= and the next/prev cursor
+// of the previous response as ?cursor=.
+func profileFollowList(c *gin.Context, getPage func(UserModel, int, string) (FollowPage, error)) {
+	username := c.Param("username")
+	userModel, err := FindOneUser(&UserModel{Username: username})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	page, err := getPage(userModel, limit, c.Query("cursor"))
+	if err == common.ErrInvalidCursor {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("cursor", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profiles", errors.New("Database error")))
+		return
+	}
+	profiles := make([]ProfileResponse, 0, len(page.Users))
+	for _, user := range page.Users {
+		serializer := ProfileSerializer{c, user}
+		profiles = append(profiles, serializer.Response())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"profiles":      profiles,
+		"profilesCount": page.Count,
+		"next":          common.CursorResponse(page.Next),
+		"prev":          common.CursorResponse(page.Prev),
+	})
+}
+
 func UsersRegistration(c *gin.Context) {
 	userModelValidator := NewUserModelValidator()
 	if err := userModelValidator.Bind(c); err != nil {
@@ -85,6 +131,15 @@ func UsersRegistration(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{"user": serializer.Response()})
 }
 
+// Functions run after a successful login, e.g. to merge the anonymous shopping cart.
+var loginHooks []func(c *gin.Context, userModel UserModel)
+
+// Register a function to run after every successful UsersLogin.
+// 	users.OnLogin(carts.MergeCartOnLogin)
+func OnLogin(hook func(c *gin.Context, userModel UserModel)) {
+	loginHooks = append(loginHooks, hook)
+}
+
 func UsersLogin(c *gin.Context) {
 	loginValidator := NewLoginValidator()
 	if err := loginValidator.Bind(c); err != nil {
@@ -103,6 +158,9 @@ func UsersLogin(c *gin.Context) {
 		return
 	}
 	UpdateContextUserModel(c, userModel.ID)
+	for _, hook := range loginHooks {
+		hook(c, userModel)
+	}
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
@@ -453,6 +453,52 @@ var unauthRequestTests = []struct {
 	},
 }
 
+func TestFollowPages(t *testing.T) {
+	asserts := assert.New(t)
+
+	people := userModelMocker(4)
+	star := people[0]
+	for _, fan := range people[1:] {
+		fan.following(star)
+	}
+	page, err := star.GetFollowersPage(2, "")
+	asserts.NoError(err)
+	asserts.Equal(3, page.Count)
+	asserts.Equal([]string{people[3].Username, people[2].Username}, []string{page.Users[0].Username, page.Users[1].Username},
+		"latest followers should come first")
+	asserts.Equal("", page.Prev)
+	next, err := star.GetFollowersPage(2, page.Next)
+	asserts.NoError(err)
+	asserts.Len(next.Users, 1)
+	asserts.Equal(people[1].Username, next.Users[0].Username)
+	asserts.Equal("", next.Next)
+	_, err = star.GetFollowingPage(2, page.Next)
+	asserts.Equal(common.ErrInvalidCursor, err, "follower cursors should not work on following lists")
+
+	following, err := people[1].GetFollowingPage(2, "")
+	asserts.NoError(err)
+	asserts.Equal(1, following.Count)
+	asserts.Equal(star.Username, following.Users[0].Username)
+
+	r := gin.New()
+	r.Use(AuthMiddleware(false))
+	ProfileRegister(r.Group("/profiles"))
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/profiles/%v/followers?limit=2&cursor=%v", star.Username, page.Next), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(fmt.Sprintf(`^{"next":null,"prev":"[^"]+","profiles":\[{"username":"%v".*\],"profilesCount":3}$`, people[1].Username), w.Body.String())
+
+	asserts.NoError(people[2].unFollowing(star))
+	asserts.NoError(people[2].unFollowing(star), "unfollowing twice should not count twice")
+	asserts.NoError(people[1].following(star), "following twice should not count twice")
+	asserts.Equal(uint(2), star.FollowCounts().Followers)
+	test_db.Model(&FollowCountsModel{}).Where("user_model_id = ?", star.ID).UpdateColumn("followers", 7)
+	asserts.NoError(Recount())
+	asserts.Equal(uint(2), star.FollowCounts().Followers, "recount should repair drift")
+	asserts.Equal(uint(1), people[1].FollowCounts().Following)
+}
+
 func TestWithoutAuth(t *testing.T) {
 	asserts := assert.New(t)
 	//You could write the reset database code here if you want to create a database for this block